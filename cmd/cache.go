@@ -0,0 +1,299 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
+	"heckel.io/ntfy/server"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+var flagsCache = []cli.Flag{
+	&cli.StringFlag{Name: "config", Aliases: []string{"c"}, EnvVars: []string{"NTFY_CONFIG_FILE"}, Value: "/etc/ntfy/server.yml", DefaultText: "/etc/ntfy/server.yml", Usage: "config file"},
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-file", Aliases: []string{"C"}, EnvVars: []string{"NTFY_CACHE_FILE"}, Usage: "cache file used for message caching"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-key", EnvVars: []string{"NTFY_CACHE_KEY"}, Usage: "key of the cache file, if it is encrypted (requires SQLCipher)"}),
+}
+
+var flagsCacheRestore = append(
+	flagsCache,
+	&cli.BoolFlag{Name: "force", Aliases: []string{"f"}, Usage: "restore even if the backup has an older schema version than the cache file"},
+)
+
+var flagsCacheTopic = append(
+	flagsCache,
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-body-dir", EnvVars: []string{"NTFY_CACHE_BODY_DIR"}, Usage: "directory of large message bodies, if set in the server config"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-table-prefix", EnvVars: []string{"NTFY_CACHE_TABLE_PREFIX"}, Usage: "prefix of the cache table names, if set in the server config"}),
+)
+
+var flagsCachePrune = append(
+	flagsCacheTopic,
+	altsrc.NewDurationFlag(&cli.DurationFlag{Name: "cache-duration", Aliases: []string{"b"}, EnvVars: []string{"NTFY_CACHE_DURATION"}, Value: server.DefaultCacheDuration, Usage: "delete messages older than this"}),
+	&cli.BoolFlag{Name: "dry-run", Usage: "only print how many messages would be deleted"},
+)
+
+var cmdCache = &cli.Command{
+	Name:      "cache",
+	Usage:     "Back up, restore, export, import and prune the message cache",
+	UsageText: "ntfy cache COMMAND [OPTIONS..]",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "backup",
+			Usage:     "Write a consistent snapshot of the cache file",
+			UsageText: "ntfy cache backup [OPTIONS..] FILE",
+			Action:    execCacheBackup,
+			Flags:     flagsCache,
+			Before:    initConfigFileInputSource("config", flagsCache),
+			Description: `Write a consistent snapshot of the cache file to FILE, or to stdout if FILE is "-".
+
+This is safe to run while the server is running. Message bodies stored in the
+cache-body-dir are not included in the backup.
+
+Examples:
+  ntfy cache backup cache.db.bak                             # Back up the cache file from /etc/ntfy/server.yml
+  ntfy cache backup -C /tmp/cache.db - | gzip > cache.db.gz  # Back up to stdout`,
+		},
+		{
+			Name:      "restore",
+			Usage:     "Replace the cache file with a backup",
+			UsageText: "ntfy cache restore [OPTIONS..] FILE",
+			Action:    execCacheRestore,
+			Flags:     flagsCacheRestore,
+			Before:    initConfigFileInputSource("config", flagsCacheRestore),
+			Description: `Replace the contents of the cache file with a backup read from FILE, or from
+stdin if FILE is "-". The server must be stopped while restoring.
+
+Backups with a different schema version than the cache file are only restored if
+--force is passed; they are then migrated to the current schema version. Backups
+written by a newer version of ntfy are never restored.
+
+Examples:
+  ntfy cache restore cache.db.bak                                # Restore the cache file from /etc/ntfy/server.yml
+  gunzip -c cache.db.gz | ntfy cache restore -C /tmp/cache.db -  # Restore from stdin`,
+		},
+		{
+			Name:      "export",
+			Usage:     "Write all messages of a topic as newline-delimited JSON",
+			UsageText: "ntfy cache export [OPTIONS..] TOPIC",
+			Action:    execCacheExport,
+			Flags:     flagsCacheTopic,
+			Before:    initConfigFileInputSource("config", flagsCacheTopic),
+			Description: `Write all messages of TOPIC, including scheduled messages, to stdout as
+newline-delimited JSON, one message per line. The export can be imported into
+another cache file with 'ntfy cache import'.
+
+This is safe to run while the server is running.
+
+Examples:
+  ntfy cache export mytopic > mytopic.json               # Export from the cache file from /etc/ntfy/server.yml
+  ntfy cache export -C /tmp/cache.db mytopic | gzip > mytopic.json.gz`,
+		},
+		{
+			Name:      "import",
+			Usage:     "Add messages of a topic export to a topic",
+			UsageText: "ntfy cache import [OPTIONS..] TOPIC",
+			Action:    execCacheImport,
+			Flags:     flagsCacheTopic,
+			Before:    initConfigFileInputSource("config", flagsCacheTopic),
+			Description: `Read a topic export (see 'ntfy cache export') from stdin, and add its messages
+to TOPIC, keeping their IDs and timestamps. The server should be stopped while importing.
+
+Examples:
+  ntfy cache import mytopic < mytopic.json          # Import into the cache file from /etc/ntfy/server.yml
+  ntfy cache import -C /tmp/cache.db newtopic < mytopic.json  # Import into a different topic`,
+		},
+		{
+			Name:      "sender",
+			Usage:     "Write all messages of a publisher as newline-delimited JSON",
+			UsageText: "ntfy cache sender [OPTIONS..] IP|SENDER",
+			Action:    execCacheSender,
+			Flags:     flagsCacheTopic,
+			Before:    initConfigFileInputSource("config", flagsCacheTopic),
+			Description: `Write all messages published from the IP address IP, in all topics, to stdout
+as newline-delimited JSON, in the same format as 'ntfy cache export'. Instead of
+an IP address, the hashed sender of a message (the "sender" field) can be passed.
+This is useful to find out what else a publisher that spammed a topic published.
+
+Messages are only recorded with their sender as of this version of ntfy. This is
+safe to run while the server is running.
+
+Examples:
+  ntfy cache sender 1.2.3.4                     # Messages published from 1.2.3.4
+  ntfy cache sender -C /tmp/cache.db 1.2.3.4    # Same, from a different cache file`,
+		},
+		{
+			Name:      "prune",
+			Usage:     "Delete old messages, or show how many would be deleted",
+			UsageText: "ntfy cache prune [OPTIONS..]",
+			Action:    execCachePrune,
+			Flags:     flagsCachePrune,
+			Before:    initConfigFileInputSource("config", flagsCachePrune),
+			Description: `Delete all messages older than the cache-duration, like the server does
+periodically. Pinned and scheduled messages are kept. Unlike the server, this does
+not apply the topic-cache-duration, priority-cache-duration and
+inactive-cache-duration overrides.
+
+With --dry-run, nothing is deleted; instead, the number of messages that would be
+deleted and the size of their bodies is printed. This is safe to run while the
+server is running, and helps to choose a cache-duration before changing it.
+
+Examples:
+  ntfy cache prune --dry-run                       # Messages older than the cache-duration from /etc/ntfy/server.yml
+  ntfy cache prune --dry-run --cache-duration 24h  # Messages older than 24h
+  ntfy cache prune -C /tmp/cache.db -b 24h         # Delete messages older than 24h`,
+		},
+	},
+}
+
+func execCacheBackup(c *cli.Context) error {
+	conf, filename, err := parseCacheArgs(c, "backup")
+	if err != nil {
+		return err
+	}
+	if filename == "-" {
+		return server.BackupCache(conf, c.App.Writer)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := server.BackupCache(conf, f); err != nil {
+		f.Close()
+		os.Remove(filename)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "Backed up cache file %s to %s\n", conf.CacheFile, filename)
+	return nil
+}
+
+func execCacheRestore(c *cli.Context) error {
+	conf, filename, err := parseCacheArgs(c, "restore")
+	if err != nil {
+		return err
+	}
+	var r io.Reader
+	if filename == "-" {
+		r = rootApp(c).Reader
+	} else {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	if err := server.RestoreCache(conf, r, c.Bool("force")); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "Restored cache file %s from %s\n", conf.CacheFile, filename)
+	return nil
+}
+
+func execCacheExport(c *cli.Context) error {
+	conf, topic, err := parseCacheArgs(c, "export")
+	if err != nil {
+		return err
+	}
+	conf.CacheBodyDir = c.String("cache-body-dir")
+	conf.CacheTablePrefix = c.String("cache-table-prefix")
+	return server.ExportCacheTopic(conf, topic, c.App.Writer)
+}
+
+func execCacheImport(c *cli.Context) error {
+	conf, topic, err := parseCacheArgs(c, "import")
+	if err != nil {
+		return err
+	}
+	conf.CacheBodyDir = c.String("cache-body-dir")
+	conf.CacheTablePrefix = c.String("cache-table-prefix")
+	if err := server.ImportCacheTopic(conf, topic, rootApp(c).Reader); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "Imported messages into topic %s of cache file %s\n", topic, conf.CacheFile)
+	return nil
+}
+
+func execCacheSender(c *cli.Context) error {
+	conf, sender, err := parseCacheArgs(c, "sender")
+	if err != nil {
+		return err
+	}
+	conf.CacheBodyDir = c.String("cache-body-dir")
+	conf.CacheTablePrefix = c.String("cache-table-prefix")
+	if net.ParseIP(sender) != nil {
+		sender = server.SenderHash(sender)
+	}
+	return server.ExportCacheSender(conf, sender, c.App.Writer)
+}
+
+func execCachePrune(c *cli.Context) error {
+	if c.NArg() != 0 {
+		return errors.New("unexpected argument, see 'ntfy cache prune --help' for help")
+	}
+	conf, err := newCacheConfig(c)
+	if err != nil {
+		return err
+	}
+	conf.CacheBodyDir = c.String("cache-body-dir")
+	conf.CacheTablePrefix = c.String("cache-table-prefix")
+	cacheDuration := c.Duration("cache-duration")
+	if cacheDuration <= 0 {
+		return errors.New("cache-duration must be positive")
+	}
+	olderThan := time.Now().Add(-cacheDuration)
+	if c.Bool("dry-run") {
+		messages, bytes, err := server.PruneCacheDryRun(conf, olderThan)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.App.Writer, "Would delete %d message(s) older than %s (%d bytes) from cache file %s\n", messages, cacheDuration, bytes, conf.CacheFile)
+		return nil
+	}
+	deleted, err := server.PruneCache(conf, olderThan)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "Deleted %d message(s) older than %s from cache file %s\n", deleted, cacheDuration, conf.CacheFile)
+	return nil
+}
+
+func parseCacheArgs(c *cli.Context, command string) (*server.Config, string, error) {
+	if c.NArg() != 1 {
+		return nil, "", fmt.Errorf("expected exactly one argument, see 'ntfy cache %s --help' for help", command)
+	}
+	conf, err := newCacheConfig(c)
+	if err != nil {
+		return nil, "", err
+	}
+	return conf, c.Args().Get(0), nil
+}
+
+// newCacheConfig returns a server config with the cache file (and its key) given via --cache-file or the config file
+func newCacheConfig(c *cli.Context) (*server.Config, error) {
+	cacheFile := c.String("cache-file")
+	if cacheFile == "" {
+		return nil, errors.New("cache-file must be set, either in the config file or via --cache-file")
+	}
+	conf := server.NewConfig()
+	conf.CacheFile = cacheFile
+	conf.CacheKey = c.String("cache-key")
+	return conf, nil
+}
+
+// rootApp returns the top-level app. Unlike the writers, subcommands do not inherit the app's reader,
+// see cli.Command.startApp.
+func rootApp(c *cli.Context) *cli.App {
+	app := c.App
+	for _, ctx := range c.Lineage() {
+		if ctx.App != nil {
+			app = ctx.App
+		}
+	}
+	return app
+}
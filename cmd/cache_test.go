@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/server"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCLI_Cache_BackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	cacheFile := filepath.Join(dir, "cache.db")
+	backupFile := filepath.Join(dir, "cache.db.bak")
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "cache", "backup", "--cache-file=" + cacheFile, backupFile}))
+	require.Contains(t, stderr.String(), "Backed up cache file")
+	backup, err := os.ReadFile(backupFile)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(string(backup), "SQLite format 3"))
+
+	app, stdin, _, stderr := newTestApp()
+	stdin.Write(backup)
+	require.Nil(t, app.Run([]string{"ntfy", "cache", "restore", "--cache-file=" + filepath.Join(dir, "restored.db"), "-"}))
+	require.Contains(t, stderr.String(), "Restored cache file")
+}
+
+func TestCLI_Cache_BackupToStdout(t *testing.T) {
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "cache", "backup", "--cache-file=" + filepath.Join(t.TempDir(), "cache.db"), "-"}))
+	require.True(t, strings.HasPrefix(stdout.String(), "SQLite format 3"))
+}
+
+func TestCLI_Cache_RestoreInvalid(t *testing.T) {
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("not a database")
+	require.NotNil(t, app.Run([]string{"ntfy", "cache", "restore", "--cache-file=" + filepath.Join(t.TempDir(), "cache.db"), "-"}))
+
+	app, _, _, _ = newTestApp()
+	require.Error(t, app.Run([]string{"ntfy", "cache", "restore", "--config=/does/not/exist", "backup.db"}))
+}
+
+func TestCLI_Cache_ExportImport(t *testing.T) {
+	dir := t.TempDir()
+	conf := server.NewConfig()
+	conf.CacheFile = filepath.Join(dir, "cache.db")
+	require.Nil(t, server.ImportCacheTopic(conf, "mytopic", strings.NewReader(`{"id":"abc","time":1000,"event":"message","topic":"mytopic","message":"hi there"}`+"\n")))
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "cache", "export", "--cache-file=" + conf.CacheFile, "mytopic"}))
+	require.Equal(t, `{"id":"abc","time":1000,"event":"message","topic":"mytopic","message":"hi there","content_type":"text/plain"}`+"\n", stdout.String())
+
+	app, stdin, _, stderr := newTestApp()
+	stdin.WriteString(stdout.String())
+	require.Nil(t, app.Run([]string{"ntfy", "cache", "import", "--cache-file=" + filepath.Join(dir, "imported.db"), "newtopic"}))
+	require.Contains(t, stderr.String(), "Imported messages into topic newtopic")
+}
+
+func TestCLI_Cache_Sender(t *testing.T) {
+	conf := server.NewConfig()
+	conf.CacheFile = filepath.Join(t.TempDir(), "cache.db")
+	sender := server.SenderHash("1.2.3.4")
+	require.Nil(t, server.ImportCacheTopic(conf, "mytopic", strings.NewReader(`{"id":"abc","time":1000,"event":"message","topic":"mytopic","message":"spam","owner":"1.2.3.4","sender":"`+sender+`"}`+"\n")))
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "cache", "sender", "--cache-file=" + conf.CacheFile, "1.2.3.4"}))
+	require.Contains(t, stdout.String(), `"message":"spam"`)
+	require.Contains(t, stdout.String(), `"sender":"`+sender+`"`)
+	require.NotContains(t, stdout.String(), "1.2.3.4") // Only the hashed sender is written
+
+	app, _, stdout, _ = newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "cache", "sender", "--cache-file=" + conf.CacheFile, sender}))
+	require.Contains(t, stdout.String(), `"message":"spam"`)
+
+	app, _, stdout, _ = newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "cache", "sender", "--cache-file=" + conf.CacheFile, "5.6.7.8"}))
+	require.Empty(t, stdout.String())
+}
+
+func TestCLI_Cache_Prune(t *testing.T) {
+	conf := server.NewConfig()
+	conf.CacheFile = filepath.Join(t.TempDir(), "cache.db")
+	export := `{"id":"old1","time":1000,"event":"message","topic":"mytopic","message":"hi"}` + "\n" +
+		`{"id":"old2","time":2000,"event":"message","topic":"mytopic","message":"there"}` + "\n" +
+		`{"id":"new1","time":` + strconv.FormatInt(time.Now().Unix(), 10) + `,"event":"message","topic":"mytopic","message":"recent"}` + "\n"
+	require.Nil(t, server.ImportCacheTopic(conf, "mytopic", strings.NewReader(export)))
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "cache", "prune", "--cache-file=" + conf.CacheFile, "--dry-run", "--cache-duration=1h"}))
+	require.Contains(t, stdout.String(), "Would delete 2 message(s) older than 1h0m0s (7 bytes)")
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "cache", "prune", "--cache-file=" + conf.CacheFile, "--cache-duration=1h"}))
+	require.Contains(t, stderr.String(), "Deleted 2 message(s) older than 1h0m0s")
+
+	app, _, stdout, _ = newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "cache", "prune", "--cache-file=" + conf.CacheFile, "--dry-run", "--cache-duration=1h"}))
+	require.Contains(t, stdout.String(), "Would delete 0 message(s)")
+
+	app, _, _, _ = newTestApp()
+	require.Error(t, app.Run([]string{"ntfy", "cache", "prune", "--cache-file=" + conf.CacheFile, "mytopic"}))
+}
+
+func TestCLI_Cache_Key(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "cache.db")
+	for _, args := range [][]string{
+		{"backup", "-"},
+		{"export", "mytopic"},
+		{"prune"},
+	} {
+		app, _, _, _ := newTestApp()
+		err := app.Run(append([]string{"ntfy", "cache", args[0], "--cache-file=" + cacheFile, "--cache-key=secret"}, args[1:]...))
+		require.Error(t, err, args[0])
+		require.Contains(t, err.Error(), "SQLCipher", args[0]) // Key is passed to the cache, see errCacheKeyUnsupported
+	}
+}
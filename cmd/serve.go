@@ -9,7 +9,10 @@ import (
 	"heckel.io/ntfy/util"
 	"log"
 	"math"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -22,8 +25,33 @@ var flagsServe = []cli.Flag{
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "key-file", Aliases: []string{"K"}, EnvVars: []string{"NTFY_KEY_FILE"}, Usage: "private key file, if listen-https is set"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "cert-file", Aliases: []string{"E"}, EnvVars: []string{"NTFY_CERT_FILE"}, Usage: "certificate file, if listen-https is set"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "firebase-key-file", Aliases: []string{"F"}, EnvVars: []string{"NTFY_FIREBASE_KEY_FILE"}, Usage: "Firebase credentials file; if set additionally publish to FCM topic"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-backend", EnvVars: []string{"NTFY_CACHE_BACKEND"}, Value: server.CacheBackendSQLite, Usage: "database used for message caching (sqlite or postgres)"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-file", Aliases: []string{"C"}, EnvVars: []string{"NTFY_CACHE_FILE"}, Usage: "cache file used for message caching"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-dsn", EnvVars: []string{"NTFY_CACHE_DSN"}, Usage: "PostgreSQL connection string, if cache-backend is postgres"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "cache-migration-backup", EnvVars: []string{"NTFY_CACHE_MIGRATION_BACKUP"}, Value: false, Usage: "if set, back up the cache file before migrating its schema"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-body-dir", EnvVars: []string{"NTFY_CACHE_BODY_DIR"}, Usage: "if set, store large message bodies in this directory instead of the cache file"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-body-threshold", EnvVars: []string{"NTFY_CACHE_BODY_THRESHOLD"}, DefaultText: "1k", Usage: "message bodies larger than this are stored in cache-body-dir"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-compression-threshold", EnvVars: []string{"NTFY_CACHE_COMPRESSION_THRESHOLD"}, DefaultText: "0", Usage: "if set, gzip-compress message bodies larger than this in the cache file (e.g. 4k)"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "cache-topic-filter-size", EnvVars: []string{"NTFY_CACHE_TOPIC_FILTER_SIZE"}, Value: 0, Usage: "if set, keep an in-memory filter sized for this many topics to answer topic lookups without hitting the cache file"}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{Name: "cache-busy-timeout", EnvVars: []string{"NTFY_CACHE_BUSY_TIMEOUT"}, Value: server.DefaultCacheBusyTimeout, Usage: "wait up to this long for a locked cache file before failing"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "cache-max-open-conns", EnvVars: []string{"NTFY_CACHE_MAX_OPEN_CONNS"}, Value: server.DefaultCacheMaxOpenConns, Usage: "max number of open connections to the cache file (0 means no limit)"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "cache-max-idle-conns", EnvVars: []string{"NTFY_CACHE_MAX_IDLE_CONNS"}, Value: server.DefaultCacheMaxIdleConns, Usage: "max number of idle connections to the cache file that are kept open"}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{Name: "cache-conn-max-lifetime", EnvVars: []string{"NTFY_CACHE_CONN_MAX_LIFETIME"}, Usage: "if set, close connections to the cache file after this time"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-key", EnvVars: []string{"NTFY_CACHE_KEY"}, Usage: "if set, encrypt the cache file with this key (requires SQLCipher)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-sync-mode", EnvVars: []string{"NTFY_CACHE_SYNC_MODE"}, Value: server.CacheSyncModeNormal, Usage: "how often the cache file is synced to disk (off, normal or full)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "cache-table-prefix", EnvVars: []string{"NTFY_CACHE_TABLE_PREFIX"}, Usage: "if set, prefix all cache table names with this, to share the cache file between several instances"}),
 	altsrc.NewDurationFlag(&cli.DurationFlag{Name: "cache-duration", Aliases: []string{"b"}, EnvVars: []string{"NTFY_CACHE_DURATION"}, Value: server.DefaultCacheDuration, Usage: "buffer messages for this time to allow `since` requests"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "topic-cache-duration", EnvVars: []string{"NTFY_TOPIC_CACHE_DURATION"}, Usage: "buffer messages of a specific topic for a different time, format topic:duration (e.g. logs:1h)"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "priority-cache-duration", EnvVars: []string{"NTFY_PRIORITY_CACHE_DURATION"}, Usage: "buffer messages of a specific priority for a different time, format priority:duration (e.g. urgent:720h)"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "cache-topic-message-limit", EnvVars: []string{"NTFY_CACHE_TOPIC_MESSAGE_LIMIT"}, Value: 0, Usage: "if set, only buffer this many messages per topic"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "cache-max-messages-per-topic", EnvVars: []string{"NTFY_CACHE_MAX_MESSAGES_PER_TOPIC"}, Value: 0, Usage: "if set, reject new messages for topics that already have this many messages"}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{Name: "cache-max-attachment-expiry", EnvVars: []string{"NTFY_CACHE_MAX_ATTACHMENT_EXPIRY"}, Value: 0, Usage: "if set, attachments of cached messages expire after this long at most"}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{Name: "cache-dedup-window", EnvVars: []string{"NTFY_CACHE_DEDUP_WINDOW"}, Value: server.DefaultCacheDedupWindow, Usage: "skip messages published with X-Dedup if an identical message was cached within this time"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "cache-compact-threshold", EnvVars: []string{"NTFY_CACHE_COMPACT_THRESHOLD"}, Value: 0, Usage: "if set, compact the cache file when idle after this many messages were pruned"}),
+	altsrc.NewStringSliceFlag(&cli.StringSliceFlag{Name: "cache-warm-topic", EnvVars: []string{"NTFY_CACHE_WARM_TOPIC"}, Usage: "keep the most recent messages of this topic in memory (can be repeated), requires cache-file"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "cache-warm-capacity", EnvVars: []string{"NTFY_CACHE_WARM_CAPACITY"}, Value: server.DefaultCacheWarmCapacity, Usage: "max number of messages per cache-warm-topic kept in memory"}),
+	altsrc.NewBoolFlag(&cli.BoolFlag{Name: "replay-window-guard", EnvVars: []string{"NTFY_REPLAY_WINDOW_GUARD"}, Value: false, Usage: "if set, limit since requests to the cache duration"}),
+	altsrc.NewDurationFlag(&cli.DurationFlag{Name: "inactive-cache-duration", EnvVars: []string{"NTFY_INACTIVE_CACHE_DURATION"}, Usage: "if set, buffer messages of topics without subscribers for this (shorter) time"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-cache-dir", EnvVars: []string{"NTFY_ATTACHMENT_CACHE_DIR"}, Usage: "cache directory for attached files"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-total-size-limit", Aliases: []string{"A"}, EnvVars: []string{"NTFY_ATTACHMENT_TOTAL_SIZE_LIMIT"}, DefaultText: "5G", Usage: "limit of the on-disk attachment cache"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "attachment-file-size-limit", Aliases: []string{"Y"}, EnvVars: []string{"NTFY_ATTACHMENT_FILE_SIZE_LIMIT"}, DefaultText: "15M", Usage: "per-file attachment size limit (e.g. 300k, 2M, 100M)"}),
@@ -37,7 +65,13 @@ var flagsServe = []cli.Flag{
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "smtp-server-listen", EnvVars: []string{"NTFY_SMTP_SERVER_LISTEN"}, Usage: "SMTP server address (ip:port) for incoming emails, e.g. :25"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "smtp-server-domain", EnvVars: []string{"NTFY_SMTP_SERVER_DOMAIN"}, Usage: "SMTP domain for incoming e-mail, e.g. ntfy.sh"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "smtp-server-addr-prefix", EnvVars: []string{"NTFY_SMTP_SERVER_ADDR_PREFIX"}, Usage: "SMTP email address prefix for topics to prevent spam (e.g. 'ntfy-')"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "tag-validation", EnvVars: []string{"NTFY_TAG_VALIDATION"}, Value: server.TagValidationOff, Usage: "validate tags against known emoji shortcodes (off, warn or strict)"}),
+	altsrc.NewStringFlag(&cli.StringFlag{Name: "message-size-limit", EnvVars: []string{"NTFY_MESSAGE_SIZE_LIMIT"}, DefaultText: "4k", Usage: "max size of a message body; larger bodies are sent as attachments, or rejected"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "message-tags-limit", EnvVars: []string{"NTFY_MESSAGE_TAGS_LIMIT"}, Value: server.DefaultMessageTagsLimit, Usage: "max number of tags per message"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "message-tag-length-limit", EnvVars: []string{"NTFY_MESSAGE_TAG_LENGTH_LIMIT"}, Value: server.DefaultMessageTagLengthLimit, Usage: "max length of a single tag in bytes"}),
 	altsrc.NewIntFlag(&cli.IntFlag{Name: "global-topic-limit", Aliases: []string{"T"}, EnvVars: []string{"NTFY_GLOBAL_TOPIC_LIMIT"}, Value: server.DefaultTotalTopicLimit, Usage: "total number of topics allowed"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "global-scheduled-limit", EnvVars: []string{"NTFY_GLOBAL_SCHEDULED_LIMIT"}, Value: server.DefaultTotalScheduledLimit, Usage: "total number of scheduled (not yet delivered) messages allowed (0 means no limit)"}),
+	altsrc.NewIntFlag(&cli.IntFlag{Name: "topic-scheduled-limit", EnvVars: []string{"NTFY_TOPIC_SCHEDULED_LIMIT"}, Value: server.DefaultTopicScheduledLimit, Usage: "number of scheduled (not yet delivered) messages allowed per topic (0 means no limit)"}),
 	altsrc.NewIntFlag(&cli.IntFlag{Name: "visitor-subscription-limit", EnvVars: []string{"NTFY_VISITOR_SUBSCRIPTION_LIMIT"}, Value: server.DefaultVisitorSubscriptionLimit, Usage: "number of subscriptions per visitor"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-attachment-total-size-limit", EnvVars: []string{"NTFY_VISITOR_ATTACHMENT_TOTAL_SIZE_LIMIT"}, Value: "100M", Usage: "total storage limit used for attachments per visitor"}),
 	altsrc.NewStringFlag(&cli.StringFlag{Name: "visitor-attachment-daily-bandwidth-limit", EnvVars: []string{"NTFY_VISITOR_ATTACHMENT_DAILY_BANDWIDTH_LIMIT"}, Value: "500M", Usage: "total daily attachment download/upload bandwidth limit per visitor"}),
@@ -78,8 +112,33 @@ func execServe(c *cli.Context) error {
 	keyFile := c.String("key-file")
 	certFile := c.String("cert-file")
 	firebaseKeyFile := c.String("firebase-key-file")
+	cacheBackend := c.String("cache-backend")
 	cacheFile := c.String("cache-file")
+	cacheDSN := c.String("cache-dsn")
+	cacheMigrationBackup := c.Bool("cache-migration-backup")
+	cacheTopicFilterSize := c.Int("cache-topic-filter-size")
+	cacheBodyDir := c.String("cache-body-dir")
+	cacheBodyThresholdStr := c.String("cache-body-threshold")
+	cacheCompressionThresholdStr := c.String("cache-compression-threshold")
+	cacheBusyTimeout := c.Duration("cache-busy-timeout")
+	cacheMaxOpenConns := c.Int("cache-max-open-conns")
+	cacheMaxIdleConns := c.Int("cache-max-idle-conns")
+	cacheConnMaxLifetime := c.Duration("cache-conn-max-lifetime")
+	cacheKey := c.String("cache-key")
+	cacheSyncMode := c.String("cache-sync-mode")
+	cacheTablePrefix := c.String("cache-table-prefix")
 	cacheDuration := c.Duration("cache-duration")
+	inactiveCacheDuration := c.Duration("inactive-cache-duration")
+	topicCacheDurationStrs := c.StringSlice("topic-cache-duration")
+	priorityCacheDurationStrs := c.StringSlice("priority-cache-duration")
+	cacheTopicMessageLimit := c.Int("cache-topic-message-limit")
+	cacheMaxMessagesPerTopic := c.Int("cache-max-messages-per-topic")
+	cacheMaxAttachmentExpiry := c.Duration("cache-max-attachment-expiry")
+	cacheDedupWindow := c.Duration("cache-dedup-window")
+	cacheCompactThreshold := c.Int("cache-compact-threshold")
+	cacheWarmTopics := c.StringSlice("cache-warm-topic")
+	cacheWarmCapacity := c.Int("cache-warm-capacity")
+	replayWindowGuard := c.Bool("replay-window-guard")
 	attachmentCacheDir := c.String("attachment-cache-dir")
 	attachmentTotalSizeLimitStr := c.String("attachment-total-size-limit")
 	attachmentFileSizeLimitStr := c.String("attachment-file-size-limit")
@@ -93,7 +152,13 @@ func execServe(c *cli.Context) error {
 	smtpServerListen := c.String("smtp-server-listen")
 	smtpServerDomain := c.String("smtp-server-domain")
 	smtpServerAddrPrefix := c.String("smtp-server-addr-prefix")
+	tagValidation := c.String("tag-validation")
+	messageSizeLimitStr := c.String("message-size-limit")
+	messageTagsLimit := c.Int("message-tags-limit")
+	messageTagLengthLimit := c.Int("message-tag-length-limit")
 	totalTopicLimit := c.Int("global-topic-limit")
+	totalScheduledLimit := c.Int("global-scheduled-limit")
+	topicScheduledLimit := c.Int("topic-scheduled-limit")
 	visitorSubscriptionLimit := c.Int("visitor-subscription-limit")
 	visitorAttachmentTotalSizeLimitStr := c.String("visitor-attachment-total-size-limit")
 	visitorAttachmentDailyBandwidthLimitStr := c.String("visitor-attachment-daily-bandwidth-limit")
@@ -112,6 +177,30 @@ func execServe(c *cli.Context) error {
 		return errors.New("manager interval cannot be lower than five seconds")
 	} else if cacheDuration > 0 && cacheDuration < managerInterval {
 		return errors.New("cache duration cannot be lower than manager interval")
+	} else if inactiveCacheDuration > cacheDuration {
+		return errors.New("inactive cache duration cannot be higher than cache duration")
+	} else if cacheTopicMessageLimit < 0 {
+		return errors.New("cache-topic-message-limit cannot be negative")
+	} else if cacheMaxMessagesPerTopic < 0 {
+		return errors.New("cache-max-messages-per-topic cannot be negative")
+	} else if cacheMaxAttachmentExpiry < 0 {
+		return errors.New("cache-max-attachment-expiry cannot be negative")
+	} else if cacheCompactThreshold < 0 {
+		return errors.New("cache-compact-threshold cannot be negative")
+	} else if !util.InStringList([]string{server.CacheBackendSQLite, server.CacheBackendPostgres}, cacheBackend) {
+		return errors.New("if set, cache-backend must be one of: sqlite, postgres")
+	} else if cacheBackend == server.CacheBackendPostgres && cacheDSN == "" {
+		return errors.New("if cache-backend is postgres, cache-dsn must also be set")
+	} else if cacheBackend != server.CacheBackendPostgres && cacheDSN != "" {
+		return errors.New("if cache-dsn is set, cache-backend must be postgres")
+	} else if cacheBackend == server.CacheBackendPostgres && (cacheFile != "" || cacheKey != "" || cacheTablePrefix != "" || cacheTopicFilterSize > 0 || cacheCompressionThresholdStr != "") {
+		return errors.New("if cache-backend is postgres, cache-file, cache-key, cache-table-prefix, cache-topic-filter-size and cache-compression-threshold cannot be set")
+	} else if len(cacheWarmTopics) > 0 && cacheFile == "" {
+		return errors.New("if cache-warm-topic is set, cache-file must also be set")
+	} else if cacheWarmCapacity < 1 {
+		return errors.New("cache-warm-capacity must be at least 1")
+	} else if cacheBodyDir != "" && cacheFile == "" {
+		return errors.New("if cache-body-dir is set, cache-file must also be set")
 	} else if keyFile != "" && !util.FileExists(keyFile) {
 		return errors.New("if set, key file must exist")
 	} else if certFile != "" && !util.FileExists(certFile) {
@@ -126,6 +215,10 @@ func execServe(c *cli.Context) error {
 		return errors.New("if attachment-cache-dir is set, base-url must also be set")
 	} else if baseURL != "" && !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
 		return errors.New("if set, base-url must start with http:// or https://")
+	} else if !util.InStringList([]string{server.CacheSyncModeOff, server.CacheSyncModeNormal, server.CacheSyncModeFull}, cacheSyncMode) {
+		return errors.New("if set, cache-sync-mode must be one of: off, normal, full")
+	} else if !util.InStringList([]string{server.TagValidationOff, server.TagValidationWarn, server.TagValidationStrict}, tagValidation) {
+		return errors.New("if set, tag-validation must be one of: off, warn, strict")
 	}
 
 	// Special case: Unset default
@@ -133,7 +226,31 @@ func execServe(c *cli.Context) error {
 		listenHTTP = ""
 	}
 
+	// Parse per-topic cache durations
+	topicCacheDurations, err := parseTopicCacheDurations(topicCacheDurationStrs)
+	if err != nil {
+		return err
+	}
+	priorityCacheDurations, err := parsePriorityCacheDurations(priorityCacheDurationStrs)
+	if err != nil {
+		return err
+	}
+
 	// Convert sizes to bytes
+	cacheBodyThreshold, err := parseSize(cacheBodyThresholdStr, server.DefaultCacheBodyThreshold)
+	if err != nil {
+		return err
+	}
+	cacheCompressionThreshold, err := parseSize(cacheCompressionThresholdStr, 0)
+	if err != nil {
+		return err
+	}
+	messageSizeLimit, err := parseSize(messageSizeLimitStr, server.DefaultMessageLengthLimit)
+	if err != nil {
+		return err
+	} else if messageSizeLimit <= 0 || messageSizeLimit > math.MaxInt32 {
+		return fmt.Errorf("config option message-size-limit must be between 1 and %d bytes", math.MaxInt32)
+	}
 	attachmentTotalSizeLimit, err := parseSize(attachmentTotalSizeLimitStr, server.DefaultAttachmentTotalSizeLimit)
 	if err != nil {
 		return err
@@ -162,8 +279,33 @@ func execServe(c *cli.Context) error {
 	conf.KeyFile = keyFile
 	conf.CertFile = certFile
 	conf.FirebaseKeyFile = firebaseKeyFile
+	conf.CacheBackend = cacheBackend
 	conf.CacheFile = cacheFile
+	conf.CacheDSN = cacheDSN
+	conf.CacheMigrationBackup = cacheMigrationBackup
+	conf.CacheTopicFilterSize = cacheTopicFilterSize
+	conf.CacheBodyDir = cacheBodyDir
+	conf.CacheBodyThreshold = int(cacheBodyThreshold)
+	conf.CacheCompressionThreshold = int(cacheCompressionThreshold)
+	conf.CacheBusyTimeout = cacheBusyTimeout
+	conf.CacheMaxOpenConns = cacheMaxOpenConns
+	conf.CacheMaxIdleConns = cacheMaxIdleConns
+	conf.CacheConnMaxLifetime = cacheConnMaxLifetime
+	conf.CacheKey = cacheKey
+	conf.CacheSyncMode = cacheSyncMode
+	conf.CacheTablePrefix = cacheTablePrefix
 	conf.CacheDuration = cacheDuration
+	conf.InactiveCacheDuration = inactiveCacheDuration
+	conf.TopicCacheDurations = topicCacheDurations
+	conf.PriorityCacheDurations = priorityCacheDurations
+	conf.CacheTopicMessageLimit = cacheTopicMessageLimit
+	conf.CacheMaxMessagesPerTopic = cacheMaxMessagesPerTopic
+	conf.CacheMaxAttachmentExpiry = cacheMaxAttachmentExpiry
+	conf.CacheDedupWindow = cacheDedupWindow
+	conf.CacheCompactThreshold = cacheCompactThreshold
+	conf.CacheWarmTopics = cacheWarmTopics
+	conf.CacheWarmCapacity = cacheWarmCapacity
+	conf.ReplayWindowGuard = replayWindowGuard
 	conf.AttachmentCacheDir = attachmentCacheDir
 	conf.AttachmentTotalSizeLimit = attachmentTotalSizeLimit
 	conf.AttachmentFileSizeLimit = attachmentFileSizeLimit
@@ -177,7 +319,13 @@ func execServe(c *cli.Context) error {
 	conf.SMTPServerListen = smtpServerListen
 	conf.SMTPServerDomain = smtpServerDomain
 	conf.SMTPServerAddrPrefix = smtpServerAddrPrefix
+	conf.TagValidation = tagValidation
 	conf.TotalTopicLimit = totalTopicLimit
+	conf.TotalScheduledLimit = totalScheduledLimit
+	conf.TopicScheduledLimit = topicScheduledLimit
+	conf.MessageLimit = int(messageSizeLimit)
+	conf.MessageTagsLimit = messageTagsLimit
+	conf.MessageTagLengthLimit = messageTagLengthLimit
 	conf.VisitorSubscriptionLimit = visitorSubscriptionLimit
 	conf.VisitorAttachmentTotalSizeLimit = visitorAttachmentTotalSizeLimit
 	conf.VisitorAttachmentDailyBandwidthLimit = int(visitorAttachmentDailyBandwidthLimit)
@@ -190,8 +338,23 @@ func execServe(c *cli.Context) error {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	stopping, stopped := make(chan struct{}), make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %s, shutting down", sig)
+		close(stopping)
+		s.Stop() // Closes the cache, which checkpoints the WAL
+		close(stopped)
+	}()
 	if err := s.Run(); err != nil {
-		log.Fatalln(err)
+		select {
+		case <-stopping: // Listeners return an error when closed, that's expected
+			<-stopped
+		default:
+			log.Fatalln(err)
+		}
 	}
 	log.Printf("Exiting.")
 	return nil
@@ -207,3 +370,41 @@ func parseSize(s string, defaultValue int64) (v int64, err error) {
 	}
 	return v, nil
 }
+
+// parseTopicCacheDurations parses a list of "topic:duration" strings (e.g. "logs:1h") into a map
+func parseTopicCacheDurations(values []string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+	for _, value := range values {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid topic-cache-duration %s, expected format topic:duration", value)
+		}
+		duration, err := time.ParseDuration(parts[1])
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid topic-cache-duration %s, duration must be positive", value)
+		}
+		durations[parts[0]] = duration
+	}
+	return durations, nil
+}
+
+// parsePriorityCacheDurations parses a list of "priority:duration" strings (e.g. "urgent:720h" or "5:720h") into a map
+func parsePriorityCacheDurations(values []string) (map[int]time.Duration, error) {
+	durations := make(map[int]time.Duration)
+	for _, value := range values {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid priority-cache-duration %s, expected format priority:duration", value)
+		}
+		priority, err := util.ParsePriority(parts[0])
+		if err != nil || priority == 0 {
+			return nil, fmt.Errorf("invalid priority-cache-duration %s, priority must be 1-5 or min/low/default/high/urgent", value)
+		}
+		duration, err := time.ParseDuration(parts[1])
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid priority-cache-duration %s, duration must be positive", value)
+		}
+		durations[priority] = duration
+	}
+	return durations, nil
+}
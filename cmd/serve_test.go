@@ -66,3 +66,34 @@ func TestCLI_Serve_WebSocket(t *testing.T) {
 	require.Equal(t, "my message", m.Message)
 	require.Equal(t, "mytopic", m.Topic)
 }
+
+func TestParseTopicCacheDurations(t *testing.T) {
+	durations, err := parseTopicCacheDurations([]string{"logs:1h", "alerts:720h"})
+	require.Nil(t, err)
+	require.Equal(t, time.Hour, durations["logs"])
+	require.Equal(t, 720*time.Hour, durations["alerts"])
+
+	_, err = parseTopicCacheDurations([]string{"logs"})
+	require.NotNil(t, err)
+	_, err = parseTopicCacheDurations([]string{":1h"})
+	require.NotNil(t, err)
+	_, err = parseTopicCacheDurations([]string{"logs:-1h"})
+	require.NotNil(t, err)
+}
+
+func TestParsePriorityCacheDurations(t *testing.T) {
+	durations, err := parsePriorityCacheDurations([]string{"urgent:720h", "1:1h", "default:24h"})
+	require.Nil(t, err)
+	require.Equal(t, 720*time.Hour, durations[5])
+	require.Equal(t, time.Hour, durations[1])
+	require.Equal(t, 24*time.Hour, durations[3])
+
+	_, err = parsePriorityCacheDurations([]string{"urgent"})
+	require.NotNil(t, err)
+	_, err = parsePriorityCacheDurations([]string{":1h"})
+	require.NotNil(t, err)
+	_, err = parsePriorityCacheDurations([]string{"6:1h"})
+	require.NotNil(t, err)
+	_, err = parsePriorityCacheDurations([]string{"urgent:0s"})
+	require.NotNil(t, err)
+}
@@ -1,25 +1,428 @@
 package server
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
+	"golang.org/x/crypto/bcrypt"
+	"heckel.io/ntfy/util"
+	"io"
+	"sort"
+	"strings"
 	"time"
 )
 
+const (
+	actionsLimit = 3 // Max number of actions per message, see checkActions
+)
+
+var (
+	actionTypes = []string{"view", "http", "broadcast"}
+)
+
 var (
-	errUnexpectedMessageType = errors.New("unexpected message type")
+	errUnexpectedMessageType  = errors.New("unexpected message type")
+	errEncodedPayloadTooLarge = errors.New("encoded payload too large")
+	errMessageTooLarge        = errors.New("message too large")
+	errInvalidBucketSize      = errors.New("invalid bucket size")
+	errNoRows                 = errors.New("no rows found")
+	errTooManyTags            = errors.New("too many tags")
+	errTagTooLong             = errors.New("tag too long")
+	errDuplicateMessage       = errors.New("duplicate message")
+	errCacheTooNew            = errors.New("cache file was written by a newer version of ntfy, please upgrade")
+	errTooManyActions         = errors.New("too many actions")
+	errInvalidActionType      = errors.New("invalid action type")
+	errReadOnlyMemoryDB       = errors.New("in-memory databases cannot be opened read-only")
+	errCacheBadKey            = errors.New("wrong cache key, or cache file is not encrypted")
+	errCacheCorrupt           = errors.New("cache file is corrupt")
+	errCacheKeyUnsupported    = errors.New("cache key is set, but ntfy is not built against SQLCipher")
+	errMessagePublished       = errors.New("message was already published")
+	errTopicFull              = errors.New("topic has too many messages")
+	errMessageExists          = errors.New("message with this ID already exists")
 )
 
-// cache implements a cache for messages of type "message" events,
-// i.e. message structs with the Event messageEvent.
+// cache implements a cache for messages of type "message" events, i.e. message structs with the
+// Event messageEvent, and other events that are replayed to subscribers, e.g. pollRequestEvent.
+// Connection-level events (open, keepalive) are rejected.
 type cache interface {
 	AddMessage(m *message) error
-	Messages(topic string, since sinceTime, scheduled bool) ([]*message, error)
+	AddMessagePublished(m *message) (published bool, err error)
+	AddMessages(ms []*message) error
+	Messages(topic string, since sinceMarker, scheduled bool, limit int) ([]*message, error)
+	MessagesContext(ctx context.Context, topic string, since sinceMarker, scheduled bool, limit int, filter *messageFilter) ([]*message, error)
+	MessagesBetween(topic string, from, to time.Time, scheduled bool) ([]*message, error)
+	MessagesFunc(topic string, since sinceMarker, scheduled bool, fn func(m *message) error) error
+	MessagesFuncContext(ctx context.Context, topic string, since sinceMarker, scheduled bool, filter *messageFilter, fn func(m *message) error) error
+	MessagesMulti(topics []string, since sinceMarker, scheduled bool) (map[string][]*message, error)
+	MessagesByIDs(ids []string) ([]*message, error)
+	MessagesBySender(sender string) ([]*message, error)
+	LatestMessage(topic string) (*message, error)
 	MessagesDue() ([]*message, error)
+	TakeMessagesDue() ([]*message, error)
+	AllScheduledMessages(limit int) ([]*message, error)
+	PendingScheduled(topic string) ([]*scheduledMessage, error)
+	MessagesAfter(after exportCursor, limit int) ([]*message, error)
+	ExportTopic(topic string, w io.Writer) error
+	ImportTopic(topic string, r io.Reader) error
+	PublishedBetween(from, to time.Time) ([]*message, error)
 	MessageCount(topic string) (int, error)
-	Topics() (map[string]*topic, error)
-	Prune(olderThan time.Time) error
+	ScheduledCount() (int, error)
+	ScheduledCountForTopic(topic string) (int, error)
+	EncodingBreakdown() (map[string]int, error)
+	AttachmentSizeByType() (map[string]int64, error)
+	Stats() (*cacheStats, error)
+	Topics(excludePrefixes ...string) (map[string]*topic, error)
+	TopicsFunc(fn func(topic string) error, excludePrefixes ...string) error
+	TopicsSince(since time.Time) (map[string]*topic, error)
+	TopicCount(excludePrefixes ...string) (int, error)
+	TopicExists(topic string) (bool, error)
+	ActiveTopics(window time.Duration, limit int) ([]*topicRate, error)
+	CumulativeCount(topic string, bucket time.Duration, from, to time.Time) ([]point, error)
+	Prune(olderThan, inactiveOlderThan time.Time, activeTopics []string, perTopic map[string]time.Time, perPriority map[int]time.Time) (int64, error)
+	PruneDryRun(olderThan time.Time) (messages int64, bytes int64, err error)
+	PruneToCount(maxPerTopic int) (int, error)
+	Compact() error
 	MarkPublished(m *message) error
+	MarkPublishedBatch(ids []string) error
+	RecomputePublished(grace time.Duration) (changed int, err error)
+	PinMessage(id string) error
+	UnpinMessage(id string) error
+	UpdateMessage(id string, m *message) error
+	DeleteMessage(id string) (int, error)
+	DeleteScheduled(id string) error
+	DeleteMessagesForTopic(topic string) (int, error)
 	AttachmentsSize(owner string) (int64, error)
+	IncrementDownloads(id string) error
+	DownloadBytes(owner string) (int64, error)
+	ReassignAttachments(oldOwner, newOwner string) error
+	ClearAttachmentOwner(owner string) error
+	ClearAttachment(id string) error
+	OwnerUsage(owner string, since time.Time) (messages int, attachmentBytes int64, err error)
 	AttachmentsExpired() ([]string, error)
+	RewriteAttachmentURLs(oldBase, newBase string) (int, error)
+	MessagesWithMissingAttachments(missing func(url string) bool) ([]*message, error)
+	SetTopicSecret(topic, secret string) error
+	VerifyTopicSecret(topic, secret string) (bool, error)
+	SetTopicDisplayName(topic, name string) error
+	MarkRead(id, user string) error
+	Ping() error
+	Close() error
+	SchemaVersion() (int, error)
+	AddDelivery(topic string, failed bool) error
+	DeliveryRatio(topic string, since time.Time) (sent, failed int, err error)
+}
+
+// topicRate is the number of messages published to a topic within a time window,
+// and the resulting rate in messages per hour
+type topicRate struct {
+	Topic   string
+	Count   int
+	PerHour float64
+}
+
+func newTopicRate(topic string, count int, window time.Duration) *topicRate {
+	return &topicRate{
+		Topic:   topic,
+		Count:   count,
+		PerHour: float64(count) / window.Hours(),
+	}
+}
+
+// CacheMetrics is notified about every message that is stored in the cache, e.g. to export per-topic Prometheus
+// counters; see Config.CacheMetrics. It is not notified about duplicates, or about messages that were rejected.
+// Implementations must be safe for concurrent use, return quickly, and must not call back into the cache.
+type CacheMetrics interface {
+	// MessageAdded is called after the message was stored. Size is the length of the message body in bytes.
+	MessageAdded(topic string, size int, attachment bool)
+}
+
+// nopCacheMetrics is used if Config.CacheMetrics is not set
+type nopCacheMetrics struct{}
+
+func (nopCacheMetrics) MessageAdded(topic string, size int, attachment bool) {}
+
+// cacheMetrics returns the metrics hook configured in conf, or a no-op hook if there is none
+func cacheMetrics(conf *Config) CacheMetrics {
+	if conf.CacheMetrics == nil {
+		return nopCacheMetrics{}
+	}
+	return conf.CacheMetrics
+}
+
+// scheduledMessage is a message that is scheduled for delivery, and the time remaining until it is delivered
+type scheduledMessage struct {
+	Message        *message
+	RemainingDelay time.Duration
+}
+
+func newScheduledMessage(m *message, now time.Time) *scheduledMessage {
+	return &scheduledMessage{
+		Message:        m,
+		RemainingDelay: time.Unix(m.Time, 0).Sub(now),
+	}
+}
+
+// cacheStats is a summary of the cache contents, e.g. for monitoring
+type cacheStats struct {
+	Messages        int       `json:"messages"`         // All messages, including scheduled messages
+	Topics          int       `json:"topics"`           // Topics with at least one message
+	AttachmentBytes int64     `json:"attachment_bytes"` // Total size of all attachments that have not expired
+	OldestMessage   time.Time `json:"oldest_message"`   // Zero if there are no messages
+
+	// AttachmentBytesByType is the size of all attachments by MIME type, see cache.AttachmentSizeByType.
+	// Unlike AttachmentBytes, it includes expired attachments whose files have not been deleted yet.
+	AttachmentBytesByType map[string]int64 `json:"attachment_bytes_by_type"`
+}
+
+// Orders in which messages are returned, see messageFilter.Order
+const (
+	orderAsc  = "asc"  // Oldest first (default)
+	orderDesc = "desc" // Newest first
+)
+
+// messageFilter narrows down the messages returned by MessagesContext. All conditions must match; empty
+// fields match any message, except for Events. Title and tags are compared case-insensitively.
+type messageFilter struct {
+	Events        []string // Event types to return; only messageEvent if empty (or if there is no filter)
+	MinPriority   int      // Messages without priority count as default priority (3)
+	Tags          []string // All of these tags must be present
+	TitleContains string
+	Until         int64  // Unix time; messages after this time are excluded, 0 means no upper bound
+	UnreadBy      string // If set, messages this user marked as read are excluded, see cache.MarkRead
+	Order         string // Not a condition; orderAsc (also if empty) or orderDesc. A limit always keeps the newest messages.
+}
+
+// betweenFilter returns a filter for messages up until the given time, or until now if it is zero,
+// see cache.MessagesBetween
+func betweenFilter(to time.Time) *messageFilter {
+	if to.IsZero() {
+		to = time.Now()
+	}
+	return &messageFilter{Until: to.Unix()}
+}
+
+// events returns the event types that pass the filter, see messageFilter.Events
+func (f *messageFilter) events() []string {
+	if f == nil || len(f.Events) == 0 {
+		return []string{messageEvent}
+	}
+	return f.Events
+}
+
+// empty returns true if the filter lets all messages pass, just like no filter at all
+func (f *messageFilter) empty() bool {
+	return f == nil || (len(f.Events) == 0 && f.MinPriority == 0 && len(f.Tags) == 0 && f.TitleContains == "" && f.Until == 0 && f.UnreadBy == "" && !f.descending())
+}
+
+// descending returns true if messages are to be returned newest first, see messageFilter.Order
+func (f *messageFilter) descending() bool {
+	return f != nil && f.Order == orderDesc
+}
+
+// matches returns true if the given message passes the filter. It must be kept consistent with filterClause.
+// UnreadBy is not checked, since the read receipts are stored in the cache, see memCache.unread.
+func (f *messageFilter) matches(m *message) bool {
+	if !util.InStringList(f.events(), m.Event) {
+		return false
+	} else if f == nil {
+		return true
+	}
+	priority := m.Priority
+	if priority == 0 {
+		priority = 3
+	}
+	if f.MinPriority > 0 && priority < f.MinPriority {
+		return false
+	}
+	if f.Until > 0 && m.Time > f.Until {
+		return false
+	}
+	if f.TitleContains != "" && !strings.Contains(strings.ToLower(m.Title), strings.ToLower(f.TitleContains)) {
+		return false
+	}
+	for _, tag := range f.Tags {
+		found := false
+		for _, t := range m.Tags {
+			if strings.EqualFold(t, tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// point is a data point of a message count timeline, e.g. the number of messages
+// published to a topic up until the end of a time bucket
+type point struct {
+	Time  time.Time // Start of the bucket
+	Count int
+}
+
+// cumulativePoints turns a per-bucket histogram (bucket index -> count) into a running total per bucket.
+// Buckets are aligned to from, and every bucket in [from, to) is included, even if it is empty.
+func cumulativePoints(histogram map[int64]int, bucket time.Duration, from, to time.Time) []point {
+	points := make([]point, 0)
+	var total int
+	for i := int64(0); from.Add(time.Duration(i) * bucket).Before(to); i++ {
+		total += histogram[i]
+		points = append(points, point{
+			Time:  from.Add(time.Duration(i) * bucket),
+			Count: total,
+		})
+	}
+	return points
+}
+
+// checkMessageSize checks the size of the message body against the message limit. This is a safeguard
+// against oversized messages that did not pass through the HTTP layer's limit (e.g. from query parameters),
+// since every subscriber that reconnects is sent all of them again. Base64-encoded messages are decoded
+// first, so that the limit applies to the decoded bytes.
+func checkMessageSize(m *message, limit int) error {
+	if m.Encoding != encodingBase64 {
+		if len(m.Message) > limit {
+			return fmt.Errorf("%w: message is %d bytes, limit is %d bytes", errMessageTooLarge, len(m.Message), limit)
+		}
+		return nil
+	}
+	payload, err := base64.StdEncoding.DecodeString(m.Message)
+	if err != nil {
+		return err
+	} else if len(payload) > limit {
+		return fmt.Errorf("%w: decoded size is %d bytes, limit is %d bytes", errEncodedPayloadTooLarge, len(payload), limit)
+	}
+	return nil
+}
+
+// normalizeAndCheckTags trims whitespace from the message tags and removes empty tags, and then
+// checks the resulting tags against the max number of tags and the max length (in bytes) per tag.
+func normalizeAndCheckTags(m *message, tagsLimit, tagLengthLimit int) error {
+	if len(m.Tags) == 0 {
+		return nil
+	}
+	tags := make([]string, 0, len(m.Tags))
+	for _, tag := range m.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	m.Tags = tags
+	if len(tags) > tagsLimit {
+		return fmt.Errorf("%w: message has %d tags, limit is %d", errTooManyTags, len(tags), tagsLimit)
+	}
+	for _, tag := range tags {
+		if len(tag) > tagLengthLimit {
+			return fmt.Errorf("%w: tag is %d bytes, limit is %d bytes", errTagTooLong, len(tag), tagLengthLimit)
+		}
+	}
+	return nil
+}
+
+// normalizeContentType sets the content type of messages that do not have one to plain text
+func normalizeContentType(m *message) {
+	if m.ContentType == "" {
+		m.ContentType = contentTypePlain
+	}
+}
+
+// clampAttachmentExpiry limits the attachment expiry of the message to maxExpiry from now, so that
+// publishers cannot keep attachments around for longer than the server allows. The message is changed
+// in place, so that the publisher sees the actual expiry. A maxExpiry of 0 means no limit.
+func clampAttachmentExpiry(m *message, maxExpiry time.Duration) {
+	if maxExpiry <= 0 || m.Attachment == nil || m.Attachment.Expires == 0 {
+		return
+	}
+	if max := time.Now().Add(maxExpiry).Unix(); m.Attachment.Expires > max {
+		m.Attachment.Expires = max
+	}
+}
+
+// checkActions checks that the message has no more than actionsLimit actions, and that all
+// actions have one of the known types, see actionTypes
+func checkActions(m *message) error {
+	if len(m.Actions) > actionsLimit {
+		return fmt.Errorf("%w: message has %d actions, limit is %d", errTooManyActions, len(m.Actions), actionsLimit)
+	}
+	for _, a := range m.Actions {
+		if a == nil || !util.InStringList(actionTypes, a.Type) {
+			return errInvalidActionType
+		}
+	}
+	return nil
+}
+
+// checkTopicLimit checks that adding the messages does not push any topic beyond maxPerTopic messages,
+// given the current number of messages per topic. This is a last-resort safeguard against runaway
+// publishers filling the disk, independent of the visitor rate limits. A maxPerTopic of 0 means no limit.
+func checkTopicLimit(ms []*message, maxPerTopic int, count func(topic string) int) error {
+	if maxPerTopic <= 0 {
+		return nil
+	}
+	added := make(map[string]int)
+	for _, m := range ms {
+		added[m.Topic]++
+	}
+	for topic, n := range added {
+		if existing := count(topic); existing+n > maxPerTopic {
+			return fmt.Errorf("%w: topic %s has %d messages, limit is %d", errTopicFull, topic, existing, maxPerTopic)
+		}
+	}
+	return nil
+}
+
+// sortMessages sorts the given slice in place by time, and messages with the same time by their sequence,
+// i.e. in the order they were added, like the "ORDER BY time, sequence" of the SQLite cache
+func sortMessages(messages []*message) {
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].Time != messages[j].Time {
+			return messages[i].Time < messages[j].Time
+		}
+		return messages[i].sequence < messages[j].sequence
+	})
+}
+
+// reverseMessages reverses the given slice in place and returns it
+func reverseMessages(messages []*message) []*message {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages
+}
+
+// dedupHash returns a hash of the fields that make two messages identical for the purpose of
+// deduplication, see message.Dedup. As in messageFilter, the default priority 0 counts as 3.
+func dedupHash(m *message) string {
+	priority := m.Priority
+	if priority == 0 {
+		priority = 3
+	}
+	h := sha256.New()
+	for _, field := range []string{m.Topic, m.Title, m.Message, fmt.Sprintf("%d", priority)} {
+		h.Write([]byte(field))
+		h.Write([]byte{0}) // Separator, so that e.g. title "ab" + message "c" != title "a" + message "bc"
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashTopicSecret returns a bcrypt hash of the given topic secret. Topic secrets are chosen by users and
+// often weak, so a slow hash is used to make brute-forcing them expensive if the cache file leaks.
+func hashTopicSecret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// verifyTopicSecret compares the given secret against a hash created by hashTopicSecret
+func verifyTopicSecret(hash, secret string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) == nil
 }
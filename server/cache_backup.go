@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var (
+	errBackupInvalid               = errors.New("invalid backup: not a cache file")
+	errBackupSchemaVersionMismatch = errors.New("backup has a different schema version than the cache file")
+)
+
+// BackupCache writes a consistent snapshot of the cache file configured in conf to w. It is safe
+// to run this while the server is running. Message bodies stored in the cache body directory are
+// not included.
+func BackupCache(conf *Config, w io.Writer) error {
+	c, err := newSqliteCache(conf)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Backup(w)
+}
+
+// RestoreCache replaces the contents of the cache file configured in conf with a backup read
+// from r, see BackupCache. The server must not be running. Unless force is set, backups with a
+// different schema version than the cache file are rejected.
+func RestoreCache(conf *Config, r io.Reader, force bool) error {
+	c, err := newSqliteCache(conf)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Restore(r, force)
+}
+
+// Backup writes a transactionally consistent copy of the database to w. The copy is
+// created in a temporary directory using BackupFile, and then streamed to w.
+func (c *sqliteCache) Backup(w io.Writer) error {
+	dir, err := os.MkdirTemp("", "ntfy-backup")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "cache.db")
+	if err := c.BackupFile(file); err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Restore replaces the database with a backup read from r, see Backup. Backups with an older
+// schema version are only restored if force is set, and are then migrated. Backups with a newer
+// schema version are always rejected. Caches with a table prefix cannot be restored, since the backup
+// contains the whole cache file.
+func (c *sqliteCache) Restore(r io.Reader, force bool) error {
+	if c.db.prefix != "" {
+		return errRestoreTablePrefix
+	}
+	dir, err := os.MkdirTemp("", "ntfy-restore")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "cache.db")
+	if err := writeFile(file, r); err != nil {
+		return err
+	}
+	src, err := openSqliteDB(file, c.key)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	var schemaVersion int
+	if err := src.QueryRow(selectSchemaVersionQuery).Scan(&schemaVersion); err != nil {
+		return fmt.Errorf("%w: %s", errBackupInvalid, err.Error())
+	} else if schemaVersion > currentSchemaVersion {
+		return fmt.Errorf("%w: backup schema version is %d, this version of ntfy supports up to %d", errCacheTooNew, schemaVersion, currentSchemaVersion)
+	} else if schemaVersion != currentSchemaVersion && !force {
+		return fmt.Errorf("%w: backup schema version is %d, cache file schema version is %d", errBackupSchemaVersionMismatch, schemaVersion, currentSchemaVersion)
+	}
+	if err := copyDB(c.db.DB, src); err != nil {
+		return err
+	}
+	if err := setupDB(c.db, ""); err != nil {
+		return err
+	}
+	if err := c.loadMessageCounts(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextAttachmentExpiry = 0 // Unknown
+	if c.topicFilter != nil {
+		return c.loadTopicFilter(c.topicFilterLen)
+	}
+	return nil
+}
+
+// copyDB overwrites the main database of dst with the one of src, using SQLite's online backup API
+func copyDB(dst, src *sql.DB) error {
+	ctx := context.Background()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	return dstConn.Raw(func(dstDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			backup, err := dstDriverConn.(*sqlite3.SQLiteConn).Backup("main", srcDriverConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+func writeFile(filename string, r io.Reader) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
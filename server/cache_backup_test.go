@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"github.com/stretchr/testify/require"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSqliteCache_BackupRestore(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my message")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other message")))
+
+	var backup bytes.Buffer
+	require.Nil(t, c.Backup(&backup))
+
+	c2 := newSqliteTestCache(t)
+	require.Nil(t, c2.AddMessage(newDefaultMessage("mytopic", "will be replaced")))
+	require.Nil(t, c2.Restore(&backup, false))
+
+	messages, err := c2.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "my message", messages[0].Message)
+	count, err := c2.MessageCount("othertopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestSqliteCache_RestoreSchemaVersionMismatch(t *testing.T) {
+	// Create "version 1" backup
+	backupFile := newSqliteTestCacheFile(t)
+	db, err := sql.Open("sqlite3", backupFile)
+	require.Nil(t, err)
+	_, err = db.Exec(`
+		CREATE TABLE messages (
+			id VARCHAR(20) PRIMARY KEY,
+			time INT NOT NULL,
+			topic VARCHAR(64) NOT NULL,
+			message VARCHAR(512) NOT NULL,
+			title VARCHAR(256) NOT NULL,
+			priority INT NOT NULL,
+			tags VARCHAR(256) NOT NULL
+		);
+		CREATE TABLE schemaVersion (
+			id INT PRIMARY KEY,
+			version INT NOT NULL
+		);
+		INSERT INTO schemaVersion (id, version) VALUES (1, 1);
+		INSERT INTO messages (id, time, topic, message, title, priority, tags) VALUES ('abcd', 1, 'mytopic', 'some message', '', 0, '');
+	`)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+	backup, err := os.ReadFile(backupFile)
+	require.Nil(t, err)
+
+	// Refused without force, restored and migrated with force
+	c := newSqliteTestCache(t)
+	require.ErrorIs(t, c.Restore(bytes.NewReader(backup), false), errBackupSchemaVersionMismatch)
+	require.Nil(t, c.Restore(bytes.NewReader(backup), true))
+	checkSchemaVersion(t, c.db)
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	// Newer versions are always refused
+	_, err = c.db.Exec(updateSchemaVersion, currentSchemaVersion+1)
+	require.Nil(t, err)
+	var newer bytes.Buffer
+	require.Nil(t, c.Backup(&newer))
+	require.ErrorIs(t, newSqliteTestCache(t).Restore(&newer, true), errCacheTooNew)
+}
+
+func TestSqliteCache_RestoreInvalid(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.ErrorIs(t, c.Restore(strings.NewReader("not a database"), true), errBackupInvalid)
+}
+
+func TestBackupRestoreCache(t *testing.T) {
+	conf := NewConfig()
+	conf.CacheFile = newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromConfig(t, conf)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my message")))
+
+	backupFile := conf.CacheFile + ".bak"
+	f, err := os.Create(backupFile)
+	require.Nil(t, err)
+	require.Nil(t, BackupCache(conf, f))
+	require.Nil(t, f.Close())
+
+	conf2 := NewConfig()
+	conf2.CacheFile = newSqliteTestCacheFile(t)
+	f, err = os.Open(backupFile)
+	require.Nil(t, err)
+	defer f.Close()
+	require.Nil(t, RestoreCache(conf2, f, false))
+
+	count, err := newSqliteTestCacheFromConfig(t, conf2).MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+}
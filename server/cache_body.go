@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	bodyOrphanGracePeriod = time.Minute // Bodies are written before their message row, see removeOrphans
+	encodingGzip          = "gzip"      // Stored encoding of compressed bodies, never returned to clients
+)
+
+// bodyStore stores large message bodies as files outside the message cache database, so that the
+// messages table stays small. The message row only holds a reference to the file (the message ID).
+type bodyStore struct {
+	dir       string
+	threshold int // Bodies larger than this many bytes are stored externally
+}
+
+func newBodyStore(dir string, threshold int) (*bodyStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &bodyStore{
+		dir:       dir,
+		threshold: threshold,
+	}, nil
+}
+
+// Externalize returns true if the message body exceeds the threshold and should be stored externally
+func (s *bodyStore) Externalize(m *message) bool {
+	return len(m.Message) > s.threshold
+}
+
+func (s *bodyStore) Write(ref, body string) error {
+	if !fileIDRegex.MatchString(ref) {
+		return errInvalidFileID
+	}
+	return ioutil.WriteFile(filepath.Join(s.dir, ref), []byte(body), 0600)
+}
+
+func (s *bodyStore) Read(ref string) (string, error) {
+	if !fileIDRegex.MatchString(ref) {
+		return "", errInvalidFileID
+	}
+	body, err := ioutil.ReadFile(filepath.Join(s.dir, ref))
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func (s *bodyStore) Exists(ref string) bool {
+	if !fileIDRegex.MatchString(ref) {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(s.dir, ref))
+	return err == nil
+}
+
+func (s *bodyStore) Remove(ref string) {
+	if fileIDRegex.MatchString(ref) {
+		_ = os.Remove(filepath.Join(s.dir, ref)) // Best effort delete
+	}
+}
+
+// removeOrphans deletes all bodies that are not referenced anymore, e.g. because their message was pruned.
+// Recently written bodies are kept, since their message row may not have been inserted yet.
+func (s *bodyStore) removeOrphans(refs map[string]bool) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if !refs[e.Name()] && time.Since(info.ModTime()) > bodyOrphanGracePeriod {
+			s.Remove(e.Name())
+		}
+	}
+	return nil
+}
+
+// compressBody gzips a message body. It returns false if compressing does not make the body smaller.
+func compressBody(body string) ([]byte, bool, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(body)); err != nil {
+		return nil, false, err
+	} else if err := w.Close(); err != nil {
+		return nil, false, err
+	}
+	return buf.Bytes(), buf.Len() < len(body), nil
+}
+
+func decompressBody(body string) (string, error) {
+	r, err := gzip.NewReader(bytes.NewReader([]byte(body)))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const (
+	exportBatchSize = 500 // Messages per query, a checkpoint marker is written after each batch
+)
+
+// exportCursor identifies a position in the keyset order (time, id) of all cached messages.
+// The zero value points before the first message.
+type exportCursor struct {
+	Time int64  `json:"time"`
+	ID   string `json:"id"`
+}
+
+// topicExportEntry is a single line of a topic export, see exportTopic. Unlike the JSON sent to subscribers,
+// it includes the fields that are only used internally, so that importing it reproduces the message exactly.
+type topicExportEntry struct {
+	*exportedMessage
+	Email               string `json:"email,omitempty"` // Not masked, see message.MarshalJSON
+	Owner               string `json:"owner,omitempty"`
+	Sender              string `json:"sender,omitempty"`
+	AttachmentOwner     string `json:"attachment_owner,omitempty"`
+	AttachmentDownloads int64  `json:"attachment_downloads,omitempty"`
+}
+
+// exportedMessage has the fields of message, but not its MarshalJSON method
+type exportedMessage message
+
+// exportCheckpoint is written to the export stream after every batch. If an export is interrupted,
+// the last checkpoint can be passed to exportMessages to continue where it stopped.
+type exportCheckpoint struct {
+	Checkpoint exportCursor `json:"checkpoint"`
+}
+
+// exportMessages writes all messages after the given cursor to w as newline-delimited JSON,
+// ordered by time and ID, interleaved with checkpoint markers
+func exportMessages(c cache, w io.Writer, after exportCursor) error {
+	encoder := json.NewEncoder(w)
+	for {
+		messages, err := c.MessagesAfter(after, exportBatchSize)
+		if err != nil {
+			return err
+		} else if len(messages) == 0 {
+			return nil
+		}
+		for _, m := range messages {
+			if err := encoder.Encode(m); err != nil {
+				return err
+			}
+		}
+		last := messages[len(messages)-1]
+		after = exportCursor{Time: last.Time, ID: last.ID}
+		if err := encoder.Encode(&exportCheckpoint{Checkpoint: after}); err != nil {
+			return err
+		}
+		if len(messages) < exportBatchSize {
+			return nil
+		}
+	}
+}
+
+// ExportCacheTopic writes all messages of a topic in the cache file configured in conf to w, see exportTopic.
+// It is safe to run this while the server is running.
+func ExportCacheTopic(conf *Config, topic string, w io.Writer) error {
+	c, err := newSqliteCache(conf)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.ExportTopic(topic, w)
+}
+
+// ImportCacheTopic adds the messages of a topic export read from r to a topic in the cache file configured
+// in conf, see importTopic. Messages that already exist in the cache file are rejected.
+func ImportCacheTopic(conf *Config, topic string, r io.Reader) error {
+	c, err := newSqliteCache(conf)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.ImportTopic(topic, r)
+}
+
+// ExportCacheSender writes all messages of the given sender (see message.Sender) in the cache file configured
+// in conf to w, in the same format as exportTopic, but without the IP addresses of the owners, e.g. to investigate
+// abuse. It is safe to run this while the server is running.
+func ExportCacheSender(conf *Config, sender string, w io.Writer) error {
+	c, err := newSqliteCache(conf)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	messages, err := c.MessagesBySender(sender)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	for _, m := range messages {
+		entry := newTopicExportEntry(m)
+		entry.Owner, entry.AttachmentOwner = "", "" // The hashed sender identifies the publisher
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportTopic writes all messages of the topic to w as newline-delimited JSON, see exportTopic
+func (c *sqliteCache) ExportTopic(topic string, w io.Writer) error {
+	return exportTopic(c, topic, w)
+}
+
+// ImportTopic adds the messages of a topic export read from r to the topic, see importTopic
+func (c *sqliteCache) ImportTopic(topic string, r io.Reader) error {
+	return importTopic(c, topic, r)
+}
+
+// ExportTopic writes all messages of the topic to w as newline-delimited JSON, see exportTopic
+func (c *memCache) ExportTopic(topic string, w io.Writer) error {
+	return exportTopic(c, topic, w)
+}
+
+// ImportTopic adds the messages of a topic export read from r to the topic, see importTopic
+func (c *memCache) ImportTopic(topic string, r io.Reader) error {
+	return importTopic(c, topic, r)
+}
+
+// ExportTopic writes all messages of the topic to w as newline-delimited JSON, see exportTopic
+func (c *postgresCache) ExportTopic(topic string, w io.Writer) error {
+	return exportTopic(c, topic, w)
+}
+
+// ImportTopic adds the messages of a topic export read from r to the topic, see importTopic
+func (c *postgresCache) ImportTopic(topic string, r io.Reader) error {
+	return importTopic(c, topic, r)
+}
+
+// exportTopic writes all messages of the topic, including scheduled messages, to w as newline-delimited JSON,
+// one topicExportEntry per line, in the order they were published
+func exportTopic(c cache, topic string, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return c.MessagesFunc(topic, sinceAllMessages, true, func(m *message) error {
+		return encoder.Encode(newTopicExportEntry(m))
+	})
+}
+
+func newTopicExportEntry(m *message) *topicExportEntry {
+	entry := &topicExportEntry{
+		exportedMessage: (*exportedMessage)(m),
+		Email:           m.Email,
+		Owner:           m.Owner,
+		Sender:          m.Sender,
+	}
+	if m.Attachment != nil {
+		entry.AttachmentOwner = m.Attachment.Owner
+		entry.AttachmentDownloads = m.Attachment.Downloads
+	}
+	return entry
+}
+
+// importTopic reads a topic export (see exportTopic) from r, and adds its messages to the given topic,
+// keeping their IDs and timestamps. Messages are added in batches of exportBatchSize.
+func importTopic(c cache, topic string, r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	messages := make([]*message, 0)
+	for i := 1; ; i++ {
+		entry := &topicExportEntry{exportedMessage: &exportedMessage{}}
+		if err := decoder.Decode(entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("invalid export entry %d: %s", i, err.Error())
+		} else if entry.ID == "" || entry.Time == 0 {
+			return fmt.Errorf("invalid export entry %d: id and time must be set", i)
+		}
+		m := (*message)(entry.exportedMessage)
+		m.Topic = topic
+		m.Email = entry.Email
+		m.Owner = entry.Owner
+		m.Sender = entry.Sender
+		if m.Attachment != nil {
+			m.Attachment.Owner = entry.AttachmentOwner
+			m.Attachment.Downloads = entry.AttachmentDownloads
+		}
+		messages = append(messages, m)
+		if len(messages) == exportBatchSize {
+			if err := c.AddMessages(messages); err != nil {
+				return err
+			}
+			messages = make([]*message, 0)
+		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return c.AddMessages(messages)
+}
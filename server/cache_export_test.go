@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemCache_ExportResume(t *testing.T) {
+	testCacheExportResume(t, newMemCache(NewConfig()))
+}
+
+func TestSqliteCache_ExportResume(t *testing.T) {
+	testCacheExportResume(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_ExportImportTopic(t *testing.T) {
+	testCacheExportImportTopic(t, newMemCache(NewConfig()), newMemCache(NewConfig()))
+}
+
+func TestSqliteCache_ExportImportTopic(t *testing.T) {
+	testCacheExportImportTopic(t, newSqliteTestCache(t), newSqliteTestCache(t))
+}
+
+func testCacheExportImportTopic(t *testing.T, c, imported cache) {
+	lat, lon := 52.52, 13.405
+	m1 := newDefaultMessage("mytopic", "first message")
+	m1.Time = 1000
+	m1.Title = "some title"
+	m1.Priority = 5
+	m1.Tags = []string{"warning", "skull"}
+	m1.Email = "phil@example.com"
+	m1.Owner = "1.2.3.4"
+	m1.Sender = SenderHash("1.2.3.4")
+	m1.Lat, m1.Lon = &lat, &lon
+	m1.Pinned = true
+	m1.Attachment = &attachment{Name: "a.jpg", Type: "image/jpeg", Size: 5000, Expires: 2000, URL: "https://ntfy.sh/file/a.jpg", Owner: "1.2.3.4", Downloads: 3}
+	m2 := newDefaultMessage("mytopic", "second message")
+	m2.Time = 1000 // Same second as the first message
+	m2.Actions = []*action{{Type: "view", Label: "Open", URL: "https://example.com"}}
+	scheduled := newDefaultMessage("mytopic", "scheduled message")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessages([]*message{m1, m2, scheduled}))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other message")))
+
+	var buf bytes.Buffer
+	require.Nil(t, c.ExportTopic("mytopic", &buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Equal(t, 3, len(lines))
+	require.Contains(t, lines[0], `"attachment":{"name":"a.jpg","type":"image/jpeg","size":5000,"expires":2000,"url":"https://ntfy.sh/file/a.jpg"}`)
+	require.Contains(t, lines[0], `"email":"phil@example.com"`)
+	require.Contains(t, lines[0], `"sender":"`+SenderHash("1.2.3.4")+`"`)
+
+	require.Nil(t, imported.ImportTopic("mytopic", &buf))
+	expected, err := c.Messages("mytopic", sinceAllMessages, true, 0)
+	require.Nil(t, err)
+	actual, err := imported.Messages("mytopic", sinceAllMessages, true, 0)
+	require.Nil(t, err)
+	require.Equal(t, expected, actual)
+	count, err := imported.ScheduledCount()
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	err = imported.ImportTopic("mytopic", strings.NewReader(`{"message":"no id"}`))
+	require.EqualError(t, err, "invalid export entry 1: id and time must be set")
+	err = imported.ImportTopic("mytopic", strings.NewReader("not json"))
+	require.Error(t, err)
+}
+
+func testCacheExportResume(t *testing.T, c cache) {
+	for i := 0; i < 5; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.ID = fmt.Sprintf("id%d", i)
+		m.Time = int64(100 + i/2) // Messages 0+1 and 2+3 share a timestamp
+		require.Nil(t, c.AddMessage(m))
+	}
+
+	var buf bytes.Buffer
+	require.Nil(t, exportMessages(c, &buf, exportCursor{}))
+	messages, checkpoints := readExport(t, &buf)
+	require.Equal(t, 5, len(messages))
+	require.Equal(t, []exportCursor{{Time: 102, ID: "id4"}}, checkpoints)
+
+	// Resume after message 2, which shares its timestamp with message 3
+	buf.Reset()
+	require.Nil(t, exportMessages(c, &buf, exportCursor{Time: 101, ID: "id2"}))
+	messages, _ = readExport(t, &buf)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 3", messages[0].Message)
+	require.Equal(t, "message 4", messages[1].Message)
+
+	// Resume from the last checkpoint, nothing left to do
+	buf.Reset()
+	require.Nil(t, exportMessages(c, &buf, checkpoints[0]))
+	messages, checkpoints = readExport(t, &buf)
+	require.Empty(t, messages)
+	require.Empty(t, checkpoints)
+}
+
+func readExport(t *testing.T, buf *bytes.Buffer) ([]*message, []exportCursor) {
+	messages := make([]*message, 0)
+	checkpoints := make([]exportCursor, 0)
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var checkpoint exportCheckpoint
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &checkpoint))
+		if checkpoint.Checkpoint.ID != "" {
+			checkpoints = append(checkpoints, checkpoint.Checkpoint)
+		} else {
+			messages = append(messages, toMessage(t, scanner.Text()))
+		}
+	}
+	return messages, checkpoints
+}
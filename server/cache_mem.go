@@ -1,26 +1,60 @@
 package server
 
 import (
+	"context"
+	"heckel.io/ntfy/util"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
+// delivery is the outcome of a single attempt to deliver a message via Firebase
+type delivery struct {
+	topic  string
+	time   int64
+	failed bool
+}
+
 type memCache struct {
-	messages  map[string][]*message
-	scheduled map[string]*message // Message ID -> message
-	nop       bool
-	mu        sync.Mutex
+	messages            map[string][]*message
+	scheduled           map[string]*message // Message ID -> message
+	publishedAt         map[string]int64    // Message ID -> Unix time of delivery
+	secrets             map[string]string   // Topic -> hashed topic secret
+	metadata            map[string]*topicMetadata
+	reads               map[string]map[string]bool // Message ID -> users that marked it as read, see MarkRead
+	deliveries          []*delivery
+	limit               int           // Message size limit, see checkMessageSize
+	tagsLimit           int           // Max number of tags per message, see normalizeAndCheckTags
+	tagLengthLimit      int           // Max length of a single tag, see normalizeAndCheckTags
+	maxPerTopic         int           // Max number of messages per topic, see checkTopicLimit
+	maxAttachmentExpiry time.Duration // Max attachment expiry from now, see clampAttachmentExpiry
+	dedupWindow         time.Duration // Window in which identical messages are skipped, see message.Dedup
+	metrics             CacheMetrics  // Notified about every added message, see addMessages
+	sequence            int64         // Sequence of the last added or published message, like the sequence column of the SQLite cache
+	nop                 bool
+	mu                  sync.Mutex
 }
 
 var _ cache = (*memCache)(nil)
 
 // newMemCache creates an in-memory cache
-func newMemCache() *memCache {
+func newMemCache(conf *Config) *memCache {
 	return &memCache{
-		messages:  make(map[string][]*message),
-		scheduled: make(map[string]*message),
-		nop:       false,
+		messages:            make(map[string][]*message),
+		scheduled:           make(map[string]*message),
+		publishedAt:         make(map[string]int64),
+		secrets:             make(map[string]string),
+		metadata:            make(map[string]*topicMetadata),
+		reads:               make(map[string]map[string]bool),
+		limit:               conf.MessageLimit,
+		tagsLimit:           conf.MessageTagsLimit,
+		maxPerTopic:         conf.CacheMaxMessagesPerTopic,
+		maxAttachmentExpiry: conf.CacheMaxAttachmentExpiry,
+		tagLengthLimit:      conf.MessageTagLengthLimit,
+		dedupWindow:         conf.CacheDedupWindow,
+		metrics:             cacheMetrics(conf),
+		nop:                 false,
 	}
 }
 
@@ -28,52 +62,284 @@ func newMemCache() *memCache {
 // it is always empty and can be used if caching is entirely disabled
 func newNopCache() *memCache {
 	return &memCache{
-		messages:  make(map[string][]*message),
-		scheduled: make(map[string]*message),
-		nop:       true,
+		messages:    make(map[string][]*message),
+		scheduled:   make(map[string]*message),
+		publishedAt: make(map[string]int64),
+		secrets:     make(map[string]string),
+		metadata:    make(map[string]*topicMetadata),
+		reads:       make(map[string]map[string]bool),
+		nop:         true,
 	}
 }
 
 func (c *memCache) AddMessage(m *message) error {
+	_, err := c.AddMessagePublished(m)
+	return err
+}
+
+func (c *memCache) AddMessagePublished(m *message) (published bool, err error) {
+	duplicates, scheduled, err := c.addMessages([]*message{m})
+	if err != nil {
+		return false, err
+	} else if duplicates > 0 {
+		return false, errDuplicateMessage
+	}
+	return scheduled == 0, nil
+}
+
+func (c *memCache) AddMessages(ms []*message) error {
+	_, _, err := c.addMessages(ms)
+	return err
+}
+
+func (c *memCache) addMessages(ms []*message) (duplicates int, scheduled int, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.nop {
-		return nil
+		return 0, 0, nil
 	}
-	if m.Event != messageEvent {
-		return errUnexpectedMessageType
+	ids := make(map[string]bool)
+	for _, m := range ms {
+		if m.Event == openEvent || m.Event == keepaliveEvent {
+			return 0, 0, errUnexpectedMessageType
+		}
+		if c.exists(m.ID) || ids[m.ID] {
+			return 0, 0, errMessageExists
+		}
+		ids[m.ID] = true
+		if err := checkMessageSize(m, c.limit); err != nil {
+			return 0, 0, err
+		}
+		if err := normalizeAndCheckTags(m, c.tagsLimit, c.tagLengthLimit); err != nil {
+			return 0, 0, err
+		}
+		if err := checkActions(m); err != nil {
+			return 0, 0, err
+		}
+		normalizeContentType(m)
+		clampAttachmentExpiry(m, c.maxAttachmentExpiry)
 	}
-	if _, ok := c.messages[m.Topic]; !ok {
-		c.messages[m.Topic] = make([]*message, 0)
+	if err := checkTopicLimit(ms, c.maxPerTopic, func(topic string) int { return len(c.messages[topic]) }); err != nil {
+		return 0, 0, err
 	}
-	delayed := m.Time > time.Now().Unix()
-	if delayed {
-		c.scheduled[m.ID] = m
+	now := time.Now().Unix()
+	for _, m := range ms {
+		if m.IdempotencyKey != "" {
+			if existing := c.findIdempotent(m.Topic, m.IdempotencyKey); existing != nil {
+				*m = *existing
+				duplicates++
+				continue
+			}
+		}
+		if m.Dedup && c.dedupWindow > 0 {
+			if existing := c.findDuplicate(m, now-int64(c.dedupWindow.Seconds())); existing != nil {
+				m.ID, m.Time = existing.ID, existing.Time
+				duplicates++
+				continue
+			}
+		}
+		if _, ok := c.messages[m.Topic]; !ok {
+			c.messages[m.Topic] = make([]*message, 0)
+		}
+		delayed := m.Time > now
+		m.Published = !delayed
+		if delayed {
+			c.scheduled[m.ID] = m
+			scheduled++
+		} else {
+			c.publishedAt[m.ID] = now
+		}
+		c.sequence++
+		m.sequence = c.sequence
+		c.messages[m.Topic] = append(c.messages[m.Topic], m)
+		metadata := c.topicMetadata(m.Topic)
+		if m.Time > metadata.LastMessageTime {
+			metadata.LastMessageTime = m.Time
+		}
+		metadata.MessageCount++
+		c.metrics.MessageAdded(m.Topic, len(m.Message), m.Attachment != nil)
+	}
+	return duplicates, scheduled, nil
+}
+
+// topicMetadata returns the metadata of the topic, and creates it if it does not exist.
+// The caller must hold the lock.
+func (c *memCache) topicMetadata(topic string) *topicMetadata {
+	if _, ok := c.metadata[topic]; !ok {
+		c.metadata[topic] = &topicMetadata{}
+	}
+	return c.metadata[topic]
+}
+
+// exists returns true if there is a message with the given ID. Every message is either scheduled or
+// published, see addMessages. The caller must hold the lock.
+func (c *memCache) exists(id string) bool {
+	_, scheduled := c.scheduled[id]
+	_, published := c.publishedAt[id]
+	return scheduled || published
+}
+
+// findIdempotent returns the message of the topic that was stored with the given idempotency key,
+// or nil if there is none. The caller must hold the lock.
+func (c *memCache) findIdempotent(topic, key string) *message {
+	for _, existing := range c.messages[topic] {
+		if existing.IdempotencyKey == key {
+			return existing
+		}
 	}
-	c.messages[m.Topic] = append(c.messages[m.Topic], m)
 	return nil
 }
 
-func (c *memCache) Messages(topic string, since sinceTime, scheduled bool) ([]*message, error) {
+// findDuplicate returns the most recent published message that is identical to m and not older
+// than the given Unix time, or nil if there is none. The caller must hold the lock.
+func (c *memCache) findDuplicate(m *message, since int64) *message {
+	hash := dedupHash(m)
+	var duplicate *message
+	for _, existing := range c.messages[m.Topic] {
+		if _, scheduled := c.scheduled[existing.ID]; scheduled || existing.Time < since {
+			continue
+		}
+		if (duplicate == nil || existing.Time >= duplicate.Time) && dedupHash(existing) == hash {
+			duplicate = existing
+		}
+	}
+	return duplicate
+}
+
+func (c *memCache) Messages(topic string, since sinceMarker, scheduled bool, limit int) ([]*message, error) {
+	return c.MessagesContext(context.Background(), topic, since, scheduled, limit, nil)
+}
+
+func (c *memCache) MessagesMulti(topics []string, since sinceMarker, scheduled bool) (map[string][]*message, error) {
+	messages := make(map[string][]*message)
+	for _, topic := range topics {
+		topicMessages, err := c.Messages(topic, since, scheduled, 0)
+		if err != nil {
+			return nil, err
+		}
+		messages[topic] = topicMessages
+	}
+	return messages, nil
+}
+
+func (c *memCache) MessagesBetween(topic string, from, to time.Time, scheduled bool) ([]*message, error) {
+	return c.MessagesContext(context.Background(), topic, newSinceTime(from.Unix()), scheduled, 0, betweenFilter(to))
+}
+
+func (c *memCache) MessagesContext(ctx context.Context, topic string, since sinceMarker, scheduled bool, limit int, filter *messageFilter) ([]*message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if _, ok := c.messages[topic]; !ok || since.IsNone() {
 		return make([]*message, 0), nil
 	}
+	after := c.sequenceOf(since.ID()) // Like the SQLite cache, an unknown ID selects all messages
 	messages := make([]*message, 0)
 	for _, m := range c.messages[topic] {
 		_, messageScheduled := c.scheduled[m.ID]
-		include := m.Time >= since.Time().Unix() && (!messageScheduled || scheduled)
+		include := m.Time >= since.Time().Unix() && m.sequence > after && (!messageScheduled || scheduled) && filter.matches(m) && c.unread(m, filter)
 		if include {
 			messages = append(messages, m)
 		}
 	}
+	sortMessages(messages)
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	if filter.descending() {
+		return reverseMessages(messages), nil
+	}
+	return messages, nil
+}
+
+// sequenceOf returns the sequence of the message with the given ID, or 0 if there is no such message.
+// The caller must hold the lock.
+func (c *memCache) sequenceOf(id string) int64 {
+	if id == "" {
+		return 0
+	}
+	for _, messages := range c.messages {
+		for _, m := range messages {
+			if m.ID == id {
+				return m.sequence
+			}
+		}
+	}
+	return 0
+}
+
+// MessagesFunc calls fn for each message of a topic, see Messages. The messages are already in memory,
+// so this is only for compatibility with sqliteCache.MessagesFunc.
+func (c *memCache) MessagesFunc(topic string, since sinceMarker, scheduled bool, fn func(m *message) error) error {
+	return c.MessagesFuncContext(context.Background(), topic, since, scheduled, nil, fn)
+}
+
+func (c *memCache) MessagesFuncContext(ctx context.Context, topic string, since sinceMarker, scheduled bool, filter *messageFilter, fn func(m *message) error) error {
+	messages, err := c.MessagesContext(ctx, topic, since, scheduled, 0, filter)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *memCache) MessagesByIDs(ids []string) ([]*message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	messages := make([]*message, 0)
+	for topic := range c.messages {
+		for _, m := range c.messages[topic] {
+			if util.InStringList(ids, m.ID) {
+				messages = append(messages, m)
+			}
+		}
+	}
+	sortMessages(messages)
+	return messages, nil
+}
+
+func (c *memCache) MessagesBySender(sender string) ([]*message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	messages := make([]*message, 0)
+	if sender == "" {
+		return messages, nil
+	}
+	for topic := range c.messages {
+		for _, m := range c.messages[topic] {
+			if m.Sender == sender {
+				messages = append(messages, m)
+			}
+		}
+	}
 	sort.Slice(messages, func(i, j int) bool {
 		return messages[i].Time < messages[j].Time
 	})
 	return messages, nil
 }
 
+func (c *memCache) LatestMessage(topic string) (*message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var latest *message
+	for _, m := range c.messages[topic] {
+		_, scheduled := c.scheduled[m.ID]
+		if !scheduled && m.Event == messageEvent && (latest == nil || m.Time >= latest.Time) {
+			latest = m
+		}
+	}
+	if latest == nil {
+		return nil, errNoRows
+	}
+	return latest, nil
+}
+
 func (c *memCache) MessagesDue() ([]*message, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -90,13 +356,246 @@ func (c *memCache) MessagesDue() ([]*message, error) {
 	return messages, nil
 }
 
+func (c *memCache) TakeMessagesDue() ([]*message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now().Unix()
+	messages := make([]*message, 0)
+	for _, m := range c.scheduled {
+		if now >= m.Time {
+			messages = append(messages, m)
+		}
+	}
+	sortMessages(messages)
+	for _, m := range messages {
+		c.publish(m.ID, now)
+	}
+	return messages, nil
+}
+
+func (c *memCache) AllScheduledMessages(limit int) ([]*message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	messages := make([]*message, 0)
+	for _, m := range c.scheduled {
+		messages = append(messages, m)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Time < messages[j].Time
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (c *memCache) PendingScheduled(topic string) ([]*scheduledMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	pending := make([]*scheduledMessage, 0)
+	for _, m := range c.scheduled {
+		if m.Topic == topic && m.Time > now.Unix() {
+			pending = append(pending, newScheduledMessage(m, now))
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].Message.Time < pending[j].Message.Time
+	})
+	return pending, nil
+}
+
+func (c *memCache) MessagesAfter(after exportCursor, limit int) ([]*message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	messages := make([]*message, 0)
+	for topic := range c.messages {
+		for _, m := range c.messages[topic] {
+			if m.Time > after.Time || (m.Time == after.Time && m.ID > after.ID) {
+				messages = append(messages, m)
+			}
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].Time != messages[j].Time {
+			return messages[i].Time < messages[j].Time
+		}
+		return messages[i].ID < messages[j].ID
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
 func (c *memCache) MarkPublished(m *message) error {
+	return c.MarkPublishedBatch([]string{m.ID})
+}
+
+func (c *memCache) MarkPublishedBatch(ids []string) error {
 	c.mu.Lock()
-	delete(c.scheduled, m.ID)
-	c.mu.Unlock()
+	defer c.mu.Unlock()
+	now := time.Now().Unix()
+	for _, id := range ids {
+		if m, ok := c.scheduled[id]; ok {
+			m.Published = true
+			c.publish(id, now)
+		}
+	}
 	return nil
 }
 
+func (c *memCache) RecomputePublished(grace time.Duration) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	due := make([]*message, 0)
+	for _, m := range c.scheduled {
+		if m.Time <= now.Add(grace).Unix() {
+			due = append(due, m)
+		}
+	}
+	sortMessages(due)
+	for _, m := range due {
+		m.Published = true
+		c.publish(m.ID, now.Unix())
+	}
+	return len(due), nil
+}
+
+// publish marks a scheduled message as published at the given Unix time, and gives it a new sequence, so that
+// since=<id> returns it if it was stored before, but published after the given message. The caller must hold the lock.
+func (c *memCache) publish(id string, now int64) {
+	if m, ok := c.scheduled[id]; ok {
+		c.sequence++
+		m.sequence = c.sequence
+	}
+	delete(c.scheduled, id)
+	c.publishedAt[id] = now
+}
+
+func (c *memCache) PinMessage(id string) error {
+	return c.setPinned(id, true)
+}
+
+func (c *memCache) UnpinMessage(id string) error {
+	return c.setPinned(id, false)
+}
+
+func (c *memCache) UpdateMessage(id string, m *message) error {
+	if err := checkMessageSize(m, c.limit); err != nil {
+		return err
+	}
+	if err := normalizeAndCheckTags(m, c.tagsLimit, c.tagLengthLimit); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, existing := range c.messages[m.Topic] {
+		if existing.ID == id {
+			existing.Message = m.Message
+			existing.Encoding = m.Encoding
+			existing.Title = m.Title
+			existing.Priority = m.Priority
+			existing.Tags = m.Tags
+			existing.Edited = m.Edited
+			return nil
+		}
+	}
+	return errNoRows
+}
+
+func (c *memCache) setPinned(id string, pinned bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for topic := range c.messages {
+		for _, m := range c.messages[topic] {
+			if m.ID == id {
+				m.Pinned = pinned
+				return nil
+			}
+		}
+	}
+	return errNoRows
+}
+
+func (c *memCache) DeleteMessage(id string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for topic := range c.messages {
+		if deleted := c.deleteMessages(topic, func(m *message) bool { return m.ID == id }); deleted > 0 {
+			return deleted, nil
+		}
+	}
+	return 0, nil
+}
+
+func (c *memCache) DeleteScheduled(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.scheduled[id]
+	if !ok {
+		for topic := range c.messages {
+			for _, m := range c.messages[topic] {
+				if m.ID == id {
+					return errMessagePublished
+				}
+			}
+		}
+		return errNoRows
+	}
+	c.deleteMessages(m.Topic, func(m *message) bool { return m.ID == id })
+	return nil
+}
+
+func (c *memCache) DeleteMessagesForTopic(topic string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deleteMessages(topic, func(m *message) bool { return true }), nil
+}
+
+// deleteMessages removes all messages of a topic matching the given function, including scheduled
+// (not yet published) messages, and returns the number of removed messages
+func (c *memCache) deleteMessages(topic string, matches func(m *message) bool) int {
+	messages := make([]*message, 0)
+	for _, m := range c.messages[topic] {
+		if matches(m) {
+			delete(c.scheduled, m.ID)
+			delete(c.publishedAt, m.ID)
+			delete(c.reads, m.ID)
+		} else {
+			messages = append(messages, m)
+		}
+	}
+	deleted := len(c.messages[topic]) - len(messages)
+	if deleted > 0 {
+		c.messages[topic] = messages
+		c.topicMetadata(topic).MessageCount -= deleted
+	}
+	return deleted
+}
+
+func (c *memCache) PublishedBetween(from, to time.Time) ([]*message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	messages := make([]*message, 0)
+	for topic := range c.messages {
+		for _, m := range c.messages[topic] {
+			publishedAt, ok := c.publishedAt[m.ID]
+			if ok && publishedAt >= from.Unix() && publishedAt <= to.Unix() {
+				messages = append(messages, m)
+			}
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if c.publishedAt[messages[i].ID] != c.publishedAt[messages[j].ID] {
+			return c.publishedAt[messages[i].ID] < c.publishedAt[messages[j].ID]
+		}
+		return messages[i].Time < messages[j].Time
+	})
+	return messages, nil
+}
+
 func (c *memCache) MessageCount(topic string) (int, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -106,22 +605,261 @@ func (c *memCache) MessageCount(topic string) (int, error) {
 	return len(c.messages[topic]), nil
 }
 
-func (c *memCache) Topics() (map[string]*topic, error) {
+func (c *memCache) ScheduledCount() (int, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	topics := make(map[string]*topic)
+	return len(c.scheduled), nil
+}
+
+func (c *memCache) ScheduledCountForTopic(topic string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var count int
+	for _, m := range c.scheduled {
+		if m.Topic == topic {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (c *memCache) EncodingBreakdown() (map[string]int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]int)
 	for topic := range c.messages {
-		topics[topic] = newTopic(topic)
+		for _, m := range c.messages[topic] {
+			counts[m.Encoding]++
+		}
+	}
+	return counts, nil
+}
+
+func (c *memCache) AttachmentSizeByType() (map[string]int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.attachmentSizeByType(), nil
+}
+
+// attachmentSizeByType returns the attachment sizes by type, see cache.AttachmentSizeByType. The caller
+// must hold the lock.
+func (c *memCache) attachmentSizeByType() map[string]int64 {
+	sizes := make(map[string]int64)
+	for topic := range c.messages {
+		for _, m := range c.messages[topic] {
+			if m.Attachment != nil && m.Attachment.URL != "" {
+				sizes[m.Attachment.Type] += m.Attachment.Size
+			}
+		}
+	}
+	return sizes
+}
+
+func (c *memCache) Stats() (*cacheStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := cacheStats{AttachmentBytesByType: c.attachmentSizeByType()}
+	now := time.Now().Unix()
+	for topic := range c.messages {
+		if len(c.messages[topic]) > 0 {
+			stats.Topics++
+		}
+		for _, m := range c.messages[topic] {
+			stats.Messages++
+			if m.Attachment != nil && m.Attachment.Expires >= now {
+				stats.AttachmentBytes += m.Attachment.Size
+			}
+			if stats.OldestMessage.IsZero() || m.Time < stats.OldestMessage.Unix() {
+				stats.OldestMessage = time.Unix(m.Time, 0)
+			}
+		}
+	}
+	return &stats, nil
+}
+
+func (c *memCache) Topics(excludePrefixes ...string) (map[string]*topic, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topics := make(map[string]*topic)
+	for topic, messages := range c.messages {
+		if len(messages) > 0 && !hasAnyPrefix(topic, excludePrefixes) {
+			topics[topic] = newTopic(topic)
+			if metadata, ok := c.metadata[topic]; ok {
+				topics[topic].topicMetadata = *metadata
+			}
+		}
 	}
 	return topics, nil
 }
 
-func (c *memCache) Prune(olderThan time.Time) error {
+func (c *memCache) TopicsSince(since time.Time) (map[string]*topic, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	topics := make(map[string]*topic)
+	for id, messages := range c.messages {
+		for _, m := range messages {
+			if _, scheduled := c.scheduled[m.ID]; !scheduled && m.Time >= since.Unix() {
+				topics[id] = newTopic(id)
+				if metadata, ok := c.metadata[id]; ok {
+					topics[id].topicMetadata = *metadata
+				}
+				break
+			}
+		}
+	}
+	return topics, nil
+}
+
+func (c *memCache) TopicsFunc(fn func(topic string) error, excludePrefixes ...string) error {
+	topics, err := c.Topics(excludePrefixes...) // Release lock before calling fn
+	if err != nil {
+		return err
+	}
+	for id := range topics {
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *memCache) TopicCount(excludePrefixes ...string) (int, error) {
+	topics, err := c.Topics(excludePrefixes...)
+	if err != nil {
+		return 0, err
+	}
+	return len(topics), nil
+}
+
+func (c *memCache) TopicExists(topic string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.messages[topic]) > 0, nil
+}
+
+func (c *memCache) ActiveTopics(window time.Duration, limit int) ([]*topicRate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	rates := make([]*topicRate, 0)
 	for topic := range c.messages {
-		c.pruneTopic(topic, olderThan)
+		var count int
+		for _, m := range c.messages[topic] {
+			_, scheduled := c.scheduled[m.ID]
+			if !scheduled && m.Time >= now.Add(-window).Unix() && m.Time <= now.Unix() {
+				count++
+			}
+		}
+		if count > 0 {
+			rates = append(rates, newTopicRate(topic, count, window))
+		}
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].Count != rates[j].Count {
+			return rates[i].Count > rates[j].Count
+		}
+		return rates[i].Topic < rates[j].Topic
+	})
+	if len(rates) > limit {
+		rates = rates[:limit]
 	}
+	return rates, nil
+}
+
+func (c *memCache) CumulativeCount(topic string, bucket time.Duration, from, to time.Time) ([]point, error) {
+	if bucket < time.Second {
+		return nil, errInvalidBucketSize
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	histogram := make(map[int64]int)
+	for _, m := range c.messages[topic] {
+		_, scheduled := c.scheduled[m.ID]
+		if !scheduled && m.Time >= from.Unix() && m.Time < to.Unix() {
+			histogram[(m.Time-from.Unix())/int64(bucket.Seconds())]++
+		}
+	}
+	return cumulativePoints(histogram, bucket, from, to), nil
+}
+
+func (c *memCache) Prune(olderThan, inactiveOlderThan time.Time, activeTopics []string, perTopic map[string]time.Time, perPriority map[int]time.Time) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	deliveries := make([]*delivery, 0)
+	for _, d := range c.deliveries {
+		if d.time >= olderThan.Unix() {
+			deliveries = append(deliveries, d)
+		}
+	}
+	c.deliveries = deliveries
+	var deleted int
+	for topic := range c.messages {
+		if topicOlderThan, ok := perTopic[topic]; ok {
+			deleted += c.pruneTopic(topic, topicOlderThan)
+			continue
+		}
+		topicOlderThan := olderThan
+		if inactiveOlderThan.After(olderThan) && !util.InStringList(activeTopics, topic) {
+			topicOlderThan = inactiveOlderThan
+		}
+		deleted += c.deleteMessages(topic, func(m *message) bool {
+			priority := m.Priority
+			if priority == 0 {
+				priority = 3 // Messages without explicit priority have the default priority
+			}
+			if priorityOlderThan, ok := perPriority[priority]; ok {
+				return c.prunable(m, priorityOlderThan)
+			}
+			return c.prunable(m, topicOlderThan)
+		})
+	}
+	return int64(deleted), nil
+}
+
+func (c *memCache) PruneDryRun(olderThan time.Time) (messages int64, bytes int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, topicMessages := range c.messages {
+		for _, m := range topicMessages {
+			if c.prunable(m, olderThan) {
+				messages++
+				bytes += int64(len(m.Message))
+			}
+		}
+	}
+	return messages, bytes, nil
+}
+
+func (c *memCache) PruneToCount(maxPerTopic int) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var deleted int
+	for topic := range c.messages {
+		published := make([]*message, 0)
+		for _, m := range c.messages[topic] {
+			if _, scheduled := c.scheduled[m.ID]; !scheduled {
+				published = append(published, m)
+			}
+		}
+		if len(published) <= maxPerTopic {
+			continue
+		}
+		sort.SliceStable(published, func(i, j int) bool {
+			return published[i].Time < published[j].Time
+		})
+		prune := make(map[string]bool)
+		for _, m := range published[:len(published)-maxPerTopic] {
+			if !m.Pinned {
+				prune[m.ID] = true
+			}
+		}
+		deleted += c.deleteMessages(topic, func(m *message) bool { return prune[m.ID] })
+	}
+	return deleted, nil
+}
+
+// Compact is a no-op, since there is nothing to reclaim in an in-memory cache
+func (c *memCache) Compact() error {
 	return nil
 }
 
@@ -140,6 +878,84 @@ func (c *memCache) AttachmentsSize(owner string) (int64, error) {
 	return size, nil
 }
 
+func (c *memCache) IncrementDownloads(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for topic := range c.messages {
+		for _, m := range c.messages[topic] {
+			if m.ID == id && m.Attachment != nil {
+				m.Attachment.Downloads++
+				return nil
+			}
+		}
+	}
+	return errNoRows
+}
+
+func (c *memCache) DownloadBytes(owner string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var bytes int64
+	for topic := range c.messages {
+		for _, m := range c.messages[topic] {
+			if m.Attachment != nil && m.Attachment.Owner == owner {
+				bytes += m.Attachment.Size * m.Attachment.Downloads
+			}
+		}
+	}
+	return bytes, nil
+}
+
+func (c *memCache) ReassignAttachments(oldOwner, newOwner string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for topic := range c.messages {
+		for _, m := range c.messages[topic] {
+			if m.Attachment != nil && m.Attachment.Owner == oldOwner {
+				m.Attachment.Owner = newOwner
+			}
+		}
+	}
+	return nil
+}
+
+func (c *memCache) ClearAttachmentOwner(owner string) error {
+	return c.ReassignAttachments(owner, "")
+}
+
+func (c *memCache) ClearAttachment(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for topic := range c.messages {
+		for _, m := range c.messages[topic] {
+			if m.ID == id {
+				m.Attachment = nil
+				return nil
+			}
+		}
+	}
+	return errNoRows
+}
+
+func (c *memCache) OwnerUsage(owner string, since time.Time) (messages int, attachmentBytes int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for topic := range c.messages {
+		for _, m := range c.messages[topic] {
+			if m.Time < since.Unix() {
+				continue
+			}
+			if m.Owner == owner {
+				messages++
+			}
+			if m.Attachment != nil && m.Attachment.Owner == owner {
+				attachmentBytes += m.Attachment.Size
+			}
+		}
+	}
+	return messages, attachmentBytes, nil
+}
+
 func (c *memCache) AttachmentsExpired() ([]string, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -154,12 +970,158 @@ func (c *memCache) AttachmentsExpired() ([]string, error) {
 	return ids, nil
 }
 
-func (c *memCache) pruneTopic(topic string, olderThan time.Time) {
-	messages := make([]*message, 0)
-	for _, m := range c.messages[topic] {
-		if m.Time >= olderThan.Unix() {
-			messages = append(messages, m)
+func (c *memCache) RewriteAttachmentURLs(oldBase, newBase string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var updated int
+	for topic := range c.messages {
+		for _, m := range c.messages[topic] {
+			if m.Attachment != nil && strings.HasPrefix(m.Attachment.URL, oldBase) {
+				m.Attachment.URL = strings.ReplaceAll(m.Attachment.URL, oldBase, newBase)
+				updated++
+			}
+		}
+	}
+	return updated, nil
+}
+
+func (c *memCache) MessagesWithMissingAttachments(missing func(url string) bool) ([]*message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	broken := make([]*message, 0)
+	for topic := range c.messages {
+		for _, m := range c.messages[topic] {
+			if m.Attachment != nil && m.Attachment.URL != "" && missing(m.Attachment.URL) {
+				broken = append(broken, m)
+			}
 		}
 	}
-	c.messages[topic] = messages
+	sort.Slice(broken, func(i, j int) bool {
+		return broken[i].Time < broken[j].Time
+	})
+	return broken, nil
+}
+
+func (c *memCache) Ping() error {
+	return nil
+}
+
+// Close is a no-op, since the memory cache holds no resources
+func (c *memCache) Close() error {
+	return nil
+}
+
+// SchemaVersion always returns 0, since the memory cache has no schema
+func (c *memCache) SchemaVersion() (int, error) {
+	return 0, nil
+}
+
+func (c *memCache) SetTopicDisplayName(topic, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.topicMetadata(topic).DisplayName = name
+	return nil
+}
+
+// MarkRead marks the message as read by the given user, see sqliteCache.MarkRead
+func (c *memCache) MarkRead(id, user string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, messages := range c.messages {
+		for _, m := range messages {
+			if m.ID == id {
+				if c.reads[id] == nil {
+					c.reads[id] = make(map[string]bool)
+				}
+				c.reads[id][user] = true
+				return nil
+			}
+		}
+	}
+	return errNoRows
+}
+
+// unread returns true if the message was not marked as read by the user in filter.UnreadBy, or if there is
+// no such user. The caller must hold c.mu.
+func (c *memCache) unread(m *message, filter *messageFilter) bool {
+	return filter == nil || filter.UnreadBy == "" || !c.reads[m.ID][filter.UnreadBy]
+}
+
+// SetTopicSecret stores the hash of the topic secret. The hash is computed (and verified, see VerifyTopicSecret)
+// without holding the lock, since bcrypt is slow on purpose.
+func (c *memCache) SetTopicSecret(topic, secret string) error {
+	if secret == "" {
+		c.mu.Lock()
+		delete(c.secrets, topic)
+		c.mu.Unlock()
+		return nil
+	}
+	hash, err := hashTopicSecret(secret)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.secrets[topic] = hash
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memCache) VerifyTopicSecret(topic, secret string) (bool, error) {
+	c.mu.Lock()
+	hash, ok := c.secrets[topic]
+	c.mu.Unlock()
+	if !ok {
+		return true, nil // No secret, topic is open
+	}
+	return verifyTopicSecret(hash, secret), nil
+}
+
+func (c *memCache) AddDelivery(topic string, failed bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nop {
+		return nil
+	}
+	c.deliveries = append(c.deliveries, &delivery{
+		topic:  topic,
+		time:   time.Now().Unix(),
+		failed: failed,
+	})
+	return nil
+}
+
+func (c *memCache) DeliveryRatio(topic string, since time.Time) (sent, failed int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, d := range c.deliveries {
+		if d.topic != topic || d.time < since.Unix() {
+			continue
+		} else if d.failed {
+			failed++
+		} else {
+			sent++
+		}
+	}
+	return sent, failed, nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *memCache) pruneTopic(topic string, olderThan time.Time) int {
+	return c.deleteMessages(topic, func(m *message) bool {
+		return c.prunable(m, olderThan)
+	})
+}
+
+// prunable returns true if the message is older than the cutoff, and is neither pinned nor scheduled
+func (c *memCache) prunable(m *message, olderThan time.Time) bool {
+	_, scheduled := c.scheduled[m.ID]
+	return m.Time < olderThan.Unix() && !m.Pinned && !scheduled
 }
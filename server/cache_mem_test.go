@@ -3,37 +3,300 @@ package server
 import (
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestMemCache_Messages(t *testing.T) {
-	testCacheMessages(t, newMemCache())
+	testCacheMessages(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessagesLimit(t *testing.T) {
+	testCacheMessagesLimit(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessagesContextCanceled(t *testing.T) {
+	testCacheMessagesContextCanceled(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessagesFilter(t *testing.T) {
+	testCacheMessagesFilter(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessagesFilterTagsExact(t *testing.T) {
+	testCacheMessagesFilterTagsExact(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessagesMulti(t *testing.T) {
+	testCacheMessagesMulti(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_Stats(t *testing.T) {
+	testCacheStats(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessagesSinceID(t *testing.T) {
+	testCacheMessagesSinceID(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessagesSinceIDScheduled(t *testing.T) {
+	testCacheMessagesSinceIDScheduled(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_AddMessages(t *testing.T) {
+	testCacheAddMessages(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_Dedup(t *testing.T) {
+	testCacheDedup(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_IdempotencyKey(t *testing.T) {
+	testCacheIdempotencyKey(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessageExists(t *testing.T) {
+	testCacheMessageExists(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_UpdateMessage(t *testing.T) {
+	testCacheUpdateMessage(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_Actions(t *testing.T) {
+	testCacheActions(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_Icon(t *testing.T) {
+	testCacheIcon(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_ContentType(t *testing.T) {
+	testCacheContentType(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_AttachmentDownloads(t *testing.T) {
+	testCacheAttachmentDownloads(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_AttachmentOwner(t *testing.T) {
+	testCacheAttachmentOwner(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_Events(t *testing.T) {
+	testCacheEvents(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessagesFunc(t *testing.T) {
+	testCacheMessagesFunc(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_TopicMetadata(t *testing.T) {
+	testCacheTopicMetadata(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_AddMessagePublished(t *testing.T) {
+	testCacheAddMessagePublished(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_ReadPublished(t *testing.T) {
+	testCacheReadPublished(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MarkPublishedBatch(t *testing.T) {
+	testCacheMarkPublishedBatch(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessagesBetween(t *testing.T) {
+	testCacheMessagesBetween(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MarkRead(t *testing.T) {
+	testCacheMarkRead(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_Close(t *testing.T) {
+	testCacheClose(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessageCount(t *testing.T) {
+	testCacheMessageCount(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessagesByIDs(t *testing.T) {
+	testCacheMessagesByIDs(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_LatestMessage(t *testing.T) {
+	testCacheLatestMessage(t, newMemCache(NewConfig()))
 }
 
 func TestMemCache_MessagesScheduled(t *testing.T) {
-	testCacheMessagesScheduled(t, newMemCache())
+	testCacheMessagesScheduled(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessagesSameSecondOrder(t *testing.T) {
+	testCacheMessagesSameSecondOrder(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessagesOrder(t *testing.T) {
+	testCacheMessagesOrder(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_RecomputePublished(t *testing.T) {
+	testCacheRecomputePublished(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_AllScheduledMessages(t *testing.T) {
+	testCacheAllScheduledMessages(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_PendingScheduled(t *testing.T) {
+	testCachePendingScheduled(t, newMemCache(NewConfig()))
 }
 
 func TestMemCache_Topics(t *testing.T) {
-	testCacheTopics(t, newMemCache())
+	testCacheTopics(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_TopicsSince(t *testing.T) {
+	testCacheTopicsSince(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_TopicsFunc(t *testing.T) {
+	testCacheTopicsFunc(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_TopicsExcludePrefix(t *testing.T) {
+	testCacheTopicsExcludePrefix(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_TopicExists(t *testing.T) {
+	testCacheTopicExists(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_ActiveTopics(t *testing.T) {
+	testCacheActiveTopics(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_CumulativeCount(t *testing.T) {
+	testCacheCumulativeCount(t, newMemCache(NewConfig()))
 }
 
 func TestMemCache_MessagesTagsPrioAndTitle(t *testing.T) {
-	testCacheMessagesTagsPrioAndTitle(t, newMemCache())
+	testCacheMessagesTagsPrioAndTitle(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_PrioritySource(t *testing.T) {
+	testCachePrioritySource(t, newMemCache(NewConfig()))
 }
 
 func TestMemCache_Prune(t *testing.T) {
-	testCachePrune(t, newMemCache())
+	testCachePrune(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_PruneDryRun(t *testing.T) {
+	testCachePruneDryRun(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_PruneInactive(t *testing.T) {
+	testCachePruneInactive(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_PrunePerTopic(t *testing.T) {
+	testCachePrunePerTopic(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_PrunePerPriority(t *testing.T) {
+	testCachePrunePerPriority(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_PruneToCount(t *testing.T) {
+	testCachePruneToCount(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_PinnedMessages(t *testing.T) {
+	testCachePinnedMessages(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_DeleteMessages(t *testing.T) {
+	testCacheDeleteMessages(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_PublishedBetween(t *testing.T) {
+	testCachePublishedBetween(t, newMemCache(NewConfig()))
 }
 
 func TestMemCache_Attachments(t *testing.T) {
-	testCacheAttachments(t, newMemCache())
+	testCacheAttachments(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_ClearAttachment(t *testing.T) {
+	testCacheClearAttachment(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_Metrics(t *testing.T) {
+	metrics := &recordingCacheMetrics{}
+	conf := NewConfig()
+	conf.CacheMetrics = metrics
+	testCacheMetrics(t, newMemCache(conf), metrics)
+}
+
+func TestMemCache_OwnerUsage(t *testing.T) {
+	testCacheOwnerUsage(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_RewriteAttachmentURLs(t *testing.T) {
+	testCacheRewriteAttachmentURLs(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessagesWithMissingAttachments(t *testing.T) {
+	testCacheMessagesWithMissingAttachments(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_TopicSecrets(t *testing.T) {
+	testCacheTopicSecrets(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_EncodedPayloadTooLarge(t *testing.T) {
+	testCacheEncodedPayloadTooLarge(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MessageTooLarge(t *testing.T) {
+	testCacheMessageTooLarge(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_EncodingBreakdown(t *testing.T) {
+	testCacheEncodingBreakdown(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_AttachmentSizeByType(t *testing.T) {
+	testCacheAttachmentSizeByType(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_TagLimits(t *testing.T) {
+	conf := NewConfig()
+	conf.MessageTagsLimit = 3
+	conf.MessageTagLengthLimit = 5
+	testCacheTagLimits(t, newMemCache(conf))
+}
+
+func TestMemCache_Email(t *testing.T) {
+	testCacheEmail(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_DeliveryRatio(t *testing.T) {
+	testCacheDeliveryRatio(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_Location(t *testing.T) {
+	testCacheLocation(t, newMemCache(NewConfig()))
 }
 
 func TestMemCache_NopCache(t *testing.T) {
 	c := newNopCache()
 	assert.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my message")))
 
-	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
 	assert.Nil(t, err)
 	assert.Empty(t, messages)
 
@@ -41,3 +304,32 @@ func TestMemCache_NopCache(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Empty(t, topics)
 }
+
+func TestMemCache_DeleteScheduled(t *testing.T) {
+	testCacheDeleteScheduled(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_TakeMessagesDue(t *testing.T) {
+	testCacheTakeMessagesDue(t, newMemCache(NewConfig()))
+}
+
+func TestMemCache_MaxMessagesPerTopic(t *testing.T) {
+	conf := NewConfig()
+	conf.CacheMaxMessagesPerTopic = 2
+	testCacheMaxMessagesPerTopic(t, newMemCache(conf))
+}
+
+func TestMemCache_MaxAttachmentExpiry(t *testing.T) {
+	conf := NewConfig()
+	conf.CacheMaxAttachmentExpiry = time.Hour
+	testCacheMaxAttachmentExpiry(t, newMemCache(conf), time.Hour)
+}
+
+func TestMemCache_MaxAttachmentExpiryUnbounded(t *testing.T) {
+	conf := NewConfig()
+	testCacheMaxAttachmentExpiry(t, newMemCache(conf), 0)
+}
+
+func TestMemCache_MessagesBySender(t *testing.T) {
+	testCacheMessagesBySender(t, newMemCache(NewConfig()))
+}
@@ -0,0 +1,1668 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Messages cache. Unlike in SQLite, IN lists are passed as a single array parameter (= ANY($n)), so queries
+// never have to be split into chunks, see MessagesByIDs and MarkPublishedBatch.
+const (
+	postgresCreateMessagesTableQuery = `
+		CREATE TABLE IF NOT EXISTS messages (
+			id TEXT PRIMARY KEY,
+			time BIGINT NOT NULL,
+			topic TEXT NOT NULL,
+			message TEXT NOT NULL,
+			title TEXT NOT NULL,
+			priority INT NOT NULL,
+			tags TEXT NOT NULL,
+			click TEXT NOT NULL,
+			attachment_name TEXT NOT NULL,
+			attachment_type TEXT NOT NULL,
+			attachment_size BIGINT NOT NULL,
+			attachment_expires BIGINT NOT NULL,
+			attachment_url TEXT NOT NULL,
+			attachment_owner TEXT NOT NULL,
+			encoding TEXT NOT NULL,
+			published BOOLEAN NOT NULL,
+			published_at BIGINT NOT NULL,
+			email TEXT NOT NULL,
+			lat DOUBLE PRECISION,
+			lon DOUBLE PRECISION,
+			owner TEXT NOT NULL,
+			body_ref TEXT NOT NULL,
+			pinned BOOLEAN NOT NULL,
+			priority_source TEXT NOT NULL,
+			dedup_hash TEXT NOT NULL,
+			idempotency_key TEXT NOT NULL,
+			edited BIGINT NOT NULL,
+			actions TEXT NOT NULL,
+			icon TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			attachment_downloads BIGINT NOT NULL,
+			event TEXT NOT NULL,
+			sequence BIGSERIAL NOT NULL,
+			sender TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_topic ON messages (topic);
+		CREATE INDEX IF NOT EXISTS idx_dedup_hash ON messages (dedup_hash);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_idempotency_key ON messages (topic, idempotency_key) WHERE idempotency_key <> '';
+		CREATE INDEX IF NOT EXISTS idx_due ON messages (time) WHERE NOT published;
+		CREATE INDEX IF NOT EXISTS idx_attachment_expires ON messages (attachment_expires) WHERE attachment_expires > 0;
+		CREATE INDEX IF NOT EXISTS idx_sequence ON messages (sequence);
+		CREATE INDEX IF NOT EXISTS idx_sender ON messages (sender) WHERE sender <> '';
+	`
+	// The sequence is assigned by the database (BIGSERIAL), so that concurrent inserts of several ntfy instances
+	// never get the same sequence. Messages are stored as they are, see postgresCache.
+	postgresInsertMessageQuery = `
+		INSERT INTO messages (id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, published, published_at, email, lat, lon, owner, body_ref, pinned, priority_source, dedup_hash, idempotency_key, edited, actions, icon, content_type, attachment_downloads, event, sender)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, '', $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32)
+		ON CONFLICT (id) DO NOTHING
+	`
+	postgresSelectDuplicateMessageQuery = `
+		SELECT id, time
+		FROM messages
+		WHERE dedup_hash = $1 AND time >= $2 AND published
+		ORDER BY time DESC, sequence DESC
+		LIMIT 1
+	`
+	postgresPruneMessagesQuery             = `DELETE FROM messages WHERE time < $1 AND published AND NOT pinned`
+	postgresPruneMessagesDryRunQuery       = `SELECT COUNT(*), COALESCE(SUM(octet_length(message)), 0) FROM messages WHERE time < $1 AND published AND NOT pinned`
+	postgresPruneExceptTopicsClause        = ` AND topic <> ALL($%d)`
+	postgresPruneExceptPrioritiesClause    = ` AND (CASE priority WHEN 0 THEN 3 ELSE priority END) <> ALL($%d)` // Priority 0 is stored if none was set, i.e. default (3)
+	postgresPruneTopicMessagesQuery        = `DELETE FROM messages WHERE time < $1 AND published AND NOT pinned AND topic = $2`
+	postgresPrunePriorityMessagesQuery     = `DELETE FROM messages WHERE time < $1 AND published AND NOT pinned AND (CASE priority WHEN 0 THEN 3 ELSE priority END) = $2`
+	postgresPruneTopicMessagesToCountQuery = `
+		DELETE FROM messages
+		WHERE topic = $1 AND published AND NOT pinned AND id NOT IN (
+			SELECT id FROM messages WHERE topic = $1 AND published ORDER BY time DESC, sequence DESC LIMIT $2
+		)
+	`
+	postgresSelectMessagesSinceTimeQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE topic = $1 AND time >= $2 AND published%s
+		ORDER BY time %s, sequence %s
+		LIMIT $3
+	`
+	// See selectMessagesSinceIDQuery
+	postgresSelectMessagesSinceIDQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE topic = $1 AND sequence > (SELECT COALESCE(MAX(sequence), 0) FROM messages WHERE id = $2) AND published%s
+		ORDER BY time %s, sequence %s
+		LIMIT $3
+	`
+	postgresSelectMessagesSinceTimeIncludeScheduledQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE topic = $1 AND time >= $2%s
+		ORDER BY time %s, sequence %s
+		LIMIT $3
+	`
+	postgresSelectMessagesSinceIDIncludeScheduledQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE topic = $1 AND sequence > (SELECT COALESCE(MAX(sequence), 0) FROM messages WHERE id = $2)%s
+		ORDER BY time %s, sequence %s
+		LIMIT $3
+	`
+	postgresSelectMessagesMultiSinceTimeQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE topic = ANY($1) AND time >= $2%s
+		ORDER BY time ASC, sequence ASC
+	`
+	postgresSelectMessagesMultiSinceIDQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE topic = ANY($1) AND sequence > (SELECT COALESCE(MAX(sequence), 0) FROM messages WHERE id = $2)%s
+		ORDER BY time ASC, sequence ASC
+	`
+	postgresSelectMessageByIdempotencyKeyQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE topic = $1 AND idempotency_key = $2
+	`
+	postgresSelectMessagesPublishedBetweenQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE published AND published_at >= $1 AND published_at <= $2
+		ORDER BY published_at ASC, time ASC, sequence ASC
+	`
+	postgresSelectMessagesByIDsQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE id = ANY($1)
+		ORDER BY time ASC, sequence ASC
+	`
+	postgresSelectLatestMessageQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE topic = $1 AND published AND event = $2
+		ORDER BY time DESC, sequence DESC
+		LIMIT 1
+	`
+	postgresSelectAllScheduledMessagesQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE NOT published
+		ORDER BY time ASC, sequence ASC
+		LIMIT $1
+	`
+	postgresSelectPendingScheduledMessagesQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE topic = $1 AND time > $2 AND NOT published
+		ORDER BY time ASC, sequence ASC
+	`
+	postgresSelectMessagesAfterQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE time > $1 OR (time = $1 AND id > $2)
+		ORDER BY time ASC, id ASC
+		LIMIT $3
+	`
+	postgresSelectMessagesBySenderQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE sender = $1
+		ORDER BY time ASC, sequence ASC
+	`
+	postgresSelectMessagesWithAttachmentQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE attachment_url <> ''
+		ORDER BY time ASC, sequence ASC
+	`
+	postgresSelectMessagesDueQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages
+		WHERE time <= $1 AND NOT published
+	`
+	// Rows that another ntfy instance is taking at the same time are skipped, so that each due message is only
+	// taken (and delivered) once, see TakeMessagesDue
+	postgresSelectMessagesDueForUpdateQuery = postgresSelectMessagesDueQuery + `
+		ORDER BY time ASC, sequence ASC
+		FOR UPDATE SKIP LOCKED
+	`
+	// See updateMessagesPublishedQuery; the new sequences are taken from the sequence of the column
+	postgresUpdateMessagesPublishedQuery = `
+		UPDATE messages
+		SET published = TRUE, published_at = $1, sequence = due.new_sequence
+		FROM (
+			SELECT id, nextval('messages_sequence_seq') AS new_sequence
+			FROM (SELECT id FROM messages WHERE id = ANY($2) AND NOT published ORDER BY time, sequence) AS ordered
+		) AS due
+		WHERE messages.id = due.id
+	`
+	postgresUpdateMessagesPublishedDueQuery = `
+		UPDATE messages
+		SET published = TRUE, published_at = $1, sequence = due.new_sequence
+		FROM (
+			SELECT id, nextval('messages_sequence_seq') AS new_sequence
+			FROM (SELECT id FROM messages WHERE time <= $2 AND NOT published ORDER BY time, sequence) AS ordered
+		) AS due
+		WHERE messages.id = due.id
+	`
+	postgresUpdateMessagePinnedQuery          = `UPDATE messages SET pinned = $1 WHERE id = $2`
+	postgresUpdateMessageContentQuery         = `UPDATE messages SET message = $1, title = $2, priority = $3, tags = $4, encoding = $5, dedup_hash = $6, edited = $7 WHERE id = $8 AND topic = $9`
+	postgresDeleteMessageQuery                = `DELETE FROM messages WHERE id = $1`
+	postgresDeleteScheduledMessageQuery       = `DELETE FROM messages WHERE id = $1 AND NOT published`
+	postgresDeleteMessagesForTopicQuery       = `DELETE FROM messages WHERE topic = $1`
+	postgresSelectMessageCountQuery           = `SELECT COUNT(*) FROM messages WHERE topic = $1`
+	postgresSelectMessageCountsQuery          = `SELECT topic, COUNT(*) FROM messages WHERE topic = ANY($1) GROUP BY topic`
+	postgresSelectMessageTopicQuery           = `SELECT topic FROM messages WHERE id = $1`
+	postgresSelectScheduledCountQuery         = `SELECT COUNT(*) FROM messages WHERE NOT published`
+	postgresSelectScheduledCountForTopicQuery = `SELECT COUNT(*) FROM messages WHERE topic = $1 AND NOT published`
+	postgresSelectEncodingBreakdownQuery      = `SELECT encoding, COUNT(*) FROM messages GROUP BY encoding`
+	postgresSelectAttachmentSizeByTypeQuery   = `SELECT attachment_type, SUM(attachment_size) FROM messages WHERE attachment_url <> '' GROUP BY attachment_type`
+	postgresSelectStatsQuery                  = `
+		SELECT
+			COUNT(*),
+			COUNT(DISTINCT topic),
+			COALESCE(SUM(CASE WHEN attachment_expires >= $1 THEN attachment_size ELSE 0 END), 0),
+			COALESCE(MIN(time), 0)
+		FROM messages
+	`
+	postgresSelectTopicsQuery          = `SELECT topic FROM messages %s GROUP BY topic`
+	postgresSelectTopicCountQuery      = `SELECT COUNT(DISTINCT topic) FROM messages %s`
+	postgresExcludeTopicPrefixesClause = `WHERE NOT (topic LIKE ANY($1))` // The default escape character of LIKE is the backslash, see escapeLike
+	postgresSelectTopicExistsQuery     = `SELECT 1 FROM messages WHERE topic = $1 LIMIT 1`
+	postgresSelectTopicsSinceQuery     = `SELECT topic FROM messages WHERE time >= $1 AND published GROUP BY topic`
+	postgresSelectActiveTopicsQuery    = `
+		SELECT topic, COUNT(*) AS count
+		FROM messages
+		WHERE time >= $1 AND time <= $2 AND published
+		GROUP BY topic
+		ORDER BY count DESC, topic ASC
+		LIMIT $3
+	`
+	postgresSelectMessageHistogramQuery = `
+		SELECT (time - $1) / $2 AS bucket, COUNT(*)
+		FROM messages
+		WHERE topic = $3 AND time >= $1 AND time < $4 AND published
+		GROUP BY bucket
+	`
+	postgresSelectOwnerUsageQuery = `
+		SELECT
+			COALESCE(SUM(CASE WHEN owner = $1 THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN attachment_owner = $1 THEN attachment_size ELSE 0 END), 0)
+		FROM messages
+		WHERE (owner = $1 OR attachment_owner = $1) AND time >= $2
+	`
+	postgresSelectAttachmentsSizeQuery     = `SELECT COALESCE(SUM(attachment_size), 0) FROM messages WHERE attachment_owner = $1 AND attachment_expires >= $2`
+	postgresSelectDownloadBytesQuery       = `SELECT COALESCE(SUM(attachment_size * attachment_downloads), 0) FROM messages WHERE attachment_owner = $1`
+	postgresUpdateAttachmentDownloadsQuery = `UPDATE messages SET attachment_downloads = attachment_downloads + 1 WHERE id = $1 AND attachment_name <> ''`
+	postgresUpdateAttachmentOwnerQuery     = `UPDATE messages SET attachment_owner = $1 WHERE attachment_owner = $2`
+	postgresSelectAttachmentsExpiredQuery  = `SELECT id FROM messages WHERE attachment_expires > 0 AND attachment_expires < $1`
+	postgresUpdateAttachmentURLsQuery      = `UPDATE messages SET attachment_url = REPLACE(attachment_url, $1, $2) WHERE attachment_url LIKE $3`
+	postgresClearAttachmentQuery           = `
+		UPDATE messages
+		SET attachment_name = '', attachment_type = '', attachment_size = 0, attachment_expires = 0, attachment_url = '', attachment_owner = '', attachment_downloads = 0
+		WHERE id = $1
+	`
+	postgresVacuumQuery = `VACUUM messages`
+)
+
+// Topic secrets
+const (
+	postgresCreateTopicSecretsTableQuery = `
+		CREATE TABLE IF NOT EXISTS topicSecrets (
+			topic TEXT PRIMARY KEY,
+			hash TEXT NOT NULL
+		);
+	`
+	postgresUpsertTopicSecretQuery = `INSERT INTO topicSecrets (topic, hash) VALUES ($1, $2) ON CONFLICT (topic) DO UPDATE SET hash = excluded.hash`
+	postgresDeleteTopicSecretQuery = `DELETE FROM topicSecrets WHERE topic = $1`
+	postgresSelectTopicSecretQuery = `SELECT hash FROM topicSecrets WHERE topic = $1`
+)
+
+// Firebase delivery outcomes
+const (
+	postgresCreateDeliveriesTableQuery = `
+		CREATE TABLE IF NOT EXISTS deliveries (
+			topic TEXT NOT NULL,
+			time BIGINT NOT NULL,
+			failed BOOLEAN NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_deliveries_topic_time ON deliveries (topic, time);
+	`
+	postgresInsertDeliveryQuery      = `INSERT INTO deliveries (topic, time, failed) VALUES ($1, $2, $3)`
+	postgresPruneDeliveriesQuery     = `DELETE FROM deliveries WHERE time < $1`
+	postgresSelectDeliveryRatioQuery = `SELECT COUNT(*) FILTER (WHERE NOT failed), COUNT(*) FILTER (WHERE failed) FROM deliveries WHERE topic = $1 AND time >= $2`
+)
+
+// Topic metadata, see topicMetadata
+const (
+	postgresCreateTopicsTableQuery = `
+		CREATE TABLE IF NOT EXISTS topics (
+			topic TEXT PRIMARY KEY,
+			last_message_time BIGINT NOT NULL,
+			message_count BIGINT NOT NULL,
+			display_name TEXT NOT NULL
+		);
+	`
+	postgresUpsertTopicMessageQuery = `
+		INSERT INTO topics (topic, last_message_time, message_count, display_name) VALUES ($1, $2, 1, '')
+		ON CONFLICT (topic) DO UPDATE SET last_message_time = GREATEST(topics.last_message_time, excluded.last_message_time), message_count = topics.message_count + 1
+	`
+	postgresUpsertTopicDisplayNameQuery = `
+		INSERT INTO topics (topic, last_message_time, message_count, display_name) VALUES ($1, 0, 0, $2)
+		ON CONFLICT (topic) DO UPDATE SET display_name = excluded.display_name
+	`
+	postgresUpdateTopicMessageCountQuery  = `UPDATE topics SET message_count = GREATEST(message_count - $1, 0) WHERE topic = $2`
+	postgresUpdateTopicMessageCountsQuery = `UPDATE topics SET message_count = (SELECT COUNT(*) FROM messages WHERE messages.topic = topics.topic)`
+	postgresSelectTopicsMetadataQuery     = `SELECT topic, last_message_time, message_count, display_name FROM topics`
+)
+
+// Read receipts, see MarkRead and messageFilter.UnreadBy; "user" is a reserved word in PostgreSQL
+const (
+	postgresCreateMessageReadsTableQuery = `
+		CREATE TABLE IF NOT EXISTS message_reads (
+			message_id TEXT NOT NULL,
+			"user" TEXT NOT NULL,
+			PRIMARY KEY (message_id, "user")
+		);
+	`
+	postgresInsertMessageReadQuery   = `INSERT INTO message_reads (message_id, "user") SELECT id, $1 FROM messages WHERE id = $2 ON CONFLICT DO NOTHING`
+	postgresSelectMessageExistsQuery = `SELECT COUNT(*) FROM messages WHERE id = $1`
+	postgresPruneMessageReadsQuery   = `DELETE FROM message_reads WHERE message_id NOT IN (SELECT id FROM messages)`
+	postgresUnreadByClause           = ` AND id NOT IN (SELECT message_id FROM message_reads WHERE "user" = %s)`
+)
+
+// Schema management queries
+const (
+	// The PostgreSQL schema was added with schema version 27, and has the same columns as the SQLite schema of that
+	// version. It must be kept in sync with currentSchemaVersion: a new SQLite migration needs a PostgreSQL migration
+	// as well, see setupPostgresDB and TestPostgresCache_SchemaVersion.
+	postgresSchemaVersion                 = 27
+	postgresCreateSchemaVersionTableQuery = `
+		CREATE TABLE IF NOT EXISTS schemaVersion (
+			id INT PRIMARY KEY,
+			version INT NOT NULL
+		);
+	`
+	postgresInsertSchemaVersion            = `INSERT INTO schemaVersion VALUES (1, $1)`
+	postgresSelectSchemaVersionQuery       = `SELECT version FROM schemaVersion WHERE id = 1`
+	postgresSelectMessagesTableExistsQuery = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'messages'`
+	postgresLockSchemaQuery                = `SELECT pg_advisory_xact_lock(7415066)` // Arbitrary, but fixed key; see setupPostgresDB
+)
+
+// postgresCache stores messages in a PostgreSQL database, so that several ntfy instances (e.g. behind a load
+// balancer) can share one cache. Unlike sqliteCache, it keeps no state in memory that other instances could
+// change behind its back: message counts are always queried, and there is no topic filter or attachment expiry
+// shortcut. Message bodies are always stored in the database as they are, i.e. neither in a body directory
+// nor compressed (PostgreSQL compresses large values by itself).
+type postgresCache struct {
+	db                  *sql.DB
+	limit               int           // Message size limit, see checkMessageSize
+	tagsLimit           int           // Max number of tags per message, see normalizeAndCheckTags
+	tagLengthLimit      int           // Max length of a single tag, see normalizeAndCheckTags
+	maxPerTopic         int           // Max number of messages per topic, see checkTopicLimit
+	maxAttachmentExpiry time.Duration // Max attachment expiry from now, see clampAttachmentExpiry
+	dedupWindow         time.Duration // Window in which identical messages are skipped, see message.Dedup
+	metrics             CacheMetrics  // Notified about every inserted message, see addMessages
+	closed              bool          // Set by Close, so that closing twice is safe
+	mu                  sync.Mutex
+}
+
+var _ cache = (*postgresCache)(nil)
+
+func newPostgresCache(conf *Config) (*postgresCache, error) {
+	db, err := sql.Open("postgres", conf.CacheDSN)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(conf.CacheMaxOpenConns)
+	db.SetMaxIdleConns(conf.CacheMaxIdleConns)
+	db.SetConnMaxLifetime(conf.CacheConnMaxLifetime)
+	if err := setupPostgresDB(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &postgresCache{
+		db:                  db,
+		limit:               conf.MessageLimit,
+		tagsLimit:           conf.MessageTagsLimit,
+		tagLengthLimit:      conf.MessageTagLengthLimit,
+		maxPerTopic:         conf.CacheMaxMessagesPerTopic,
+		maxAttachmentExpiry: conf.CacheMaxAttachmentExpiry,
+		dedupWindow:         conf.CacheDedupWindow,
+		metrics:             cacheMetrics(conf),
+	}, nil
+}
+
+// AddMessage inserts a single message, see sqliteCache.AddMessage
+func (c *postgresCache) AddMessage(m *message) error {
+	_, err := c.AddMessagePublished(m)
+	return err
+}
+
+// AddMessagePublished inserts a single message, and returns whether it was stored as published, see sqliteCache.AddMessagePublished
+func (c *postgresCache) AddMessagePublished(m *message) (published bool, err error) {
+	duplicates, scheduled, err := c.addMessages([]*message{m})
+	if err != nil {
+		return false, err
+	} else if duplicates > 0 {
+		return false, errDuplicateMessage
+	}
+	return scheduled == 0, nil
+}
+
+// AddMessages inserts all given messages in a single transaction, see sqliteCache.AddMessages
+func (c *postgresCache) AddMessages(ms []*message) error {
+	_, _, err := c.addMessages(ms)
+	return err
+}
+
+func (c *postgresCache) addMessages(ms []*message) (duplicates int, scheduled int, err error) {
+	for _, m := range ms {
+		if m.Event == openEvent || m.Event == keepaliveEvent {
+			return 0, 0, errUnexpectedMessageType
+		}
+		if err := checkMessageSize(m, c.limit); err != nil {
+			return 0, 0, err
+		}
+		if err := normalizeAndCheckTags(m, c.tagsLimit, c.tagLengthLimit); err != nil {
+			return 0, 0, err
+		}
+		if err := checkActions(m); err != nil {
+			return 0, 0, err
+		}
+		normalizeContentType(m)
+		clampAttachmentExpiry(m, c.maxAttachmentExpiry)
+	}
+	if c.maxPerTopic > 0 {
+		counts, err := c.messageCounts(ms)
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := checkTopicLimit(ms, c.maxPerTopic, func(topic string) int { return counts[topic] }); err != nil {
+			return 0, 0, err // Concurrent inserts may still exceed the limit slightly; it is only a safeguard
+		}
+	}
+	inserted := make([]*message, 0)
+	duplicates, scheduled, err = c.insertMessages(ms, &inserted)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, m := range inserted {
+		c.metrics.MessageAdded(m.Topic, len(m.Message), m.Attachment != nil)
+	}
+	return duplicates, scheduled, nil
+}
+
+// messageCounts returns the number of messages of the topics of the given messages, see checkTopicLimit
+func (c *postgresCache) messageCounts(ms []*message) (map[string]int, error) {
+	topics := make([]string, 0, len(ms))
+	for _, m := range ms {
+		topics = append(topics, m.Topic)
+	}
+	rows, err := c.db.Query(postgresSelectMessageCountsQuery, pq.Array(topics))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var topic string
+		var count int
+		if err := rows.Scan(&topic, &count); err != nil {
+			return nil, err
+		}
+		counts[topic] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// insertMessages writes the messages within one transaction, see sqliteCache.insertMessages. If a message
+// with the ID of one of the messages exists, nothing is inserted, and errMessageExists is returned.
+func (c *postgresCache) insertMessages(ms []*message, inserted *[]*message) (duplicates int, scheduled int, err error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(postgresInsertMessageQuery)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmt.Close()
+	topicStmt, err := tx.Prepare(postgresUpsertTopicMessageQuery)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer topicStmt.Close()
+	now := time.Now().Unix()
+	for _, m := range ms {
+		if m.IdempotencyKey != "" {
+			existing, err := postgresMessageByIdempotencyKey(tx, m.Topic, m.IdempotencyKey)
+			if err != nil {
+				return 0, 0, err
+			} else if existing != nil {
+				*m = *existing
+				duplicates++
+				continue
+			}
+		}
+		hash := dedupHash(m)
+		if m.Dedup && c.dedupWindow > 0 {
+			var id string
+			var timestamp int64
+			err := tx.QueryRow(postgresSelectDuplicateMessageQuery, hash, now-int64(c.dedupWindow.Seconds())).Scan(&id, &timestamp)
+			if err == nil {
+				m.ID, m.Time = id, timestamp
+				duplicates++
+				continue
+			} else if err != sql.ErrNoRows {
+				return 0, 0, err
+			}
+		}
+		published := m.Time <= now
+		var publishedAt int64
+		if published {
+			publishedAt = now
+		} else {
+			scheduled++
+		}
+		tags := strings.Join(m.Tags, ",")
+		var actions string
+		if len(m.Actions) > 0 {
+			actionsBytes, err := json.Marshal(m.Actions)
+			if err != nil {
+				return 0, 0, err
+			}
+			actions = string(actionsBytes)
+		}
+		var attachmentName, attachmentType, attachmentURL, attachmentOwner string
+		var attachmentSize, attachmentExpires, attachmentDownloads int64
+		if m.Attachment != nil {
+			attachmentName = m.Attachment.Name
+			attachmentType = m.Attachment.Type
+			attachmentSize = m.Attachment.Size
+			attachmentExpires = m.Attachment.Expires
+			attachmentURL = m.Attachment.URL
+			attachmentOwner = m.Attachment.Owner
+			attachmentDownloads = m.Attachment.Downloads
+		}
+		res, err := stmt.Exec(
+			m.ID,
+			m.Time,
+			m.Topic,
+			m.Message,
+			m.Title,
+			m.Priority,
+			tags,
+			m.Click,
+			attachmentName,
+			attachmentType,
+			attachmentSize,
+			attachmentExpires,
+			attachmentURL,
+			attachmentOwner,
+			m.Encoding,
+			published,
+			publishedAt,
+			m.Email,
+			m.Lat,
+			m.Lon,
+			m.Owner,
+			m.Pinned,
+			m.PrioritySource,
+			hash,
+			m.IdempotencyKey,
+			m.Edited,
+			actions,
+			m.Icon,
+			m.ContentType,
+			attachmentDownloads,
+			m.Event,
+			m.Sender,
+		)
+		if err != nil {
+			return 0, 0, err
+		} else if affected, err := res.RowsAffected(); err != nil {
+			return 0, 0, err
+		} else if affected == 0 {
+			return 0, 0, errMessageExists // IDs may be chosen by the publisher, see message.ID
+		}
+		if _, err := topicStmt.Exec(m.Topic, m.Time); err != nil {
+			return 0, 0, err
+		}
+		*inserted = append(*inserted, m)
+	}
+	return duplicates, scheduled, tx.Commit()
+}
+
+// postgresMessageByIdempotencyKey returns the message of the topic that was stored with the given idempotency
+// key within the transaction, or nil if there is none
+func postgresMessageByIdempotencyKey(tx *sql.Tx, topic, key string) (*message, error) {
+	rows, err := tx.Query(postgresSelectMessageByIdempotencyKeyQuery, topic, key)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := readMessages(rows)
+	if err != nil {
+		return nil, err
+	} else if len(messages) == 0 {
+		return nil, nil
+	}
+	return messages[0], nil
+}
+
+// Messages returns the messages of a topic since the given time, see sqliteCache.Messages
+func (c *postgresCache) Messages(topic string, since sinceMarker, scheduled bool, limit int) ([]*message, error) {
+	return c.MessagesContext(context.Background(), topic, since, scheduled, limit, nil)
+}
+
+// MessagesBetween returns the messages of the topic with a time between from and to, see sqliteCache.MessagesBetween
+func (c *postgresCache) MessagesBetween(topic string, from, to time.Time, scheduled bool) ([]*message, error) {
+	return c.MessagesContext(context.Background(), topic, newSinceTime(from.Unix()), scheduled, 0, betweenFilter(to))
+}
+
+// MessagesContext is like Messages, but aborts the query if the context is canceled, see sqliteCache.MessagesContext
+func (c *postgresCache) MessagesContext(ctx context.Context, topic string, since sinceMarker, scheduled bool, limit int, filter *messageFilter) ([]*message, error) {
+	if since.IsNone() {
+		return make([]*message, 0), nil
+	}
+	query, args := postgresMessagesQuery(topic, since, scheduled, limit, filter)
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := readMessages(rows)
+	if err != nil {
+		return nil, err
+	} else if limit <= 0 || filter.descending() {
+		return messages, nil // Without a limit, the messages are selected in the right order, see postgresMessagesQuery
+	}
+	return reverseMessages(messages), nil
+}
+
+// MessagesFunc calls fn for each message of a topic since the given time, see sqliteCache.MessagesFunc
+func (c *postgresCache) MessagesFunc(topic string, since sinceMarker, scheduled bool, fn func(m *message) error) error {
+	return c.MessagesFuncContext(context.Background(), topic, since, scheduled, nil, fn)
+}
+
+// MessagesFuncContext is like MessagesFunc, but aborts the query if the context is canceled. Like in
+// sqliteCache.MessagesFuncContext, the IDs are selected first, so that fn is never called while a query is running.
+func (c *postgresCache) MessagesFuncContext(ctx context.Context, topic string, since sinceMarker, scheduled bool, filter *messageFilter, fn func(m *message) error) error {
+	if since.IsNone() {
+		return nil
+	}
+	query, args := postgresMessagesQuery(topic, since, scheduled, 0, filter)
+	query = "SELECT id " + query[strings.Index(query, "FROM messages"):] // Same conditions and order, see postgresMessagesQuery
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	return forEachMessageByID(ctx, ids, c.MessagesByIDs, fn)
+}
+
+// postgresMessagesQuery returns the query and arguments to select the messages of a topic, see messagesQuery.
+// Without a limit, the limit parameter is NULL, which means "no limit" in PostgreSQL.
+func postgresMessagesQuery(topic string, since sinceMarker, scheduled bool, limit int, filter *messageFilter) (string, []interface{}) {
+	order, limitArg := "DESC", interface{}(limit) // With a limit, the newest messages are selected; see MessagesContext
+	if limit <= 0 {
+		limitArg = nil
+		if !filter.descending() {
+			order = "ASC"
+		}
+	}
+	query, marker := postgresSelectMessagesSinceTimeQuery, interface{}(since.Time().Unix())
+	if since.IsID() && scheduled {
+		query, marker = postgresSelectMessagesSinceIDIncludeScheduledQuery, since.ID()
+	} else if since.IsID() {
+		query, marker = postgresSelectMessagesSinceIDQuery, since.ID()
+	} else if scheduled {
+		query = postgresSelectMessagesSinceTimeIncludeScheduledQuery
+	}
+	clause, filterArgs := postgresFilterClause(filter, 4)
+	args := append([]interface{}{topic, marker, limitArg}, filterArgs...)
+	return fmt.Sprintf(query, clause, order, order), args
+}
+
+// MessagesMulti returns the messages of several topics since the given time, grouped by topic, see sqliteCache.MessagesMulti
+func (c *postgresCache) MessagesMulti(topics []string, since sinceMarker, scheduled bool) (map[string][]*message, error) {
+	messages := make(map[string][]*message)
+	for _, topic := range topics {
+		messages[topic] = make([]*message, 0)
+	}
+	if since.IsNone() {
+		return messages, nil
+	}
+	query, marker := postgresSelectMessagesMultiSinceTimeQuery, interface{}(since.Time().Unix())
+	if since.IsID() {
+		query, marker = postgresSelectMessagesMultiSinceIDQuery, since.ID()
+	}
+	clause, filterArgs := postgresFilterClause(nil, 3)
+	if !scheduled {
+		clause = " AND published" + clause
+	}
+	args := append([]interface{}{pq.Array(topics), marker}, filterArgs...)
+	rows, err := c.db.Query(fmt.Sprintf(query, clause), args...)
+	if err != nil {
+		return nil, err
+	}
+	all, err := readMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range all {
+		messages[m.Topic] = append(messages[m.Topic], m) // Rows are ordered by time, so each topic is too
+	}
+	return messages, nil
+}
+
+// MessagesByIDs returns the messages with the given IDs, ordered by time
+func (c *postgresCache) MessagesByIDs(ids []string) ([]*message, error) {
+	rows, err := c.db.Query(postgresSelectMessagesByIDsQuery, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	return readMessages(rows)
+}
+
+// MessagesBySender returns all messages of the given sender in all topics, see sqliteCache.MessagesBySender
+func (c *postgresCache) MessagesBySender(sender string) ([]*message, error) {
+	if sender == "" {
+		return make([]*message, 0), nil // Messages published before senders were recorded
+	}
+	rows, err := c.db.Query(postgresSelectMessagesBySenderQuery, sender)
+	if err != nil {
+		return nil, err
+	}
+	return readMessages(rows)
+}
+
+// LatestMessage returns the most recent published message event of the topic, or errNoRows if there is none
+func (c *postgresCache) LatestMessage(topic string) (*message, error) {
+	rows, err := c.db.Query(postgresSelectLatestMessageQuery, topic, messageEvent)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := readMessages(rows)
+	if err != nil {
+		return nil, err
+	} else if len(messages) == 0 {
+		return nil, errNoRows
+	}
+	return messages[0], nil
+}
+
+// MessagesDue returns all scheduled messages whose time has come
+func (c *postgresCache) MessagesDue() ([]*message, error) {
+	rows, err := c.db.Query(postgresSelectMessagesDueQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return readMessages(rows)
+}
+
+// TakeMessagesDue returns all messages that are due, and marks them as published within the same transaction,
+// see sqliteCache.TakeMessagesDue. The due messages are locked, so that if several ntfy instances share the
+// database, each due message is only returned to one of them.
+func (c *postgresCache) TakeMessagesDue() ([]*message, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(postgresSelectMessagesDueForUpdateQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	messages, err := readMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	if _, err := tx.Exec(postgresUpdateMessagesPublishedQuery, time.Now().Unix(), pq.Array(ids)); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// AllScheduledMessages returns up to limit scheduled messages of all topics, the next due first
+func (c *postgresCache) AllScheduledMessages(limit int) ([]*message, error) {
+	rows, err := c.db.Query(postgresSelectAllScheduledMessagesQuery, limit)
+	if err != nil {
+		return nil, err
+	}
+	return readMessages(rows)
+}
+
+// PendingScheduled returns the scheduled messages of the topic that are not due yet, see scheduledMessage
+func (c *postgresCache) PendingScheduled(topic string) ([]*scheduledMessage, error) {
+	now := time.Now()
+	rows, err := c.db.Query(postgresSelectPendingScheduledMessagesQuery, topic, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	messages, err := readMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]*scheduledMessage, 0, len(messages))
+	for _, m := range messages {
+		pending = append(pending, newScheduledMessage(m, now))
+	}
+	return pending, nil
+}
+
+// MessagesAfter returns up to limit messages of all topics after the cursor, ordered by time and ID, see exportCursor
+func (c *postgresCache) MessagesAfter(after exportCursor, limit int) ([]*message, error) {
+	rows, err := c.db.Query(postgresSelectMessagesAfterQuery, after.Time, after.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return readMessages(rows)
+}
+
+// MarkPublished marks the message as published, see MarkPublishedBatch
+func (c *postgresCache) MarkPublished(m *message) error {
+	return c.MarkPublishedBatch([]string{m.ID})
+}
+
+// MarkPublishedBatch marks all messages with the given IDs as published in a single query
+func (c *postgresCache) MarkPublishedBatch(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := c.db.Exec(postgresUpdateMessagesPublishedQuery, time.Now().Unix(), pq.Array(ids))
+	return err
+}
+
+// RecomputePublished marks all unpublished messages within the grace window as published, see sqliteCache.RecomputePublished
+func (c *postgresCache) RecomputePublished(grace time.Duration) (int, error) {
+	now := time.Now()
+	res, err := c.db.Exec(postgresUpdateMessagesPublishedDueQuery, now.Unix(), now.Add(grace).Unix())
+	if err != nil {
+		return 0, err
+	}
+	changed, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(changed), nil
+}
+
+func (c *postgresCache) PinMessage(id string) error {
+	return c.setPinned(id, true)
+}
+
+func (c *postgresCache) UnpinMessage(id string) error {
+	return c.setPinned(id, false)
+}
+
+// UpdateMessage replaces the content of the message with the given ID, see sqliteCache.UpdateMessage
+func (c *postgresCache) UpdateMessage(id string, m *message) error {
+	if err := checkMessageSize(m, c.limit); err != nil {
+		return err
+	}
+	if err := normalizeAndCheckTags(m, c.tagsLimit, c.tagLengthLimit); err != nil {
+		return err
+	}
+	tags := strings.Join(m.Tags, ",")
+	res, err := c.db.Exec(postgresUpdateMessageContentQuery, m.Message, m.Title, m.Priority, tags, m.Encoding, dedupHash(m), m.Edited, id, m.Topic)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errNoRows
+	}
+	return nil
+}
+
+func (c *postgresCache) setPinned(id string, pinned bool) error {
+	res, err := c.db.Exec(postgresUpdateMessagePinnedQuery, pinned, id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errNoRows
+	}
+	return nil
+}
+
+// DeleteMessage deletes a single message, regardless of whether it is published, and returns the number of deleted rows
+func (c *postgresCache) DeleteMessage(id string) (int, error) {
+	var topic string
+	if err := c.db.QueryRow(postgresSelectMessageTopicQuery, id).Scan(&topic); err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	deleted, err := c.delete(postgresDeleteMessageQuery, id)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.subtractMessageCount(topic, deleted); err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+// DeleteScheduled cancels a scheduled message by deleting it, see sqliteCache.DeleteScheduled
+func (c *postgresCache) DeleteScheduled(id string) error {
+	var topic string
+	if err := c.db.QueryRow(postgresSelectMessageTopicQuery, id).Scan(&topic); err == sql.ErrNoRows {
+		return errNoRows
+	} else if err != nil {
+		return err
+	}
+	deleted, err := c.delete(postgresDeleteScheduledMessageQuery, id)
+	if err != nil {
+		return err
+	} else if deleted == 0 {
+		return errMessagePublished // Or deleted in the meantime, which is indistinguishable for the caller
+	}
+	return c.subtractMessageCount(topic, deleted)
+}
+
+// DeleteMessagesForTopic deletes all messages of a topic, including scheduled and pinned messages,
+// and returns the number of deleted rows
+func (c *postgresCache) DeleteMessagesForTopic(topic string) (int, error) {
+	deleted, err := c.delete(postgresDeleteMessagesForTopicQuery, topic)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.subtractMessageCount(topic, deleted); err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+// subtractMessageCount adjusts the message count in the topic metadata after messages were deleted, see Topics
+func (c *postgresCache) subtractMessageCount(topic string, deleted int64) error {
+	_, err := c.db.Exec(postgresUpdateTopicMessageCountQuery, deleted, topic)
+	return err
+}
+
+func (c *postgresCache) delete(query string, args ...interface{}) (int64, error) {
+	res, err := c.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// PublishedBetween returns all messages that were published between from and to, in the order they were published
+func (c *postgresCache) PublishedBetween(from, to time.Time) ([]*message, error) {
+	rows, err := c.db.Query(postgresSelectMessagesPublishedBetweenQuery, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return readMessages(rows)
+}
+
+// MessageCount returns the number of messages of a topic, including scheduled messages. Unlike in
+// sqliteCache, the count is always queried, since other ntfy instances may add messages.
+func (c *postgresCache) MessageCount(topic string) (int, error) {
+	return c.count(postgresSelectMessageCountQuery, topic)
+}
+
+func (c *postgresCache) ScheduledCount() (int, error) {
+	return c.count(postgresSelectScheduledCountQuery)
+}
+
+func (c *postgresCache) ScheduledCountForTopic(topic string) (int, error) {
+	return c.count(postgresSelectScheduledCountForTopicQuery, topic)
+}
+
+func (c *postgresCache) EncodingBreakdown() (map[string]int, error) {
+	rows, err := c.db.Query(postgresSelectEncodingBreakdownQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var encoding string
+		var count int
+		if err := rows.Scan(&encoding, &count); err != nil {
+			return nil, err
+		}
+		counts[encoding] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// AttachmentSizeByType returns the total size of all attachments by MIME type, see sqliteCache.AttachmentSizeByType
+func (c *postgresCache) AttachmentSizeByType() (map[string]int64, error) {
+	rows, err := c.db.Query(postgresSelectAttachmentSizeByTypeQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sizes := make(map[string]int64)
+	for rows.Next() {
+		var attachmentType string
+		var size int64
+		if err := rows.Scan(&attachmentType, &size); err != nil {
+			return nil, err
+		}
+		sizes[attachmentType] = size
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// Stats returns a summary of the cache contents, see sqliteCache.Stats
+func (c *postgresCache) Stats() (*cacheStats, error) {
+	var stats cacheStats
+	var oldest int64
+	if err := c.db.QueryRow(postgresSelectStatsQuery, time.Now().Unix()).Scan(&stats.Messages, &stats.Topics, &stats.AttachmentBytes, &oldest); err != nil {
+		return nil, err
+	}
+	if stats.Messages > 0 {
+		stats.OldestMessage = time.Unix(oldest, 0)
+	}
+	var err error
+	if stats.AttachmentBytesByType, err = c.AttachmentSizeByType(); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func (c *postgresCache) count(query string, args ...interface{}) (int, error) {
+	var count int
+	if err := c.db.QueryRow(query, args...).Scan(&count); err == sql.ErrNoRows {
+		return 0, errNoRows
+	} else if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Topics returns all topics that currently have messages, including their metadata, see topicMetadata
+func (c *postgresCache) Topics(excludePrefixes ...string) (map[string]*topic, error) {
+	topics := make(map[string]*topic)
+	err := c.TopicsFunc(func(id string) error {
+		topics[id] = newTopic(id)
+		return nil
+	}, excludePrefixes...)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.readTopicsMetadata(topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// TopicsSince returns all topics with at least one message published since the given time, see sqliteCache.TopicsSince
+func (c *postgresCache) TopicsSince(since time.Time) (map[string]*topic, error) {
+	rows, err := c.db.Query(postgresSelectTopicsSinceQuery, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	topics := make(map[string]*topic)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		topics[id] = newTopic(id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if err := c.readTopicsMetadata(topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// readTopicsMetadata sets the metadata of the given topics, see topicMetadata
+func (c *postgresCache) readTopicsMetadata(topics map[string]*topic) error {
+	rows, err := c.db.Query(postgresSelectTopicsMetadataQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var metadata topicMetadata
+		if err := rows.Scan(&id, &metadata.LastMessageTime, &metadata.MessageCount, &metadata.DisplayName); err != nil {
+			return err
+		}
+		if t, ok := topics[id]; ok {
+			t.topicMetadata = metadata
+		}
+	}
+	return rows.Err()
+}
+
+func (c *postgresCache) TopicsFunc(fn func(topic string) error, excludePrefixes ...string) error {
+	where, args := postgresTopicsWhereClause(excludePrefixes)
+	rows, err := c.db.Query(fmt.Sprintf(postgresSelectTopicsQuery, where), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (c *postgresCache) TopicCount(excludePrefixes ...string) (int, error) {
+	where, args := postgresTopicsWhereClause(excludePrefixes)
+	return c.count(fmt.Sprintf(postgresSelectTopicCountQuery, where), args...)
+}
+
+// postgresTopicsWhereClause returns a WHERE clause (and its arguments) that excludes all topics
+// starting with one of the given prefixes, or an empty string if there are no prefixes
+func postgresTopicsWhereClause(excludePrefixes []string) (string, []interface{}) {
+	if len(excludePrefixes) == 0 {
+		return "", nil
+	}
+	patterns := make([]string, 0, len(excludePrefixes))
+	for _, prefix := range excludePrefixes {
+		patterns = append(patterns, escapeLike(prefix)+"%")
+	}
+	return postgresExcludeTopicPrefixesClause, []interface{}{pq.Array(patterns)}
+}
+
+// TopicExists returns true if there are messages for the given topic
+func (c *postgresCache) TopicExists(topic string) (bool, error) {
+	rows, err := c.db.Query(postgresSelectTopicExistsQuery, topic)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	exists := rows.Next()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// ActiveTopics returns up to limit topics with the most messages published within the window, see topicRate
+func (c *postgresCache) ActiveTopics(window time.Duration, limit int) ([]*topicRate, error) {
+	now := time.Now()
+	rows, err := c.db.Query(postgresSelectActiveTopicsQuery, now.Add(-window).Unix(), now.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rates := make([]*topicRate, 0)
+	for rows.Next() {
+		var id string
+		var count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return nil, err
+		}
+		rates = append(rates, newTopicRate(id, count, window))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// CumulativeCount returns the cumulative number of published messages of the topic per bucket, see cumulativePoints
+func (c *postgresCache) CumulativeCount(topic string, bucket time.Duration, from, to time.Time) ([]point, error) {
+	if bucket < time.Second {
+		return nil, errInvalidBucketSize
+	}
+	rows, err := c.db.Query(postgresSelectMessageHistogramQuery, from.Unix(), int64(bucket.Seconds()), topic, to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	histogram := make(map[int64]int)
+	for rows.Next() {
+		var index int64
+		var count int
+		if err := rows.Scan(&index, &count); err != nil {
+			return nil, err
+		}
+		histogram[index] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return cumulativePoints(histogram, bucket, from, to), nil
+}
+
+// Prune deletes old messages (see pruneMessages) and returns the number of deleted messages, see sqliteCache.Prune
+func (c *postgresCache) Prune(olderThan, inactiveOlderThan time.Time, activeTopics []string, perTopic map[string]time.Time, perPriority map[int]time.Time) (int64, error) {
+	deleted, err := c.pruneMessages(olderThan, inactiveOlderThan, activeTopics, perTopic, perPriority)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.db.Exec(postgresUpdateTopicMessageCountsQuery); err != nil {
+		return 0, err
+	}
+	if _, err := c.db.Exec(postgresPruneMessageReadsQuery); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// PruneDryRun returns the number of messages that Prune would delete with the given cutoff (and no
+// overrides), and the size of their bodies in bytes, without deleting anything
+func (c *postgresCache) PruneDryRun(olderThan time.Time) (messages int64, bytes int64, err error) {
+	if err := c.db.QueryRow(postgresPruneMessagesDryRunQuery, olderThan.Unix()).Scan(&messages, &bytes); err != nil {
+		return 0, 0, err
+	}
+	return messages, bytes, nil
+}
+
+// pruneMessages deletes old messages, see sqliteCache.pruneMessages
+func (c *postgresCache) pruneMessages(olderThan, inactiveOlderThan time.Time, activeTopics []string, perTopic map[string]time.Time, perPriority map[int]time.Time) (int64, error) {
+	if _, err := c.db.Exec(postgresPruneDeliveriesQuery, olderThan.Unix()); err != nil {
+		return 0, err
+	}
+	var deleted int64
+	overridden := make([]string, 0)
+	for topic, topicOlderThan := range perTopic {
+		n, err := c.delete(postgresPruneTopicMessagesQuery, topicOlderThan.Unix(), topic)
+		if err != nil {
+			return 0, err
+		}
+		deleted += n
+		overridden = append(overridden, topic)
+	}
+	n, err := c.pruneMessagesByPriority(perPriority, overridden)
+	if err != nil {
+		return 0, err
+	}
+	deleted += n
+	overriddenPriorities := make([]int64, 0)
+	for priority := range perPriority {
+		overriddenPriorities = append(overriddenPriorities, int64(priority))
+	}
+	n, err = c.pruneMessagesExcept(olderThan, overridden, overriddenPriorities)
+	if err != nil {
+		return 0, err
+	}
+	deleted += n
+	if !inactiveOlderThan.After(olderThan) {
+		return deleted, nil
+	}
+	n, err = c.pruneMessagesExcept(inactiveOlderThan, append(overridden, activeTopics...), overriddenPriorities)
+	if err != nil {
+		return 0, err
+	}
+	return deleted + n, nil
+}
+
+// pruneMessagesByPriority deletes old messages with the cutoff of their priority in a single transaction.
+// Messages of the excluded topics are not deleted, since these topics have their own cutoff.
+func (c *postgresCache) pruneMessagesByPriority(perPriority map[int]time.Time, excludedTopics []string) (int64, error) {
+	if len(perPriority) == 0 {
+		return 0, nil
+	}
+	query, topicArgs := postgresPrunePriorityMessagesQuery, make([]interface{}, 0)
+	if len(excludedTopics) > 0 {
+		query += fmt.Sprintf(postgresPruneExceptTopicsClause, 3)
+		topicArgs = append(topicArgs, pq.Array(excludedTopics))
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var deleted int64
+	for priority, priorityOlderThan := range perPriority {
+		res, err := tx.Exec(query, append([]interface{}{priorityOlderThan.Unix(), priority}, topicArgs...)...)
+		if err != nil {
+			return 0, err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		deleted += affected
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func (c *postgresCache) pruneMessagesExcept(olderThan time.Time, excludedTopics []string, excludedPriorities []int64) (int64, error) {
+	query, args := postgresPruneMessagesQuery, []interface{}{olderThan.Unix()}
+	if len(excludedTopics) > 0 {
+		args = append(args, pq.Array(excludedTopics))
+		query += fmt.Sprintf(postgresPruneExceptTopicsClause, len(args))
+	}
+	if len(excludedPriorities) > 0 {
+		args = append(args, pq.Array(excludedPriorities))
+		query += fmt.Sprintf(postgresPruneExceptPrioritiesClause, len(args))
+	}
+	return c.delete(query, args...)
+}
+
+// PruneToCount deletes all but the newest maxPerTopic published messages of each topic, see sqliteCache.PruneToCount
+func (c *postgresCache) PruneToCount(maxPerTopic int) (int, error) {
+	topics, err := c.Topics()
+	if err != nil {
+		return 0, err
+	}
+	var deleted int
+	for topic := range topics {
+		n, err := c.delete(postgresPruneTopicMessagesToCountQuery, topic, maxPerTopic)
+		if err != nil {
+			return 0, err
+		}
+		deleted += int(n)
+	}
+	if _, err := c.db.Exec(postgresUpdateTopicMessageCountsQuery); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// Compact vacuums the messages table, so that the space of deleted messages can be reused. Unlike VACUUM FULL,
+// this does not lock the table, so other ntfy instances sharing the database are not blocked. PostgreSQL also
+// vacuums by itself (autovacuum), so this only speeds things up after many messages were pruned.
+func (c *postgresCache) Compact() error {
+	if _, err := c.db.Exec(postgresVacuumQuery); err != nil {
+		return err
+	}
+	log.Printf("Vacuumed cache database")
+	return nil
+}
+
+// AttachmentsSize returns the total size of the unexpired attachments of the given owner
+func (c *postgresCache) AttachmentsSize(owner string) (int64, error) {
+	var size int64
+	if err := c.db.QueryRow(postgresSelectAttachmentsSizeQuery, owner, time.Now().Unix()).Scan(&size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// IncrementDownloads atomically increments the download counter of the attachment of the given message.
+// It returns errNoRows if there is no such message, or if it has no attachment.
+func (c *postgresCache) IncrementDownloads(id string) error {
+	res, err := c.db.Exec(postgresUpdateAttachmentDownloadsQuery, id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errNoRows
+	}
+	return nil
+}
+
+// DownloadBytes returns the number of attachment bytes that were downloaded from attachments uploaded by
+// the given owner, see sqliteCache.DownloadBytes
+func (c *postgresCache) DownloadBytes(owner string) (int64, error) {
+	var bytes int64
+	if err := c.db.QueryRow(postgresSelectDownloadBytesQuery, owner).Scan(&bytes); err != nil {
+		return 0, err
+	}
+	return bytes, nil
+}
+
+// ReassignAttachments transfers all attachments of oldOwner to newOwner, e.g. when a user account is deleted.
+func (c *postgresCache) ReassignAttachments(oldOwner, newOwner string) error {
+	_, err := c.db.Exec(postgresUpdateAttachmentOwnerQuery, newOwner, oldOwner)
+	return err
+}
+
+// ClearAttachmentOwner anonymizes all attachments of the given owner, see sqliteCache.ClearAttachmentOwner
+func (c *postgresCache) ClearAttachmentOwner(owner string) error {
+	return c.ReassignAttachments(owner, "")
+}
+
+// ClearAttachment removes the attachment from the given message, see sqliteCache.ClearAttachment
+func (c *postgresCache) ClearAttachment(id string) error {
+	res, err := c.db.Exec(postgresClearAttachmentQuery, id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errNoRows
+	}
+	return nil
+}
+
+func (c *postgresCache) OwnerUsage(owner string, since time.Time) (messages int, attachmentBytes int64, err error) {
+	if err := c.db.QueryRow(postgresSelectOwnerUsageQuery, owner, since.Unix()).Scan(&messages, &attachmentBytes); err != nil {
+		return 0, 0, err
+	}
+	return messages, attachmentBytes, nil
+}
+
+// AttachmentsExpired returns the IDs of all messages with expired attachments. Unlike in sqliteCache, the
+// table is always scanned, since other ntfy instances may add attachments; see idx_attachment_expires.
+func (c *postgresCache) AttachmentsExpired() ([]string, error) {
+	rows, err := c.db.Query(postgresSelectAttachmentsExpiredQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (c *postgresCache) RewriteAttachmentURLs(oldBase, newBase string) (int, error) {
+	res, err := c.db.Exec(postgresUpdateAttachmentURLsQuery, oldBase, newBase, escapeLike(oldBase)+"%")
+	if err != nil {
+		return 0, err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(updated), nil
+}
+
+func (c *postgresCache) MessagesWithMissingAttachments(missing func(url string) bool) ([]*message, error) {
+	rows, err := c.db.Query(postgresSelectMessagesWithAttachmentQuery)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := readMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	broken := make([]*message, 0)
+	for _, m := range messages {
+		if m.Attachment != nil && missing(m.Attachment.URL) {
+			broken = append(broken, m)
+		}
+	}
+	return broken, nil
+}
+
+// MarkRead marks the message as read by the given user, see sqliteCache.MarkRead
+func (c *postgresCache) MarkRead(id, user string) error {
+	res, err := c.db.Exec(postgresInsertMessageReadQuery, user, id)
+	if err != nil {
+		return err
+	} else if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected > 0 {
+		return nil
+	}
+	exists, err := c.count(postgresSelectMessageExistsQuery, id)
+	if err != nil {
+		return err
+	} else if exists == 0 {
+		return errNoRows
+	}
+	return nil // Already read
+}
+
+// SetTopicDisplayName sets the human-readable name of the topic, see topicMetadata. An empty name removes it.
+func (c *postgresCache) SetTopicDisplayName(topic, name string) error {
+	_, err := c.db.Exec(postgresUpsertTopicDisplayNameQuery, topic, name)
+	return err
+}
+
+func (c *postgresCache) SetTopicSecret(topic, secret string) error {
+	if secret == "" {
+		_, err := c.db.Exec(postgresDeleteTopicSecretQuery, topic)
+		return err
+	}
+	hash, err := hashTopicSecret(secret)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(postgresUpsertTopicSecretQuery, topic, hash)
+	return err
+}
+
+func (c *postgresCache) VerifyTopicSecret(topic, secret string) (bool, error) {
+	var hash string
+	if err := c.db.QueryRow(postgresSelectTopicSecretQuery, topic).Scan(&hash); err == sql.ErrNoRows {
+		return true, nil // No secret, topic is open
+	} else if err != nil {
+		return false, err
+	}
+	return verifyTopicSecret(hash, secret), nil
+}
+
+func (c *postgresCache) AddDelivery(topic string, failed bool) error {
+	_, err := c.db.Exec(postgresInsertDeliveryQuery, topic, time.Now().Unix(), failed)
+	return err
+}
+
+func (c *postgresCache) DeliveryRatio(topic string, since time.Time) (sent, failed int, err error) {
+	if err := c.db.QueryRow(postgresSelectDeliveryRatioQuery, topic, since.Unix()).Scan(&sent, &failed); err != nil {
+		return 0, 0, err
+	}
+	return sent, failed, nil
+}
+
+// Ping checks that the cache database is reachable and readable
+func (c *postgresCache) Ping() error {
+	_, err := c.SchemaVersion()
+	return err
+}
+
+// Close closes the database connections. Closing the cache twice is not an error.
+func (c *postgresCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.db.Close()
+}
+
+// SchemaVersion returns the schema version of the cache database, see postgresSchemaVersion
+func (c *postgresCache) SchemaVersion() (int, error) {
+	var schemaVersion int
+	if err := c.db.QueryRow(postgresSelectSchemaVersionQuery).Scan(&schemaVersion); err != nil {
+		return 0, err
+	}
+	return schemaVersion, nil
+}
+
+// postgresFilterClause translates the filter into additional SQL conditions (starting with " AND") and their
+// arguments, like filterClause. The first argument is bound to the parameter $next.
+func postgresFilterClause(f *messageFilter, next int) (string, []interface{}) {
+	var clause strings.Builder
+	args := make([]interface{}, 0)
+	param := func(arg interface{}) string {
+		args = append(args, arg)
+		return fmt.Sprintf("$%d", next+len(args)-1)
+	}
+	clause.WriteString(" AND event = ANY(" + param(pq.Array(f.events())) + ")")
+	if f == nil {
+		return clause.String(), args
+	}
+	if f.MinPriority > 0 {
+		clause.WriteString(" AND (CASE WHEN priority = 0 THEN 3 ELSE priority END) >= " + param(f.MinPriority))
+	}
+	if f.Until > 0 {
+		clause.WriteString(" AND time <= " + param(f.Until))
+	}
+	if f.TitleContains != "" {
+		clause.WriteString(" AND title ILIKE " + param("%"+escapeLike(f.TitleContains)+"%")) // LIKE is case-sensitive in PostgreSQL
+	}
+	for _, tag := range f.Tags {
+		clause.WriteString(" AND (',' || tags || ',') ILIKE " + param("%,"+escapeLike(tag)+",%"))
+	}
+	if f.UnreadBy != "" {
+		clause.WriteString(fmt.Sprintf(postgresUnreadByClause, param(f.UnreadBy)))
+	}
+	return clause.String(), args
+}
+
+// setupPostgresDB creates the database schema, or checks the schema version of an existing database, see
+// setupDB. Several ntfy instances may start at the same time, so the schema is set up in a single transaction
+// that holds an advisory lock; the other instances wait for it, and then find the schema in place.
+func setupPostgresDB(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(postgresLockSchemaQuery); err != nil {
+		return err
+	}
+	var messagesTables int
+	if err := tx.QueryRow(postgresSelectMessagesTableExistsQuery).Scan(&messagesTables); err != nil {
+		return err
+	} else if messagesTables == 0 {
+		if err := setupNewPostgresDB(tx); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	var schemaVersion int
+	if err := tx.QueryRow(postgresSelectSchemaVersionQuery).Scan(&schemaVersion); err != nil {
+		return fmt.Errorf("cannot determine schema version: %w", err)
+	}
+	if schemaVersion > postgresSchemaVersion {
+		return fmt.Errorf("%w: schema version is %d, this version of ntfy supports up to %d", errCacheTooNew, schemaVersion, postgresSchemaVersion)
+	} else if schemaVersion < postgresSchemaVersion {
+		// No migrations yet; add them here once postgresSchemaVersion is increased
+		return fmt.Errorf("unexpected schema version %d of PostgreSQL cache database", schemaVersion)
+	}
+	return tx.Commit()
+}
+
+func setupNewPostgresDB(tx *sql.Tx) error {
+	queries := []string{
+		postgresCreateMessagesTableQuery,
+		postgresCreateTopicSecretsTableQuery,
+		postgresCreateDeliveriesTableQuery,
+		postgresCreateTopicsTableQuery,
+		postgresCreateMessageReadsTableQuery,
+		postgresCreateSchemaVersionTableQuery,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(postgresInsertSchemaVersion, postgresSchemaVersion)
+	return err
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+)
+
+var (
+	// tablePrefixRegex defines the allowed table prefixes, see Config.CacheTablePrefix. Since the prefix
+	// becomes part of the SQL identifiers, it must not contain anything that would need quoting.
+	tablePrefixRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,31}$`)
+
+	// tableNameRegex matches all table and index names of the cache schema, see prefixQuery
+	tableNameRegex = regexp.MustCompile(`\b(messages|topicSecrets|deliveries|topics|message_reads|schemaVersion|idx_\w+)\b`)
+
+	errCacheTablePrefixInvalid = errors.New("invalid cache table prefix: must start with a letter, and only contain letters, numbers and underscores (max. 32 characters)")
+	errRestoreTablePrefix      = errors.New("cannot restore a backup into a cache with a table prefix, since a backup contains the tables of all prefixes")
+)
+
+// sqliteDB is a database handle that rewrites the table and index names of all queries so that they start
+// with a table prefix, e.g. "messages" becomes "tenantA_messages". This allows several caches to share one
+// database file, each with its own tables and schema version. Without a prefix, queries are passed as-is.
+//
+// Queries are rewritten when they are executed rather than when they are defined, so that dynamically built
+// queries (see filterClause and MessagesByIDs) are covered as well.
+type sqliteDB struct {
+	*sql.DB
+	prefix string
+}
+
+// sqliteTx is a transaction of a sqliteDB, see sqliteDB.Begin
+type sqliteTx struct {
+	*sql.Tx
+	prefix string
+}
+
+func newSqliteDB(db *sql.DB, prefix string) (*sqliteDB, error) {
+	if prefix != "" && !tablePrefixRegex.MatchString(prefix) {
+		return nil, errCacheTablePrefixInvalid
+	}
+	return &sqliteDB{DB: db, prefix: prefix}, nil
+}
+
+func (db *sqliteDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DB.Exec(prefixQuery(query, db.prefix), args...)
+}
+
+func (db *sqliteDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.Query(prefixQuery(query, db.prefix), args...)
+}
+
+func (db *sqliteDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DB.QueryContext(ctx, prefixQuery(query, db.prefix), args...)
+}
+
+func (db *sqliteDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.DB.QueryRow(prefixQuery(query, db.prefix), args...)
+}
+
+func (db *sqliteDB) Begin() (*sqliteTx, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteTx{Tx: tx, prefix: db.prefix}, nil
+}
+
+func (tx *sqliteTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.Exec(prefixQuery(query, tx.prefix), args...)
+}
+
+func (tx *sqliteTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.Tx.Query(prefixQuery(query, tx.prefix), args...)
+}
+
+func (tx *sqliteTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRow(prefixQuery(query, tx.prefix), args...)
+}
+
+func (tx *sqliteTx) Prepare(query string) (*sql.Stmt, error) {
+	return tx.Tx.Prepare(prefixQuery(query, tx.prefix))
+}
+
+// prefixQuery prepends the prefix and an underscore to all table and index names in the query. Since
+// the names are matched as whole words, names that already have a prefix are left alone.
+func prefixQuery(query, prefix string) string {
+	if prefix == "" {
+		return query
+	}
+	return tableNameRegex.ReplaceAllString(query, prefix+"_$1")
+}
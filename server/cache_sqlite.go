@@ -1,19 +1,26 @@
 package server
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3" // SQLite driver
+	"github.com/mattn/go-sqlite3"
+	"heckel.io/ntfy/util"
 	"log"
+	"math"
+	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Messages cache
 const (
 	createMessagesTableQuery = `
-		BEGIN;
 		CREATE TABLE IF NOT EXISTS messages (
 			id TEXT PRIMARY KEY,
 			time INT NOT NULL,
@@ -30,44 +37,347 @@ const (
 			attachment_url TEXT NOT NULL,
 			attachment_owner TEXT NOT NULL,
 			encoding TEXT NOT NULL,
-			published INT NOT NULL
+			published INT NOT NULL,
+			published_at INT NOT NULL,
+			email TEXT NOT NULL,
+			lat REAL,
+			lon REAL,
+			owner TEXT NOT NULL,
+			body_ref TEXT NOT NULL,
+			pinned INT NOT NULL,
+			priority_source TEXT NOT NULL,
+			dedup_hash TEXT NOT NULL,
+			idempotency_key TEXT NOT NULL,
+			edited INT NOT NULL,
+			actions TEXT NOT NULL,
+			icon TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			attachment_downloads INT NOT NULL,
+			event TEXT NOT NULL,
+			sequence INT NOT NULL,
+			sender TEXT NOT NULL
 		);
 		CREATE INDEX IF NOT EXISTS idx_topic ON messages (topic);
-		COMMIT;
+		CREATE INDEX IF NOT EXISTS idx_dedup_hash ON messages (dedup_hash);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_idempotency_key ON messages (topic, idempotency_key) WHERE idempotency_key != '';
+		CREATE INDEX IF NOT EXISTS idx_due ON messages (time) WHERE published = 0;
+		CREATE INDEX IF NOT EXISTS idx_attachment_expires ON messages (attachment_expires) WHERE attachment_expires > 0;
+		CREATE INDEX IF NOT EXISTS idx_sequence ON messages (sequence);
+		CREATE INDEX IF NOT EXISTS idx_sender ON messages (sender) WHERE sender != '';
 	`
 	insertMessageQuery = `
-		INSERT INTO messages (id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, published) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, published, published_at, email, lat, lon, owner, body_ref, pinned, priority_source, dedup_hash, idempotency_key, edited, actions, icon, content_type, attachment_downloads, event, sender, sequence) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, (SELECT IFNULL(MAX(sequence), 0) + 1 FROM messages))
+	`
+	selectDuplicateMessageQuery = `
+		SELECT id, time
+		FROM messages
+		WHERE dedup_hash = ? AND time >= ? AND published = 1
+		ORDER BY time DESC, sequence DESC
+		LIMIT 1
+	`
+	pruneMessagesQuery             = `DELETE FROM messages WHERE time < ? AND published = 1 AND pinned = 0`
+	pruneMessagesDryRunQuery       = `SELECT COUNT(*), IFNULL(SUM(length(CAST(message AS BLOB))), 0) FROM messages WHERE time < ? AND published = 1 AND pinned = 0`
+	pruneExceptTopicsClause        = ` AND topic NOT IN (%s)`
+	pruneExceptPrioritiesClause    = ` AND (CASE priority WHEN 0 THEN 3 ELSE priority END) NOT IN (%s)` // Priority 0 is stored if none was set, i.e. default (3)
+	pruneTopicMessagesQuery        = `DELETE FROM messages WHERE time < ? AND published = 1 AND pinned = 0 AND topic = ?`
+	prunePriorityMessagesQuery     = `DELETE FROM messages WHERE time < ? AND published = 1 AND pinned = 0 AND (CASE priority WHEN 0 THEN 3 ELSE priority END) = ?`
+	pruneTopicMessagesToCountQuery = `
+		DELETE FROM messages
+		WHERE topic = ? AND published = 1 AND pinned = 0 AND rowid NOT IN (
+			SELECT rowid FROM messages WHERE topic = ? AND published = 1 ORDER BY time DESC, sequence DESC LIMIT ?
+		)
 	`
-	pruneMessagesQuery           = `DELETE FROM messages WHERE time < ? AND published = 1`
 	selectMessagesSinceTimeQuery = `
-		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages 
+		WHERE topic = ? AND time >= ? AND published = 1%s
+		ORDER BY time %s, sequence %s
+		LIMIT ?
+	`
+	// Messages since an ID are selected in publish order (see updateMessagesPublishedQuery). If the ID is unknown,
+	// e.g. because the message was pruned already, MAX(sequence) is NULL, and all messages are selected (like since=all).
+	selectMessagesSinceIDQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
 		FROM messages 
-		WHERE topic = ? AND time >= ? AND published = 1
-		ORDER BY time ASC
+		WHERE topic = ? AND sequence > (SELECT IFNULL(MAX(sequence), 0) FROM messages WHERE id = ?) AND published = 1%s
+		ORDER BY time %s, sequence %s
+		LIMIT ?
 	`
 	selectMessagesSinceTimeIncludeScheduledQuery = `
-		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages 
+		WHERE topic = ? AND time >= ?%s
+		ORDER BY time %s, sequence %s
+		LIMIT ?
+	`
+	selectMessagesSinceIDIncludeScheduledQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages 
+		WHERE topic = ? AND sequence > (SELECT IFNULL(MAX(sequence), 0) FROM messages WHERE id = ?)%s
+		ORDER BY time %s, sequence %s
+		LIMIT ?
+	`
+	selectMessagesMultiSinceTimeQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages 
+		WHERE topic IN (%s) AND time >= ?%s
+		ORDER BY time ASC, sequence ASC
+	`
+	selectMessagesMultiSinceIDQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages 
+		WHERE topic IN (%s) AND sequence > (SELECT IFNULL(MAX(sequence), 0) FROM messages WHERE id = ?)%s
+		ORDER BY time ASC, sequence ASC
+	`
+	selectMessageByIdempotencyKeyQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages 
+		WHERE topic = ? AND idempotency_key = ?
+	`
+	selectMessagesPublishedBetweenQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages 
+		WHERE published = 1 AND published_at >= ? AND published_at <= ?
+		ORDER BY published_at ASC, time ASC, sequence ASC
+	`
+	selectMessagesByIDsQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages 
+		WHERE id IN (%s)
+		ORDER BY time ASC, sequence ASC
+	`
+	selectLatestMessageQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages 
+		WHERE topic = ? AND published = 1 AND event = ?
+		ORDER BY time DESC, sequence DESC
+		LIMIT 1
+	`
+	selectAllScheduledMessagesQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages 
+		WHERE published = 0
+		ORDER BY time ASC, sequence ASC
+		LIMIT ?
+	`
+	selectPendingScheduledMessagesQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages 
+		WHERE topic = ? AND time > ? AND published = 0
+		ORDER BY time ASC, sequence ASC
+	`
+	selectMessagesAfterQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages 
+		WHERE time > ? OR (time = ? AND id > ?)
+		ORDER BY time ASC, id ASC
+		LIMIT ?
+	`
+	selectMessagesBySenderQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
+		FROM messages 
+		WHERE sender = ?
+		ORDER BY time ASC, sequence ASC
+	`
+	selectMessagesWithAttachmentQuery = `
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
 		FROM messages 
-		WHERE topic = ? AND time >= ?
-		ORDER BY time ASC
+		WHERE attachment_url != ''
+		ORDER BY time ASC, sequence ASC
 	`
 	selectMessagesDueQuery = `
-		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding
+		SELECT id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, email, lat, lon, owner, body_ref, pinned, priority_source, edited, actions, icon, content_type, attachment_downloads, event, published, sequence, sender
 		FROM messages 
 		WHERE time <= ? AND published = 0
 	`
-	updateMessagePublishedQuery     = `UPDATE messages SET published = 1 WHERE id = ?`
-	selectMessagesCountQuery        = `SELECT COUNT(*) FROM messages`
-	selectMessageCountForTopicQuery = `SELECT COUNT(*) FROM messages WHERE topic = ?`
-	selectTopicsQuery               = `SELECT topic FROM messages GROUP BY topic`
-	selectAttachmentsSizeQuery      = `SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE attachment_owner = ? AND attachment_expires >= ?`
-	selectAttachmentsExpiredQuery   = `SELECT id FROM messages WHERE attachment_expires > 0 AND attachment_expires < ?`
+	// Published messages get a new sequence (in the order of their time), so that since=<id> returns scheduled messages
+	// that were stored before, but published after the given message, see selectMessagesSinceIDQuery
+	updateMessagesPublishedQuery = `
+		UPDATE messages
+		SET published = 1, published_at = ?, sequence = due.new_sequence
+		FROM (
+			SELECT id, (SELECT IFNULL(MAX(sequence), 0) FROM messages) + ROW_NUMBER() OVER (ORDER BY time, sequence) AS new_sequence
+			FROM messages
+			WHERE id IN (%s) AND published = 0
+		) AS due
+		WHERE messages.id = due.id
+	`
+	updateMessagesPublishedDueQuery = `
+		UPDATE messages
+		SET published = 1, published_at = ?, sequence = due.new_sequence
+		FROM (
+			SELECT id, (SELECT IFNULL(MAX(sequence), 0) FROM messages) + ROW_NUMBER() OVER (ORDER BY time, sequence) AS new_sequence
+			FROM messages
+			WHERE time <= ? AND published = 0
+		) AS due
+		WHERE messages.id = due.id
+	`
+	updateMessagePinnedQuery          = `UPDATE messages SET pinned = ? WHERE id = ?`
+	updateMessageContentQuery         = `UPDATE messages SET message = ?, title = ?, priority = ?, tags = ?, encoding = ?, body_ref = ?, dedup_hash = ?, edited = ? WHERE id = ? AND topic = ?`
+	deleteMessageQuery                = `DELETE FROM messages WHERE id = ?`
+	deleteScheduledMessageQuery       = `DELETE FROM messages WHERE id = ? AND published = 0`
+	deleteMessagesForTopicQuery       = `DELETE FROM messages WHERE topic = ?`
+	selectMessagesCountQuery          = `SELECT COUNT(*) FROM messages`
+	selectMessageCountsQuery          = `SELECT topic, COUNT(*) FROM messages GROUP BY topic`
+	selectMessageTopicQuery           = `SELECT topic FROM messages WHERE id = ?`
+	selectScheduledCountQuery         = `SELECT COUNT(*) FROM messages WHERE published = 0`
+	selectScheduledCountForTopicQuery = `SELECT COUNT(*) FROM messages WHERE topic = ? AND published = 0`
+	selectEncodingBreakdownQuery      = `SELECT encoding, COUNT(*) FROM messages GROUP BY encoding`
+	selectAttachmentSizeByTypeQuery   = `SELECT attachment_type, SUM(attachment_size) FROM messages WHERE attachment_url != '' GROUP BY attachment_type`
+	selectStatsQuery                  = `
+		SELECT
+			COUNT(*),
+			COUNT(DISTINCT topic),
+			IFNULL(SUM(CASE WHEN attachment_expires >= ? THEN attachment_size ELSE 0 END), 0),
+			IFNULL(MIN(time), 0)
+		FROM messages
+	`
+	selectTopicsQuery       = `SELECT topic FROM messages %s GROUP BY topic`
+	selectTopicCountQuery   = `SELECT COUNT(DISTINCT topic) FROM messages %s`
+	selectBodyRefsQuery     = `SELECT body_ref FROM messages WHERE body_ref != ''`
+	selectTopicExistsQuery  = `SELECT 1 FROM messages WHERE topic = ? LIMIT 1`
+	selectTopicsSinceQuery  = `SELECT topic FROM messages WHERE time >= ? AND published = 1 GROUP BY topic`
+	selectActiveTopicsQuery = `
+		SELECT topic, COUNT(*) AS count
+		FROM messages
+		WHERE time >= ? AND time <= ? AND published = 1
+		GROUP BY topic
+		ORDER BY count DESC, topic ASC
+		LIMIT ?
+	`
+	selectMessageHistogramQuery = `
+		SELECT (time - ?) / ? AS bucket, COUNT(*)
+		FROM messages
+		WHERE topic = ? AND time >= ? AND time < ? AND published = 1
+		GROUP BY bucket
+	`
+	selectOwnerUsageQuery = `
+		SELECT
+			IFNULL(SUM(CASE WHEN owner = ? THEN 1 ELSE 0 END), 0),
+			IFNULL(SUM(CASE WHEN attachment_owner = ? THEN attachment_size ELSE 0 END), 0)
+		FROM messages
+		WHERE (owner = ? OR attachment_owner = ?) AND time >= ?
+	`
+	selectAttachmentsSizeQuery     = `SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE attachment_owner = ? AND attachment_expires >= ?`
+	selectDownloadBytesQuery       = `SELECT IFNULL(SUM(attachment_size * attachment_downloads), 0) FROM messages WHERE attachment_owner = ?`
+	updateAttachmentDownloadsQuery = `UPDATE messages SET attachment_downloads = attachment_downloads + 1 WHERE id = ? AND attachment_name != ''`
+	updateAttachmentOwnerQuery     = `UPDATE messages SET attachment_owner = ? WHERE attachment_owner = ?`
+	selectAttachmentsExpiredQuery  = `SELECT id FROM messages WHERE attachment_expires > 0 AND attachment_expires < ?`
+	selectNextAttachmentExpiry     = `SELECT IFNULL(MIN(attachment_expires), 0) FROM messages WHERE attachment_expires >= ?`
+	updateAttachmentURLsQuery      = `UPDATE messages SET attachment_url = REPLACE(attachment_url, ?, ?) WHERE attachment_url LIKE ? ESCAPE '\'`
+	clearAttachmentQuery           = `
+		UPDATE messages
+		SET attachment_name = '', attachment_type = '', attachment_size = 0, attachment_expires = 0, attachment_url = '', attachment_owner = '', attachment_downloads = 0
+		WHERE id = ?
+	`
+)
+
+// Topic secrets
+const (
+	createTopicSecretsTableQuery = `
+		CREATE TABLE IF NOT EXISTS topicSecrets (
+			topic TEXT PRIMARY KEY,
+			hash TEXT NOT NULL
+		);
+	`
+	upsertTopicSecretQuery = `INSERT INTO topicSecrets (topic, hash) VALUES (?, ?) ON CONFLICT (topic) DO UPDATE SET hash = excluded.hash`
+	deleteTopicSecretQuery = `DELETE FROM topicSecrets WHERE topic = ?`
+	selectTopicSecretQuery = `SELECT hash FROM topicSecrets WHERE topic = ?`
+)
+
+// Firebase delivery outcomes
+const (
+	createDeliveriesTableQuery = `
+		CREATE TABLE IF NOT EXISTS deliveries (
+			topic TEXT NOT NULL,
+			time INT NOT NULL,
+			failed INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_deliveries_topic_time ON deliveries (topic, time);
+	`
+	insertDeliveryQuery      = `INSERT INTO deliveries (topic, time, failed) VALUES (?, ?, ?)`
+	pruneDeliveriesQuery     = `DELETE FROM deliveries WHERE time < ?`
+	selectDeliveryRatioQuery = `SELECT IFNULL(SUM(1 - failed), 0), IFNULL(SUM(failed), 0) FROM deliveries WHERE topic = ? AND time >= ?`
+)
+
+// Topic metadata, see topicMetadata
+const (
+	createTopicsTableQuery = `
+		CREATE TABLE IF NOT EXISTS topics (
+			topic TEXT PRIMARY KEY,
+			last_message_time INT NOT NULL,
+			message_count INT NOT NULL,
+			display_name TEXT NOT NULL
+		);
+	`
+	upsertTopicMessageQuery = `
+		INSERT INTO topics (topic, last_message_time, message_count, display_name) VALUES (?, ?, 1, '')
+		ON CONFLICT (topic) DO UPDATE SET last_message_time = MAX(last_message_time, excluded.last_message_time), message_count = message_count + 1
+	`
+	upsertTopicDisplayNameQuery = `
+		INSERT INTO topics (topic, last_message_time, message_count, display_name) VALUES (?, 0, 0, ?)
+		ON CONFLICT (topic) DO UPDATE SET display_name = excluded.display_name
+	`
+	updateTopicMessageCountQuery  = `UPDATE topics SET message_count = MAX(message_count - ?, 0) WHERE topic = ?`
+	updateTopicMessageCountsQuery = `UPDATE topics SET message_count = (SELECT COUNT(*) FROM messages WHERE messages.topic = topics.topic)`
+	selectTopicsMetadataQuery     = `SELECT topic, last_message_time, message_count, display_name FROM topics`
+)
+
+// Read receipts, see MarkRead and messageFilter.UnreadBy
+const (
+	createMessageReadsTableQuery = `
+		CREATE TABLE IF NOT EXISTS message_reads (
+			message_id TEXT NOT NULL,
+			user TEXT NOT NULL,
+			PRIMARY KEY (message_id, user)
+		);
+	`
+	insertMessageReadQuery   = `INSERT OR IGNORE INTO message_reads (message_id, user) SELECT id, ? FROM messages WHERE id = ?`
+	selectMessageExistsQuery = `SELECT COUNT(*) FROM messages WHERE id = ?`
+	pruneMessageReadsQuery   = `DELETE FROM message_reads WHERE message_id NOT IN (SELECT id FROM messages)`
+	unreadByClause           = ` AND id NOT IN (SELECT message_id FROM message_reads WHERE user = ?)`
+)
+
+// Diagnostic queries, see Diagnose and checkIntegrity
+const (
+	integrityCheckQuery                 = `PRAGMA integrity_check`
+	quickCheckQuery                     = `PRAGMA quick_check` // Like integrity_check, but O(N) and without checking index contents
+	checkpointTruncateQuery             = `PRAGMA wal_checkpoint(TRUNCATE)`
+	selectMessagesTableExistsQuery      = `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'messages'`
+	selectOrphanedAttachmentsCountQuery = `SELECT COUNT(*) FROM messages WHERE (attachment_name = '') != (attachment_url = '')`
+	selectDuplicateIDsCountQuery        = `SELECT COUNT(*) FROM (SELECT id FROM messages GROUP BY id HAVING COUNT(*) > 1)`
+)
+
+// Limits the number of bound parameters per query, see MessagesByIDs, MessagesMulti and MarkPublishedBatch
+const (
+	selectMessagesByIDsChunkSize     = 500
+	selectMessagesMultiChunkSize     = 500
+	updateMessagesPublishedChunkSize = 500
+)
+
+// Number of messages that MessagesFuncContext reads before passing them on, see MessagesFuncContext
+const messagesFuncBatchSize = 100
+
+// Durability and concurrency queries
+const (
+	checkpointQuery     = `PRAGMA wal_checkpoint(FULL)` // No-op if the database is not in WAL mode
+	journalModeWALQuery = `PRAGMA journal_mode=WAL`     // Persistent, i.e. applies to all connections
+	vacuumQuery         = `VACUUM`
+	pageCountQuery      = `PRAGMA page_count`
+	pageSizeQuery       = `PRAGMA page_size`
+)
+
+// Encryption queries, see openSqliteDB
+const (
+	keyQuery           = `PRAGMA key = '%s'`
+	cipherVersionQuery = `PRAGMA cipher_version` // Returns no rows if SQLite is not built with SQLCipher
+	checkKeyQuery      = `SELECT COUNT(*) FROM sqlite_master`
 )
 
 // Schema management queries
 const (
-	currentSchemaVersion          = 4
+	currentSchemaVersion          = 27
 	createSchemaVersionTableQuery = `
 		CREATE TABLE IF NOT EXISTS schemaVersion (
 			id INT PRIMARY KEY,
@@ -77,14 +387,14 @@ const (
 	insertSchemaVersion      = `INSERT INTO schemaVersion VALUES (1, ?)`
 	updateSchemaVersion      = `UPDATE schemaVersion SET version = ? WHERE id = 1`
 	selectSchemaVersionQuery = `SELECT version FROM schemaVersion WHERE id = 1`
+	selectColumnExistsQuery  = `SELECT COUNT(*) FROM pragma_table_info('%s') WHERE name = ?`
+	backupQuery              = `VACUUM INTO ?`
 
 	// 0 -> 1
 	migrate0To1AlterMessagesTableQuery = `
-		BEGIN;
 		ALTER TABLE messages ADD COLUMN title TEXT NOT NULL DEFAULT('');
 		ALTER TABLE messages ADD COLUMN priority INT NOT NULL DEFAULT(0);
 		ALTER TABLE messages ADD COLUMN tags TEXT NOT NULL DEFAULT('');
-		COMMIT;
 	`
 
 	// 1 -> 2
@@ -94,7 +404,6 @@ const (
 
 	// 2 -> 3
 	migrate2To3AlterMessagesTableQuery = `
-		BEGIN;
 		ALTER TABLE messages ADD COLUMN click TEXT NOT NULL DEFAULT('');
 		ALTER TABLE messages ADD COLUMN attachment_name TEXT NOT NULL DEFAULT('');
 		ALTER TABLE messages ADD COLUMN attachment_type TEXT NOT NULL DEFAULT('');
@@ -102,237 +411,2243 @@ const (
 		ALTER TABLE messages ADD COLUMN attachment_expires INT NOT NULL DEFAULT('0');
 		ALTER TABLE messages ADD COLUMN attachment_owner TEXT NOT NULL DEFAULT('');
 		ALTER TABLE messages ADD COLUMN attachment_url TEXT NOT NULL DEFAULT('');
-		COMMIT;
 	`
 	// 3 -> 4
 	migrate3To4AlterMessagesTableQuery = `
 		ALTER TABLE messages ADD COLUMN encoding TEXT NOT NULL DEFAULT('');
 	`
+
+	// 4 -> 5
+	migrate4To5AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN published_at INT NOT NULL DEFAULT('0');
+		UPDATE messages SET published_at = time WHERE published = 1;
+	`
+
+	// 5 -> 6
+	migrate5To6CreateTopicSecretsTableQuery = createTopicSecretsTableQuery
+
+	// 6 -> 7
+	migrate6To7AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN email TEXT NOT NULL DEFAULT('');
+	`
+
+	// 7 -> 8
+	migrate7To8CreateDeliveriesTableQuery = createDeliveriesTableQuery
+
+	// 8 -> 9
+	migrate8To9AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN lat REAL;
+		ALTER TABLE messages ADD COLUMN lon REAL;
+	`
+
+	// 9 -> 10
+	migrate9To10AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN owner TEXT NOT NULL DEFAULT('');
+	`
+
+	// 10 -> 11
+	migrate10To11AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN body_ref TEXT NOT NULL DEFAULT('');
+	`
+
+	// 11 -> 12
+	migrate11To12AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN pinned INT NOT NULL DEFAULT(0);
+	`
+
+	// 12 -> 13
+	migrate12To13AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN priority_source TEXT NOT NULL DEFAULT('');
+	`
+
+	// 13 -> 14
+	migrate13To14AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN dedup_hash TEXT NOT NULL DEFAULT('');
+		CREATE INDEX IF NOT EXISTS idx_dedup_hash ON messages (dedup_hash);
+	`
+
+	// 14 -> 15
+	migrate14To15AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN idempotency_key TEXT NOT NULL DEFAULT('');
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_idempotency_key ON messages (topic, idempotency_key) WHERE idempotency_key != '';
+	`
+
+	// 15 -> 16
+	migrate15To16AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN edited INT NOT NULL DEFAULT(0);
+	`
+
+	// 16 -> 17
+	migrate16To17AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN actions TEXT NOT NULL DEFAULT('');
+	`
+
+	// 17 -> 18
+	migrate17To18AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN icon TEXT NOT NULL DEFAULT('');
+	`
+
+	// 18 -> 19
+	migrate18To19AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN content_type TEXT NOT NULL DEFAULT('text/plain');
+	`
+
+	// 19 -> 20
+	migrate19To20AlterMessagesTableQuery = `
+		CREATE INDEX IF NOT EXISTS idx_due ON messages (time) WHERE published = 0;
+	`
+
+	// 20 -> 21
+	migrate20To21AlterMessagesTableQuery = `
+		CREATE INDEX IF NOT EXISTS idx_attachment_expires ON messages (attachment_expires) WHERE attachment_expires > 0;
+	`
+
+	// 21 -> 22
+	migrate21To22AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN attachment_downloads INT NOT NULL DEFAULT(0);
+	`
+
+	// 22 -> 23
+	migrate22To23AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN event TEXT NOT NULL DEFAULT('message');
+	`
+
+	// 23 -> 24; the message count is the current number of messages, just like it is kept at runtime
+	migrate23To24CreateTopicsTableQuery = createTopicsTableQuery + `
+		INSERT OR IGNORE INTO topics (topic, last_message_time, message_count, display_name)
+			SELECT topic, MAX(time), COUNT(*), '' FROM messages GROUP BY topic;
+	`
+
+	// 24 -> 25
+	migrate24To25AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN sequence INT NOT NULL DEFAULT(0);
+		UPDATE messages SET sequence = rowid;
+		CREATE INDEX IF NOT EXISTS idx_sequence ON messages (sequence);
+	`
+
+	// 25 -> 26
+	migrate25To26CreateMessageReadsTableQuery = createMessageReadsTableQuery
+
+	// 26 -> 27
+	migrate26To27AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN sender TEXT NOT NULL DEFAULT('');
+		CREATE INDEX IF NOT EXISTS idx_sender ON messages (sender) WHERE sender != '';
+	`
+)
+
+// Topic filter
+const (
+	topicFilterFalsePositiveRate = 0.01
+)
+
+// sharedMemoryDB is the DSN that ":memory:" is turned into, see openSqliteCachePool. A plain ":memory:" database only
+// exists within a single connection, so every connection of the pool would see its own, empty database.
+const sharedMemoryDB = "file::memory:?cache=shared"
+
+var (
+	modeParamRegex = regexp.MustCompile(`([?&])mode=[a-z]+`)                   // SQLite URI filename parameter, see sqliteReadOnlyDSN
+	addColumnRegex = regexp.MustCompile(`^ALTER TABLE (\w+) ADD COLUMN (\w+)`) // Statements that are skipped if the column exists, see migrate
+	dataRegex      = regexp.MustCompile(`^(INSERT|UPDATE|DELETE) `)            // Statements whose affected rows are logged, see migrate
 )
 
+// cacheReport is the result of a consistency check of the cache database, see Diagnose
+type cacheReport struct {
+	SchemaVersion         int      `json:"schema_version"`
+	ExpectedSchemaVersion int      `json:"expected_schema_version"`
+	IntegrityErrors       []string `json:"integrity_errors"`     // Output of "PRAGMA integrity_check", empty if ok
+	OrphanedAttachments   int      `json:"orphaned_attachments"` // Messages with either an attachment name or URL, but not both
+	DuplicateIDs          int      `json:"duplicate_ids"`        // Message IDs that occur more than once
+	MissingBodies         int      `json:"missing_bodies"`       // Externally stored message bodies that do not exist, see bodyStore
+}
+
+// OK returns true if no inconsistencies were found
+func (r *cacheReport) OK() bool {
+	return r.SchemaVersion == r.ExpectedSchemaVersion && len(r.IntegrityErrors) == 0 && r.OrphanedAttachments == 0 && r.DuplicateIDs == 0 && r.MissingBodies == 0
+}
+
 type sqliteCache struct {
-	db *sql.DB
+	db                  *sqliteDB         // Rewrites table names if there is a table prefix, see sqliteDB
+	limit               int               // Message size limit, see checkMessageSize
+	tagsLimit           int               // Max number of tags per message, see normalizeAndCheckTags
+	tagLengthLimit      int               // Max length of a single tag, see normalizeAndCheckTags
+	maxPerTopic         int               // Max number of messages per topic, see checkTopicLimit
+	maxAttachmentExpiry time.Duration     // Max attachment expiry from now, see clampAttachmentExpiry
+	topicFilter         *util.BloomFilter // Topics with messages, may be nil; see TopicExists
+	topicFilterLen      int               // Number of topics the topic filter is sized for
+	bodies              *bodyStore        // External storage for large message bodies, may be nil
+	compressAbove       int               // Message bodies larger than this many bytes are compressed, 0 means never
+	dedupWindow         time.Duration     // Window in which identical messages are skipped, see message.Dedup
+	readOnlyDSN         string            // DSN of the read-only connection used by QueryRaw, empty for in-memory databases
+	readOnlyDB          *sqliteDB         // Opened on first use, see QueryRaw
+	key                 string            // Encryption key, see openSqliteDB
+	messageCounts       map[string]int    // Topic -> number of messages, see MessageCount and loadMessageCounts
+	metrics             CacheMetrics      // Notified about every inserted message, see addMessages
+	closed              bool              // Set by Close, so that closing twice is safe
+
+	// Unix time of the earliest attachment expiry that has not passed yet, 0 if unknown or
+	// math.MaxInt64 if there is none; used to skip unnecessary scans, see AttachmentsExpired
+	nextAttachmentExpiry int64
+	mu                   sync.Mutex
 }
 
 var _ cache = (*sqliteCache)(nil)
 
-func newSqliteCache(filename string) (*sqliteCache, error) {
-	db, err := sql.Open("sqlite3", filename)
+func newSqliteCache(conf *Config) (*sqliteCache, error) {
+	rawDB, err := openSqliteCacheFile(conf)
+	if err != nil {
+		return nil, err
+	}
+	db, err := newSqliteDB(rawDB, conf.CacheTablePrefix)
+	if err != nil {
+		rawDB.Close()
+		return nil, err
+	}
+	if !isMemoryDB(conf.CacheFile) {
+		if _, err := db.Exec(journalModeWALQuery); err != nil {
+			return nil, err
+		}
+	}
+	var backupFile string
+	if conf.CacheMigrationBackup && !isMemoryDB(conf.CacheFile) {
+		backupFile = fmt.Sprintf("%s.%d.bak", conf.CacheFile, time.Now().Unix())
+	}
+	if err := setupDB(db, backupFile); err != nil {
+		return nil, err
+	}
+	c := &sqliteCache{
+		db:                  db,
+		limit:               conf.MessageLimit,
+		tagsLimit:           conf.MessageTagsLimit,
+		maxPerTopic:         conf.CacheMaxMessagesPerTopic,
+		maxAttachmentExpiry: conf.CacheMaxAttachmentExpiry,
+		tagLengthLimit:      conf.MessageTagLengthLimit,
+		compressAbove:       conf.CacheCompressionThreshold,
+		dedupWindow:         conf.CacheDedupWindow,
+		key:                 conf.CacheKey,
+		metrics:             cacheMetrics(conf),
+	}
+	if !isMemoryDB(conf.CacheFile) {
+		c.readOnlyDSN = sqliteReadOnlyDSN(conf.CacheFile, conf.CacheBusyTimeout)
+	}
+	if err := c.loadMessageCounts(); err != nil {
+		return nil, err
+	}
+	if conf.CacheTopicFilterSize > 0 {
+		if err := c.loadTopicFilter(conf.CacheTopicFilterSize); err != nil {
+			return nil, err
+		}
+	}
+	if conf.CacheBodyDir != "" {
+		c.bodies, err = newBodyStore(conf.CacheBodyDir, conf.CacheBodyThreshold)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// loadTopicFilter populates the topic filter with all topics that currently have messages
+func (c *sqliteCache) loadTopicFilter(size int) error {
+	topics, err := c.Topics()
+	if err != nil {
+		return err
+	}
+	filter := util.NewBloomFilter(size, topicFilterFalsePositiveRate)
+	for topic := range topics {
+		filter.Add(topic)
+	}
+	c.topicFilter, c.topicFilterLen = filter, size
+	return nil
+}
+
+// loadMessageCounts (re-)reads the number of messages per topic from the database. The counts are kept
+// up-to-date in memory when messages are added or deleted, and re-synced with each Prune to correct any
+// drift, e.g. from messages that were deleted from the database file by other means.
+func (c *sqliteCache) loadMessageCounts() error {
+	rows, err := c.db.Query(selectMessageCountsQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var topic string
+		var count int
+		if err := rows.Scan(&topic, &count); err != nil {
+			return err
+		}
+		counts[topic] = count
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.messageCounts = counts
+	c.mu.Unlock()
+	return nil
+}
+
+// addMessageCount adjusts the in-memory message count of a topic by delta, see loadMessageCounts.
+// The caller must hold c.mu.
+func (c *sqliteCache) addMessageCount(topic string, delta int) {
+	if count := c.messageCounts[topic] + delta; count > 0 {
+		c.messageCounts[topic] = count
+	} else {
+		delete(c.messageCounts, topic)
+	}
+}
+
+// openSqliteCacheFile opens the cache file and checks its integrity, see checkIntegrity. If the file is corrupt
+// (e.g. after an unclean shutdown), it first tries to recover it by checkpointing the WAL into the database file.
+// If that does not help, the corrupt file is moved aside and ntfy starts with an empty cache.
+func openSqliteCacheFile(conf *Config) (*sql.DB, error) {
+	db, err := openSqliteCachePool(conf)
+	if err != nil || isMemoryDB(conf.CacheFile) {
+		return db, err
+	}
+	err = checkIntegrity(db)
+	if errors.Is(err, errCacheCorrupt) {
+		log.Printf("Cache database %s is corrupt, trying to recover by checkpointing the WAL: %s", conf.CacheFile, err.Error())
+		if _, checkpointErr := db.Exec(checkpointTruncateQuery); checkpointErr == nil {
+			err = checkIntegrity(db)
+		}
+	}
+	if err == nil {
+		return db, nil
+	} else if !errors.Is(err, errCacheCorrupt) || strings.HasPrefix(conf.CacheFile, "file:") {
+		db.Close()
+		return nil, err
+	}
+	db.Close()
+	corruptFile := fmt.Sprintf("%s.%d.corrupt", conf.CacheFile, time.Now().Unix())
+	log.Printf("WARNING: Cache database %s is corrupt and cannot be recovered: %s", conf.CacheFile, err.Error())
+	log.Printf("WARNING: Moving corrupt cache database to %s, and starting with an empty cache", corruptFile)
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Rename(conf.CacheFile+suffix, corruptFile+suffix); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return openSqliteCachePool(conf)
+}
+
+// openSqliteCachePool opens the cache file and configures its connection pool
+func openSqliteCachePool(conf *Config) (*sql.DB, error) {
+	filename := conf.CacheFile
+	if filename == ":memory:" {
+		filename = sharedMemoryDB
+	}
+	db, err := openSqliteDB(sqliteDSN(filename, conf.CacheBusyTimeout, conf.CacheSyncMode), conf.CacheKey)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(conf.CacheMaxOpenConns)
+	db.SetMaxIdleConns(conf.CacheMaxIdleConns)
+	db.SetConnMaxLifetime(conf.CacheConnMaxLifetime)
+	if isMemoryDB(conf.CacheFile) {
+		// An in-memory database is deleted when its last connection is closed, so keep exactly one open at all
+		// times. Connections of a shared-cache database use table-level locks, which fail right away with
+		// SQLITE_LOCKED instead of waiting for the busy timeout, so each cache must not have more than one.
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		db.SetConnMaxLifetime(0)
+	}
+	return db, nil
+}
+
+// checkIntegrity runs a quick integrity check of the database, and returns errCacheCorrupt if the database is
+// corrupt or not a database at all. Other errors, e.g. if the database is locked, are returned as they are, since
+// they do not mean that the file is damaged.
+func checkIntegrity(db *sql.DB) error {
+	rows, err := db.Query(quickCheckQuery)
+	if err != nil {
+		return toCorruptError(err)
+	}
+	defer rows.Close()
+	problems := make([]string, 0)
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return toCorruptError(err)
+		} else if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return toCorruptError(err)
+	} else if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", errCacheCorrupt, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// isPrimaryKeyError returns true if the error is SQLite's "UNIQUE constraint failed" error for a primary key
+func isPrimaryKeyError(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+}
+
+// toCorruptError wraps SQLite's "database disk image is malformed" and "file is not a database" errors
+// in errCacheCorrupt, and returns all other errors as they are
+func toCorruptError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrCorrupt || sqliteErr.Code == sqlite3.ErrNotADB) {
+		return fmt.Errorf("%w: %s", errCacheCorrupt, err.Error())
+	}
+	return err
+}
+
+// openSqliteDB opens the database with the given DSN. If key is set, the database is encrypted with SQLCipher:
+// the key is passed to every new connection in the pool as "PRAGMA key", before any other query. Since plain SQLite
+// silently ignores "PRAGMA key", opening fails with errCacheKeyUnsupported if ntfy is not built against SQLCipher.
+// A wrong key is only detected when the database is first read, and fails with errCacheBadKey.
+func openSqliteDB(dsn, key string) (*sql.DB, error) {
+	if key == "" {
+		return sql.Open("sqlite3", dsn)
+	}
+	db := sql.OpenDB(&sqliteKeyConnector{
+		dsn: dsn,
+		driver: &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				_, err := conn.Exec(sqliteKeyQuery(key), nil)
+				return err
+			},
+		},
+	})
+	rows, err := db.Query(cipherVersionQuery)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	supported := rows.Next()
+	rows.Close()
+	if !supported {
+		db.Close()
+		return nil, errCacheKeyUnsupported
+	}
+	var tables int
+	if err := db.QueryRow(checkKeyQuery).Scan(&tables); err != nil {
+		db.Close()
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrNotADB {
+			return nil, errCacheBadKey
+		}
+		return nil, err
+	}
+	return db, nil
+}
+
+// sqliteKeyQuery returns the "PRAGMA key" query for the given key. PRAGMA does not support bind
+// parameters, so the key is quoted as an SQL string literal.
+func sqliteKeyQuery(key string) string {
+	return fmt.Sprintf(keyQuery, strings.ReplaceAll(key, "'", "''"))
+}
+
+// sqliteKeyConnector opens connections with the SQLite driver, so that a ConnectHook can be used
+// without registering a separate driver for every key, see openSqliteDB
+type sqliteKeyConnector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func (c *sqliteKeyConnector) Connect(_ context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *sqliteKeyConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// sqlPlaceholders returns n comma-separated bind parameters, e.g. "?,?,?" for n = 3
+func sqlPlaceholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// sqliteDSN appends the busy timeout and synchronous mode to the filename. Unlike "PRAGMA busy_timeout" and
+// "PRAGMA synchronous", which only apply to a single connection, the DSN parameters apply to every connection in the pool.
+//
+// Transactions are started with "BEGIN IMMEDIATE", so that they take the write lock up front (waiting for the busy
+// timeout if needed). All transactions of the cache write, and most read first (e.g. TakeMessagesDue): a deferred
+// transaction is only upgraded to a write transaction on its first write, which fails with SQLITE_BUSY_SNAPSHOT
+// without waiting if another connection committed in between.
+func sqliteDSN(filename string, busyTimeout time.Duration, syncMode string) string {
+	params := []string{"_txlock=immediate"}
+	if busyTimeout > 0 {
+		params = append(params, fmt.Sprintf("_busy_timeout=%d", busyTimeout.Milliseconds()))
+	}
+	if syncMode != "" {
+		params = append(params, "_sync="+syncMode)
+	}
+	return appendDSNParams(filename, params)
+}
+
+// sqliteReadOnlyDSN turns the filename into a URI filename with mode=ro, so that SQLite refuses all writes,
+// and appends the busy timeout, see sqliteDSN. Only URI filenames (starting with "file:") support the mode parameter.
+func sqliteReadOnlyDSN(filename string, busyTimeout time.Duration) string {
+	if !strings.HasPrefix(filename, "file:") {
+		filename = "file:" + filename
+	}
+	if modeParamRegex.MatchString(filename) {
+		filename = modeParamRegex.ReplaceAllString(filename, "${1}mode=ro")
+	} else if strings.Contains(filename, "?") {
+		filename += "&mode=ro"
+	} else {
+		filename += "?mode=ro"
+	}
+	params := make([]string, 0)
+	if busyTimeout > 0 {
+		params = append(params, fmt.Sprintf("_busy_timeout=%d", busyTimeout.Milliseconds()))
+	}
+	return appendDSNParams(filename, params)
+}
+
+// appendDSNParams appends the query parameters to the filename
+func appendDSNParams(filename string, params []string) string {
+	if len(params) == 0 {
+		return filename
+	}
+	separator := "?"
+	if strings.Contains(filename, "?") {
+		separator = "&"
+	}
+	return filename + separator + strings.Join(params, "&")
+}
+
+// isMemoryDB returns true if the given SQLite filename refers to an in-memory database
+func isMemoryDB(filename string) bool {
+	return filename == ":memory:" || strings.HasPrefix(filename, "file::memory:") || strings.Contains(filename, "mode=memory")
+}
+
+// AddMessage inserts a single message. If the message was skipped as a duplicate, errDuplicateMessage
+// is returned and the message's ID and time are set to those of the existing message. If it was skipped
+// because its idempotency key was used before, the message is replaced by the stored one entirely.
+func (c *sqliteCache) AddMessage(m *message) error {
+	_, err := c.AddMessagePublished(m)
+	return err
+}
+
+// AddMessagePublished inserts a single message, see AddMessage, and returns whether it was stored as published,
+// i.e. it can be delivered to subscribers right away, or as scheduled, i.e. it is delivered by sendDelayedMessages.
+func (c *sqliteCache) AddMessagePublished(m *message) (published bool, err error) {
+	duplicates, scheduled, err := c.addMessages([]*message{m})
+	if err != nil {
+		return false, err
+	} else if duplicates > 0 {
+		return false, errDuplicateMessage
+	}
+	return scheduled == 0, nil
+}
+
+// AddMessages inserts all given messages in a single transaction, using one prepared statement.
+// Either all messages are added, or none of them are. Duplicates are skipped, see AddMessage.
+func (c *sqliteCache) AddMessages(ms []*message) error {
+	_, _, err := c.addMessages(ms)
+	return err
+}
+
+func (c *sqliteCache) addMessages(ms []*message) (duplicates int, scheduled int, err error) {
+	for _, m := range ms {
+		if m.Event == openEvent || m.Event == keepaliveEvent {
+			return 0, 0, errUnexpectedMessageType
+		}
+		if err := checkMessageSize(m, c.limit); err != nil {
+			return 0, 0, err
+		}
+		if err := normalizeAndCheckTags(m, c.tagsLimit, c.tagLengthLimit); err != nil {
+			return 0, 0, err
+		}
+		if err := checkActions(m); err != nil {
+			return 0, 0, err
+		}
+		normalizeContentType(m)
+		clampAttachmentExpiry(m, c.maxAttachmentExpiry)
+	}
+	c.mu.Lock()
+	err = checkTopicLimit(ms, c.maxPerTopic, func(topic string) int { return c.messageCounts[topic] })
+	c.mu.Unlock()
+	if err != nil {
+		return 0, 0, err // Concurrent inserts may still exceed the limit slightly; it is only a safeguard
+	}
+	bodyRefs := make([]string, 0)
+	inserted := make([]*message, 0)
+	duplicates, scheduled, err = c.insertMessages(ms, &bodyRefs, &inserted)
+	if err != nil {
+		for _, bodyRef := range bodyRefs {
+			c.bodies.Remove(bodyRef)
+		}
+		return 0, 0, err
+	}
+	durable := false
+	c.mu.Lock()
+	for _, m := range ms {
+		if m.Attachment != nil && m.Attachment.Expires > 0 {
+			if c.nextAttachmentExpiry > 0 && m.Attachment.Expires < c.nextAttachmentExpiry {
+				c.nextAttachmentExpiry = m.Attachment.Expires
+			}
+		}
+		if c.topicFilter != nil {
+			c.topicFilter.Add(m.Topic)
+		}
+		durable = durable || m.Durable
+	}
+	for _, m := range inserted {
+		c.addMessageCount(m.Topic, 1)
+	}
+	c.mu.Unlock()
+	for _, m := range inserted {
+		c.metrics.MessageAdded(m.Topic, len(m.Message), m.Attachment != nil)
+	}
+	if durable {
+		return duplicates, scheduled, c.checkpoint()
+	}
+	return duplicates, scheduled, nil
+}
+
+// insertMessages writes the messages (and their externalized bodies) within one transaction. The
+// references of all bodies written to disk are appended to bodyRefs, so the caller can clean them up.
+// All inserted messages, i.e. all messages except for duplicates, are appended to inserted. If a message
+// with the ID of one of the messages exists, nothing is inserted, and errMessageExists is returned. This
+// is detected by the primary key of the insert itself, so no extra SELECT is needed.
+// It returns the number of messages that were skipped as duplicates, and the number of scheduled messages.
+func (c *sqliteCache) insertMessages(ms []*message, bodyRefs *[]string, inserted *[]*message) (duplicates int, scheduled int, err error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(insertMessageQuery)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmt.Close()
+	topicStmt, err := tx.Prepare(upsertTopicMessageQuery)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer topicStmt.Close()
+	now := time.Now().Unix()
+	for _, m := range ms {
+		if m.IdempotencyKey != "" {
+			existing, err := c.messageByIdempotencyKey(tx, m.Topic, m.IdempotencyKey)
+			if err != nil {
+				return 0, 0, err
+			} else if existing != nil {
+				*m = *existing
+				duplicates++
+				continue
+			}
+		}
+		hash := dedupHash(m)
+		if m.Dedup && c.dedupWindow > 0 {
+			var id string
+			var timestamp int64
+			err := tx.QueryRow(selectDuplicateMessageQuery, hash, now-int64(c.dedupWindow.Seconds())).Scan(&id, &timestamp)
+			if err == nil {
+				m.ID, m.Time = id, timestamp
+				duplicates++
+				continue
+			} else if err != sql.ErrNoRows {
+				return 0, 0, err
+			}
+		}
+		published := m.Time <= now
+		var publishedAt int64
+		if published {
+			publishedAt = now
+		} else {
+			scheduled++
+		}
+		body, bodyRef, encoding, err := c.storedBody(m)
+		if err != nil {
+			return 0, 0, err
+		}
+		tags := strings.Join(m.Tags, ",")
+		var actions string
+		if len(m.Actions) > 0 {
+			actionsBytes, err := json.Marshal(m.Actions)
+			if err != nil {
+				return 0, 0, err
+			}
+			actions = string(actionsBytes)
+		}
+		var attachmentName, attachmentType, attachmentURL, attachmentOwner string
+		var attachmentSize, attachmentExpires, attachmentDownloads int64
+		if m.Attachment != nil {
+			attachmentName = m.Attachment.Name
+			attachmentType = m.Attachment.Type
+			attachmentSize = m.Attachment.Size
+			attachmentExpires = m.Attachment.Expires
+			attachmentURL = m.Attachment.URL
+			attachmentOwner = m.Attachment.Owner
+			attachmentDownloads = m.Attachment.Downloads
+		}
+		_, err = stmt.Exec(
+			m.ID,
+			m.Time,
+			m.Topic,
+			body,
+			m.Title,
+			m.Priority,
+			tags,
+			m.Click,
+			attachmentName,
+			attachmentType,
+			attachmentSize,
+			attachmentExpires,
+			attachmentURL,
+			attachmentOwner,
+			encoding,
+			published,
+			publishedAt,
+			m.Email,
+			m.Lat,
+			m.Lon,
+			m.Owner,
+			bodyRef,
+			m.Pinned,
+			m.PrioritySource,
+			hash,
+			m.IdempotencyKey,
+			m.Edited,
+			actions,
+			m.Icon,
+			m.ContentType,
+			attachmentDownloads,
+			m.Event,
+			m.Sender,
+		)
+		if isPrimaryKeyError(err) {
+			return 0, 0, errMessageExists // IDs may be chosen by the publisher, see message.ID
+		} else if err != nil {
+			return 0, 0, err
+		}
+		if bodyRef != "" {
+			// The body is only written once the row is inserted, so that an existing message's body is never overwritten
+			if err := c.bodies.Write(bodyRef, m.Message); err != nil {
+				return 0, 0, err
+			}
+			*bodyRefs = append(*bodyRefs, bodyRef)
+		}
+		if _, err := topicStmt.Exec(m.Topic, m.Time); err != nil {
+			return 0, 0, err
+		}
+		*inserted = append(*inserted, m)
+	}
+	return duplicates, scheduled, tx.Commit()
+}
+
+// storedBody returns the body, body reference and encoding that the message is stored with. Large
+// bodies are to be written to the body store by the caller (if bodyRef is set), and large text bodies
+// are compressed, see bodyStore and compressBody.
+func (c *sqliteCache) storedBody(m *message) (body interface{}, bodyRef string, encoding string, err error) {
+	if c.bodies != nil && c.bodies.Externalize(m) {
+		return "", m.ID, m.Encoding, nil
+	} else if c.compressAbove > 0 && m.Encoding == "" && len(m.Message) > c.compressAbove {
+		compressed, smaller, err := compressBody(m.Message)
+		if err != nil {
+			return nil, "", "", err
+		} else if smaller {
+			return compressed, "", encodingGzip, nil // Stored as BLOB
+		}
+	}
+	return m.Message, "", m.Encoding, nil
+}
+
+// messageByIdempotencyKey returns the message of the topic that was stored with the given idempotency
+// key within the transaction, or nil if there is none
+func (c *sqliteCache) messageByIdempotencyKey(tx *sqliteTx, topic, key string) (*message, error) {
+	rows, err := tx.Query(selectMessageByIdempotencyKeyQuery, topic, key)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.readMessages(rows)
+	if err != nil {
+		return nil, err
+	} else if len(messages) == 0 {
+		return nil, nil
+	}
+	return messages[0], nil
+}
+
+// checkpoint makes sure that all committed transactions are written to the main database file
+// and synced to disk, even if a write-ahead log (WAL) is used
+func (c *sqliteCache) checkpoint() error {
+	_, err := c.db.Exec(checkpointQuery)
+	return err
+}
+
+// Messages returns the messages of a topic since the given time, ordered by time. If limit is greater
+// than zero, only the most recent limit messages are returned.
+func (c *sqliteCache) Messages(topic string, since sinceMarker, scheduled bool, limit int) ([]*message, error) {
+	return c.MessagesContext(context.Background(), topic, since, scheduled, limit, nil)
+}
+
+// MessagesBetween returns the messages of the topic with a time between from and to, both inclusive. If to
+// is zero, it defaults to now.
+func (c *sqliteCache) MessagesBetween(topic string, from, to time.Time, scheduled bool) ([]*message, error) {
+	return c.MessagesContext(context.Background(), topic, newSinceTime(from.Unix()), scheduled, 0, betweenFilter(to))
+}
+
+// MessagesContext is like Messages, but aborts the query if the context is canceled. If filter is set,
+// only matching messages are returned (and counted towards the limit), in the order given by filter.Order.
+func (c *sqliteCache) MessagesContext(ctx context.Context, topic string, since sinceMarker, scheduled bool, limit int, filter *messageFilter) ([]*message, error) {
+	if since.IsNone() {
+		return make([]*message, 0), nil
+	}
+	rows, err := c.queryMessages(ctx, topic, since, scheduled, limit, filter)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.readMessages(rows)
+	if err != nil {
+		return nil, err
+	} else if limit <= 0 || filter.descending() {
+		return messages, nil // Without a limit, the messages are selected in the right order, see queryMessages
+	}
+	return reverseMessages(messages), nil
+}
+
+// MessagesFunc calls fn for each message of a topic since the given time, ordered by time. Unlike Messages,
+// the messages are read from the database in batches, so they are never all held in memory. If fn returns
+// an error, no further messages are read, and the error is returned.
+func (c *sqliteCache) MessagesFunc(topic string, since sinceMarker, scheduled bool, fn func(m *message) error) error {
+	return c.MessagesFuncContext(context.Background(), topic, since, scheduled, nil, fn)
+}
+
+// MessagesFuncContext is like MessagesFunc, but aborts the query if the context is canceled. If filter is
+// set, fn is only called for matching messages.
+//
+// Since a query holds a database connection until all of its rows are read, fn is never called while a query
+// is running, so that a slow fn (e.g. writing to a slow subscriber) cannot starve the connection pool: the IDs
+// of all matching messages are selected first, and the messages are then read and passed on in batches of
+// messagesFuncBatchSize. Messages that are deleted in the meantime are skipped.
+func (c *sqliteCache) MessagesFuncContext(ctx context.Context, topic string, since sinceMarker, scheduled bool, filter *messageFilter, fn func(m *message) error) error {
+	if since.IsNone() {
+		return nil
+	}
+	ids, err := c.queryMessageIDs(ctx, topic, since, scheduled, filter)
+	if err != nil {
+		return err
+	}
+	return forEachMessageByID(ctx, ids, c.MessagesByIDs, fn)
+}
+
+// forEachMessageByID reads the messages with the given IDs with byIDs in batches of messagesFuncBatchSize,
+// and calls fn for each of them in the order of the IDs, see MessagesFuncContext
+func forEachMessageByID(ctx context.Context, ids []string, byIDs func(ids []string) ([]*message, error), fn func(m *message) error) error {
+	for len(ids) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch := ids
+		if len(batch) > messagesFuncBatchSize {
+			batch = batch[:messagesFuncBatchSize]
+		}
+		ids = ids[len(batch):]
+		messages, err := byIDs(batch)
+		if err != nil {
+			return err
+		}
+		byID := make(map[string]*message, len(messages))
+		for _, m := range messages {
+			byID[m.ID] = m
+		}
+		for _, id := range batch { // byIDs does not keep the order of the IDs, see filter.Order
+			if m, ok := byID[id]; ok {
+				if err := fn(m); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// queryMessageIDs returns the IDs of the messages that queryMessages would select without a limit, see MessagesFuncContext
+func (c *sqliteCache) queryMessageIDs(ctx context.Context, topic string, since sinceMarker, scheduled bool, filter *messageFilter) ([]string, error) {
+	query, args := messagesQuery(topic, since, scheduled, 0, filter)
+	query = "SELECT id " + query[strings.Index(query, "FROM messages"):] // Same conditions and order, see messagesQuery
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// MessageHeaders is like Messages, but does not load externally stored message bodies (see bodyStore).
+// The Message field of these messages is empty.
+func (c *sqliteCache) MessageHeaders(topic string, since sinceMarker, scheduled bool, limit int) ([]*message, error) {
+	if since.IsNone() {
+		return make([]*message, 0), nil
+	}
+	rows, err := c.queryMessages(context.Background(), topic, since, scheduled, limit, nil)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := readMessages(rows)
+	if err != nil {
+		return nil, err
+	} else if limit > 0 {
+		return reverseMessages(messages), nil
+	}
+	return messages, nil
+}
+
+// queryMessages selects the messages of a topic. If limit is greater than zero, the newest messages
+// are selected first, so that the limit applies to the most recent messages. Otherwise, all messages
+// are selected, oldest first. A limit of -1 means "no limit" in SQLite.
+func (c *sqliteCache) queryMessages(ctx context.Context, topic string, since sinceMarker, scheduled bool, limit int, filter *messageFilter) (*sql.Rows, error) {
+	query, args := messagesQuery(topic, since, scheduled, limit, filter)
+	return c.db.QueryContext(ctx, query, args...)
+}
+
+// messagesQuery returns the query and arguments to select the messages of a topic, see queryMessages
+func messagesQuery(topic string, since sinceMarker, scheduled bool, limit int, filter *messageFilter) (string, []interface{}) {
+	order := "DESC" // With a limit, the newest messages are selected; see MessagesContext
+	if limit <= 0 {
+		limit = -1
+		if !filter.descending() {
+			order = "ASC"
+		}
+	}
+	query, marker := selectMessagesSinceTimeQuery, interface{}(since.Time().Unix())
+	if since.IsID() && scheduled {
+		query, marker = selectMessagesSinceIDIncludeScheduledQuery, since.ID()
+	} else if since.IsID() {
+		query, marker = selectMessagesSinceIDQuery, since.ID()
+	} else if scheduled {
+		query = selectMessagesSinceTimeIncludeScheduledQuery
+	}
+	clause, filterArgs := filterClause(filter)
+	args := append([]interface{}{topic, marker}, filterArgs...)
+	args = append(args, limit)
+	return fmt.Sprintf(query, clause, order, order), args
+}
+
+// MessagesMulti returns the messages of several topics since the given time, grouped by topic, with the
+// messages of each topic ordered by time. Unlike calling Messages for each topic, the topics are selected
+// in a single query (or one per selectMessagesMultiChunkSize topics). Every requested topic is in the result,
+// even if it has no messages.
+func (c *sqliteCache) MessagesMulti(topics []string, since sinceMarker, scheduled bool) (map[string][]*message, error) {
+	messages := make(map[string][]*message)
+	for _, topic := range topics {
+		messages[topic] = make([]*message, 0)
+	}
+	if since.IsNone() {
+		return messages, nil
+	}
+	query, marker := selectMessagesMultiSinceTimeQuery, interface{}(since.Time().Unix())
+	if since.IsID() {
+		query, marker = selectMessagesMultiSinceIDQuery, since.ID()
+	}
+	clause, filterArgs := filterClause(nil)
+	if !scheduled {
+		clause = " AND published = 1" + clause
+	}
+	for len(topics) > 0 {
+		chunk := topics
+		if len(chunk) > selectMessagesMultiChunkSize {
+			chunk = chunk[:selectMessagesMultiChunkSize]
+		}
+		topics = topics[len(chunk):]
+		args := make([]interface{}, 0, len(chunk)+1+len(filterArgs))
+		for _, topic := range chunk {
+			args = append(args, topic)
+		}
+		args = append(args, marker)
+		args = append(args, filterArgs...)
+		rows, err := c.db.Query(fmt.Sprintf(query, sqlPlaceholders(len(chunk)), clause), args...)
+		if err != nil {
+			return nil, err
+		}
+		chunkMessages, err := c.readMessages(rows)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range chunkMessages {
+			messages[m.Topic] = append(messages[m.Topic], m) // Rows are ordered by time, so each topic is too
+		}
+	}
+	return messages, nil
+}
+
+// MessagesByIDs returns the messages with the given IDs, ordered by time
+func (c *sqliteCache) MessagesByIDs(ids []string) ([]*message, error) {
+	messages := make([]*message, 0)
+	for len(ids) > 0 {
+		chunk := ids
+		if len(chunk) > selectMessagesByIDsChunkSize {
+			chunk = chunk[:selectMessagesByIDsChunkSize]
+		}
+		ids = ids[len(chunk):]
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		rows, err := c.db.Query(fmt.Sprintf(selectMessagesByIDsQuery, sqlPlaceholders(len(chunk))), args...)
+		if err != nil {
+			return nil, err
+		}
+		chunkMessages, err := c.readMessages(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, chunkMessages...)
+	}
+	sortMessages(messages)
+	return messages, nil
+}
+
+// MessagesBySender returns all messages of the given sender (see message.Sender) in all topics, including
+// scheduled messages, e.g. to find out what else a publisher that spammed a topic has published
+func (c *sqliteCache) MessagesBySender(sender string) ([]*message, error) {
+	if sender == "" {
+		return make([]*message, 0), nil // Messages published before senders were recorded
+	}
+	rows, err := c.db.Query(selectMessagesBySenderQuery, sender)
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(rows)
+}
+
+// LatestMessage returns the most recent published message event of the topic, or errNoRows if there is none
+func (c *sqliteCache) LatestMessage(topic string) (*message, error) {
+	rows, err := c.db.Query(selectLatestMessageQuery, topic, messageEvent)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.readMessages(rows)
+	if err != nil {
+		return nil, err
+	} else if len(messages) == 0 {
+		return nil, errNoRows
+	}
+	return messages[0], nil
+}
+
+func (c *sqliteCache) MessagesDue() ([]*message, error) {
+	rows, err := c.db.Query(selectMessagesDueQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(rows)
+}
+
+// TakeMessagesDue returns all messages that are due, and marks them as published within the same
+// transaction, so that a scheduled message cannot be cancelled (see DeleteScheduled) after it was returned.
+func (c *sqliteCache) TakeMessagesDue() ([]*message, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(selectMessagesDueQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.readMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	if err := markPublished(tx, ids); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// AllScheduledMessages returns up to limit scheduled messages of all topics, the next due first
+func (c *sqliteCache) AllScheduledMessages(limit int) ([]*message, error) {
+	rows, err := c.db.Query(selectAllScheduledMessagesQuery, limit)
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(rows)
+}
+
+// PendingScheduled returns the scheduled messages of the topic that are not due yet, see scheduledMessage
+func (c *sqliteCache) PendingScheduled(topic string) ([]*scheduledMessage, error) {
+	now := time.Now()
+	rows, err := c.db.Query(selectPendingScheduledMessagesQuery, topic, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.readMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]*scheduledMessage, 0, len(messages))
+	for _, m := range messages {
+		pending = append(pending, newScheduledMessage(m, now))
+	}
+	return pending, nil
+}
+
+// MessagesAfter returns up to limit messages of all topics after the cursor, ordered by time and ID, see exportCursor
+func (c *sqliteCache) MessagesAfter(after exportCursor, limit int) ([]*message, error) {
+	rows, err := c.db.Query(selectMessagesAfterQuery, after.Time, after.Time, after.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(rows)
+}
+
+func (c *sqliteCache) MarkPublished(m *message) error {
+	return c.MarkPublishedBatch([]string{m.ID})
+}
+
+// MarkPublishedBatch marks all messages with the given IDs as published in a single transaction, e.g. when
+// many scheduled messages are due at the same time, see markPublished.
+func (c *sqliteCache) MarkPublishedBatch(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := markPublished(tx, ids); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// markPublished marks the messages with the given IDs as published. To stay within SQLite's limit of
+// bound parameters, the IDs are updated in chunks.
+func markPublished(tx *sqliteTx, ids []string) error {
+	now := time.Now().Unix()
+	for len(ids) > 0 {
+		chunk := ids
+		if len(chunk) > updateMessagesPublishedChunkSize {
+			chunk = chunk[:updateMessagesPublishedChunkSize]
+		}
+		ids = ids[len(chunk):]
+		args := []interface{}{now}
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(updateMessagesPublishedQuery, sqlPlaceholders(len(chunk))), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecomputePublished marks all unpublished messages whose time is within the given grace window
+// (i.e. time <= now+grace) as published, and returns the number of messages that were changed
+func (c *sqliteCache) RecomputePublished(grace time.Duration) (int, error) {
+	now := time.Now()
+	res, err := c.db.Exec(updateMessagesPublishedDueQuery, now.Unix(), now.Add(grace).Unix())
+	if err != nil {
+		return 0, err
+	}
+	changed, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(changed), nil
+}
+
+func (c *sqliteCache) PinMessage(id string) error {
+	return c.setPinned(id, true)
+}
+
+func (c *sqliteCache) UnpinMessage(id string) error {
+	return c.setPinned(id, false)
+}
+
+// UpdateMessage replaces the message body, title, priority and tags of the message with the given ID in
+// the topic of m, and sets its edited time to m.Edited. All other fields, including the time, are kept.
+// It returns errNoRows if the topic has no such message.
+func (c *sqliteCache) UpdateMessage(id string, m *message) error {
+	if err := checkMessageSize(m, c.limit); err != nil {
+		return err
+	}
+	if err := normalizeAndCheckTags(m, c.tagsLimit, c.tagLengthLimit); err != nil {
+		return err
+	}
+	updated := *m
+	updated.ID = id // Externally stored bodies are named after the message ID
+	body, bodyRef, encoding, err := c.storedBody(&updated)
+	if err != nil {
+		return err
+	} else if bodyRef != "" {
+		if err := c.bodies.Write(bodyRef, updated.Message); err != nil {
+			return err
+		}
+	}
+	tags := strings.Join(m.Tags, ",")
+	res, err := c.db.Exec(updateMessageContentQuery, body, m.Title, m.Priority, tags, encoding, bodyRef, dedupHash(m), m.Edited, id, m.Topic)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		if bodyRef != "" {
+			c.bodies.Remove(bodyRef)
+		}
+		return errNoRows
+	}
+	return nil
+}
+
+func (c *sqliteCache) setPinned(id string, pinned bool) error {
+	res, err := c.db.Exec(updateMessagePinnedQuery, pinned, id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errNoRows
+	}
+	return nil
+}
+
+// DeleteMessage deletes a single message, regardless of whether it is published, and returns the
+// number of deleted rows. Externally stored bodies are removed with the next Prune.
+func (c *sqliteCache) DeleteMessage(id string) (int, error) {
+	var topic string
+	if err := c.db.QueryRow(selectMessageTopicQuery, id).Scan(&topic); err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	deleted, err := c.delete(deleteMessageQuery, id)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.subtractMessageCount(topic, deleted); err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+// DeleteScheduled cancels a scheduled message by deleting it, but only if it was not published yet.
+// It returns errNoRows if the message does not exist, and errMessagePublished if it was already published.
+func (c *sqliteCache) DeleteScheduled(id string) error {
+	var topic string
+	if err := c.db.QueryRow(selectMessageTopicQuery, id).Scan(&topic); err == sql.ErrNoRows {
+		return errNoRows
+	} else if err != nil {
+		return err
+	}
+	deleted, err := c.delete(deleteScheduledMessageQuery, id)
+	if err != nil {
+		return err
+	} else if deleted == 0 {
+		return errMessagePublished // Or deleted in the meantime, which is indistinguishable for the caller
+	}
+	return c.subtractMessageCount(topic, deleted)
+}
+
+// DeleteMessagesForTopic deletes all messages of a topic, including scheduled and pinned messages,
+// and returns the number of deleted rows
+func (c *sqliteCache) DeleteMessagesForTopic(topic string) (int, error) {
+	deleted, err := c.delete(deleteMessagesForTopicQuery, topic)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.subtractMessageCount(topic, deleted); err != nil {
+		return 0, err
+	}
+	return int(deleted), nil
+}
+
+// subtractMessageCount adjusts the message count of a topic after messages were deleted, both in memory
+// (see loadMessageCounts) and in the topic metadata (see Topics)
+func (c *sqliteCache) subtractMessageCount(topic string, deleted int64) error {
+	if _, err := c.db.Exec(updateTopicMessageCountQuery, deleted, topic); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.addMessageCount(topic, -int(deleted))
+	c.mu.Unlock()
+	return nil
+}
+
+// syncMessageCounts re-counts the messages of all topics after messages were pruned, both in the
+// topic metadata (see Topics) and in memory (see loadMessageCounts)
+func (c *sqliteCache) syncMessageCounts() error {
+	if _, err := c.db.Exec(updateTopicMessageCountsQuery); err != nil {
+		return err
+	}
+	return c.loadMessageCounts()
+}
+
+func (c *sqliteCache) delete(query string, args ...interface{}) (int64, error) {
+	res, err := c.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// PublishedBetween returns all messages that were published between from and to, in the order they were published
+func (c *sqliteCache) PublishedBetween(from, to time.Time) ([]*message, error) {
+	rows, err := c.db.Query(selectMessagesPublishedBetweenQuery, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	return c.readMessages(rows)
+}
+
+// MessageCount returns the number of messages of a topic, including scheduled messages. The count is
+// served from memory, see loadMessageCounts.
+func (c *sqliteCache) MessageCount(topic string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.messageCounts[topic], nil
+}
+
+func (c *sqliteCache) ScheduledCount() (int, error) {
+	return c.count(selectScheduledCountQuery)
+}
+
+func (c *sqliteCache) ScheduledCountForTopic(topic string) (int, error) {
+	return c.count(selectScheduledCountForTopicQuery, topic)
+}
+
+func (c *sqliteCache) EncodingBreakdown() (map[string]int, error) {
+	rows, err := c.db.Query(selectEncodingBreakdownQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var encoding string
+		var count int
+		if err := rows.Scan(&encoding, &count); err != nil {
+			return nil, err
+		}
+		counts[encoding] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// AttachmentSizeByType returns the total size of all attachments by MIME type, e.g. to find out which
+// types of files use the most storage. Attachments that have been deleted (see ClearAttachment) are not
+// included; external attachments (see message.Attachment) are included with their size, usually 0.
+func (c *sqliteCache) AttachmentSizeByType() (map[string]int64, error) {
+	rows, err := c.db.Query(selectAttachmentSizeByTypeQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sizes := make(map[string]int64)
+	for rows.Next() {
+		var attachmentType string
+		var size int64
+		if err := rows.Scan(&attachmentType, &size); err != nil {
+			return nil, err
+		}
+		sizes[attachmentType] = size
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// Stats returns a summary of the cache contents, using a single aggregate query, and the attachment
+// sizes by type, see AttachmentSizeByType
+func (c *sqliteCache) Stats() (*cacheStats, error) {
+	rows, err := c.db.Query(selectStatsQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, errNoRows
+	}
+	var stats cacheStats
+	var oldest int64
+	if err := rows.Scan(&stats.Messages, &stats.Topics, &stats.AttachmentBytes, &oldest); err != nil {
+		return nil, err
+	} else if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close() // Release the connection before the next query
+	if stats.Messages > 0 {
+		stats.OldestMessage = time.Unix(oldest, 0)
+	}
+	if stats.AttachmentBytesByType, err = c.AttachmentSizeByType(); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+func (c *sqliteCache) count(query string, args ...interface{}) (int, error) {
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var count int
+	if !rows.Next() {
+		return 0, errNoRows
+	}
+	if err := rows.Scan(&count); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Topics returns all topics that currently have messages, including their metadata, see topicMetadata
+func (c *sqliteCache) Topics(excludePrefixes ...string) (map[string]*topic, error) {
+	topics := make(map[string]*topic)
+	err := c.TopicsFunc(func(id string) error {
+		topics[id] = newTopic(id)
+		return nil
+	}, excludePrefixes...)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.readTopicsMetadata(topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// TopicsSince returns all topics with at least one message published since the given time, e.g. to list
+// recently active topics without listing all topics that ever had a message, see Topics
+func (c *sqliteCache) TopicsSince(since time.Time) (map[string]*topic, error) {
+	rows, err := c.db.Query(selectTopicsSinceQuery, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	topics := make(map[string]*topic)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		topics[id] = newTopic(id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if err := c.readTopicsMetadata(topics); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// readTopicsMetadata sets the metadata of the given topics, see topicMetadata
+func (c *sqliteCache) readTopicsMetadata(topics map[string]*topic) error {
+	rows, err := c.db.Query(selectTopicsMetadataQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var metadata topicMetadata
+		if err := rows.Scan(&id, &metadata.LastMessageTime, &metadata.MessageCount, &metadata.DisplayName); err != nil {
+			return err
+		}
+		if t, ok := topics[id]; ok {
+			t.topicMetadata = metadata
+		}
+	}
+	return rows.Err()
+}
+
+func (c *sqliteCache) TopicsFunc(fn func(topic string) error, excludePrefixes ...string) error {
+	where, args := topicsWhereClause(excludePrefixes)
+	rows, err := c.db.Query(fmt.Sprintf(selectTopicsQuery, where), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (c *sqliteCache) TopicCount(excludePrefixes ...string) (int, error) {
+	where, args := topicsWhereClause(excludePrefixes)
+	return c.count(fmt.Sprintf(selectTopicCountQuery, where), args...)
+}
+
+// topicsWhereClause returns a WHERE clause (and its arguments) that excludes all topics
+// starting with one of the given prefixes, or an empty string if there are no prefixes
+func topicsWhereClause(excludePrefixes []string) (string, []interface{}) {
+	if len(excludePrefixes) == 0 {
+		return "", nil
+	}
+	conditions := make([]string, 0, len(excludePrefixes))
+	args := make([]interface{}, 0, len(excludePrefixes))
+	for _, prefix := range excludePrefixes {
+		conditions = append(conditions, `topic NOT LIKE ? ESCAPE '\'`)
+		args = append(args, escapeLike(prefix)+"%")
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// TopicExists returns true if there are messages for the given topic. If the topic filter is enabled,
+// topics that were never written to are answered without querying the database.
+func (c *sqliteCache) TopicExists(topic string) (bool, error) {
+	if c.topicFilter != nil && !c.topicFilter.Test(topic) {
+		return false, nil
+	}
+	rows, err := c.db.Query(selectTopicExistsQuery, topic)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	exists := rows.Next()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// ActiveTopics returns up to limit topics with the most messages published within the window, see topicRate
+func (c *sqliteCache) ActiveTopics(window time.Duration, limit int) ([]*topicRate, error) {
+	now := time.Now()
+	rows, err := c.db.Query(selectActiveTopicsQuery, now.Add(-window).Unix(), now.Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rates := make([]*topicRate, 0)
+	for rows.Next() {
+		var id string
+		var count int
+		if err := rows.Scan(&id, &count); err != nil {
+			return nil, err
+		}
+		rates = append(rates, newTopicRate(id, count, window))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// CumulativeCount returns the cumulative number of published messages of the topic per bucket, see cumulativePoints
+func (c *sqliteCache) CumulativeCount(topic string, bucket time.Duration, from, to time.Time) ([]point, error) {
+	if bucket < time.Second {
+		return nil, errInvalidBucketSize
+	}
+	rows, err := c.db.Query(selectMessageHistogramQuery, from.Unix(), int64(bucket.Seconds()), topic, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	histogram := make(map[int64]int)
+	for rows.Next() {
+		var index int64
+		var count int
+		if err := rows.Scan(&index, &count); err != nil {
+			return nil, err
+		}
+		histogram[index] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return cumulativePoints(histogram, bucket, from, to), nil
+}
+
+// PruneCache deletes the messages older than olderThan from the cache file configured in conf, like the
+// server does periodically with the cache-duration, and returns the number of deleted messages
+func PruneCache(conf *Config, olderThan time.Time) (int64, error) {
+	c, err := newSqliteCache(conf)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	return c.Prune(olderThan, olderThan, nil, nil, nil)
+}
+
+// PruneCacheDryRun returns the number of messages, and their size in bytes, that PruneCache would delete,
+// see sqliteCache.PruneDryRun. It is safe to run this while the server is running.
+func PruneCacheDryRun(conf *Config, olderThan time.Time) (messages int64, bytes int64, err error) {
+	c, err := newSqliteCache(conf)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer c.Close()
+	return c.PruneDryRun(olderThan)
+}
+
+// Prune deletes old messages (see pruneMessages) and returns the number of deleted messages. Since it is
+// called periodically, it also re-syncs the in-memory message counts with the database, see syncMessageCounts.
+func (c *sqliteCache) Prune(olderThan, inactiveOlderThan time.Time, activeTopics []string, perTopic map[string]time.Time, perPriority map[int]time.Time) (int64, error) {
+	deleted, err := c.pruneMessages(olderThan, inactiveOlderThan, activeTopics, perTopic, perPriority)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.syncMessageCounts(); err != nil {
+		return 0, err
+	}
+	if _, err := c.db.Exec(pruneMessageReadsQuery); err != nil {
+		return 0, err
+	}
+	if c.bodies != nil {
+		if err := c.pruneBodies(); err != nil {
+			return 0, err
+		}
+	}
+	return deleted, nil
+}
+
+// PruneDryRun returns the number of messages that Prune would delete with the given cutoff (and no
+// overrides), and the size of their bodies in bytes, without deleting anything. The size is that of the
+// bodies as stored, i.e. compressed, and excludes bodies stored in the body directory (see bodyStore).
+func (c *sqliteCache) PruneDryRun(olderThan time.Time) (messages int64, bytes int64, err error) {
+	if err := c.db.QueryRow(pruneMessagesDryRunQuery, olderThan.Unix()).Scan(&messages, &bytes); err != nil {
+		return 0, 0, err
+	}
+	return messages, bytes, nil
+}
+
+// pruneBodies removes externally stored message bodies that are not referenced by any message anymore
+func (c *sqliteCache) pruneBodies() error {
+	rows, err := c.db.Query(selectBodyRefsQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	refs := make(map[string]bool)
+	for rows.Next() {
+		var ref string
+		if err := rows.Scan(&ref); err != nil {
+			return err
+		}
+		refs[ref] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return c.bodies.removeOrphans(refs)
+}
+
+// pruneMessages deletes old messages. Topics in perTopic are pruned with their own cutoff, and are excluded
+// from the default (and inactive) cutoff, so that they may also keep their messages longer. Likewise, messages
+// of the priorities in perPriority are pruned with their own cutoff, unless their topic is in perTopic.
+func (c *sqliteCache) pruneMessages(olderThan, inactiveOlderThan time.Time, activeTopics []string, perTopic map[string]time.Time, perPriority map[int]time.Time) (int64, error) {
+	if _, err := c.db.Exec(pruneDeliveriesQuery, olderThan.Unix()); err != nil {
+		return 0, err
+	}
+	var deleted int64
+	overridden := make([]string, 0)
+	for topic, topicOlderThan := range perTopic {
+		n, err := c.delete(pruneTopicMessagesQuery, topicOlderThan.Unix(), topic)
+		if err != nil {
+			return 0, err
+		}
+		deleted += n
+		overridden = append(overridden, topic)
+	}
+	n, err := c.pruneMessagesByPriority(perPriority, overridden)
+	if err != nil {
+		return 0, err
+	}
+	deleted += n
+	overriddenPriorities := make([]int, 0)
+	for priority := range perPriority {
+		overriddenPriorities = append(overriddenPriorities, priority)
+	}
+	n, err = c.pruneMessagesExcept(olderThan, overridden, overriddenPriorities)
+	if err != nil {
+		return 0, err
+	}
+	deleted += n
+	if !inactiveOlderThan.After(olderThan) {
+		return deleted, nil
+	}
+	n, err = c.pruneMessagesExcept(inactiveOlderThan, append(overridden, activeTopics...), overriddenPriorities)
+	if err != nil {
+		return 0, err
+	}
+	return deleted + n, nil
+}
+
+// pruneMessagesByPriority deletes old messages with the cutoff of their priority in a single transaction.
+// Messages of the excluded topics are not deleted, since these topics have their own cutoff.
+func (c *sqliteCache) pruneMessagesByPriority(perPriority map[int]time.Time, excludedTopics []string) (int64, error) {
+	if len(perPriority) == 0 {
+		return 0, nil
+	}
+	query, topicArgs := prunePriorityMessagesQuery, make([]interface{}, 0)
+	if len(excludedTopics) > 0 {
+		query += fmt.Sprintf(pruneExceptTopicsClause, sqlPlaceholders(len(excludedTopics)))
+		for _, topic := range excludedTopics {
+			topicArgs = append(topicArgs, topic)
+		}
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var deleted int64
+	for priority, priorityOlderThan := range perPriority {
+		res, err := tx.Exec(query, append([]interface{}{priorityOlderThan.Unix(), priority}, topicArgs...)...)
+		if err != nil {
+			return 0, err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		deleted += affected
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func (c *sqliteCache) pruneMessagesExcept(olderThan time.Time, excludedTopics []string, excludedPriorities []int) (int64, error) {
+	query, args := pruneMessagesQuery, []interface{}{olderThan.Unix()}
+	if len(excludedTopics) > 0 {
+		query += fmt.Sprintf(pruneExceptTopicsClause, sqlPlaceholders(len(excludedTopics)))
+		for _, topic := range excludedTopics {
+			args = append(args, topic)
+		}
+	}
+	if len(excludedPriorities) > 0 {
+		query += fmt.Sprintf(pruneExceptPrioritiesClause, sqlPlaceholders(len(excludedPriorities)))
+		for _, priority := range excludedPriorities {
+			args = append(args, priority)
+		}
+	}
+	return c.delete(query, args...)
+}
+
+// PruneToCount deletes all but the newest maxPerTopic published messages of each topic. Scheduled
+// messages are neither counted nor deleted, and pinned messages are never deleted.
+func (c *sqliteCache) PruneToCount(maxPerTopic int) (int, error) {
+	topics, err := c.Topics()
+	if err != nil {
+		return 0, err
+	}
+	var deleted int
+	for topic := range topics {
+		n, err := c.delete(pruneTopicMessagesToCountQuery, topic, topic, maxPerTopic)
+		if err != nil {
+			return 0, err
+		}
+		deleted += int(n)
+	}
+	if err := c.syncMessageCounts(); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// Compact rebuilds the database file to reclaim the space of deleted messages. This requires an
+// exclusive lock and temporarily as much free disk space as the database size, so it should be
+// used sparingly, e.g. after many messages were pruned.
+func (c *sqliteCache) Compact() error {
+	before, err := c.size()
+	if err != nil {
+		return err
+	}
+	if _, err := c.db.Exec(vacuumQuery); err != nil {
+		return err
+	}
+	after, err := c.size()
+	if err != nil {
+		return err
+	}
+	log.Printf("Compacted cache database, reclaimed %d bytes (%d -> %d bytes)", before-after, before, after)
+	return nil
+}
+
+// size returns the size of the database in bytes, based on the number of pages
+func (c *sqliteCache) size() (int64, error) {
+	pages, err := c.count(pageCountQuery)
+	if err != nil {
+		return 0, err
+	}
+	pageSize, err := c.count(pageSizeQuery)
+	if err != nil {
+		return 0, err
+	}
+	return int64(pages) * int64(pageSize), nil
+}
+
+func (c *sqliteCache) AttachmentsSize(owner string) (int64, error) {
+	rows, err := c.db.Query(selectAttachmentsSizeQuery, owner, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var size int64
+	if !rows.Next() {
+		return 0, errNoRows
+	}
+	if err := rows.Scan(&size); err != nil {
+		return 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// IncrementDownloads atomically increments the download counter of the attachment of the given message.
+// It returns errNoRows if there is no such message, or if it has no attachment.
+func (c *sqliteCache) IncrementDownloads(id string) error {
+	res, err := c.db.Exec(updateAttachmentDownloadsQuery, id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errNoRows
+	}
+	return nil
+}
+
+// DownloadBytes returns the number of attachment bytes that were downloaded from attachments uploaded by
+// the given owner, i.e. the sum of the attachment size times the number of downloads, see IncrementDownloads.
+func (c *sqliteCache) DownloadBytes(owner string) (int64, error) {
+	var bytes int64
+	if err := c.db.QueryRow(selectDownloadBytesQuery, owner).Scan(&bytes); err != nil {
+		return 0, err
+	}
+	return bytes, nil
+}
+
+// ReassignAttachments transfers all attachments of oldOwner to newOwner, e.g. when a user account is deleted.
+func (c *sqliteCache) ReassignAttachments(oldOwner, newOwner string) error {
+	_, err := c.db.Exec(updateAttachmentOwnerQuery, newOwner, oldOwner)
+	return err
+}
+
+// ClearAttachmentOwner anonymizes all attachments of the given owner, so they no longer count towards
+// its AttachmentsSize. The attachments themselves are kept until they expire.
+func (c *sqliteCache) ClearAttachmentOwner(owner string) error {
+	return c.ReassignAttachments(owner, "")
+}
+
+// ClearAttachment removes the attachment from the given message, e.g. after the attachment file expired
+// and was deleted. The message itself is kept. It returns errNoRows if there is no such message.
+func (c *sqliteCache) ClearAttachment(id string) error {
+	res, err := c.db.Exec(clearAttachmentQuery, id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errNoRows
+	}
+	return nil
+}
+
+func (c *sqliteCache) OwnerUsage(owner string, since time.Time) (messages int, attachmentBytes int64, err error) {
+	rows, err := c.db.Query(selectOwnerUsageQuery, owner, owner, owner, owner, since.Unix())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, 0, errNoRows
+	}
+	if err := rows.Scan(&messages, &attachmentBytes); err != nil {
+		return 0, 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	return messages, attachmentBytes, nil
+}
+
+// AttachmentsExpired returns the IDs of all messages with expired attachments. To avoid scanning the table
+// on every call, the scan is skipped until the earliest known attachment expiry has passed. If expired attachments
+// were found, the next call scans again, so that attachments are returned until they are removed with ClearAttachment,
+// e.g. if deleting their files failed.
+func (c *sqliteCache) AttachmentsExpired() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now().Unix()
+	if c.nextAttachmentExpiry > 0 && now <= c.nextAttachmentExpiry {
+		return make([]string, 0), nil
+	}
+	rows, err := c.db.Query(selectAttachmentsExpiredQuery, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	next, err := c.count(selectNextAttachmentExpiry, now)
+	if err != nil {
+		return nil, err
+	} else if len(ids) > 0 {
+		c.nextAttachmentExpiry = 0 // Scan again until they are cleared
+	} else if next == 0 {
+		c.nextAttachmentExpiry = math.MaxInt64
+	} else {
+		c.nextAttachmentExpiry = int64(next)
+	}
+	return ids, nil
+}
+
+func (c *sqliteCache) RewriteAttachmentURLs(oldBase, newBase string) (int, error) {
+	res, err := c.db.Exec(updateAttachmentURLsQuery, oldBase, newBase, escapeLike(oldBase)+"%")
+	if err != nil {
+		return 0, err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(updated), nil
+}
+
+func (c *sqliteCache) MessagesWithMissingAttachments(missing func(url string) bool) ([]*message, error) {
+	rows, err := c.db.Query(selectMessagesWithAttachmentQuery)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.readMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+	broken := make([]*message, 0)
+	for _, m := range messages {
+		if m.Attachment != nil && missing(m.Attachment.URL) {
+			broken = append(broken, m)
+		}
+	}
+	return broken, nil
+}
+
+// MarkRead marks the message as read by the given user, so that it is excluded from queries with
+// messageFilter.UnreadBy. Marking a message as read twice is not an error. It returns errNoRows if
+// there is no such message. Read receipts of deleted messages are removed with the next Prune.
+func (c *sqliteCache) MarkRead(id, user string) error {
+	res, err := c.db.Exec(insertMessageReadQuery, user, id)
+	if err != nil {
+		return err
+	} else if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected > 0 {
+		return nil
+	}
+	exists, err := c.count(selectMessageExistsQuery, id)
+	if err != nil {
+		return err
+	} else if exists == 0 {
+		return errNoRows
+	}
+	return nil // Already read
+}
+
+// SetTopicDisplayName sets the human-readable name of the topic, see topicMetadata. An empty name removes it.
+func (c *sqliteCache) SetTopicDisplayName(topic, name string) error {
+	_, err := c.db.Exec(upsertTopicDisplayNameQuery, topic, name)
+	return err
+}
+
+func (c *sqliteCache) SetTopicSecret(topic, secret string) error {
+	if secret == "" {
+		_, err := c.db.Exec(deleteTopicSecretQuery, topic)
+		return err
+	}
+	hash, err := hashTopicSecret(secret)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(upsertTopicSecretQuery, topic, hash)
+	return err
+}
+
+func (c *sqliteCache) VerifyTopicSecret(topic, secret string) (bool, error) {
+	rows, err := c.db.Query(selectTopicSecretQuery, topic)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return true, rows.Err() // No secret, topic is open
+	}
+	var hash string
+	if err := rows.Scan(&hash); err != nil {
+		return false, err
+	}
+	return verifyTopicSecret(hash, secret), nil
+}
+
+func (c *sqliteCache) AddDelivery(topic string, failed bool) error {
+	_, err := c.db.Exec(insertDeliveryQuery, topic, time.Now().Unix(), failed)
+	return err
+}
+
+func (c *sqliteCache) DeliveryRatio(topic string, since time.Time) (sent, failed int, err error) {
+	rows, err := c.db.Query(selectDeliveryRatioQuery, topic, since.Unix())
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
-	if err := setupDB(db); err != nil {
-		return nil, err
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, 0, errNoRows
+	}
+	if err := rows.Scan(&sent, &failed); err != nil {
+		return 0, 0, err
+	} else if err := rows.Err(); err != nil {
+		return 0, 0, err
 	}
-	return &sqliteCache{
-		db: db,
-	}, nil
+	return sent, failed, nil
 }
 
-func (c *sqliteCache) AddMessage(m *message) error {
-	if m.Event != messageEvent {
-		return errUnexpectedMessageType
-	}
-	published := m.Time <= time.Now().Unix()
-	tags := strings.Join(m.Tags, ",")
-	var attachmentName, attachmentType, attachmentURL, attachmentOwner string
-	var attachmentSize, attachmentExpires int64
-	if m.Attachment != nil {
-		attachmentName = m.Attachment.Name
-		attachmentType = m.Attachment.Type
-		attachmentSize = m.Attachment.Size
-		attachmentExpires = m.Attachment.Expires
-		attachmentURL = m.Attachment.URL
-		attachmentOwner = m.Attachment.Owner
-	}
-	_, err := c.db.Exec(
-		insertMessageQuery,
-		m.ID,
-		m.Time,
-		m.Topic,
-		m.Message,
-		m.Title,
-		m.Priority,
-		tags,
-		m.Click,
-		attachmentName,
-		attachmentType,
-		attachmentSize,
-		attachmentExpires,
-		attachmentURL,
-		attachmentOwner,
-		m.Encoding,
-		published,
-	)
+// BackupFile writes a consistent snapshot of the cache database to destPath, which must not exist yet.
+// This is safe to call while the server is running, i.e. while messages are being written. See Backup.
+func (c *sqliteCache) BackupFile(destPath string) error {
+	_, err := c.db.Exec(backupQuery, destPath)
 	return err
 }
 
-func (c *sqliteCache) Messages(topic string, since sinceTime, scheduled bool) ([]*message, error) {
-	if since.IsNone() {
-		return make([]*message, 0), nil
+// Ping checks that the cache database is reachable and readable. Unlike db.Ping, it reads from the
+// database file, so a corrupt or unreadable file is detected as well.
+func (c *sqliteCache) Ping() error {
+	_, err := c.SchemaVersion()
+	return err
+}
+
+// Close checkpoints the write-ahead log (WAL) into the database file and truncates it, and then closes
+// the database. This leaves a single self-contained file behind. Closing the cache twice is not an error.
+func (c *sqliteCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
 	}
-	var rows *sql.Rows
-	var err error
-	if scheduled {
-		rows, err = c.db.Query(selectMessagesSinceTimeIncludeScheduledQuery, topic, since.Time().Unix())
-	} else {
-		rows, err = c.db.Query(selectMessagesSinceTimeQuery, topic, since.Time().Unix())
+	c.closed = true
+	if c.readOnlyDB != nil {
+		c.readOnlyDB.Close()
 	}
-	if err != nil {
-		return nil, err
+	if _, err := c.db.Exec(checkpointTruncateQuery); err != nil {
+		c.db.Close()
+		return err
 	}
-	return readMessages(rows)
+	return c.db.Close()
 }
 
-func (c *sqliteCache) MessagesDue() ([]*message, error) {
-	rows, err := c.db.Query(selectMessagesDueQuery, time.Now().Unix())
-	if err != nil {
-		return nil, err
+// SchemaVersion returns the schema version of the cache database, see currentSchemaVersion
+func (c *sqliteCache) SchemaVersion() (int, error) {
+	var schemaVersion int
+	if err := c.db.QueryRow(selectSchemaVersionQuery).Scan(&schemaVersion); err != nil {
+		return 0, err
 	}
-	return readMessages(rows)
-}
-
-func (c *sqliteCache) MarkPublished(m *message) error {
-	_, err := c.db.Exec(updateMessagePublishedQuery, m.ID)
-	return err
+	return schemaVersion, nil
 }
 
-func (c *sqliteCache) MessageCount(topic string) (int, error) {
-	rows, err := c.db.Query(selectMessageCountForTopicQuery, topic)
+// QueryRaw runs a read-only SQL query against the cache database, e.g. for reporting. The query runs on a separate
+// connection that is opened with mode=ro, so any attempt to write fails. The caller must consume and close the
+// returned rows, since the connection is blocked until they are closed. In-memory databases are not supported.
+func (c *sqliteCache) QueryRaw(query string, args ...interface{}) (*sql.Rows, error) {
+	db, err := c.openReadOnly()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	defer rows.Close()
-	var count int
-	if !rows.Next() {
-		return 0, errors.New("no rows found")
+	return db.Query(query, args...)
+}
+
+func (c *sqliteCache) openReadOnly() (*sqliteDB, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readOnlyDB != nil {
+		return c.readOnlyDB, nil
+	} else if c.readOnlyDSN == "" {
+		return nil, errReadOnlyMemoryDB
 	}
-	if err := rows.Scan(&count); err != nil {
-		return 0, err
-	} else if err := rows.Err(); err != nil {
-		return 0, err
+	db, err := openSqliteDB(c.readOnlyDSN, c.key)
+	if err != nil {
+		return nil, err
 	}
-	return count, nil
+	c.readOnlyDB = &sqliteDB{DB: db, prefix: c.db.prefix}
+	return c.readOnlyDB, nil
 }
 
-func (c *sqliteCache) Topics() (map[string]*topic, error) {
-	rows, err := c.db.Query(selectTopicsQuery)
+// Diagnose checks the consistency of the cache database and returns a report of all inconsistencies.
+// It does not modify any data.
+func (c *sqliteCache) Diagnose() (*cacheReport, error) {
+	report := &cacheReport{
+		ExpectedSchemaVersion: currentSchemaVersion,
+		IntegrityErrors:       make([]string, 0),
+	}
+	var err error
+	if report.SchemaVersion, err = c.count(selectSchemaVersionQuery); err != nil {
+		return nil, err
+	}
+	rows, err := c.db.Query(integrityCheckQuery)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	topics := make(map[string]*topic)
 	for rows.Next() {
-		var id string
-		if err := rows.Scan(&id); err != nil {
+		var result string
+		if err := rows.Scan(&result); err != nil {
 			return nil, err
+		} else if result != "ok" {
+			report.IntegrityErrors = append(report.IntegrityErrors, result)
 		}
-		topics[id] = newTopic(id)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-	return topics, nil
-}
-
-func (c *sqliteCache) Prune(olderThan time.Time) error {
-	_, err := c.db.Exec(pruneMessagesQuery, olderThan.Unix())
-	return err
+	rows.Close()
+	if report.OrphanedAttachments, err = c.count(selectOrphanedAttachmentsCountQuery); err != nil {
+		return nil, err
+	}
+	if report.DuplicateIDs, err = c.count(selectDuplicateIDsCountQuery); err != nil {
+		return nil, err
+	}
+	if c.bodies != nil {
+		if report.MissingBodies, err = c.countMissingBodies(); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
 }
 
-func (c *sqliteCache) AttachmentsSize(owner string) (int64, error) {
-	rows, err := c.db.Query(selectAttachmentsSizeQuery, owner, time.Now().Unix())
+func (c *sqliteCache) countMissingBodies() (int, error) {
+	rows, err := c.db.Query(selectBodyRefsQuery)
 	if err != nil {
 		return 0, err
 	}
 	defer rows.Close()
-	var size int64
-	if !rows.Next() {
-		return 0, errors.New("no rows found")
+	var missing int
+	for rows.Next() {
+		var ref string
+		if err := rows.Scan(&ref); err != nil {
+			return 0, err
+		}
+		if !c.bodies.Exists(ref) {
+			missing++
+		}
 	}
-	if err := rows.Scan(&size); err != nil {
-		return 0, err
-	} else if err := rows.Err(); err != nil {
-		return 0, err
+	return missing, rows.Err()
+}
+
+// filterClause translates the filter into additional SQL conditions (starting with " AND") and their arguments.
+// It must be kept consistent with messageFilter.matches.
+func filterClause(f *messageFilter) (string, []interface{}) {
+	var clause strings.Builder
+	args := make([]interface{}, 0)
+	events := f.events()
+	clause.WriteString(" AND event IN (" + sqlPlaceholders(len(events)) + ")")
+	for _, event := range events {
+		args = append(args, event)
 	}
-	return size, nil
+	if f == nil {
+		return clause.String(), args
+	}
+	if f.MinPriority > 0 {
+		clause.WriteString(" AND (CASE WHEN priority = 0 THEN 3 ELSE priority END) >= ?")
+		args = append(args, f.MinPriority)
+	}
+	if f.Until > 0 {
+		clause.WriteString(" AND time <= ?")
+		args = append(args, f.Until)
+	}
+	if f.TitleContains != "" {
+		clause.WriteString(` AND title LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(f.TitleContains)+"%")
+	}
+	for _, tag := range f.Tags {
+		clause.WriteString(` AND (',' || tags || ',') LIKE ? ESCAPE '\'`)
+		args = append(args, "%,"+escapeLike(tag)+",%")
+	}
+	if f.UnreadBy != "" {
+		clause.WriteString(unreadByClause)
+		args = append(args, f.UnreadBy)
+	}
+	return clause.String(), args
 }
 
-func (c *sqliteCache) AttachmentsExpired() ([]string, error) {
-	rows, err := c.db.Query(selectAttachmentsExpiredQuery, time.Now().Unix())
+// escapeLike escapes the wildcard characters of a LIKE pattern, so that s is matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// readMessages reads all messages from rows, and loads externally stored message bodies
+func (c *sqliteCache) readMessages(rows *sql.Rows) ([]*message, error) {
+	messages, err := readMessages(rows)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	ids := make([]string, 0)
-	for rows.Next() {
-		var id string
-		if err := rows.Scan(&id); err != nil {
+	for _, m := range messages {
+		if err := c.readBody(m); err != nil {
 			return nil, err
 		}
-		ids = append(ids, id)
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	return messages, nil
+}
+
+// readBody loads the externally stored body of the message, if any, see bodyStore
+func (c *sqliteCache) readBody(m *message) error {
+	if m.bodyRef == "" || c.bodies == nil {
+		return nil
 	}
-	return ids, nil
+	var err error
+	m.Message, err = c.bodies.Read(m.bodyRef)
+	return err
 }
 
 func readMessages(rows *sql.Rows) ([]*message, error) {
 	defer rows.Close()
 	messages := make([]*message, 0)
 	for rows.Next() {
-		var timestamp, attachmentSize, attachmentExpires int64
-		var priority int
-		var id, topic, msg, title, tagsStr, click, attachmentName, attachmentType, attachmentURL, attachmentOwner, encoding string
-		err := rows.Scan(
-			&id,
-			&timestamp,
-			&topic,
-			&msg,
-			&title,
-			&priority,
-			&tagsStr,
-			&click,
-			&attachmentName,
-			&attachmentType,
-			&attachmentSize,
-			&attachmentExpires,
-			&attachmentURL,
-			&attachmentOwner,
-			&encoding,
-		)
+		m, err := readMessage(rows)
 		if err != nil {
 			return nil, err
 		}
-		var tags []string
-		if tagsStr != "" {
-			tags = strings.Split(tagsStr, ",")
-		}
-		var att *attachment
-		if attachmentName != "" && attachmentURL != "" {
-			att = &attachment{
-				Name:    attachmentName,
-				Type:    attachmentType,
-				Size:    attachmentSize,
-				Expires: attachmentExpires,
-				URL:     attachmentURL,
-				Owner:   attachmentOwner,
-			}
-		}
-		messages = append(messages, &message{
-			ID:         id,
-			Time:       timestamp,
-			Event:      messageEvent,
-			Topic:      topic,
-			Message:    msg,
-			Title:      title,
-			Priority:   priority,
-			Tags:       tags,
-			Click:      click,
-			Attachment: att,
-			Encoding:   encoding,
-		})
+		messages = append(messages, m)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -340,13 +2655,120 @@ func readMessages(rows *sql.Rows) ([]*message, error) {
 	return messages, nil
 }
 
-func setupDB(db *sql.DB) error {
-	// If 'messages' table does not exist, this must be a new database
-	rowsMC, err := db.Query(selectMessagesCountQuery)
+// readMessage scans the current row of rows into a message. It does not load externally stored message bodies.
+func readMessage(rows *sql.Rows) (*message, error) {
+	var timestamp, attachmentSize, attachmentExpires, attachmentDownloads, edited, sequence int64
+	var priority int
+	var pinned, published bool
+	var lat, lon sql.NullFloat64
+	var id, topic, msg, title, tagsStr, click, attachmentName, attachmentType, attachmentURL, attachmentOwner, encoding, email, owner, bodyRef, prioritySource, actionsStr, icon, contentType, event, sender string
+	err := rows.Scan(
+		&id,
+		&timestamp,
+		&topic,
+		&msg,
+		&title,
+		&priority,
+		&tagsStr,
+		&click,
+		&attachmentName,
+		&attachmentType,
+		&attachmentSize,
+		&attachmentExpires,
+		&attachmentURL,
+		&attachmentOwner,
+		&encoding,
+		&email,
+		&lat,
+		&lon,
+		&owner,
+		&bodyRef,
+		&pinned,
+		&prioritySource,
+		&edited,
+		&actionsStr,
+		&icon,
+		&contentType,
+		&attachmentDownloads,
+		&event,
+		&published,
+		&sequence,
+		&sender,
+	)
 	if err != nil {
+		return nil, err
+	}
+	if encoding == encodingGzip {
+		if msg, err = decompressBody(msg); err != nil {
+			return nil, err
+		}
+		encoding = ""
+	}
+	var tags []string
+	if tagsStr != "" {
+		tags = strings.Split(tagsStr, ",")
+	}
+	var actions []*action
+	if actionsStr != "" {
+		if err := json.Unmarshal([]byte(actionsStr), &actions); err != nil {
+			return nil, err
+		}
+	}
+	var att *attachment
+	if attachmentName != "" && attachmentURL != "" {
+		att = &attachment{
+			Name:      attachmentName,
+			Type:      attachmentType,
+			Size:      attachmentSize,
+			Expires:   attachmentExpires,
+			URL:       attachmentURL,
+			Owner:     attachmentOwner,
+			Downloads: attachmentDownloads,
+		}
+	}
+	m := &message{
+		ID:             id,
+		Time:           timestamp,
+		Event:          event,
+		Topic:          topic,
+		Message:        msg,
+		Title:          title,
+		Priority:       priority,
+		Tags:           tags,
+		Click:          click,
+		Actions:        actions,
+		Icon:           icon,
+		Attachment:     att,
+		Encoding:       encoding,
+		ContentType:    contentType,
+		Email:          email,
+		Owner:          owner,
+		bodyRef:        bodyRef,
+		Pinned:         pinned,
+		PrioritySource: prioritySource,
+		Edited:         edited,
+		Published:      published,
+		Sender:         sender,
+		sequence:       sequence,
+	}
+	if lat.Valid && lon.Valid {
+		m.Lat = &lat.Float64
+		m.Lon = &lon.Float64
+	}
+	return m, nil
+}
+
+// setupDB creates or migrates the database schema. If backupFile is set, a copy of the database
+// is written to it before any migration is performed, so that a failed migration can be rolled back.
+func setupDB(db *sqliteDB, backupFile string) error {
+	// If 'messages' table does not exist, this must be a new database. Errors are not taken as a sign of
+	// a new database, since running setupNewDB on a damaged database makes things worse.
+	var messagesTables int
+	if err := db.QueryRow(selectMessagesTableExistsQuery).Scan(&messagesTables); err != nil {
+		return toCorruptError(err)
+	} else if messagesTables == 0 {
 		return setupNewDB(db)
 	}
-	rowsMC.Close()
 
 	// If 'messages' table exists, check 'schemaVersion' table
 	schemaVersion := 0
@@ -362,6 +2784,19 @@ func setupDB(db *sql.DB) error {
 		rowsSV.Close()
 	}
 
+	// Refuse to touch a database written by a newer version; we do not know its schema
+	if schemaVersion > currentSchemaVersion {
+		return fmt.Errorf("%w: schema version is %d, this version of ntfy supports up to %d", errCacheTooNew, schemaVersion, currentSchemaVersion)
+	}
+
+	// Back up database before migrating
+	if schemaVersion < currentSchemaVersion && backupFile != "" {
+		log.Printf("Backing up cache database to %s before migration", backupFile)
+		if _, err := db.Exec(backupQuery, backupFile); err != nil {
+			return err
+		}
+	}
+
 	// Do migrations
 	if schemaVersion == currentSchemaVersion {
 		return nil
@@ -373,65 +2808,363 @@ func setupDB(db *sql.DB) error {
 		return migrateFrom2(db)
 	} else if schemaVersion == 3 {
 		return migrateFrom3(db)
+	} else if schemaVersion == 4 {
+		return migrateFrom4(db)
+	} else if schemaVersion == 5 {
+		return migrateFrom5(db)
+	} else if schemaVersion == 6 {
+		return migrateFrom6(db)
+	} else if schemaVersion == 7 {
+		return migrateFrom7(db)
+	} else if schemaVersion == 8 {
+		return migrateFrom8(db)
+	} else if schemaVersion == 9 {
+		return migrateFrom9(db)
+	} else if schemaVersion == 10 {
+		return migrateFrom10(db)
+	} else if schemaVersion == 11 {
+		return migrateFrom11(db)
+	} else if schemaVersion == 12 {
+		return migrateFrom12(db)
+	} else if schemaVersion == 13 {
+		return migrateFrom13(db)
+	} else if schemaVersion == 14 {
+		return migrateFrom14(db)
+	} else if schemaVersion == 15 {
+		return migrateFrom15(db)
+	} else if schemaVersion == 16 {
+		return migrateFrom16(db)
+	} else if schemaVersion == 17 {
+		return migrateFrom17(db)
+	} else if schemaVersion == 18 {
+		return migrateFrom18(db)
+	} else if schemaVersion == 19 {
+		return migrateFrom19(db)
+	} else if schemaVersion == 20 {
+		return migrateFrom20(db)
+	} else if schemaVersion == 21 {
+		return migrateFrom21(db)
+	} else if schemaVersion == 22 {
+		return migrateFrom22(db)
+	} else if schemaVersion == 23 {
+		return migrateFrom23(db)
+	} else if schemaVersion == 24 {
+		return migrateFrom24(db)
+	} else if schemaVersion == 25 {
+		return migrateFrom25(db)
+	} else if schemaVersion == 26 {
+		return migrateFrom26(db)
 	}
 	return fmt.Errorf("unexpected schema version found: %d", schemaVersion)
 }
 
-func setupNewDB(db *sql.DB) error {
-	if _, err := db.Exec(createMessagesTableQuery); err != nil {
+// setupNewDB creates all tables in a single transaction, so that an interrupted setup does not leave behind
+// a messages table without schemaVersion table, which would be mistaken for schema version 0
+func setupNewDB(db *sqliteDB) error {
+	tx, err := db.Begin()
+	if err != nil {
 		return err
 	}
-	if _, err := db.Exec(createSchemaVersionTableQuery); err != nil {
+	defer tx.Rollback()
+	if _, err := tx.Exec(createMessagesTableQuery); err != nil {
 		return err
 	}
-	if _, err := db.Exec(insertSchemaVersion, currentSchemaVersion); err != nil {
+	if _, err := tx.Exec(createTopicSecretsTableQuery); err != nil {
 		return err
 	}
-	return nil
+	if _, err := tx.Exec(createDeliveriesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(createTopicsTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(createMessageReadsTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(createSchemaVersionTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(insertSchemaVersion, currentSchemaVersion); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrationLogEntry is logged as JSON after every schema migration step, so that upgrades of
+// large cache files can be monitored by log aggregators, see logMigration
+type migrationLogEntry struct {
+	FromVersion  int   `json:"from_version"`
+	ToVersion    int   `json:"to_version"`
+	DurationMs   int64 `json:"duration_ms"`
+	RowsMigrated int64 `json:"rows_migrated"`
+}
+
+// logMigration logs the migration step from the given schema version, which started at the given time,
+// and the number of rows that its INSERT, UPDATE and DELETE statements changed, see migrate
+func logMigration(from int, started time.Time, rowsMigrated int64) {
+	entry := &migrationLogEntry{
+		FromVersion:  from,
+		ToVersion:    from + 1,
+		DurationMs:   time.Since(started).Milliseconds(),
+		RowsMigrated: rowsMigrated,
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	log.Print(string(b))
 }
 
-func migrateFrom0(db *sql.DB) error {
-	log.Print("Migrating cache database schema: from 0 to 1")
-	if _, err := db.Exec(migrate0To1AlterMessagesTableQuery); err != nil {
+// migrate runs a migration step from the given schema version: it executes the statements of the queries and
+// updates the schema version in a single transaction. If the process is killed in the middle of a migration,
+// the database is left at the previous schema version, and the step is simply repeated on the next start.
+//
+// Older versions of ntfy did not run the migration and the version update in one transaction, so a database
+// may already have columns that its schema version does not know about. Columns that already exist are not
+// added again (see columnExists), and all other statements of the migrations can safely be repeated.
+func migrate(db *sqliteDB, from int, queries ...string) error {
+	log.Printf("Migrating cache database schema: from %d to %d", from, from+1)
+	start := time.Now()
+	tx, err := db.Begin()
+	if err != nil {
 		return err
 	}
-	if _, err := db.Exec(createSchemaVersionTableQuery); err != nil {
+	defer tx.Rollback()
+	var rowsMigrated int64
+	for _, query := range queries {
+		for _, statement := range strings.Split(query, ";") { // Migrations do not contain semicolons in strings
+			statement = strings.TrimSpace(statement)
+			if statement == "" {
+				continue
+			}
+			if matches := addColumnRegex.FindStringSubmatch(statement); matches != nil {
+				if exists, err := columnExists(tx, matches[1], matches[2]); err != nil {
+					return err
+				} else if exists {
+					continue
+				}
+			}
+			res, err := tx.Exec(statement)
+			if err != nil {
+				return err
+			}
+			if dataRegex.MatchString(statement) { // SQLite does not reset the number of changes for other statements
+				rows, err := res.RowsAffected()
+				if err != nil {
+					return err
+				}
+				rowsMigrated += rows
+			}
+		}
+	}
+	if from == 0 {
+		_, err = tx.Exec(insertSchemaVersion, 1) // Schema version 0 has no schemaVersion table, it is created by the migration
+	} else {
+		_, err = tx.Exec(updateSchemaVersion, from+1)
+	}
+	if err != nil {
 		return err
 	}
-	if _, err := db.Exec(insertSchemaVersion, 1); err != nil {
+	if err := tx.Commit(); err != nil {
 		return err
 	}
-	return migrateFrom1(db)
+	logMigration(from, start, rowsMigrated)
+	return nil
+}
+
+// columnExists returns true if the table has a column with the given name, see migrate
+func columnExists(tx *sqliteTx, table, column string) (bool, error) {
+	var count int
+	if err := tx.QueryRow(fmt.Sprintf(selectColumnExistsQuery, table), column).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
 }
 
-func migrateFrom1(db *sql.DB) error {
-	log.Print("Migrating cache database schema: from 1 to 2")
-	if _, err := db.Exec(migrate1To2AlterMessagesTableQuery); err != nil {
+func migrateFrom0(db *sqliteDB) error {
+	if err := migrate(db, 0, migrate0To1AlterMessagesTableQuery, createSchemaVersionTableQuery); err != nil {
 		return err
 	}
-	if _, err := db.Exec(updateSchemaVersion, 2); err != nil {
+	return migrateFrom1(db)
+}
+
+func migrateFrom1(db *sqliteDB) error {
+	if err := migrate(db, 1, migrate1To2AlterMessagesTableQuery); err != nil {
 		return err
 	}
 	return migrateFrom2(db)
 }
 
-func migrateFrom2(db *sql.DB) error {
-	log.Print("Migrating cache database schema: from 2 to 3")
-	if _, err := db.Exec(migrate2To3AlterMessagesTableQuery); err != nil {
+func migrateFrom2(db *sqliteDB) error {
+	if err := migrate(db, 2, migrate2To3AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom3(db)
+}
+
+func migrateFrom3(db *sqliteDB) error {
+	if err := migrate(db, 3, migrate3To4AlterMessagesTableQuery); err != nil {
 		return err
 	}
-	if _, err := db.Exec(updateSchemaVersion, 3); err != nil {
+	return migrateFrom4(db)
+}
+
+func migrateFrom4(db *sqliteDB) error {
+	if err := migrate(db, 4, migrate4To5AlterMessagesTableQuery); err != nil {
 		return err
 	}
-	return migrateFrom3(db)
+	return migrateFrom5(db)
+}
+
+func migrateFrom5(db *sqliteDB) error {
+	if err := migrate(db, 5, migrate5To6CreateTopicSecretsTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom6(db)
+}
+
+func migrateFrom6(db *sqliteDB) error {
+	if err := migrate(db, 6, migrate6To7AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom7(db)
+}
+
+func migrateFrom7(db *sqliteDB) error {
+	if err := migrate(db, 7, migrate7To8CreateDeliveriesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom8(db)
+}
+
+func migrateFrom8(db *sqliteDB) error {
+	if err := migrate(db, 8, migrate8To9AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom9(db)
+}
+
+func migrateFrom9(db *sqliteDB) error {
+	if err := migrate(db, 9, migrate9To10AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom10(db)
+}
+
+func migrateFrom10(db *sqliteDB) error {
+	if err := migrate(db, 10, migrate10To11AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom11(db)
+}
+
+func migrateFrom11(db *sqliteDB) error {
+	if err := migrate(db, 11, migrate11To12AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom12(db)
+}
+
+func migrateFrom12(db *sqliteDB) error {
+	if err := migrate(db, 12, migrate12To13AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom13(db)
+}
+
+func migrateFrom13(db *sqliteDB) error {
+	if err := migrate(db, 13, migrate13To14AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom14(db)
+}
+
+func migrateFrom14(db *sqliteDB) error {
+	if err := migrate(db, 14, migrate14To15AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom15(db)
+}
+
+func migrateFrom15(db *sqliteDB) error {
+	if err := migrate(db, 15, migrate15To16AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom16(db)
+}
+
+func migrateFrom16(db *sqliteDB) error {
+	if err := migrate(db, 16, migrate16To17AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom17(db)
+}
+
+func migrateFrom17(db *sqliteDB) error {
+	if err := migrate(db, 17, migrate17To18AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom18(db)
+}
+
+func migrateFrom18(db *sqliteDB) error {
+	if err := migrate(db, 18, migrate18To19AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom19(db)
+}
+
+func migrateFrom19(db *sqliteDB) error {
+	if err := migrate(db, 19, migrate19To20AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom20(db)
+}
+
+func migrateFrom20(db *sqliteDB) error {
+	if err := migrate(db, 20, migrate20To21AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom21(db)
+}
+
+func migrateFrom21(db *sqliteDB) error {
+	if err := migrate(db, 21, migrate21To22AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom22(db)
+}
+
+func migrateFrom22(db *sqliteDB) error {
+	if err := migrate(db, 22, migrate22To23AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom23(db)
+}
+
+func migrateFrom23(db *sqliteDB) error {
+	if err := migrate(db, 23, migrate23To24CreateTopicsTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom24(db)
+}
+
+func migrateFrom24(db *sqliteDB) error {
+	if err := migrate(db, 24, migrate24To25AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	return migrateFrom25(db)
 }
 
-func migrateFrom3(db *sql.DB) error {
-	log.Print("Migrating cache database schema: from 3 to 4")
-	if _, err := db.Exec(migrate3To4AlterMessagesTableQuery); err != nil {
+func migrateFrom25(db *sqliteDB) error {
+	if err := migrate(db, 25, migrate25To26CreateMessageReadsTableQuery); err != nil {
 		return err
 	}
-	if _, err := db.Exec(updateSchemaVersion, 4); err != nil {
+	return migrateFrom26(db)
+}
+
+func migrateFrom26(db *sqliteDB) error {
+	if err := migrate(db, 26, migrate26To27AlterMessagesTableQuery); err != nil {
 		return err
 	}
 	return nil // Update this when a new version is added
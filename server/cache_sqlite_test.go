@@ -1,10 +1,18 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/require"
+	"log"
+	"math"
+	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -13,24 +21,976 @@ func TestSqliteCache_Messages(t *testing.T) {
 	testCacheMessages(t, newSqliteTestCache(t))
 }
 
+func TestSqliteCache_MessagesLimit(t *testing.T) {
+	testCacheMessagesLimit(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MessagesContextCanceled(t *testing.T) {
+	testCacheMessagesContextCanceled(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MessagesFilter(t *testing.T) {
+	testCacheMessagesFilter(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MessagesFilterTagsExact(t *testing.T) {
+	testCacheMessagesFilterTagsExact(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MessagesMulti(t *testing.T) {
+	testCacheMessagesMulti(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_Stats(t *testing.T) {
+	testCacheStats(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MessagesSinceID(t *testing.T) {
+	testCacheMessagesSinceID(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MessagesSinceIDScheduled(t *testing.T) {
+	testCacheMessagesSinceIDScheduled(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_AddMessages(t *testing.T) {
+	testCacheAddMessages(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_Dedup(t *testing.T) {
+	testCacheDedup(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_IdempotencyKey(t *testing.T) {
+	testCacheIdempotencyKey(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MessageExists(t *testing.T) {
+	testCacheMessageExists(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_UpdateMessage(t *testing.T) {
+	testCacheUpdateMessage(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_Actions(t *testing.T) {
+	testCacheActions(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_Icon(t *testing.T) {
+	testCacheIcon(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_ContentType(t *testing.T) {
+	testCacheContentType(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_AttachmentDownloads(t *testing.T) {
+	testCacheAttachmentDownloads(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_AttachmentOwner(t *testing.T) {
+	testCacheAttachmentOwner(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_Events(t *testing.T) {
+	testCacheEvents(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MessagesFunc(t *testing.T) {
+	testCacheMessagesFunc(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MessagesFuncDoesNotHoldConnection(t *testing.T) {
+	conf := NewConfig()
+	conf.CacheFile = newSqliteTestCacheFile(t)
+	conf.CacheMaxOpenConns = 1
+	c := newSqliteTestCacheFromConfig(t, conf)
+	messages := make([]*message, 0)
+	for i := 0; i < 2*messagesFuncBatchSize+10; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = int64(1000 + i)
+		messages = append(messages, m)
+	}
+	require.Nil(t, c.AddMessages(messages))
+
+	// fn uses the only connection of the pool, which would block forever if the rows were still open
+	received := make([]string, 0)
+	desc := &messageFilter{Order: orderDesc}
+	require.Nil(t, c.MessagesFuncContext(context.Background(), "mytopic", sinceAllMessages, false, desc, func(m *message) error {
+		count, err := c.ScheduledCountForTopic("mytopic")
+		if err != nil {
+			return err
+		}
+		require.Equal(t, 0, count)
+		received = append(received, m.Message)
+		return nil
+	}))
+	require.Equal(t, len(messages), len(received))
+	require.Equal(t, fmt.Sprintf("message %d", len(messages)-1), received[0])
+	require.Equal(t, "message 0", received[len(received)-1])
+}
+
+func TestSqliteCache_TopicMetadata(t *testing.T) {
+	testCacheTopicMetadata(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_AddMessagePublished(t *testing.T) {
+	testCacheAddMessagePublished(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_ReadPublished(t *testing.T) {
+	testCacheReadPublished(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MarkPublishedBatch(t *testing.T) {
+	testCacheMarkPublishedBatch(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MessagesBetween(t *testing.T) {
+	testCacheMessagesBetween(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MarkRead(t *testing.T) {
+	testCacheMarkRead(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_Close(t *testing.T) {
+	testCacheClose(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_CloseCheckpointsWAL(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	for i := 0; i < 100; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))))
+	}
+	stat, err := os.Stat(filename + "-wal")
+	require.Nil(t, err)
+	require.Greater(t, stat.Size(), int64(0))
+
+	require.Nil(t, c.Close())
+	stat, err = os.Stat(filename + "-wal")
+	if err == nil {
+		require.Equal(t, int64(0), stat.Size())
+	} else {
+		require.True(t, os.IsNotExist(err))
+	}
+
+	c = newSqliteTestCacheFromFile(t, filename)
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 100, count)
+}
+
+func TestSqliteCache_MessageCount(t *testing.T) {
+	testCacheMessageCount(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MessageCountReconciled(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my message")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my other message")))
+
+	// Counts are seeded from the database on startup
+	c = newSqliteTestCacheFromFile(t, filename)
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+
+	// Out-of-band deletes are picked up with the next prune
+	_, err = c.db.Exec(`DELETE FROM messages WHERE message = 'my message'`)
+	require.Nil(t, err)
+	count, err = c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+	_, err = c.Prune(time.Unix(0, 0), time.Unix(0, 0), nil, nil, nil)
+	require.Nil(t, err)
+	count, err = c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestSqliteCache_MessagesByIDs(t *testing.T) {
+	testCacheMessagesByIDs(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_LatestMessage(t *testing.T) {
+	testCacheLatestMessage(t, newSqliteTestCache(t))
+}
+
 func TestSqliteCache_MessagesScheduled(t *testing.T) {
 	testCacheMessagesScheduled(t, newSqliteTestCache(t))
 }
 
-func TestSqliteCache_Topics(t *testing.T) {
-	testCacheTopics(t, newSqliteTestCache(t))
+func TestSqliteCache_MessagesSameSecondOrder(t *testing.T) {
+	testCacheMessagesSameSecondOrder(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MessagesOrder(t *testing.T) {
+	testCacheMessagesOrder(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_RecomputePublished(t *testing.T) {
+	testCacheRecomputePublished(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_AllScheduledMessages(t *testing.T) {
+	testCacheAllScheduledMessages(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_PendingScheduled(t *testing.T) {
+	testCachePendingScheduled(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_Topics(t *testing.T) {
+	testCacheTopics(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_TopicsSince(t *testing.T) {
+	testCacheTopicsSince(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_TopicsFunc(t *testing.T) {
+	testCacheTopicsFunc(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_TopicsExcludePrefix(t *testing.T) {
+	testCacheTopicsExcludePrefix(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_TopicExists(t *testing.T) {
+	testCacheTopicExists(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_TopicExistsWithFilter(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	require.Nil(t, c.AddMessage(newDefaultMessage("oldtopic", "written before the filter was enabled")))
+
+	conf := NewConfig()
+	conf.CacheFile = filename
+	conf.CacheTopicFilterSize = 1000
+	c = newSqliteTestCacheFromConfig(t, conf)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my example message")))
+
+	// Never written: definitive "no" from the filter, without querying the database
+	require.False(t, c.topicFilter.Test("nevertopic"))
+	exists, err := c.TopicExists("nevertopic")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	// Written (before or after startup): possible positive, confirmed by the database
+	for _, topic := range []string{"oldtopic", "mytopic"} {
+		require.True(t, c.topicFilter.Test(topic))
+		exists, err = c.TopicExists(topic)
+		require.Nil(t, err)
+		require.True(t, exists)
+	}
+
+	// Pruned: filter still says "maybe", but the database query says "no"
+	_, err = c.Prune(time.Now().Add(time.Hour), time.Time{}, nil, nil, nil)
+	require.Nil(t, err)
+	require.True(t, c.topicFilter.Test("mytopic"))
+	exists, err = c.TopicExists("mytopic")
+	require.Nil(t, err)
+	require.False(t, exists)
+}
+
+func TestSqliteCache_ActiveTopics(t *testing.T) {
+	testCacheActiveTopics(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_CumulativeCount(t *testing.T) {
+	testCacheCumulativeCount(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MessagesTagsPrioAndTitle(t *testing.T) {
+	testCacheMessagesTagsPrioAndTitle(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_PrioritySource(t *testing.T) {
+	testCachePrioritySource(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_Prune(t *testing.T) {
+	testCachePrune(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_PruneDryRun(t *testing.T) {
+	testCachePruneDryRun(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_PruneInactive(t *testing.T) {
+	testCachePruneInactive(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_PrunePerTopic(t *testing.T) {
+	testCachePrunePerTopic(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_PrunePerPriority(t *testing.T) {
+	testCachePrunePerPriority(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_PruneToCount(t *testing.T) {
+	testCachePruneToCount(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_PinnedMessages(t *testing.T) {
+	testCachePinnedMessages(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_DeleteMessages(t *testing.T) {
+	testCacheDeleteMessages(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_PublishedBetween(t *testing.T) {
+	testCachePublishedBetween(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_Attachments(t *testing.T) {
+	testCacheAttachments(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_ClearAttachment(t *testing.T) {
+	testCacheClearAttachment(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_Metrics(t *testing.T) {
+	metrics := &recordingCacheMetrics{}
+	conf := NewConfig()
+	conf.CacheFile = newSqliteTestCacheFile(t)
+	conf.CacheMetrics = metrics
+	testCacheMetrics(t, newSqliteTestCacheFromConfig(t, conf), metrics)
+}
+
+func TestSqliteCache_OwnerUsage(t *testing.T) {
+	testCacheOwnerUsage(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_RewriteAttachmentURLs(t *testing.T) {
+	testCacheRewriteAttachmentURLs(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MessagesWithMissingAttachments(t *testing.T) {
+	testCacheMessagesWithMissingAttachments(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_TopicSecrets(t *testing.T) {
+	testCacheTopicSecrets(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_EncodedPayloadTooLarge(t *testing.T) {
+	testCacheEncodedPayloadTooLarge(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MessageTooLarge(t *testing.T) {
+	testCacheMessageTooLarge(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_EncodingBreakdown(t *testing.T) {
+	testCacheEncodingBreakdown(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_AttachmentSizeByType(t *testing.T) {
+	testCacheAttachmentSizeByType(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_TagLimits(t *testing.T) {
+	conf := NewConfig()
+	conf.CacheFile = newSqliteTestCacheFile(t)
+	conf.MessageTagsLimit = 3
+	conf.MessageTagLengthLimit = 5
+	testCacheTagLimits(t, newSqliteTestCacheFromConfig(t, conf))
+}
+
+func TestSqliteCache_Email(t *testing.T) {
+	testCacheEmail(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_DeliveryRatio(t *testing.T) {
+	testCacheDeliveryRatio(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_Location(t *testing.T) {
+	testCacheLocation(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_DurableMessage(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	m := newDefaultMessage("mytopic", "must not get lost")
+	m.Durable = true
+	require.Nil(t, c.AddMessage(m))
+
+	// Open a second cache on the same file without closing the first one (simulated crash)
+	c2 := newSqliteTestCacheFromFile(t, filename)
+	messages, err := c2.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "must not get lost", messages[0].Message)
+}
+
+func TestSqliteCache_ReadDuringWriteTransaction(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	c2 := newSqliteTestCacheFromFile(t, filename)
+
+	var journalMode string
+	require.Nil(t, c.db.QueryRow("PRAGMA journal_mode").Scan(&journalMode))
+	require.Equal(t, "wal", journalMode)
+
+	// Keep a write transaction open on the first connection, and read via the second one
+	tx, err := c.db.Begin()
+	require.Nil(t, err)
+	_, err = tx.Exec("INSERT INTO messages (id, time, topic, message, title, priority, tags, click, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_owner, encoding, published, published_at, email, owner, body_ref, pinned, priority_source, dedup_hash, idempotency_key, edited, actions, icon, content_type, attachment_downloads, event, sender, sequence) VALUES ('abc', 1, 'mytopic', 'hi', '', 0, '', '', '', '', 0, 0, '', '', '', 1, 1, '', '', '', 0, '', '', '', 0, '', '', 'text/plain', 0, 'message', '', 1)")
+	require.Nil(t, err)
+	messages, err := c2.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(messages)) // Not committed yet
+
+	require.Nil(t, tx.Commit())
+	messages, err = c2.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+}
+
+func TestSqliteCache_MessagesDueUsesIndex(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.Contains(t, queryPlan(t, c.db, selectMessagesDueQuery, time.Now().Unix()), "USING INDEX idx_due")
+}
+
+func TestSqliteCache_AttachmentsExpiredUsesIndex(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.Contains(t, queryPlan(t, c.db, selectAttachmentsExpiredQuery, time.Now().Unix()), "USING INDEX idx_attachment_expires")
+}
+
+func TestSqliteDSN(t *testing.T) {
+	require.Equal(t, "cache.db?_txlock=immediate", sqliteDSN("cache.db", 0, ""))
+	require.Equal(t, "cache.db?_txlock=immediate&_busy_timeout=5000", sqliteDSN("cache.db", 5*time.Second, ""))
+	require.Equal(t, "file:cache.db?mode=rwc&_txlock=immediate&_busy_timeout=250", sqliteDSN("file:cache.db?mode=rwc", 250*time.Millisecond, ""))
+	require.Equal(t, "cache.db?_txlock=immediate&_busy_timeout=5000&_sync=full", sqliteDSN("cache.db", 5*time.Second, "full"))
+	require.Equal(t, "cache.db?_txlock=immediate&_sync=off", sqliteDSN("cache.db", 0, "off"))
+	require.Equal(t, "file::memory:?cache=shared&_txlock=immediate&_busy_timeout=5000", sqliteDSN(sharedMemoryDB, 5*time.Second, ""))
+}
+
+func TestSqliteCache_SharedMemoryDB(t *testing.T) {
+	for _, filename := range []string{":memory:", "file:TestSqliteCache_SharedMemoryDB?mode=memory&cache=shared"} {
+		conf := NewConfig()
+		conf.CacheFile = filename
+		c1 := newSqliteTestCacheFromConfig(t, conf)
+		m := newDefaultMessage("sharedmemorytopic", "written by the first handle")
+		require.Nil(t, c1.AddMessage(m))
+
+		// A second handle opens the same in-memory database, as long as the first one is still open
+		c2 := newSqliteTestCacheFromConfig(t, conf)
+		messages, err := c2.Messages("sharedmemorytopic", sinceAllMessages, false, 0)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(messages))
+		require.Equal(t, m.ID, messages[0].ID)
+		require.Nil(t, c2.Close())
+		require.Nil(t, c1.Close())
+
+		// The database is deleted with its last handle
+		c3 := newSqliteTestCacheFromConfig(t, conf)
+		messages, err = c3.Messages("sharedmemorytopic", sinceAllMessages, false, 0)
+		require.Nil(t, err)
+		require.Empty(t, messages)
+		require.Nil(t, c3.Close())
+	}
+}
+
+func TestSqliteCache_MemoryDBConcurrent(t *testing.T) {
+	c := newSqliteTestCacheFromFile(t, ":memory:")
+	defer c.Close()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			topic := fmt.Sprintf("topic%d", i)
+			for j := 0; j < 200; j++ {
+				if err := c.AddMessage(newDefaultMessage(topic, "some message")); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := c.Messages(topic, sinceAllMessages, false, 0); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err)
+	}
+	for i := 0; i < 8; i++ {
+		count, err := c.MessageCount(fmt.Sprintf("topic%d", i))
+		require.Nil(t, err)
+		require.Equal(t, 200, count)
+	}
+}
+
+func TestSqliteCache_SyncMode(t *testing.T) {
+	for mode, expected := range map[string]int{CacheSyncModeOff: 0, CacheSyncModeNormal: 1, CacheSyncModeFull: 2} {
+		conf := NewConfig()
+		conf.CacheFile = newSqliteTestCacheFile(t)
+		conf.CacheSyncMode = mode
+		c := newSqliteTestCacheFromConfig(t, conf)
+		var synchronous int
+		require.Nil(t, c.db.QueryRow("PRAGMA synchronous").Scan(&synchronous))
+		require.Equal(t, expected, synchronous, mode)
+	}
+}
+
+func BenchmarkSqliteCache_AddMessage(b *testing.B) {
+	for _, mode := range []string{CacheSyncModeOff, CacheSyncModeNormal, CacheSyncModeFull} {
+		b.Run(mode, func(b *testing.B) {
+			conf := NewConfig()
+			conf.CacheFile = newSqliteTestCacheFile(b)
+			conf.CacheSyncMode = mode
+			c := newSqliteTestCacheFromConfig(b, conf)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.AddMessage(newDefaultMessage("mytopic", "some log line")); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSqliteCache_ConnectionPool(t *testing.T) {
+	conf := NewConfig()
+	conf.CacheFile = newSqliteTestCacheFile(t)
+	conf.CacheMaxOpenConns = 3
+	conf.CacheMaxIdleConns = 2
+	c := newSqliteTestCacheFromConfig(t, conf)
+	require.Equal(t, 3, c.db.Stats().MaxOpenConnections)
+
+	// Concurrent readers beyond the pool size wait for a free connection instead of failing
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+			require.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	require.LessOrEqual(t, c.db.Stats().Idle, 2)
+}
+
+func TestSqliteCache_TakeMessagesDueConcurrentDeleteScheduled(t *testing.T) {
+	conf := NewConfig()
+	conf.CacheFile = newSqliteTestCacheFile(t)
+	conf.CacheMaxOpenConns = 4
+	c := newSqliteTestCacheFromConfig(t, conf)
+
+	ids := make([]string, 0)
+	for i := 0; i < 200; i++ {
+		m := newDefaultMessage("mytopic", "remind me")
+		m.Time = time.Now().Add(time.Hour).Unix()
+		require.Nil(t, c.AddMessage(m))
+		ids = append(ids, m.ID)
+	}
+	_, err := c.db.Exec("UPDATE messages SET time = ?", time.Now().Add(-time.Minute).Unix()) // All due now
+	require.Nil(t, err)
+
+	// Every message is either taken or cancelled, never both, and neither side fails
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	taken, deleted := make(map[string]bool), make(map[string]bool)
+	errs := make(chan error, 5)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			messages, err := c.TakeMessagesDue()
+			if err != nil {
+				errs <- err
+				return
+			}
+			mu.Lock()
+			for _, m := range messages {
+				taken[m.ID] = true
+			}
+			mu.Unlock()
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < len(ids); j += 4 {
+				if err := c.DeleteScheduled(ids[j]); err == nil {
+					mu.Lock()
+					deleted[ids[j]] = true
+					mu.Unlock()
+				} else if err != errMessagePublished {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err)
+	}
+	messages, err := c.TakeMessagesDue()
+	require.Nil(t, err)
+	for _, m := range messages {
+		taken[m.ID] = true
+	}
+	for _, id := range ids {
+		require.True(t, taken[id] != deleted[id], id)
+	}
+}
+
+func TestSqliteReadOnlyDSN(t *testing.T) {
+	require.Equal(t, "file:cache.db?mode=ro", sqliteReadOnlyDSN("cache.db", 0))
+	require.Equal(t, "file:/var/cache/ntfy/cache.db?mode=ro&_busy_timeout=5000", sqliteReadOnlyDSN("/var/cache/ntfy/cache.db", 5*time.Second))
+	require.Equal(t, "file:cache.db?mode=ro&cache=shared", sqliteReadOnlyDSN("file:cache.db?mode=rwc&cache=shared", 0))
+	require.Equal(t, "file:cache.db?cache=shared&mode=ro", sqliteReadOnlyDSN("file:cache.db?cache=shared", 0))
+}
+
+func TestSqliteKeyQuery(t *testing.T) {
+	require.Equal(t, `PRAGMA key = 'secret'`, sqliteKeyQuery("secret"))
+	require.Equal(t, `PRAGMA key = 'it''s a secret'`, sqliteKeyQuery("it's a secret"))
+}
+
+func TestSqliteCache_KeyUnsupported(t *testing.T) {
+	// The bundled SQLite library ignores "PRAGMA key", so the cache must not be created unencrypted
+	filename := newSqliteTestCacheFile(t)
+	conf := NewConfig()
+	conf.CacheFile = filename
+	conf.CacheKey = "secret"
+	_, err := newSqliteCache(conf)
+	require.ErrorIs(t, err, errCacheKeyUnsupported)
+	stat, err := os.Stat(filename) // Opening the connection creates an empty file, but nothing must be written
+	require.Nil(t, err)
+	require.Equal(t, int64(0), stat.Size())
+}
+
+func TestSqliteCache_QueryRaw(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my message")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other message")))
+
+	rows, err := c.QueryRaw("SELECT topic, COUNT(*) FROM messages WHERE topic = ? GROUP BY topic", "mytopic")
+	require.Nil(t, err)
+	require.True(t, rows.Next())
+	var topic string
+	var count int
+	require.Nil(t, rows.Scan(&topic, &count))
+	require.Equal(t, "mytopic", topic)
+	require.Equal(t, 1, count)
+	require.False(t, rows.Next())
+	require.Nil(t, rows.Close())
+
+	// Writes are refused
+	rows, err = c.QueryRaw("DELETE FROM messages")
+	if err == nil { // Depending on the statement, SQLite may only fail when stepping through the rows
+		require.False(t, rows.Next())
+		err = rows.Err()
+		rows.Close()
+	}
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "readonly")
+	count, err = c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+}
+
+func TestSqliteCache_QueryRawMemoryDB(t *testing.T) {
+	c := newSqliteTestCacheFromFile(t, ":memory:")
+	defer c.Close()
+	_, err := c.QueryRaw("SELECT COUNT(*) FROM messages")
+	require.Equal(t, errReadOnlyMemoryDB, err)
+}
+
+func TestSqliteCache_Compact(t *testing.T) {
+	c := newSqliteTestCache(t)
+	messages := make([]*message, 0)
+	for i := 0; i < 1000; i++ {
+		m := newDefaultMessage("mytopic", strings.Repeat("x", 1000))
+		m.Time = time.Now().Add(-2 * time.Hour).Unix()
+		messages = append(messages, m)
+	}
+	require.Nil(t, c.AddMessages(messages))
+	deleted, err := c.Prune(time.Now().Add(-time.Hour), time.Now().Add(-time.Hour), nil, nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(1000), deleted)
+
+	before, err := c.size()
+	require.Nil(t, err)
+	require.Nil(t, c.Compact())
+	after, err := c.size()
+	require.Nil(t, err)
+	require.Less(t, after, before/10)
+}
+
+func TestSqliteCache_SameSecondOrderAfterCompact(t *testing.T) {
+	c := newSqliteTestCache(t)
+	ids := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = 1000
+		require.Nil(t, c.AddMessage(m))
+		ids = append(ids, m.ID)
+	}
+	_, err := c.DeleteMessage(ids[0])
+	require.Nil(t, err)
+	require.Nil(t, c.Compact()) // May renumber rowids, but not the sequence
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(messages))
+	for i, m := range messages {
+		require.Equal(t, fmt.Sprintf("message %d", i+1), m.Message)
+		require.Equal(t, int64(1000), m.Time)
+	}
+	messages, err = c.Messages("mytopic", newSinceID(ids[2]), false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 3", messages[0].Message)
+	require.Equal(t, "message 4", messages[1].Message)
+}
+
+func TestSqliteCache_CompressedBodies(t *testing.T) {
+	conf := NewConfig()
+	conf.CacheFile = newSqliteTestCacheFile(t)
+	conf.CacheCompressionThreshold = 100
+	c := newSqliteTestCacheFromConfig(t, conf)
+
+	large := newDefaultMessage("mytopic", strings.Repeat(`{"level":"info","msg":"all good"}`, 100))
+	small := newDefaultMessage("mytopic", "small message")
+	binary := newDefaultMessage("mytopic", strings.Repeat("AAAA", 100))
+	binary.Encoding = encodingBase64
+	require.Nil(t, c.AddMessages([]*message{large, small, binary}))
+
+	// Only the large text body is compressed
+	var storedEncoding string
+	var storedLength int
+	require.Nil(t, c.db.QueryRow("SELECT encoding, LENGTH(CAST(message AS BLOB)) FROM messages WHERE id = ?", large.ID).Scan(&storedEncoding, &storedLength))
+	require.Equal(t, encodingGzip, storedEncoding)
+	require.Less(t, storedLength, len(large.Message)/10)
+	require.Nil(t, c.db.QueryRow("SELECT encoding FROM messages WHERE id = ?", binary.ID).Scan(&storedEncoding))
+	require.Equal(t, encodingBase64, storedEncoding)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, large.Message, messages[0].Message)
+	require.Equal(t, "", messages[0].Encoding)
+	require.Equal(t, "small message", messages[1].Message)
+	require.Equal(t, binary.Message, messages[2].Message)
+	require.Equal(t, encodingBase64, messages[2].Encoding)
 }
 
-func TestSqliteCache_MessagesTagsPrioAndTitle(t *testing.T) {
-	testCacheMessagesTagsPrioAndTitle(t, newSqliteTestCache(t))
+func TestSqliteCache_AttachmentsExpiredSkipsScan(t *testing.T) {
+	c := newSqliteTestCache(t)
+	m := newDefaultMessage("mytopic", "flower for you")
+	m.Attachment = &attachment{Name: "flower.jpg", Size: 5000, Expires: time.Now().Add(time.Second).Unix(), URL: "https://ntfy.sh/file/flower.jpg", Owner: "1.2.3.4"}
+	require.Nil(t, c.AddMessage(m))
+
+	ids, err := c.AttachmentsExpired() // First call always scans
+	require.Nil(t, err)
+	require.Empty(t, ids)
+	require.Equal(t, m.Attachment.Expires, c.nextAttachmentExpiry)
+
+	// Sneak an expired attachment past AddMessage: not found, because the scan is skipped
+	_, err = c.db.Exec(`UPDATE messages SET attachment_expires = ? WHERE id = ?`, time.Now().Add(-time.Minute).Unix(), m.ID)
+	require.Nil(t, err)
+	ids, err = c.AttachmentsExpired()
+	require.Nil(t, err)
+	require.Empty(t, ids)
+
+	// Scan runs once the earliest known expiry has passed
+	time.Sleep(2100 * time.Millisecond)
+	ids, err = c.AttachmentsExpired()
+	require.Nil(t, err)
+	require.Equal(t, []string{m.ID}, ids)
+	require.Equal(t, int64(0), c.nextAttachmentExpiry) // Scan again until cleared
+
+	// Attachments that were not cleared are returned again
+	ids, err = c.AttachmentsExpired()
+	require.Nil(t, err)
+	require.Equal(t, []string{m.ID}, ids)
+	require.Nil(t, c.ClearAttachment(m.ID))
+	ids, err = c.AttachmentsExpired()
+	require.Nil(t, err)
+	require.Empty(t, ids)
+	require.Equal(t, int64(math.MaxInt64), c.nextAttachmentExpiry) // No future expiries left
+
+	// New attachments lower the next expiry
+	m2 := newDefaultMessage("mytopic", "another flower")
+	m2.Attachment = &attachment{Name: "flower2.jpg", Size: 5000, Expires: time.Now().Add(time.Hour).Unix(), URL: "https://ntfy.sh/file/flower2.jpg", Owner: "1.2.3.4"}
+	require.Nil(t, c.AddMessage(m2))
+	require.Equal(t, m2.Attachment.Expires, c.nextAttachmentExpiry)
 }
 
-func TestSqliteCache_Prune(t *testing.T) {
-	testCachePrune(t, newSqliteTestCache(t))
+func TestSqliteCache_Diagnose(t *testing.T) {
+	conf := NewConfig()
+	conf.CacheFile = newSqliteTestCacheFile(t)
+	conf.CacheBodyDir = filepath.Join(t.TempDir(), "bodies")
+	conf.CacheBodyThreshold = 10
+	c := newSqliteTestCacheFromConfig(t, conf)
+	m := newDefaultMessage("mytopic", "a body that is stored externally")
+	m.Attachment = &attachment{Name: "car.jpg", Size: 10000, Expires: time.Now().Add(time.Hour).Unix(), URL: "https://ntfy.sh/file/car.jpg", Owner: "1.2.3.4"}
+	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "inline")))
+
+	report, err := c.Diagnose()
+	require.Nil(t, err)
+	require.True(t, report.OK())
+	require.Equal(t, currentSchemaVersion, report.SchemaVersion)
+	require.Empty(t, report.IntegrityErrors)
+
+	// Introduce inconsistencies
+	_, err = c.db.Exec(`UPDATE messages SET attachment_name = '' WHERE id = ?`, m.ID)
+	require.Nil(t, err)
+	_, err = c.db.Exec(updateSchemaVersion, currentSchemaVersion-1)
+	require.Nil(t, err)
+	require.Nil(t, os.Remove(filepath.Join(conf.CacheBodyDir, m.ID)))
+
+	report, err = c.Diagnose()
+	require.Nil(t, err)
+	require.False(t, report.OK())
+	require.Equal(t, currentSchemaVersion-1, report.SchemaVersion)
+	require.Equal(t, 1, report.OrphanedAttachments)
+	require.Equal(t, 1, report.MissingBodies)
+	require.Equal(t, 0, report.DuplicateIDs)
+	require.Empty(t, report.IntegrityErrors)
+
+	var attachmentURL string // Nothing was repaired
+	require.Nil(t, c.db.QueryRow(`SELECT attachment_url FROM messages WHERE id = ?`, m.ID).Scan(&attachmentURL))
+	require.Equal(t, "https://ntfy.sh/file/car.jpg", attachmentURL)
 }
 
-func TestSqliteCache_Attachments(t *testing.T) {
-	testCacheAttachments(t, newSqliteTestCache(t))
+func TestSqliteCache_MessageExistsConcurrent(t *testing.T) {
+	conf := NewConfig()
+	conf.CacheFile = newSqliteTestCacheFile(t)
+	conf.CacheBusyTimeout = 5 * time.Second
+	c := newSqliteTestCacheFromConfig(t, conf)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8*50)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				m := newDefaultMessage("mytopic", "some message")
+				m.ID = fmt.Sprintf("id%02dx%05d", i, j%25) // Every ID is used twice
+				if err := c.AddMessage(m); err != nil && err != errMessageExists {
+					errs <- err
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err) // No SQLITE_BUSY
+	}
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 8*25, count)
+}
+
+func TestSqliteCache_MessageExistsKeepsExternalBody(t *testing.T) {
+	conf := NewConfig()
+	conf.CacheFile = newSqliteTestCacheFile(t)
+	conf.CacheBodyDir = filepath.Join(t.TempDir(), "bodies")
+	conf.CacheBodyThreshold = 10
+	c := newSqliteTestCacheFromConfig(t, conf)
+	m1 := newDefaultMessage("mytopic", "the original, externally stored body")
+	m1.ID = "abcdefghij"
+	require.Nil(t, c.AddMessage(m1))
+
+	m2 := newDefaultMessage("mytopic", "a body that must not overwrite the original")
+	m2.ID = "abcdefghij"
+	require.Equal(t, errMessageExists, c.AddMessage(m2))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "the original, externally stored body", messages[0].Message)
+}
+
+func TestSqliteCache_Backup(t *testing.T) {
+	c := newSqliteTestCache(t)
+	for i := 0; i < 10; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))))
+	}
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other message")))
+
+	backupFile := filepath.Join(t.TempDir(), "backup.db")
+	require.Nil(t, c.BackupFile(backupFile))
+	require.NotNil(t, c.BackupFile(backupFile)) // Refuses to overwrite
+
+	backup := newSqliteTestCacheFromFile(t, backupFile)
+	for _, topic := range []string{"mytopic", "othertopic"} {
+		expected, err := c.MessageCount(topic)
+		require.Nil(t, err)
+		count, err := backup.MessageCount(topic)
+		require.Nil(t, err)
+		require.Equal(t, expected, count)
+	}
+	messages, err := backup.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 10, len(messages))
+	require.Equal(t, "message 0", messages[0].Message)
+}
+
+func TestSqliteCache_ExternalBodies(t *testing.T) {
+	conf := NewConfig()
+	conf.CacheFile = newSqliteTestCacheFile(t)
+	conf.CacheBodyDir = filepath.Join(t.TempDir(), "bodies")
+	conf.CacheBodyThreshold = 100
+	c := newSqliteTestCacheFromConfig(t, conf)
+
+	large := newDefaultMessage("mytopic", strings.Repeat("x", 101))
+	small := newDefaultMessage("mytopic", "small message")
+	require.Nil(t, c.AddMessage(large))
+	require.Nil(t, c.AddMessage(small))
+	require.Equal(t, 101, len(large.Message)) // Not modified
+
+	// Large body is stored as a file, not in the database
+	require.FileExists(t, filepath.Join(conf.CacheBodyDir, large.ID))
+	require.NoFileExists(t, filepath.Join(conf.CacheBodyDir, small.ID))
+	var body, bodyRef string
+	require.Nil(t, c.db.QueryRow(`SELECT message, body_ref FROM messages WHERE id = ?`, large.ID).Scan(&body, &bodyRef))
+	require.Equal(t, "", body)
+	require.Equal(t, large.ID, bodyRef)
+
+	// Bodies are loaded on demand
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, strings.Repeat("x", 101), messages[0].Message)
+	require.Equal(t, "small message", messages[1].Message)
+
+	// ... and not loaded at all for headers
+	headers, err := c.MessageHeaders("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(headers))
+	require.Equal(t, "", headers[0].Message)
+	require.Equal(t, "small message", headers[1].Message)
+
+	// Bodies of pruned messages are removed (after a grace period)
+	require.Nil(t, os.Chtimes(filepath.Join(conf.CacheBodyDir, large.ID), time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+	_, err = c.Prune(time.Now().Add(time.Hour), time.Time{}, nil, nil, nil)
+	require.Nil(t, err)
+	require.NoFileExists(t, filepath.Join(conf.CacheBodyDir, large.ID))
 }
 
 func TestSqliteCache_Migration_From0(t *testing.T) {
@@ -64,7 +1024,7 @@ func TestSqliteCache_Migration_From0(t *testing.T) {
 	c := newSqliteTestCacheFromFile(t, filename)
 	checkSchemaVersion(t, c.db)
 
-	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
 	require.Nil(t, err)
 	require.Equal(t, 10, len(messages))
 	require.Equal(t, "some message 5", messages[5].Message)
@@ -116,17 +1076,282 @@ func TestSqliteCache_Migration_From1(t *testing.T) {
 	require.Nil(t, c.AddMessage(delayedMessage))
 
 	// 10, not 11!
-	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
 	require.Nil(t, err)
 	require.Equal(t, 10, len(messages))
 
 	// 11!
-	messages, err = c.Messages("mytopic", sinceAllMessages, true)
+	messages, err = c.Messages("mytopic", sinceAllMessages, true, 0)
 	require.Nil(t, err)
 	require.Equal(t, 11, len(messages))
+
+	// Migrated columns are empty, not NULL
+	var nullIcons int
+	require.Nil(t, c.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE icon IS NULL`).Scan(&nullIcons))
+	require.Equal(t, 0, nullIcons)
+	require.Equal(t, "", messages[0].Icon)
+	require.Equal(t, contentTypePlain, messages[0].ContentType)
+
+	// Topic metadata was backfilled, and counts the message added after the migration
+	topics, err := c.Topics()
+	require.Nil(t, err)
+	require.Equal(t, 11, topics["mytopic"].MessageCount)
+	require.Equal(t, delayedMessage.Time, topics["mytopic"].LastMessageTime)
+}
+
+// createVersion1Cache creates a cache file with the "version 1" schema and a single message
+func createVersion1Cache(t *testing.T, filename string) *sql.DB {
+	db, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS messages (
+			id VARCHAR(20) PRIMARY KEY,
+			time INT NOT NULL,
+			topic VARCHAR(64) NOT NULL,
+			message VARCHAR(512) NOT NULL,
+			title VARCHAR(256) NOT NULL,
+			priority INT NOT NULL,
+			tags VARCHAR(256) NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_topic ON messages (topic);
+		CREATE TABLE IF NOT EXISTS schemaVersion (
+			id INT PRIMARY KEY,
+			version INT NOT NULL
+		);
+		INSERT INTO schemaVersion (id, version) VALUES (1, 1);
+		INSERT INTO messages (id, time, topic, message, title, priority, tags) VALUES ('abcd1', 1000, 'mytopic', 'some message', '', 0, '');
+	`)
+	require.Nil(t, err)
+	return db
+}
+
+func TestSqliteCache_Migration_InterruptedRollsBack(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	db := createVersion1Cache(t, filename)
+
+	// Simulate a crash after the ALTER statements of the 1 -> 2 migration, but before the version is updated
+	_, err := db.Exec(`CREATE TRIGGER crash BEFORE UPDATE ON schemaVersion BEGIN SELECT RAISE(ABORT, 'crash'); END`)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+
+	conf := NewConfig()
+	conf.CacheFile = filename
+	_, err = newSqliteCache(conf)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "crash")
+
+	// The migration was rolled back entirely
+	db, err = sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	var version, published int
+	require.Nil(t, db.QueryRow(`SELECT version FROM schemaVersion`).Scan(&version))
+	require.Equal(t, 1, version)
+	require.Nil(t, db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('messages') WHERE name = 'published'`).Scan(&published))
+	require.Equal(t, 0, published)
+
+	// The migration is repeated on the next start
+	_, err = db.Exec(`DROP TRIGGER crash`)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+	c := newSqliteTestCacheFromFile(t, filename)
+	checkSchemaVersion(t, c.db)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+}
+
+func TestSqliteCache_Migration_ColumnAlreadyAdded(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	db := createVersion1Cache(t, filename)
+
+	// Older versions of ntfy did not update the schema version in the same transaction as the migration,
+	// so a crash may have left the column of the 1 -> 2 migration behind without updating the version
+	_, err := db.Exec(`ALTER TABLE messages ADD COLUMN published INT NOT NULL DEFAULT(1)`)
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+
+	c := newSqliteTestCacheFromFile(t, filename)
+	checkSchemaVersion(t, c.db)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "some message", messages[0].Message)
+}
+
+func TestSqliteCache_Migration_Repeated(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "some message")))
+
+	// Pretend that the last migration step was interrupted after its statements were committed
+	_, err := c.db.Exec(updateSchemaVersion, currentSchemaVersion-1)
+	require.Nil(t, err)
+	require.Nil(t, c.Close())
+
+	c = newSqliteTestCacheFromFile(t, filename)
+	checkSchemaVersion(t, c.db)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+}
+
+func TestSqliteCache_CorruptFileTruncated(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	for i := 0; i < 500; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", fmt.Sprintf("message %d: %s", i, strings.Repeat("x", 200)))))
+	}
+	require.Nil(t, c.db.Close())
+	stat, err := os.Stat(filename)
+	require.Nil(t, err)
+	require.Nil(t, os.Truncate(filename, stat.Size()/2))
+
+	c = newSqliteTestCacheFromFile(t, filename)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Empty(t, messages) // Fresh cache
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "new message")))
+
+	corruptFiles, err := filepath.Glob(filename + ".*.corrupt")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(corruptFiles))
+	corruptStat, err := os.Stat(corruptFiles[0])
+	require.Nil(t, err)
+	require.Equal(t, stat.Size()/2, corruptStat.Size())
+}
+
+func TestSqliteCache_CorruptFileNotADatabase(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	require.Nil(t, os.WriteFile(filename, []byte(strings.Repeat("this is not a database\n", 1000)), 0600))
+
+	c := newSqliteTestCacheFromFile(t, filename)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "new message")))
+
+	corruptFiles, err := filepath.Glob(filename + ".*.corrupt")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(corruptFiles))
+	b, err := os.ReadFile(corruptFiles[0])
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(string(b), "this is not a database"))
+}
+
+func TestSqliteCache_CorruptFileURINotMoved(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	require.Nil(t, os.WriteFile(filename, []byte(strings.Repeat("this is not a database\n", 1000)), 0600))
+	conf := NewConfig()
+	conf.CacheFile = "file:" + filename
+	_, err := newSqliteCache(conf)
+	require.ErrorIs(t, err, errCacheCorrupt)
+	require.FileExists(t, filename)
+}
+
+func TestSqliteCache_Migration_Log(t *testing.T) {
+	c := newSqliteTestCache(t)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "message 1")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "message 2")))
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+	logMigration(12, time.Now().Add(-1500*time.Millisecond), 2)
+
+	var entry migrationLogEntry
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, 12, entry.FromVersion)
+	require.Equal(t, 13, entry.ToVersion)
+	require.GreaterOrEqual(t, entry.DurationMs, int64(1500))
+	require.Equal(t, int64(2), entry.RowsMigrated)
+	require.Contains(t, buf.String(), `"from_version":12,"to_version":13,"duration_ms":`)
+
+	// Only rows changed by the migration step count, not the table size
+	buf.Reset()
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "message 3")))
+	require.Nil(t, migrate(c.db, currentSchemaVersion-1, `
+		CREATE INDEX IF NOT EXISTS idx_test ON messages (title);
+		UPDATE messages SET title = 'migrated' WHERE topic = 'mytopic';
+		CREATE INDEX IF NOT EXISTS idx_test2 ON messages (click);
+	`))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Nil(t, json.Unmarshal([]byte(lines[len(lines)-1]), &entry))
+	require.Equal(t, int64(2), entry.RowsMigrated)
+	checkSchemaVersion(t, c.db)
+}
+
+func TestSqliteCache_Migration_Backup(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	db, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+
+	// Create "version 1" schema with a few messages
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS messages (
+			id VARCHAR(20) PRIMARY KEY,
+			time INT NOT NULL,
+			topic VARCHAR(64) NOT NULL,
+			message VARCHAR(512) NOT NULL,
+			title VARCHAR(256) NOT NULL,
+			priority INT NOT NULL,
+			tags VARCHAR(256) NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS schemaVersion (
+			id INT PRIMARY KEY,
+			version INT NOT NULL
+		);		
+		INSERT INTO schemaVersion (id, version) VALUES (1, 1);
+	`)
+	require.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = db.Exec(`INSERT INTO messages (id, time, topic, message, title, priority, tags) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			fmt.Sprintf("abcd%d", i), time.Now().Unix(), "mytopic", fmt.Sprintf("some message %d", i), "", 0, "")
+		require.Nil(t, err)
+	}
+	require.Nil(t, db.Close())
+
+	// Create cache to trigger migration
+	conf := NewConfig()
+	conf.CacheFile = filename
+	conf.CacheMigrationBackup = true
+	c := newSqliteTestCacheFromConfig(t, conf)
+	checkSchemaVersion(t, c.db)
+
+	// Backup must be a copy of the pre-migration state
+	backupFiles, err := filepath.Glob(filename + ".*.bak")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(backupFiles))
+	backup, err := sql.Open("sqlite3", backupFiles[0])
+	require.Nil(t, err)
+	defer backup.Close()
+	var schemaVersion, count int
+	require.Nil(t, backup.QueryRow(`SELECT version FROM schemaVersion`).Scan(&schemaVersion))
+	require.Equal(t, 1, schemaVersion)
+	require.Nil(t, backup.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&count))
+	require.Equal(t, 3, count)
+
+	// No migration, no backup
+	newSqliteTestCacheFromConfig(t, conf)
+	backupFiles, err = filepath.Glob(filename + ".*.bak")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(backupFiles))
 }
 
-func checkSchemaVersion(t *testing.T, db *sql.DB) {
+func TestSqliteCache_SchemaVersionTooNew(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename)
+	_, err := c.db.Exec(updateSchemaVersion, currentSchemaVersion+1)
+	require.Nil(t, err)
+	require.Nil(t, c.db.Close())
+
+	conf := NewConfig()
+	conf.CacheFile = filename
+	_, err = newSqliteCache(conf)
+	require.ErrorIs(t, err, errCacheTooNew)
+}
+
+func checkSchemaVersion(t *testing.T, db *sqliteDB) {
 	rows, err := db.Query(`SELECT version FROM schemaVersion`)
 	require.Nil(t, err)
 	require.True(t, rows.Next())
@@ -137,22 +1362,166 @@ func checkSchemaVersion(t *testing.T, db *sql.DB) {
 	require.Nil(t, rows.Close())
 }
 
-func newSqliteTestCache(t *testing.T) *sqliteCache {
-	c, err := newSqliteCache(newSqliteTestCacheFile(t))
-	if err != nil {
-		t.Fatal(err)
+func TestSqliteCache_TablePrefix(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	caches := make(map[string]*sqliteCache)
+	for _, prefix := range []string{"", "tenantA", "tenant_b"} {
+		conf := NewConfig()
+		conf.CacheFile = filename
+		conf.CacheTablePrefix = prefix
+		caches[prefix] = newSqliteTestCacheFromConfig(t, conf)
+		checkSchemaVersion(t, caches[prefix].db)
 	}
-	return c
+	require.Nil(t, caches[""].AddMessage(newDefaultMessage("mytopic", "no tenant")))
+	require.Nil(t, caches["tenantA"].AddMessage(newDefaultMessage("mytopic", "tenant A")))
+	require.Nil(t, caches["tenantA"].AddMessage(newDefaultMessage("mytopic", "tenant A again")))
+
+	messages, err := caches[""].Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "no tenant", messages[0].Message)
+
+	messages, err = caches["tenantA"].Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "tenant A", messages[0].Message)
+
+	messages, err = caches["tenant_b"].Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	rows, err := caches["tenantA"].QueryRaw("SELECT COUNT(*) FROM messages")
+	require.Nil(t, err)
+	require.True(t, rows.Next())
+	var count int
+	require.Nil(t, rows.Scan(&count))
+	require.Nil(t, rows.Close())
+	require.Equal(t, 2, count)
+
+	var tables int
+	require.Nil(t, caches[""].db.DB.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name IN ('messages', 'tenantA_messages', 'tenant_b_messages', 'tenantA_idx_topic')`).Scan(&tables))
+	require.Equal(t, 4, tables)
+
+	require.Equal(t, errRestoreTablePrefix, caches["tenantA"].Restore(strings.NewReader(""), false))
+}
+
+func TestSqliteCache_TablePrefixInvalid(t *testing.T) {
+	for _, prefix := range []string{"1tenant", "tenant-a", "tenant;DROP TABLE messages", "_tenant", strings.Repeat("a", 33)} {
+		conf := NewConfig()
+		conf.CacheFile = newSqliteTestCacheFile(t)
+		conf.CacheTablePrefix = prefix
+		_, err := newSqliteCache(conf)
+		require.Equal(t, errCacheTablePrefixInvalid, err)
+	}
+}
+
+func TestSqliteCache_TablePrefixMigration(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	rawDB, err := sql.Open("sqlite3", filename)
+	require.Nil(t, err)
+	db, err := newSqliteDB(rawDB, "tenantA")
+	require.Nil(t, err)
+
+	// Create "version 0" schema for the prefix only
+	_, err = db.Exec(`
+		BEGIN;
+		CREATE TABLE IF NOT EXISTS messages (
+			id VARCHAR(20) PRIMARY KEY,
+			time INT NOT NULL,
+			topic VARCHAR(64) NOT NULL,
+			message VARCHAR(1024) NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_topic ON messages (topic);
+		COMMIT;
+	`)
+	require.Nil(t, err)
+	_, err = db.Exec(`INSERT INTO messages (id, time, topic, message) VALUES (?, ?, ?, ?)`, "abcd", time.Now().Unix(), "mytopic", "some message")
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+
+	// Create an unprefixed cache first; it must not touch the prefixed tables
+	unprefixed := newSqliteTestCacheFromFile(t, filename)
+	checkSchemaVersion(t, unprefixed.db)
+
+	// Create prefixed cache to trigger migration
+	conf := NewConfig()
+	conf.CacheFile = filename
+	conf.CacheTablePrefix = "tenantA"
+	c := newSqliteTestCacheFromConfig(t, conf)
+	checkSchemaVersion(t, c.db)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "some message", messages[0].Message)
+}
+
+func newSqliteTestCache(t *testing.T) *sqliteCache {
+	return newSqliteTestCacheFromFile(t, newSqliteTestCacheFile(t))
 }
 
-func newSqliteTestCacheFile(t *testing.T) string {
+func newSqliteTestCacheFile(t testing.TB) string {
 	return filepath.Join(t.TempDir(), "cache.db")
 }
 
 func newSqliteTestCacheFromFile(t *testing.T, filename string) *sqliteCache {
-	c, err := newSqliteCache(filename)
+	conf := NewConfig()
+	conf.CacheFile = filename
+	return newSqliteTestCacheFromConfig(t, conf)
+}
+
+func newSqliteTestCacheFromConfig(t testing.TB, conf *Config) *sqliteCache {
+	c, err := newSqliteCache(conf)
 	if err != nil {
 		t.Fatal(err)
 	}
 	return c
 }
+
+// queryPlan returns the details of the EXPLAIN QUERY PLAN output for the given query, one step per line
+func queryPlan(t *testing.T, db *sqliteDB, query string, args ...interface{}) string {
+	rows, err := db.Query("EXPLAIN QUERY PLAN "+query, args...)
+	require.Nil(t, err)
+	defer rows.Close()
+	plan := make([]string, 0)
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		require.Nil(t, rows.Scan(&id, &parent, &notUsed, &detail))
+		plan = append(plan, detail)
+	}
+	require.Nil(t, rows.Err())
+	return strings.Join(plan, "\n")
+}
+
+func TestSqliteCache_DeleteScheduled(t *testing.T) {
+	testCacheDeleteScheduled(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_TakeMessagesDue(t *testing.T) {
+	testCacheTakeMessagesDue(t, newSqliteTestCache(t))
+}
+
+func TestSqliteCache_MaxMessagesPerTopic(t *testing.T) {
+	conf := NewConfig()
+	conf.CacheFile = newSqliteTestCacheFile(t)
+	conf.CacheMaxMessagesPerTopic = 2
+	testCacheMaxMessagesPerTopic(t, newSqliteTestCacheFromConfig(t, conf))
+}
+
+func TestSqliteCache_MaxAttachmentExpiry(t *testing.T) {
+	conf := NewConfig()
+	conf.CacheFile = newSqliteTestCacheFile(t)
+	conf.CacheMaxAttachmentExpiry = time.Hour
+	testCacheMaxAttachmentExpiry(t, newSqliteTestCacheFromConfig(t, conf), time.Hour)
+}
+
+func TestSqliteCache_MaxAttachmentExpiryUnbounded(t *testing.T) {
+	conf := NewConfig()
+	conf.CacheFile = newSqliteTestCacheFile(t)
+	testCacheMaxAttachmentExpiry(t, newSqliteTestCacheFromConfig(t, conf), 0)
+}
+
+func TestSqliteCache_MessagesBySender(t *testing.T) {
+	testCacheMessagesBySender(t, newSqliteTestCache(t))
+}
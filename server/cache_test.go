@@ -1,7 +1,14 @@
 package server
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -27,7 +34,7 @@ func testCacheMessages(t *testing.T, c cache) {
 	require.Equal(t, 2, count)
 
 	// mytopic: since all
-	messages, _ := c.Messages("mytopic", sinceAllMessages, false)
+	messages, _ := c.Messages("mytopic", sinceAllMessages, false, 0)
 	require.Equal(t, 2, len(messages))
 	require.Equal(t, "my message", messages[0].Message)
 	require.Equal(t, "mytopic", messages[0].Topic)
@@ -38,11 +45,11 @@ func testCacheMessages(t *testing.T, c cache) {
 	require.Equal(t, "my other message", messages[1].Message)
 
 	// mytopic: since none
-	messages, _ = c.Messages("mytopic", sinceNoMessages, false)
+	messages, _ = c.Messages("mytopic", sinceNoMessages, false, 0)
 	require.Empty(t, messages)
 
 	// mytopic: since 2
-	messages, _ = c.Messages("mytopic", sinceTime(time.Unix(2, 0)), false)
+	messages, _ = c.Messages("mytopic", newSinceTime(2), false, 0)
 	require.Equal(t, 1, len(messages))
 	require.Equal(t, "my other message", messages[0].Message)
 
@@ -52,7 +59,7 @@ func testCacheMessages(t *testing.T, c cache) {
 	require.Equal(t, 1, count)
 
 	// example: since all
-	messages, _ = c.Messages("example", sinceAllMessages, false)
+	messages, _ = c.Messages("example", sinceAllMessages, false, 0)
 	require.Equal(t, "my example message", messages[0].Message)
 
 	// non-existing: count
@@ -61,162 +68,2109 @@ func testCacheMessages(t *testing.T, c cache) {
 	require.Equal(t, 0, count)
 
 	// non-existing: since all
-	messages, _ = c.Messages("doesnotexist", sinceAllMessages, false)
+	messages, _ = c.Messages("doesnotexist", sinceAllMessages, false, 0)
 	require.Empty(t, messages)
 }
 
+func testCacheMessagesLimit(t *testing.T, c cache) {
+	for i := 1; i <= 5; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = int64(i)
+		require.Nil(t, c.AddMessage(m))
+	}
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 2) // Most recent two, ascending
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 4", messages[0].Message)
+	require.Equal(t, "message 5", messages[1].Message)
+
+	messages, err = c.Messages("mytopic", sinceAllMessages, false, 10)
+	require.Nil(t, err)
+	require.Equal(t, 5, len(messages))
+
+	messages, err = c.Messages("mytopic", sinceAllMessages, false, 0) // No limit
+	require.Nil(t, err)
+	require.Equal(t, 5, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+	require.Equal(t, "message 5", messages[4].Message)
+}
+
+func testCacheMessagesContextCanceled(t *testing.T, c cache) {
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my message")))
+
+	messages, err := c.MessagesContext(context.Background(), "mytopic", sinceAllMessages, false, 0, nil)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.MessagesContext(ctx, "mytopic", sinceAllMessages, false, 0, nil)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func testCacheMessagesFunc(t *testing.T, c cache) {
+	for i := 0; i < 5; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = int64(100 + i)
+		require.Nil(t, c.AddMessage(m))
+	}
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(scheduled))
+
+	// All messages, oldest first
+	messages := make([]string, 0)
+	require.Nil(t, c.MessagesFunc("mytopic", sinceAllMessages, false, func(m *message) error {
+		messages = append(messages, m.Message)
+		return nil
+	}))
+	require.Equal(t, []string{"message 0", "message 1", "message 2", "message 3", "message 4"}, messages)
+
+	count := 0
+	require.Nil(t, c.MessagesFunc("mytopic", newSinceTime(103), true, func(m *message) error {
+		count++
+		return nil
+	}))
+	require.Equal(t, 3, count) // message 3, message 4, scheduled
+
+	// Stops at the first error
+	errStop := errors.New("stop")
+	messages = make([]string, 0)
+	require.Equal(t, errStop, c.MessagesFunc("mytopic", sinceAllMessages, false, func(m *message) error {
+		messages = append(messages, m.Message)
+		if len(messages) == 2 {
+			return errStop
+		}
+		return nil
+	}))
+	require.Equal(t, []string{"message 0", "message 1"}, messages)
+
+	require.Nil(t, c.MessagesFunc("mytopic", sinceNoMessages, false, func(m *message) error {
+		t.Fatal("unexpected message")
+		return nil
+	}))
+}
+
+func testCacheMessagesFilter(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "disk full")
+	m1.Priority = 5
+	m1.Tags = []string{"warning", "disk"}
+	m1.Title = "Server alert"
+	m2 := newDefaultMessage("mytopic", "backup done")
+	m2.Tags = []string{"backup"}
+	m2.Title = "Backup"
+	m3 := newDefaultMessage("mytopic", "cpu hot")
+	m3.Priority = 4
+	m3.Tags = []string{"warning"}
+	m3.Title = "Another alert"
+	m4 := newDefaultMessage("mytopic", "weird tag")
+	m4.Tags = []string{"100%_sure"}
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4}))
+
+	filtered := func(filter *messageFilter, limit int) []string {
+		messages, err := c.MessagesContext(context.Background(), "mytopic", sinceAllMessages, false, limit, filter)
+		require.Nil(t, err)
+		texts := make([]string, 0)
+		for _, m := range messages {
+			texts = append(texts, m.Message)
+		}
+		return texts
+	}
+	require.Equal(t, []string{"disk full", "backup done", "cpu hot", "weird tag"}, filtered(nil, 0))
+	require.Equal(t, []string{"disk full", "cpu hot"}, filtered(&messageFilter{MinPriority: 4}, 0))
+	require.Equal(t, []string{"disk full", "backup done", "cpu hot", "weird tag"}, filtered(&messageFilter{MinPriority: 3}, 0)) // No priority = 3
+	require.Equal(t, []string{"disk full", "cpu hot"}, filtered(&messageFilter{Tags: []string{"warning"}}, 0))
+	require.Equal(t, []string{"disk full"}, filtered(&messageFilter{Tags: []string{"disk", "warning"}}, 0))
+	require.Equal(t, []string{}, filtered(&messageFilter{Tags: []string{"warn"}}, 0)) // No partial tag matches
+	require.Equal(t, []string{"weird tag"}, filtered(&messageFilter{Tags: []string{"100%_sure"}}, 0))
+	require.Equal(t, []string{}, filtered(&messageFilter{Tags: []string{"100%"}}, 0))
+	require.Equal(t, []string{"disk full", "cpu hot"}, filtered(&messageFilter{TitleContains: "ALERT"}, 0))
+	require.Equal(t, []string{"cpu hot"}, filtered(&messageFilter{TitleContains: "alert", MinPriority: 4}, 1)) // Limit applies after filtering
+}
+
+func testCacheMessagesFilterTagsExact(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "tagged warning")
+	m1.Tags = []string{"warning"}
+	m2 := newDefaultMessage("mytopic", "tagged unwarranted")
+	m2.Tags = []string{"unwarranted", "other"}
+	m3 := newDefaultMessage("mytopic", "tagged warn")
+	m3.Tags = []string{"disk", "warn", "full"}
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3}))
+
+	filtered := func(tags ...string) []string {
+		messages, err := c.MessagesContext(context.Background(), "mytopic", sinceAllMessages, false, 0, &messageFilter{Tags: tags})
+		require.Nil(t, err)
+		texts := make([]string, 0)
+		for _, m := range messages {
+			texts = append(texts, m.Message)
+		}
+		return texts
+	}
+	require.Equal(t, []string{"tagged warn"}, filtered("warn"))
+	require.Equal(t, []string{"tagged warning"}, filtered("warning"))
+	require.Equal(t, []string{"tagged unwarranted"}, filtered("unwarranted"))
+	require.Equal(t, []string{}, filtered("warr"))
+}
+
+func testCacheStats(t *testing.T, c cache) {
+	stats, err := c.Stats()
+	require.Nil(t, err)
+	require.Equal(t, 0, stats.Messages)
+	require.True(t, stats.OldestMessage.IsZero())
+
+	m1 := newDefaultMessage("mytopic", "oldest")
+	m1.Time = 1000
+	m2 := newDefaultMessage("mytopic", "with attachment")
+	m2.Attachment = &attachment{Name: "a.jpg", URL: "https://ntfy.sh/file/a.jpg", Size: 5000, Expires: time.Now().Add(time.Hour).Unix()}
+	m3 := newDefaultMessage("othertopic", "expired attachment")
+	m3.Attachment = &attachment{Name: "b.jpg", URL: "https://ntfy.sh/file/b.jpg", Size: 7000, Expires: time.Now().Add(-time.Hour).Unix()}
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3}))
+
+	stats, err = c.Stats()
+	require.Nil(t, err)
+	require.Equal(t, 3, stats.Messages)
+	require.Equal(t, 2, stats.Topics)
+	require.Equal(t, int64(5000), stats.AttachmentBytes)
+	require.Equal(t, int64(1000), stats.OldestMessage.Unix())
+	require.Equal(t, map[string]int64{"": 12000}, stats.AttachmentBytesByType) // Includes the expired attachment
+}
+
+func testCacheMessagesSinceID(t *testing.T, c cache) {
+	now := time.Now().Unix()
+	ids := make([]string, 0)
+	for i := 1; i <= 3; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = now // All in the same second
+		require.Nil(t, c.AddMessage(m))
+		ids = append(ids, m.ID)
+	}
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other")))
+
+	messages, err := c.Messages("mytopic", newSinceID(ids[0]), false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 2", messages[0].Message)
+	require.Equal(t, "message 3", messages[1].Message)
+
+	messages, err = c.Messages("mytopic", newSinceID(ids[2]), false, 0)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	messages, err = c.Messages("mytopic", newSinceID("doesnotexist"), false, 0) // Unknown ID returns everything
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+
+	// The ID of a deleted (e.g. pruned) message is unknown as well
+	_, err = c.DeleteMessage(ids[0])
+	require.Nil(t, err)
+	messages, err = c.Messages("mytopic", newSinceID(ids[0]), false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+}
+
+func testCacheMessagesSinceIDScheduled(t *testing.T, c cache) {
+	now := time.Now().Unix()
+	scheduled1 := newDefaultMessage("mytopic", "scheduled 1")
+	scheduled1.Time = now + 100
+	require.Nil(t, c.AddMessage(scheduled1))
+	scheduled2 := newDefaultMessage("mytopic", "scheduled 2")
+	scheduled2.Time = now + 200
+	require.Nil(t, c.AddMessage(scheduled2))
+	m := newDefaultMessage("mytopic", "message")
+	require.Nil(t, c.AddMessage(m))
+
+	messages, err := c.Messages("mytopic", newSinceID(m.ID), false, 0)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	// Scheduled messages that were stored before, but published after the given message are returned
+	require.Nil(t, c.MarkPublished(scheduled1))
+	messages, err = c.Messages("mytopic", newSinceID(m.ID), false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, scheduled1.ID, messages[0].ID)
+
+	changed, err := c.RecomputePublished(300 * time.Second)
+	require.Nil(t, err)
+	require.Equal(t, 1, changed)
+	messages, err = c.Messages("mytopic", newSinceID(scheduled1.ID), false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, scheduled2.ID, messages[0].ID)
+}
+
+func testCacheAddMessages(t *testing.T, c cache) {
+	require.Nil(t, c.AddMessages([]*message{
+		newDefaultMessage("mytopic", "message 1"),
+		newDefaultMessage("mytopic", "message 2"),
+		newDefaultMessage("example", "message 3"),
+	}))
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+	count, err = c.MessageCount("example")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	// All or nothing
+	invalid := newDefaultMessage("mytopic", "invalid")
+	invalid.Event = keepaliveEvent
+	require.Equal(t, errUnexpectedMessageType, c.AddMessages([]*message{
+		newDefaultMessage("mytopic", "message 4"),
+		invalid,
+	}))
+	count, err = c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+
+	require.Nil(t, c.AddMessages([]*message{}))
+}
+
+func testCacheDedup(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "backup failed")
+	m1.Dedup = true
+	require.Nil(t, c.AddMessage(m1))
+
+	// Identical message is skipped, and gets the ID of the original
+	m2 := newDefaultMessage("mytopic", "backup failed")
+	m2.Dedup = true
+	m2.Priority = 3 // Same as default priority
+	require.Equal(t, errDuplicateMessage, c.AddMessage(m2))
+	require.Equal(t, m1.ID, m2.ID)
+	require.Equal(t, m1.Time, m2.Time)
+
+	// Different topic, title or priority, or dedup not requested
+	m3 := newDefaultMessage("othertopic", "backup failed")
+	m3.Dedup = true
+	m4 := newDefaultMessage("mytopic", "backup failed")
+	m4.Dedup = true
+	m4.Title = "Backup"
+	m5 := newDefaultMessage("mytopic", "backup failed")
+	m5.Dedup = true
+	m5.Priority = 5
+	m6 := newDefaultMessage("mytopic", "backup failed")
+	for _, m := range []*message{m3, m4, m5, m6} {
+		require.Nil(t, c.AddMessage(m))
+	}
+
+	// Duplicates outside of the window are not skipped
+	m7 := newDefaultMessage("oldtopic", "backup failed")
+	m7.Time = time.Now().Add(-2 * time.Minute).Unix()
+	require.Nil(t, c.AddMessage(m7))
+	m8 := newDefaultMessage("oldtopic", "backup failed")
+	m8.Dedup = true
+	require.Nil(t, c.AddMessage(m8))
+	require.NotEqual(t, m7.ID, m8.ID)
+
+	// Duplicates within a batch are skipped without an error
+	m9 := newDefaultMessage("mytopic", "backup failed")
+	m9.Dedup = true
+	m10 := newDefaultMessage("batchtopic", "disk full")
+	m10.Dedup = true
+	m11 := newDefaultMessage("batchtopic", "disk full")
+	m11.Dedup = true
+	require.Nil(t, c.AddMessages([]*message{m9, m10, m11}))
+	require.Equal(t, m10.ID, m11.ID)
+
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 4, count) // m1, m4, m5, m6
+	count, err = c.MessageCount("batchtopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+}
+
+func testCacheMessageExists(t *testing.T, c cache) {
+	m := newDefaultMessage("mytopic", "first")
+	m.ID = "customid01"
+	require.Nil(t, c.AddMessage(m))
+
+	m2 := newDefaultMessage("othertopic", "second")
+	m2.ID = "customid01"
+	require.Equal(t, errMessageExists, c.AddMessage(m2))
+
+	// Batches are rejected as a whole, also if they contain the same ID twice
+	m3, m4 := newDefaultMessage("mytopic", "third"), newDefaultMessage("mytopic", "fourth")
+	m4.ID = "customid01"
+	require.Equal(t, errMessageExists, c.AddMessages([]*message{m3, m4}))
+	m5, m6 := newDefaultMessage("mytopic", "fifth"), newDefaultMessage("mytopic", "sixth")
+	m6.ID = m5.ID
+	require.Equal(t, errMessageExists, c.AddMessages([]*message{m5, m6}))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "first", messages[0].Message)
+	messages, err = c.Messages("othertopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(messages))
+}
+
+func testCacheIdempotencyKey(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "order shipped")
+	m1.IdempotencyKey = "order-1234"
+	m1.Tags = []string{"package"}
+	require.Nil(t, c.AddMessage(m1))
+
+	// Replayed key returns the original message, even if the content differs
+	m2 := newDefaultMessage("mytopic", "order shipped (retry)")
+	m2.IdempotencyKey = "order-1234"
+	require.Equal(t, errDuplicateMessage, c.AddMessage(m2))
+	require.Equal(t, m1.ID, m2.ID)
+	require.Equal(t, m1.Time, m2.Time)
+	require.Equal(t, "order shipped", m2.Message)
+	require.Equal(t, []string{"package"}, m2.Tags)
+
+	// Keys are scoped to the topic
+	m3 := newDefaultMessage("othertopic", "order shipped")
+	m3.IdempotencyKey = "order-1234"
+	require.Nil(t, c.AddMessage(m3))
+
+	// Replayed keys within a batch are skipped without an error
+	m4 := newDefaultMessage("mytopic", "order delivered")
+	m4.IdempotencyKey = "order-5678"
+	m5 := newDefaultMessage("mytopic", "order delivered")
+	m5.IdempotencyKey = "order-5678"
+	require.Nil(t, c.AddMessages([]*message{m4, m5}))
+	require.Equal(t, m4.ID, m5.ID)
+
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+	count, err = c.MessageCount("othertopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+}
+
+func testCacheUpdateMessage(t *testing.T, c cache) {
+	m := newDefaultMessage("mytopic", "temperature: 20C")
+	m.Title = "Living room"
+	m.Click = "https://example.com"
+	require.Nil(t, c.AddMessage(m))
+
+	update := newDefaultMessage("mytopic", "temperature: 22C")
+	update.Priority = 4
+	update.Tags = []string{"thermometer"}
+	update.Edited = m.Time + 10
+	require.Nil(t, c.UpdateMessage(m.ID, update))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m.ID, messages[0].ID)
+	require.Equal(t, m.Time, messages[0].Time) // Time is kept
+	require.Equal(t, m.Time+10, messages[0].Edited)
+	require.Equal(t, "temperature: 22C", messages[0].Message)
+	require.Equal(t, "", messages[0].Title)
+	require.Equal(t, 4, messages[0].Priority)
+	require.Equal(t, []string{"thermometer"}, messages[0].Tags)
+	require.Equal(t, "https://example.com", messages[0].Click) // Not part of the content
+
+	// Messages can only be updated within their topic
+	require.Equal(t, errNoRows, c.UpdateMessage("doesnotexist", update))
+	other := newDefaultMessage("othertopic", "hijacked")
+	require.Equal(t, errNoRows, c.UpdateMessage(m.ID, other))
+}
+
+func testCacheActions(t *testing.T, c cache) {
+	m := newDefaultMessage("mytopic", "door opened")
+	m.Actions = []*action{
+		{Type: "view", Label: "Open camera", URL: "https://home.example.com/camera"},
+		{Type: "http", Label: "Lock door", URL: "https://home.example.com/door", Method: "PUT", Headers: map[string]string{"Authorization": "Bearer abc"}, Body: "lock", Clear: true},
+		{Type: "broadcast", Label: "Take picture", Extras: map[string]string{"camera": "front"}},
+	}
+	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "no actions")))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, m.Actions, messages[0].Actions)
+	require.Nil(t, messages[1].Actions)
+
+	tooMany := newDefaultMessage("mytopic", "too many actions")
+	tooMany.Actions = append(m.Actions, &action{Type: "view", Label: "Fourth", URL: "https://example.com"})
+	require.ErrorIs(t, c.AddMessage(tooMany), errTooManyActions)
+
+	invalid := newDefaultMessage("mytopic", "invalid action")
+	invalid.Actions = []*action{{Type: "download", Label: "Download"}}
+	require.ErrorIs(t, c.AddMessage(invalid), errInvalidActionType)
+
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+}
+
+func testCacheIcon(t *testing.T, c cache) {
+	m := newDefaultMessage("mytopic", "with icon")
+	m.Icon = "https://example.com/icon.png"
+	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "without icon")))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "https://example.com/icon.png", messages[0].Icon)
+	require.Equal(t, "", messages[1].Icon)
+}
+
+func testCacheContentType(t *testing.T, c cache) {
+	m := newDefaultMessage("mytopic", "**disk full**")
+	m.ContentType = contentTypeMarkdown
+	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "no content type")))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, contentTypeMarkdown, messages[0].ContentType)
+	require.Equal(t, contentTypePlain, messages[1].ContentType)
+}
+
+func testCacheEvents(t *testing.T, c cache) {
+	m := newDefaultMessage("mytopic", "a message")
+	pollRequest := newMessage(pollRequestEvent, "mytopic", "")
+	require.Nil(t, c.AddMessages([]*message{m, pollRequest}))
+
+	// Default is message events only
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m.ID, messages[0].ID)
+	require.Equal(t, messageEvent, messages[0].Event)
+
+	messages, err = c.MessagesContext(context.Background(), "mytopic", sinceAllMessages, false, 0, &messageFilter{MinPriority: 1})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+
+	// Other events have to be requested explicitly
+	messages, err = c.MessagesContext(context.Background(), "mytopic", sinceAllMessages, false, 0, &messageFilter{Events: []string{pollRequestEvent}})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, pollRequest.ID, messages[0].ID)
+	require.Equal(t, pollRequestEvent, messages[0].Event)
+
+	messages, err = c.MessagesContext(context.Background(), "mytopic", sinceAllMessages, false, 0, &messageFilter{Events: []string{messageEvent, pollRequestEvent}})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+}
+
+func testCacheMessagesBetween(t *testing.T, c cache) {
+	for _, ts := range []int64{1000, 2000, 3000, 4000} {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message at %d", ts))
+		m.Time = ts
+		require.Nil(t, c.AddMessage(m))
+	}
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "message now")))
+	scheduled := newDefaultMessage("mytopic", "scheduled message")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(scheduled))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other message")))
+
+	// Both bounds are inclusive
+	messages, err := c.MessagesBetween("mytopic", time.Unix(2000, 0), time.Unix(3000, 0), false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message at 2000", messages[0].Message)
+	require.Equal(t, "message at 3000", messages[1].Message)
+
+	// Zero upper bound means now, even if scheduled messages are included
+	messages, err = c.MessagesBetween("mytopic", time.Unix(3500, 0), time.Time{}, true)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message at 4000", messages[0].Message)
+	require.Equal(t, "message now", messages[1].Message)
+
+	messages, err = c.MessagesBetween("mytopic", time.Unix(5000, 0), time.Unix(6000, 0), false)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func testCacheMessageCount(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "my message")
+	m1.Time = 1000
+	m1.IdempotencyKey = "key1"
+	require.Nil(t, c.AddMessage(m1))
+	m2 := newDefaultMessage("mytopic", "my other message")
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other message")))
+	duplicate := newDefaultMessage("mytopic", "my message again")
+	duplicate.IdempotencyKey = "key1"
+	require.Equal(t, errDuplicateMessage, c.AddMessage(duplicate))
+
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+
+	_, err = c.DeleteMessage(m2.ID)
+	require.Nil(t, err)
+	_, err = c.DeleteMessage("doesnotexist")
+	require.Nil(t, err)
+	count, err = c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	_, err = c.Prune(time.Unix(2000, 0), time.Unix(2000, 0), nil, nil, nil)
+	require.Nil(t, err)
+	count, err = c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+
+	_, err = c.DeleteMessagesForTopic("othertopic")
+	require.Nil(t, err)
+	count, err = c.MessageCount("othertopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+}
+
+func testCacheMarkRead(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "first message")
+	m2 := newDefaultMessage("mytopic", "second message")
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	require.Nil(t, c.MarkRead(m1.ID, "phil"))
+	require.Nil(t, c.MarkRead(m1.ID, "phil")) // Twice is fine
+	require.Equal(t, errNoRows, c.MarkRead("doesnotexist", "phil"))
+
+	messages, err := c.MessagesContext(context.Background(), "mytopic", sinceAllMessages, false, 0, &messageFilter{UnreadBy: "phil"})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "second message", messages[0].Message)
+
+	messages, err = c.MessagesContext(context.Background(), "mytopic", sinceAllMessages, false, 0, &messageFilter{UnreadBy: "lisa"})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+
+	messages, err = c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+
+	// Read receipts do not outlive their messages
+	_, err = c.DeleteMessage(m1.ID)
+	require.Nil(t, err)
+	_, err = c.Prune(time.Unix(0, 0), time.Unix(0, 0), nil, nil, nil)
+	require.Nil(t, err)
+	require.Nil(t, c.AddMessage(m1))
+	messages, err = c.MessagesContext(context.Background(), "mytopic", sinceAllMessages, false, 0, &messageFilter{UnreadBy: "phil"})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+}
+
+func testCacheClose(t *testing.T, c cache) {
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my message")))
+	require.Nil(t, c.Close())
+	require.Nil(t, c.Close()) // Twice is fine
+}
+
+func testCacheMarkPublishedBatch(t *testing.T, c cache) {
+	ms := make([]*message, 0)
+	ids := make([]string, 0)
+	for i := 0; i < 1200; i++ { // More than one chunk
+		m := newDefaultMessage("mytopic", fmt.Sprintf("scheduled message %d", i))
+		m.Time = time.Now().Add(time.Hour).Unix()
+		ms = append(ms, m)
+		if i%2 == 0 {
+			ids = append(ids, m.ID)
+		}
+	}
+	require.Nil(t, c.AddMessages(ms))
+	require.Nil(t, c.MarkPublishedBatch(ids))
+	require.Nil(t, c.MarkPublishedBatch(nil))
+
+	count, err := c.ScheduledCount()
+	require.Nil(t, err)
+	require.Equal(t, 600, count)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0) // Only published messages
+	require.Nil(t, err)
+	require.Equal(t, 600, len(messages))
+	require.Equal(t, "scheduled message 0", messages[0].Message)
+}
+
+func testCacheAddMessagePublished(t *testing.T, c cache) {
+	published, err := c.AddMessagePublished(newDefaultMessage("mytopic", "now"))
+	require.Nil(t, err)
+	require.True(t, published)
+
+	delayed := newDefaultMessage("mytopic", "later")
+	delayed.Time = time.Now().Add(time.Hour).Unix()
+	published, err = c.AddMessagePublished(delayed)
+	require.Nil(t, err)
+	require.False(t, published)
+
+	count, err := c.ScheduledCount()
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	m := newDefaultMessage("mytopic", "once")
+	m.Dedup = true
+	published, err = c.AddMessagePublished(m)
+	require.Nil(t, err)
+	require.True(t, published)
+	duplicate := newDefaultMessage("mytopic", "once")
+	duplicate.Dedup = true
+	published, err = c.AddMessagePublished(duplicate)
+	require.ErrorIs(t, err, errDuplicateMessage)
+	require.False(t, published)
+}
+
+func testCacheReadPublished(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "delivered")
+	m2 := newDefaultMessage("mytopic", "scheduled")
+	m2.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, true, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.True(t, messages[0].Published)
+	require.False(t, messages[1].Published)
+	b, err := json.Marshal(messages[1])
+	require.Nil(t, err)
+	require.NotContains(t, string(b), "published") // Not exposed to subscribers
+
+	messages, err = c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.True(t, messages[0].Published)
+
+	require.Nil(t, c.MarkPublished(m2))
+	messages, err = c.MessagesByIDs([]string{m2.ID})
+	require.Nil(t, err)
+	require.True(t, messages[0].Published)
+
+	m3 := newDefaultMessage("mytopic", "scheduled")
+	m3.Time = time.Now().Add(time.Second).Unix()
+	require.Nil(t, c.AddMessage(m3))
+	changed, err := c.RecomputePublished(time.Minute)
+	require.Nil(t, err)
+	require.Equal(t, 1, changed)
+	messages, err = c.MessagesByIDs([]string{m3.ID})
+	require.Nil(t, err)
+	require.True(t, messages[0].Published)
+}
+
+func testCacheTopicMetadata(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m1.Time = 1000
+	m2 := newDefaultMessage("mytopic", "message 2")
+	m2.Time = 3000
+	m3 := newDefaultMessage("mytopic", "message 3")
+	m3.Time = 2000
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other")))
+	require.Nil(t, c.SetTopicDisplayName("mytopic", "My Topic"))
+
+	topics, err := c.Topics()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(topics))
+	require.Equal(t, int64(3000), topics["mytopic"].LastMessageTime)
+	require.Equal(t, 3, topics["mytopic"].MessageCount)
+	require.Equal(t, "My Topic", topics["mytopic"].DisplayName)
+	require.Equal(t, 1, topics["othertopic"].MessageCount)
+	require.Equal(t, "", topics["othertopic"].DisplayName)
+
+	// Message count excludes pruned and deleted messages, but the last message time is kept
+	_, err = c.Prune(time.Unix(1500, 0), time.Unix(1500, 0), nil, nil, nil)
+	require.Nil(t, err)
+	topics, err = c.Topics()
+	require.Nil(t, err)
+	require.Equal(t, 2, topics["mytopic"].MessageCount)
+	require.Equal(t, int64(3000), topics["mytopic"].LastMessageTime)
+
+	_, err = c.DeleteMessage(m3.ID)
+	require.Nil(t, err)
+	topics, err = c.Topics()
+	require.Nil(t, err)
+	require.Equal(t, 1, topics["mytopic"].MessageCount)
+	require.Equal(t, int64(3000), topics["mytopic"].LastMessageTime)
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, count, topics["mytopic"].MessageCount)
+}
+
 func testCacheTopics(t *testing.T, c cache) {
 	require.Nil(t, c.AddMessage(newDefaultMessage("topic1", "my example message")))
 	require.Nil(t, c.AddMessage(newDefaultMessage("topic2", "message 1")))
 	require.Nil(t, c.AddMessage(newDefaultMessage("topic2", "message 2")))
 	require.Nil(t, c.AddMessage(newDefaultMessage("topic2", "message 3")))
 
-	topics, err := c.Topics()
-	if err != nil {
-		t.Fatal(err)
+	topics, err := c.Topics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	require.Equal(t, 2, len(topics))
+	require.Equal(t, "topic1", topics["topic1"].ID)
+	require.Equal(t, "topic2", topics["topic2"].ID)
+}
+
+func testCacheTopicsSince(t *testing.T, c cache) {
+	old := newDefaultMessage("deadtopic", "long ago")
+	old.Time = time.Now().Add(-48 * time.Hour).Unix()
+	scheduled := newDefaultMessage("scheduledtopic", "not yet")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessages([]*message{
+		old,
+		scheduled,
+		newDefaultMessage("topic1", "recent"),
+		newDefaultMessage("topic2", "recent 1"),
+		newDefaultMessage("topic2", "recent 2"),
+	}))
+
+	topics, err := c.TopicsSince(time.Now().Add(-time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(topics))
+	require.Equal(t, "topic1", topics["topic1"].ID)
+	require.Equal(t, "topic2", topics["topic2"].ID)
+
+	topics, err = c.TopicsSince(time.Now().Add(-72 * time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, 3, len(topics))
+	require.NotNil(t, topics["deadtopic"])
+}
+
+func testCacheMessagesMulti(t *testing.T, c cache) {
+	m1 := newDefaultMessage("topic1", "first")
+	m1.Time = 100
+	m2 := newDefaultMessage("topic2", "second")
+	m2.Time = 200
+	m3 := newDefaultMessage("topic1", "third")
+	m3.Time = 300
+	scheduled := newDefaultMessage("topic2", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessages([]*message{m3, m1, m2, scheduled, newDefaultMessage("othertopic", "other")}))
+
+	messages, err := c.MessagesMulti([]string{"topic1", "topic2", "emptytopic"}, sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, 2, len(messages["topic1"]))
+	require.Equal(t, "first", messages["topic1"][0].Message)
+	require.Equal(t, "third", messages["topic1"][1].Message)
+	require.Equal(t, 1, len(messages["topic2"]))
+	require.Equal(t, "second", messages["topic2"][0].Message)
+	require.Equal(t, 0, len(messages["emptytopic"]))
+
+	messages, err = c.MessagesMulti([]string{"topic1", "topic2"}, newSinceTime(150), true)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages["topic1"]))
+	require.Equal(t, "third", messages["topic1"][0].Message)
+	require.Equal(t, 2, len(messages["topic2"]))
+	require.Equal(t, "second", messages["topic2"][0].Message)
+	require.Equal(t, "scheduled", messages["topic2"][1].Message)
+
+	messages, err = c.MessagesMulti([]string{"topic1", "topic2"}, sinceNoMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(messages["topic1"]))
+	require.Equal(t, 0, len(messages["topic2"]))
+}
+
+func testCacheTopicExists(t *testing.T, c cache) {
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "my example message")))
+
+	exists, err := c.TopicExists("mytopic")
+	require.Nil(t, err)
+	require.True(t, exists)
+
+	exists, err = c.TopicExists("nevertopic")
+	require.Nil(t, err)
+	require.False(t, exists)
+}
+
+func testCachePrune(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "my message")
+	m1.Time = 1
+
+	m2 := newDefaultMessage("mytopic", "my other message")
+	m2.Time = 2
+
+	m3 := newDefaultMessage("another_topic", "and another one")
+	m3.Time = 1
+
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+	deleted, err := c.Prune(time.Unix(2, 0), time.Unix(2, 0), nil, nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), deleted)
+
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	count, err = c.MessageCount("another_topic")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "my other message", messages[0].Message)
+}
+
+func testCachePruneDryRun(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "my message")
+	m1.Time = 1
+	m2 := newDefaultMessage("mytopic", "my other message")
+	m2.Time = 2
+	m3 := newDefaultMessage("another_topic", "pinned")
+	m3.Time = 1
+	m3.Pinned = true
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, scheduled}))
+
+	messages, bytes, err := c.PruneDryRun(time.Unix(2, 0))
+	require.Nil(t, err)
+	require.Equal(t, int64(1), messages)
+	require.Equal(t, int64(len("my message")), bytes)
+
+	messages, bytes, err = c.PruneDryRun(time.Now().Add(2 * time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, int64(2), messages)
+	require.Equal(t, int64(len("my message")+len("my other message")), bytes)
+
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 3, count) // Nothing was deleted
+}
+
+func testCachePruneInactive(t *testing.T, c cache) {
+	for _, topic := range []string{"active", "inactive"} {
+		m1 := newDefaultMessage(topic, "two hours old")
+		m1.Time = time.Now().Add(-2 * time.Hour).Unix()
+		m2 := newDefaultMessage(topic, "five minutes old")
+		m2.Time = time.Now().Add(-5 * time.Minute).Unix()
+		require.Nil(t, c.AddMessage(m1))
+		require.Nil(t, c.AddMessage(m2))
+	}
+	deleted, err := c.Prune(time.Now().Add(-3*time.Hour), time.Now().Add(-time.Hour), []string{"active"}, nil, nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), deleted)
+
+	count, err := c.MessageCount("active")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+
+	messages, err := c.Messages("inactive", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "five minutes old", messages[0].Message)
+
+	deleted, err = c.Prune(time.Now().Add(-3*time.Hour), time.Now().Add(-time.Minute), nil, nil, nil) // No active topics
+	require.Nil(t, err)
+	require.Equal(t, int64(3), deleted)
+	count, err = c.MessageCount("active")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+}
+
+func testCachePrunePerTopic(t *testing.T, c cache) {
+	for _, topic := range []string{"logs", "alerts", "other"} {
+		m1 := newDefaultMessage(topic, "two days old")
+		m1.Time = time.Now().Add(-48 * time.Hour).Unix()
+		m2 := newDefaultMessage(topic, "two hours old")
+		m2.Time = time.Now().Add(-2 * time.Hour).Unix()
+		require.Nil(t, c.AddMessage(m1))
+		require.Nil(t, c.AddMessage(m2))
+	}
+	perTopic := map[string]time.Time{
+		"logs":   time.Now().Add(-time.Hour),           // Shorter than the default
+		"alerts": time.Now().Add(-30 * 24 * time.Hour), // Longer than the default
+	}
+	deleted, err := c.Prune(time.Now().Add(-12*time.Hour), time.Now().Add(-12*time.Hour), nil, perTopic, nil)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), deleted)
+
+	count, err := c.MessageCount("logs")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+
+	count, err = c.MessageCount("alerts")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+
+	messages, err := c.Messages("other", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "two hours old", messages[0].Message)
+}
+
+func testCachePrunePerPriority(t *testing.T, c cache) {
+	for _, topic := range []string{"mytopic", "logs"} {
+		for _, priority := range []int{0, 1, 3, 5} {
+			m := newDefaultMessage(topic, fmt.Sprintf("priority %d, two days old", priority))
+			m.Priority = priority
+			m.Time = time.Now().Add(-48 * time.Hour).Unix()
+			require.Nil(t, c.AddMessage(m))
+		}
+	}
+	perTopic := map[string]time.Time{
+		"logs": time.Now().Add(-time.Hour), // Topic overrides priority
+	}
+	perPriority := map[int]time.Time{
+		5: time.Now().Add(-30 * 24 * time.Hour), // Longer than the default
+		3: time.Now().Add(-72 * time.Hour),      // Applies to messages without explicit priority too
+	}
+	deleted, err := c.Prune(time.Now().Add(-24*time.Hour), time.Now().Add(-24*time.Hour), nil, perTopic, perPriority)
+	require.Nil(t, err)
+	require.Equal(t, int64(5), deleted)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "priority 0, two days old", messages[0].Message)
+	require.Equal(t, "priority 3, two days old", messages[1].Message)
+	require.Equal(t, "priority 5, two days old", messages[2].Message)
+
+	count, err := c.MessageCount("logs")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+}
+
+func testCachePruneToCount(t *testing.T, c cache) {
+	for i := 1; i <= 5; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = time.Now().Add(time.Duration(i-10) * time.Minute).Unix()
+		m.Pinned = i == 1
+		require.Nil(t, c.AddMessage(m))
+	}
+	scheduled := newDefaultMessage("mytopic", "scheduled")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(scheduled))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other")))
+
+	deleted, err := c.PruneToCount(2)
+	require.Nil(t, err)
+	require.Equal(t, 2, deleted)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, true, 0)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(messages))
+	require.Equal(t, "message 1", messages[0].Message) // Pinned
+	require.Equal(t, "message 4", messages[1].Message)
+	require.Equal(t, "message 5", messages[2].Message)
+	require.Equal(t, "scheduled", messages[3].Message) // Not counted, not deleted
+
+	count, err := c.MessageCount("othertopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+}
+
+func testCacheMessagesTagsPrioAndTitle(t *testing.T, c cache) {
+	m := newDefaultMessage("mytopic", "some message")
+	m.Tags = []string{"tag1", "tag2"}
+	m.Priority = 5
+	m.Title = "some title"
+	require.Nil(t, c.AddMessage(m))
+
+	messages, _ := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Equal(t, []string{"tag1", "tag2"}, messages[0].Tags)
+	require.Equal(t, 5, messages[0].Priority)
+	require.Equal(t, "some title", messages[0].Title)
+}
+
+func testCacheMessagesByIDs(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m1.Time = 1
+	m2 := newDefaultMessage("another-topic", "message 2")
+	m2.Time = 2
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "message 3")))
+
+	messages, err := c.MessagesByIDs([]string{m2.ID, "doesnotexist", m1.ID})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+	require.Equal(t, "message 2", messages[1].Message)
+
+	ids := make([]string, 0) // More IDs than fit into one query
+	for i := 0; i < 1200; i++ {
+		ids = append(ids, fmt.Sprintf("id%d", i))
+	}
+	ids = append(ids, m1.ID)
+	messages, err = c.MessagesByIDs(ids)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+
+	// Messages with the same time are returned in the order they were added, across topics and queries
+	sameTime := make([]*message, 0)
+	for i := 0; i < 600; i++ {
+		m := newDefaultMessage(fmt.Sprintf("topic%d", i%3), fmt.Sprintf("same second %d", i))
+		m.Time = 5
+		sameTime = append(sameTime, m)
+	}
+	require.Nil(t, c.AddMessages(sameTime))
+	ids = make([]string, 0)
+	for i := len(sameTime) - 1; i >= 0; i-- {
+		ids = append(ids, sameTime[i].ID)
+	}
+	messages, err = c.MessagesByIDs(ids)
+	require.Nil(t, err)
+	require.Equal(t, 600, len(messages))
+	for i, m := range messages {
+		require.Equal(t, sameTime[i].ID, m.ID)
+	}
+
+	messages, err = c.MessagesByIDs([]string{})
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func testCacheMessagesScheduled(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m2 := newDefaultMessage("mytopic", "message 2")
+	m2.Time = time.Now().Add(time.Hour).Unix()
+	m3 := newDefaultMessage("mytopic", "message 3")
+	m3.Time = time.Now().Add(time.Minute).Unix() // earlier than m2!
+	m4 := newDefaultMessage("mytopic2", "message 4")
+	m4.Time = time.Now().Add(time.Minute).Unix()
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+
+	messages, _ := c.Messages("mytopic", sinceAllMessages, false, 0) // exclude scheduled
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+
+	messages, _ = c.Messages("mytopic", sinceAllMessages, true, 0) // include scheduled
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "message 1", messages[0].Message)
+	require.Equal(t, "message 3", messages[1].Message) // Order!
+	require.Equal(t, "message 2", messages[2].Message)
+
+	messages, _ = c.MessagesDue()
+	require.Empty(t, messages)
+
+	count, err := c.ScheduledCount()
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+
+	require.Nil(t, c.AddMessage(m4))
+	count, err = c.ScheduledCountForTopic("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+	count, err = c.ScheduledCountForTopic("mytopic2")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+	count, err = c.ScheduledCount()
+	require.Nil(t, err)
+	require.Equal(t, 3, count)
+}
+
+func testCacheMessagesSameSecondOrder(t *testing.T, c cache) {
+	now := time.Now().Unix()
+	for _, id := range []string{"zzz", "aaa", "mmm"} { // IDs deliberately not in sort order
+		m := newDefaultMessage("mytopic", "message "+id)
+		m.ID = id
+		m.Time = now
+		require.Nil(t, c.AddMessage(m))
 	}
-	require.Equal(t, 2, len(topics))
-	require.Equal(t, "topic1", topics["topic1"].ID)
-	require.Equal(t, "topic2", topics["topic2"].ID)
+	for i := 0; i < 10; i++ {
+		messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+		require.Nil(t, err)
+		require.Equal(t, 3, len(messages))
+		require.Equal(t, "zzz", messages[0].ID)
+		require.Equal(t, "aaa", messages[1].ID)
+		require.Equal(t, "mmm", messages[2].ID)
+	}
+}
+
+func testCacheMessagesOrder(t *testing.T, c cache) {
+	now := time.Now().Unix()
+	for i := 0; i < 5; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = now - int64(4-i)
+		require.Nil(t, c.AddMessage(m))
+	}
+	m := newDefaultMessage("mytopic", "message 5") // Same second as message 4
+	m.Time = now
+	require.Nil(t, c.AddMessage(m))
+
+	desc := &messageFilter{Order: orderDesc}
+	messages, err := c.MessagesContext(context.Background(), "mytopic", sinceAllMessages, false, 0, desc)
+	require.Nil(t, err)
+	require.Equal(t, 6, len(messages))
+	require.Equal(t, "message 5", messages[0].Message)
+	require.Equal(t, "message 4", messages[1].Message)
+	require.Equal(t, "message 0", messages[5].Message)
+
+	messages, err = c.MessagesContext(context.Background(), "mytopic", sinceAllMessages, false, 3, desc)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "message 5", messages[0].Message)
+	require.Equal(t, "message 3", messages[2].Message)
+
+	collected := make([]string, 0)
+	require.Nil(t, c.MessagesFuncContext(context.Background(), "mytopic", newSinceTime(now-1), false, desc, func(m *message) error {
+		collected = append(collected, m.Message)
+		return nil
+	}))
+	require.Equal(t, []string{"message 5", "message 4", "message 3"}, collected)
+
+	// Ascending is the default
+	messages, err = c.MessagesContext(context.Background(), "mytopic", sinceAllMessages, false, 3, &messageFilter{Order: orderAsc})
+	require.Nil(t, err)
+	require.Equal(t, "message 3", messages[0].Message)
+	require.Equal(t, "message 5", messages[2].Message)
+	messages, err = c.Messages("mytopic", sinceAllMessages, false, 3)
+	require.Nil(t, err)
+	require.Equal(t, "message 3", messages[0].Message)
+	require.Equal(t, "message 5", messages[2].Message)
+}
+
+func testCacheRecomputePublished(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "in 10 seconds")
+	m1.Time = time.Now().Add(10 * time.Second).Unix()
+	m2 := newDefaultMessage("mytopic", "in an hour")
+	m2.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+
+	changed, err := c.RecomputePublished(time.Minute)
+	require.Nil(t, err)
+	require.Equal(t, 1, changed)
+
+	messages, _ := c.Messages("mytopic", sinceAllMessages, false, 0) // exclude scheduled
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "in 10 seconds", messages[0].Message)
+
+	count, err := c.ScheduledCount()
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	changed, err = c.RecomputePublished(time.Minute) // Nothing left to change
+	require.Nil(t, err)
+	require.Equal(t, 0, changed)
+}
+
+func testCachePublishedBetween(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "sent right away")
+	m1.Time = time.Now().Add(-2 * time.Hour).Unix()
+	m2 := newDefaultMessage("mytopic", "scheduled message")
+	m2.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+
+	now := time.Now()
+	messages, err := c.PublishedBetween(now.Add(-time.Minute), now.Add(time.Minute))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages)) // Not m2, it has not been delivered yet
+	require.Equal(t, "sent right away", messages[0].Message)
+
+	require.Nil(t, c.MarkPublished(m2)) // Delivered now, not at its logical time
+	messages, err = c.PublishedBetween(now.Add(-time.Minute), now.Add(time.Minute))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "sent right away", messages[0].Message)
+	require.Equal(t, "scheduled message", messages[1].Message)
+
+	messages, err = c.PublishedBetween(now.Add(30*time.Minute), now.Add(2*time.Hour)) // Around m2.Time
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func testCacheAllScheduledMessages(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "in two hours")
+	m1.Time = time.Now().Add(2 * time.Hour).Unix()
+	m2 := newDefaultMessage("another-topic", "in one hour")
+	m2.Time = time.Now().Add(time.Hour).Unix()
+	m3 := newDefaultMessage("third-topic", "in three hours")
+	m3.Time = time.Now().Add(3 * time.Hour).Unix()
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "not scheduled")))
+
+	messages, err := c.AllScheduledMessages(10)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "in one hour", messages[0].Message)
+	require.Equal(t, "another-topic", messages[0].Topic)
+	require.Equal(t, "in two hours", messages[1].Message)
+	require.Equal(t, "in three hours", messages[2].Message)
+
+	messages, err = c.AllScheduledMessages(2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "in two hours", messages[1].Message)
+}
+
+func testCacheAttachments(t *testing.T, c cache) {
+	expires1 := time.Now().Add(-4 * time.Hour).Unix()
+	m := newDefaultMessage("mytopic", "flower for you")
+	m.ID = "m1"
+	m.Attachment = &attachment{
+		Name:    "flower.jpg",
+		Type:    "image/jpeg",
+		Size:    5000,
+		Expires: expires1,
+		URL:     "https://ntfy.sh/file/AbDeFgJhal.jpg",
+		Owner:   "1.2.3.4",
+	}
+	require.Nil(t, c.AddMessage(m))
+
+	expires2 := time.Now().Add(2 * time.Hour).Unix() // Future
+	m = newDefaultMessage("mytopic", "sending you a car")
+	m.ID = "m2"
+	m.Attachment = &attachment{
+		Name:    "car.jpg",
+		Type:    "image/jpeg",
+		Size:    10000,
+		Expires: expires2,
+		URL:     "https://ntfy.sh/file/aCaRURL.jpg",
+		Owner:   "1.2.3.4",
+	}
+	require.Nil(t, c.AddMessage(m))
+
+	expires3 := time.Now().Add(1 * time.Hour).Unix() // Future
+	m = newDefaultMessage("another-topic", "sending you another car")
+	m.ID = "m3"
+	m.Attachment = &attachment{
+		Name:    "another-car.jpg",
+		Type:    "image/jpeg",
+		Size:    20000,
+		Expires: expires3,
+		URL:     "https://ntfy.sh/file/zakaDHFW.jpg",
+		Owner:   "1.2.3.4",
+	}
+	require.Nil(t, c.AddMessage(m))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+
+	require.Equal(t, "flower for you", messages[0].Message)
+	require.Equal(t, "flower.jpg", messages[0].Attachment.Name)
+	require.Equal(t, "image/jpeg", messages[0].Attachment.Type)
+	require.Equal(t, int64(5000), messages[0].Attachment.Size)
+	require.Equal(t, expires1, messages[0].Attachment.Expires)
+	require.Equal(t, "https://ntfy.sh/file/AbDeFgJhal.jpg", messages[0].Attachment.URL)
+	require.Equal(t, "1.2.3.4", messages[0].Attachment.Owner)
+
+	require.Equal(t, "sending you a car", messages[1].Message)
+	require.Equal(t, "car.jpg", messages[1].Attachment.Name)
+	require.Equal(t, "image/jpeg", messages[1].Attachment.Type)
+	require.Equal(t, int64(10000), messages[1].Attachment.Size)
+	require.Equal(t, expires2, messages[1].Attachment.Expires)
+	require.Equal(t, "https://ntfy.sh/file/aCaRURL.jpg", messages[1].Attachment.URL)
+	require.Equal(t, "1.2.3.4", messages[1].Attachment.Owner)
+
+	size, err := c.AttachmentsSize("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(30000), size)
+
+	size, err = c.AttachmentsSize("5.6.7.8")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), size)
+
+	ids, err := c.AttachmentsExpired()
+	require.Nil(t, err)
+	require.Equal(t, []string{"m1"}, ids)
+}
+
+func testCacheAttachmentOwner(t *testing.T, c cache) {
+	expires := time.Now().Add(time.Hour).Unix()
+	for i, owner := range []string{"1.2.3.4", "1.2.3.4", "5.6.7.8", "9.9.9.9"} {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Attachment = &attachment{
+			Name:    fmt.Sprintf("file%d.txt", i),
+			Size:    1000,
+			Expires: expires,
+			URL:     fmt.Sprintf("https://ntfy.sh/file/file%d.txt", i),
+			Owner:   owner,
+		}
+		require.Nil(t, c.AddMessage(m))
+	}
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "no attachment")))
+
+	// Re-home attachments of 1.2.3.4 to 5.6.7.8
+	require.Nil(t, c.ReassignAttachments("1.2.3.4", "5.6.7.8"))
+	size, err := c.AttachmentsSize("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), size)
+	size, err = c.AttachmentsSize("5.6.7.8")
+	require.Nil(t, err)
+	require.Equal(t, int64(3000), size)
+
+	// Anonymize attachments of 5.6.7.8, other owners are untouched
+	require.Nil(t, c.ClearAttachmentOwner("5.6.7.8"))
+	size, err = c.AttachmentsSize("5.6.7.8")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), size)
+	size, err = c.AttachmentsSize("9.9.9.9")
+	require.Nil(t, err)
+	require.Equal(t, int64(1000), size)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 5, len(messages))
+	require.Equal(t, "", messages[0].Attachment.Owner)
+	require.Equal(t, "9.9.9.9", messages[3].Attachment.Owner)
+}
+
+func testCacheAttachmentDownloads(t *testing.T, c cache) {
+	m := newDefaultMessage("mytopic", "flower for you")
+	m.Attachment = &attachment{
+		Name:    "flower.jpg",
+		Size:    5000,
+		Expires: time.Now().Add(time.Hour).Unix(),
+		URL:     "https://ntfy.sh/file/AbDeFgJhal.jpg",
+		Owner:   "1.2.3.4",
+	}
+	require.Nil(t, c.AddMessage(m))
+	noAttachment := newDefaultMessage("mytopic", "no attachment")
+	require.Nil(t, c.AddMessage(noAttachment))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.Nil(t, c.IncrementDownloads(m.ID))
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, errNoRows, c.IncrementDownloads(noAttachment.ID))
+	require.Equal(t, errNoRows, c.IncrementDownloads("doesnotexist"))
+
+	bytes, err := c.DownloadBytes("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(50000), bytes)
+	bytes, err = c.DownloadBytes("5.6.7.8")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), bytes)
 }
 
-func testCachePrune(t *testing.T, c cache) {
-	m1 := newDefaultMessage("mytopic", "my message")
-	m1.Time = 1
+func testCacheRewriteAttachmentURLs(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "flower for you")
+	m1.Attachment = &attachment{Name: "flower.jpg", URL: "https://old.example.com/file/AbDeFgJhal.jpg"}
+	m2 := newDefaultMessage("mytopic", "external file")
+	m2.Attachment = &attachment{Name: "car.jpg", URL: "https://other.example.com/car.jpg"}
+	m3 := newDefaultMessage("another-topic", "another flower")
+	m3.Attachment = &attachment{Name: "flower2.jpg", URL: "https://old.example.com/file/zakaDHFW.jpg"}
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "no attachment")))
+
+	updated, err := c.RewriteAttachmentURLs("https://old.example.com", "https://new.example.com")
+	require.Nil(t, err)
+	require.Equal(t, 2, updated)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "https://new.example.com/file/AbDeFgJhal.jpg", messages[0].Attachment.URL)
+	require.Equal(t, "https://other.example.com/car.jpg", messages[1].Attachment.URL)
+	require.Nil(t, messages[2].Attachment)
+
+	messages, err = c.Messages("another-topic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, "https://new.example.com/file/zakaDHFW.jpg", messages[0].Attachment.URL)
+
+	updated, err = c.RewriteAttachmentURLs("https://old_example.com", "https://new.example.com") // No LIKE wildcards
+	require.Nil(t, err)
+	require.Equal(t, 0, updated)
+}
+
+func testCacheEncodedPayloadTooLarge(t *testing.T, c cache) {
+	m := newDefaultMessage("mytopic", base64.StdEncoding.EncodeToString(make([]byte, DefaultMessageLengthLimit)))
+	m.Encoding = encodingBase64
+	require.Nil(t, c.AddMessage(m))
+
+	m = newDefaultMessage("mytopic", base64.StdEncoding.EncodeToString(make([]byte, DefaultMessageLengthLimit+1)))
+	m.Encoding = encodingBase64
+	err := c.AddMessage(m)
+	require.True(t, errors.Is(err, errEncodedPayloadTooLarge))
+	require.Contains(t, err.Error(), "4097 bytes")
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+}
+
+func testCacheMessageTooLarge(t *testing.T, c cache) {
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", strings.Repeat("x", DefaultMessageLengthLimit))))
+	m := newDefaultMessage("mytopic", strings.Repeat("x", DefaultMessageLengthLimit+1))
+	err := c.AddMessage(m)
+	require.True(t, errors.Is(err, errMessageTooLarge))
+	require.Equal(t, "message too large: message is 4097 bytes, limit is 4096 bytes", err.Error())
+	require.True(t, errors.Is(c.AddMessages([]*message{newDefaultMessage("mytopic", "small"), m}), errMessageTooLarge))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.True(t, errors.Is(c.UpdateMessage(messages[0].ID, m), errMessageTooLarge))
+}
+
+func testCacheActiveTopics(t *testing.T, c cache) {
+	for i := 0; i < 5; i++ { // More messages in total, but old
+		m := newDefaultMessage("old-but-busy", "old message")
+		m.Time = time.Now().Add(-3 * time.Hour).Unix()
+		require.Nil(t, c.AddMessage(m))
+	}
+	for i := 0; i < 3; i++ {
+		require.Nil(t, c.AddMessage(newDefaultMessage("trending", "recent message")))
+	}
+	require.Nil(t, c.AddMessage(newDefaultMessage("quiet", "recent message")))
+	scheduled := newDefaultMessage("quiet", "scheduled message")
+	scheduled.Time = time.Now().Add(time.Minute).Unix()
+	require.Nil(t, c.AddMessage(scheduled))
+
+	rates, err := c.ActiveTopics(time.Hour, 10)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(rates))
+	require.Equal(t, "trending", rates[0].Topic)
+	require.Equal(t, 3, rates[0].Count)
+	require.Equal(t, 3.0, rates[0].PerHour)
+	require.Equal(t, "quiet", rates[1].Topic)
+	require.Equal(t, 1, rates[1].Count)
+
+	rates, err = c.ActiveTopics(30*time.Minute, 1)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(rates))
+	require.Equal(t, "trending", rates[0].Topic)
+	require.Equal(t, 6.0, rates[0].PerHour)
+
+	rates, err = c.ActiveTopics(4*time.Hour, 10)
+	require.Nil(t, err)
+	require.Equal(t, "old-but-busy", rates[0].Topic)
+}
+
+func testCacheEncodingBreakdown(t *testing.T, c cache) {
+	counts, err := c.EncodingBreakdown()
+	require.Nil(t, err)
+	require.Empty(t, counts)
+
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "plain message")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("another-topic", "another plain message")))
+	m := newDefaultMessage("mytopic", "AQID")
+	m.Encoding = encodingBase64
+	require.Nil(t, c.AddMessage(m))
+	m = newDefaultMessage("mytopic", "compressed message")
+	m.Encoding = "gzip"
+	require.Nil(t, c.AddMessage(m))
+
+	counts, err = c.EncodingBreakdown()
+	require.Nil(t, err)
+	require.Equal(t, map[string]int{"": 2, encodingBase64: 1, "gzip": 1}, counts)
+}
+
+func testCacheAttachmentSizeByType(t *testing.T, c cache) {
+	sizes, err := c.AttachmentSizeByType()
+	require.Nil(t, err)
+	require.Empty(t, sizes)
+
+	m1 := newDefaultMessage("mytopic", "flower")
+	m1.Attachment = &attachment{Name: "flower.jpg", Type: "image/jpeg", URL: "https://ntfy.sh/file/AbDeFgJhal.jpg", Size: 5000}
+	m2 := newDefaultMessage("another-topic", "car")
+	m2.Attachment = &attachment{Name: "car.jpg", Type: "image/jpeg", URL: "https://ntfy.sh/file/aCaRURLabc.jpg", Size: 7000}
+	m3 := newDefaultMessage("mytopic", "video")
+	m3.Attachment = &attachment{Name: "video.mp4", Type: "video/mp4", URL: "https://ntfy.sh/file/vIdEoURLab.mp4", Size: 100000}
+	m4 := newDefaultMessage("mytopic", "deleted")
+	m4.Attachment = &attachment{Name: "deleted.mp4", Type: "video/mp4", URL: "https://ntfy.sh/file/dElEtEdabc.mp4", Size: 50000}
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4, newDefaultMessage("mytopic", "no attachment")}))
+	require.Nil(t, c.ClearAttachment(m4.ID))
+
+	sizes, err = c.AttachmentSizeByType()
+	require.Nil(t, err)
+	require.Equal(t, map[string]int64{"image/jpeg": 12000, "video/mp4": 100000}, sizes)
+}
+
+func testCacheMessagesWithMissingAttachments(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "flower for you")
+	m1.Attachment = &attachment{Name: "flower.jpg", URL: "https://ntfy.sh/file/AbDeFgJhal.jpg"}
+	m2 := newDefaultMessage("another-topic", "sending you a car")
+	m2.Attachment = &attachment{Name: "car.jpg", URL: "https://ntfy.sh/file/aCaRURL.jpg"}
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "no attachment")))
+
+	checked := make([]string, 0)
+	messages, err := c.MessagesWithMissingAttachments(func(url string) bool {
+		checked = append(checked, url)
+		return url == "https://ntfy.sh/file/aCaRURL.jpg"
+	})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "sending you a car", messages[0].Message)
+	require.Equal(t, 2, len(checked)) // Messages without attachment are not checked
+}
+
+func testCacheTopicSecrets(t *testing.T, c cache) {
+	ok, err := c.VerifyTopicSecret("open-topic", "anything")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	require.Nil(t, c.SetTopicSecret("mytopic", "correct horse"))
+	ok, err = c.VerifyTopicSecret("mytopic", "correct horse")
+	require.Nil(t, err)
+	require.True(t, ok)
+	ok, err = c.VerifyTopicSecret("mytopic", "battery staple")
+	require.Nil(t, err)
+	require.False(t, ok)
+	ok, err = c.VerifyTopicSecret("mytopic", "")
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	require.Nil(t, c.SetTopicSecret("mytopic", "battery staple")) // Change secret
+	ok, err = c.VerifyTopicSecret("mytopic", "correct horse")
+	require.Nil(t, err)
+	require.False(t, ok)
+	ok, err = c.VerifyTopicSecret("mytopic", "battery staple")
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	require.Nil(t, c.SetTopicSecret("mytopic", "")) // Remove secret
+	ok, err = c.VerifyTopicSecret("mytopic", "anything")
+	require.Nil(t, err)
+	require.True(t, ok)
+}
 
-	m2 := newDefaultMessage("mytopic", "my other message")
-	m2.Time = 2
+func testCacheEmail(t *testing.T, c cache) {
+	m := newDefaultMessage("mytopic", "also sent via e-mail")
+	m.Email = "phil@example.com"
+	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "not e-mailed")))
 
-	m3 := newDefaultMessage("another_topic", "and another one")
-	m3.Time = 1
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "phil@example.com", messages[0].Email)
+	require.Equal(t, "", messages[1].Email)
+}
 
-	require.Nil(t, c.AddMessage(m1))
-	require.Nil(t, c.AddMessage(m2))
-	require.Nil(t, c.AddMessage(m3))
-	require.Nil(t, c.Prune(time.Unix(2, 0)))
+func testCacheDeliveryRatio(t *testing.T, c cache) {
+	for i := 0; i < 8; i++ {
+		require.Nil(t, c.AddDelivery("mytopic", false))
+	}
+	for i := 0; i < 2; i++ {
+		require.Nil(t, c.AddDelivery("mytopic", true))
+	}
+	require.Nil(t, c.AddDelivery("othertopic", true))
 
-	count, err := c.MessageCount("mytopic")
+	sent, failed, err := c.DeliveryRatio("mytopic", time.Now().Add(-time.Hour))
 	require.Nil(t, err)
-	require.Equal(t, 1, count)
+	require.Equal(t, 8, sent)
+	require.Equal(t, 2, failed)
 
-	count, err = c.MessageCount("another_topic")
+	sent, failed, err = c.DeliveryRatio("mytopic", time.Now().Add(time.Hour))
 	require.Nil(t, err)
-	require.Equal(t, 0, count)
+	require.Equal(t, 0, sent)
+	require.Equal(t, 0, failed)
 
-	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	sent, failed, err = c.DeliveryRatio("unknowntopic", time.Now().Add(-time.Hour))
 	require.Nil(t, err)
-	require.Equal(t, 1, len(messages))
-	require.Equal(t, "my other message", messages[0].Message)
+	require.Equal(t, 0, sent)
+	require.Equal(t, 0, failed)
 }
 
-func testCacheMessagesTagsPrioAndTitle(t *testing.T, c cache) {
-	m := newDefaultMessage("mytopic", "some message")
-	m.Tags = []string{"tag1", "tag2"}
-	m.Priority = 5
-	m.Title = "some title"
+func testCacheLocation(t *testing.T, c cache) {
+	lat, lon := 52.5200, 13.4050
+	m := newDefaultMessage("mytopic", "fire alarm")
+	m.Lat, m.Lon = &lat, &lon
 	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "no location")))
 
-	messages, _ := c.Messages("mytopic", sinceAllMessages, false)
-	require.Equal(t, []string{"tag1", "tag2"}, messages[0].Tags)
-	require.Equal(t, 5, messages[0].Priority)
-	require.Equal(t, "some title", messages[0].Title)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, 52.5200, *messages[0].Lat)
+	require.Equal(t, 13.4050, *messages[0].Lon)
+	require.Nil(t, messages[1].Lat)
+	require.Nil(t, messages[1].Lon)
 }
 
-func testCacheMessagesScheduled(t *testing.T, c cache) {
-	m1 := newDefaultMessage("mytopic", "message 1")
-	m2 := newDefaultMessage("mytopic", "message 2")
-	m2.Time = time.Now().Add(time.Hour).Unix()
-	m3 := newDefaultMessage("mytopic", "message 3")
-	m3.Time = time.Now().Add(time.Minute).Unix() // earlier than m2!
-	m4 := newDefaultMessage("mytopic2", "message 4")
-	m4.Time = time.Now().Add(time.Minute).Unix()
-	require.Nil(t, c.AddMessage(m1))
-	require.Nil(t, c.AddMessage(m2))
-	require.Nil(t, c.AddMessage(m3))
+func testCacheCumulativeCount(t *testing.T, c cache) {
+	from := time.Now().Add(-4 * time.Hour).Truncate(time.Hour)
+	to := from.Add(4 * time.Hour)
+	for i, offset := range []time.Duration{10 * time.Minute, 20 * time.Minute, 70 * time.Minute, 190 * time.Minute, 200 * time.Minute} {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = from.Add(offset).Unix()
+		require.Nil(t, c.AddMessage(m))
+	}
+	outside := newDefaultMessage("mytopic", "before range")
+	outside.Time = from.Add(-time.Minute).Unix()
+	require.Nil(t, c.AddMessage(outside))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other topic")))
 
-	messages, _ := c.Messages("mytopic", sinceAllMessages, false) // exclude scheduled
-	require.Equal(t, 1, len(messages))
-	require.Equal(t, "message 1", messages[0].Message)
+	points, err := c.CumulativeCount("mytopic", time.Hour, from, to)
+	require.Nil(t, err)
+	require.Equal(t, 4, len(points))
+	require.Equal(t, from, points[0].Time)
+	require.Equal(t, 2, points[0].Count)
+	require.Equal(t, 3, points[1].Count)
+	require.Equal(t, 3, points[2].Count) // Empty bucket
+	require.Equal(t, 5, points[3].Count) // Total count in range
 
-	messages, _ = c.Messages("mytopic", sinceAllMessages, true) // include scheduled
-	require.Equal(t, 3, len(messages))
-	require.Equal(t, "message 1", messages[0].Message)
-	require.Equal(t, "message 3", messages[1].Message) // Order!
-	require.Equal(t, "message 2", messages[2].Message)
+	_, err = c.CumulativeCount("mytopic", 0, from, to)
+	require.Equal(t, errInvalidBucketSize, err)
+}
 
-	messages, _ = c.MessagesDue()
-	require.Empty(t, messages)
+func testCacheLatestMessage(t *testing.T, c cache) {
+	_, err := c.LatestMessage("mytopic")
+	require.Equal(t, errNoRows, err)
+
+	m1 := newDefaultMessage("mytopic", "oldest")
+	m1.Time = time.Now().Add(-2 * time.Hour).Unix()
+	m2 := newDefaultMessage("mytopic", "newest")
+	m3 := newDefaultMessage("mytopic", "middle")
+	m3.Time = time.Now().Add(-time.Hour).Unix()
+	m4 := newDefaultMessage("mytopic", "scheduled")
+	m4.Time = time.Now().Add(time.Hour).Unix()
+	for _, m := range []*message{m1, m2, m3, m4} {
+		require.Nil(t, c.AddMessage(m))
+	}
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "other topic")))
+	require.Nil(t, c.AddMessage(newMessage(pollRequestEvent, "mytopic", ""))) // Other events are not messages
+
+	latest, err := c.LatestMessage("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, "newest", latest.Message)
+	require.Equal(t, messageEvent, latest.Event)
+
+	_, err = c.LatestMessage("emptytopic")
+	require.Equal(t, errNoRows, err)
 }
 
-func testCacheAttachments(t *testing.T, c cache) {
-	expires1 := time.Now().Add(-4 * time.Hour).Unix()
+func testCacheTagLimits(t *testing.T, c cache) {
+	// Limits are 3 tags and 5 bytes per tag, see callers
+	m := newDefaultMessage("mytopic", "at the limits")
+	m.Tags = []string{"tag1", " tag2 ", "", "tag_3", "  "} // 3 tags after normalization
+	require.Nil(t, c.AddMessage(m))
+
+	m = newDefaultMessage("mytopic", "too many tags")
+	m.Tags = []string{"tag1", "tag2", "tag3", "tag4"}
+	require.True(t, errors.Is(c.AddMessage(m), errTooManyTags))
+
+	m = newDefaultMessage("mytopic", "tag too long")
+	m.Tags = []string{"tag1", "tag_22"}
+	require.True(t, errors.Is(c.AddMessage(m), errTagTooLong))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, []string{"tag1", "tag2", "tag_3"}, messages[0].Tags)
+}
+
+func testCacheClearAttachment(t *testing.T, c cache) {
 	m := newDefaultMessage("mytopic", "flower for you")
-	m.ID = "m1"
 	m.Attachment = &attachment{
 		Name:    "flower.jpg",
 		Type:    "image/jpeg",
 		Size:    5000,
-		Expires: expires1,
+		Expires: time.Now().Add(time.Hour).Unix(),
 		URL:     "https://ntfy.sh/file/AbDeFgJhal.jpg",
 		Owner:   "1.2.3.4",
 	}
 	require.Nil(t, c.AddMessage(m))
+	size, err := c.AttachmentsSize("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(5000), size)
 
-	expires2 := time.Now().Add(2 * time.Hour).Unix() // Future
-	m = newDefaultMessage("mytopic", "sending you a car")
-	m.ID = "m2"
-	m.Attachment = &attachment{
-		Name:    "car.jpg",
-		Type:    "image/jpeg",
-		Size:    10000,
-		Expires: expires2,
-		URL:     "https://ntfy.sh/file/aCaRURL.jpg",
-		Owner:   "1.2.3.4",
-	}
+	require.Nil(t, c.ClearAttachment(m.ID))
+	require.Equal(t, errNoRows, c.ClearAttachment("doesnotexist"))
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "flower for you", messages[0].Message)
+	require.Nil(t, messages[0].Attachment)
+
+	size, err = c.AttachmentsSize("1.2.3.4")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), size)
+}
+
+func testCacheOwnerUsage(t *testing.T, c cache) {
+	expires := time.Now().Add(time.Hour).Unix()
+	m := newDefaultMessage("mytopic", "text only")
+	m.Owner = "1.2.3.4"
 	require.Nil(t, c.AddMessage(m))
 
-	expires3 := time.Now().Add(1 * time.Hour).Unix() // Future
-	m = newDefaultMessage("another-topic", "sending you another car")
-	m.ID = "m3"
-	m.Attachment = &attachment{
-		Name:    "another-car.jpg",
-		Type:    "image/jpeg",
-		Size:    20000,
-		Expires: expires3,
-		URL:     "https://ntfy.sh/file/zakaDHFW.jpg",
-		Owner:   "1.2.3.4",
+	m = newDefaultMessage("mytopic", "with attachment")
+	m.Owner = "1.2.3.4"
+	m.Attachment = &attachment{Name: "car.jpg", Size: 10000, Expires: expires, URL: "https://ntfy.sh/file/car.jpg", Owner: "1.2.3.4"}
+	require.Nil(t, c.AddMessage(m))
+
+	m = newDefaultMessage("othertopic", "attachment only, e.g. forwarded by someone else")
+	m.Owner = "5.6.7.8"
+	m.Attachment = &attachment{Name: "flower.jpg", Size: 2000, Expires: expires, URL: "https://ntfy.sh/file/flower.jpg", Owner: "1.2.3.4"}
+	require.Nil(t, c.AddMessage(m))
+
+	m = newDefaultMessage("mytopic", "too old")
+	m.Owner = "1.2.3.4"
+	m.Time = time.Now().Add(-2 * time.Hour).Unix()
+	m.Attachment = &attachment{Name: "old.jpg", Size: 50000, Expires: expires, URL: "https://ntfy.sh/file/old.jpg", Owner: "1.2.3.4"}
+	require.Nil(t, c.AddMessage(m))
+
+	messages, attachmentBytes, err := c.OwnerUsage("1.2.3.4", time.Now().Add(-time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, 2, messages)
+	require.Equal(t, int64(12000), attachmentBytes)
+
+	messages, attachmentBytes, err = c.OwnerUsage("5.6.7.8", time.Now().Add(-time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, 1, messages)
+	require.Equal(t, int64(0), attachmentBytes)
+
+	messages, attachmentBytes, err = c.OwnerUsage("9.9.9.9", time.Now().Add(-time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, 0, messages)
+	require.Equal(t, int64(0), attachmentBytes)
+}
+
+func testCachePendingScheduled(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "in two hours")
+	m1.Time = time.Now().Add(2 * time.Hour).Unix()
+	m2 := newDefaultMessage("mytopic", "in one hour")
+	m2.Time = time.Now().Add(time.Hour).Unix()
+	m3 := newDefaultMessage("othertopic", "other topic")
+	m3.Time = time.Now().Add(time.Hour).Unix()
+	for _, m := range []*message{m1, m2, m3, newDefaultMessage("mytopic", "published")} {
+		require.Nil(t, c.AddMessage(m))
 	}
+	m4 := newDefaultMessage("mytopic", "past due, but not yet published")
+	m4.Time = time.Now().Add(2 * time.Second).Unix()
+	require.Nil(t, c.AddMessage(m4))
+	time.Sleep(2100 * time.Millisecond)
+
+	pending, err := c.PendingScheduled("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(pending))
+	require.Equal(t, "in one hour", pending[0].Message.Message)
+	require.InDelta(t, time.Hour.Seconds(), pending[0].RemainingDelay.Seconds(), 5)
+	require.Equal(t, "in two hours", pending[1].Message.Message)
+	require.InDelta(t, (2 * time.Hour).Seconds(), pending[1].RemainingDelay.Seconds(), 5)
+}
+
+func testCacheTopicsExcludePrefix(t *testing.T, c cache) {
+	require.Nil(t, c.AddMessage(newDefaultMessage("_internal", "system message")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("_sys_health", "system message")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("alerts", "user message")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("alerts", "another user message")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("my_topic", "underscore, but not a prefix")))
+
+	topics, err := c.Topics("_")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(topics))
+	require.NotNil(t, topics["alerts"])
+	require.NotNil(t, topics["my_topic"])
+	require.Nil(t, topics["_internal"])
+	count, err := c.TopicCount("_")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+
+	topics, err = c.Topics() // No filter
+	require.Nil(t, err)
+	require.Equal(t, 4, len(topics))
+	require.NotNil(t, topics["_internal"])
+	count, err = c.TopicCount()
+	require.Nil(t, err)
+	require.Equal(t, 4, count)
+
+	count, err = c.TopicCount("_internal", "alerts")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+}
+
+func testCachePinnedMessages(t *testing.T, c cache) {
+	oldPinned := newDefaultMessage("mytopic", "pinned, survives pruning")
+	oldPinned.Time = time.Now().Add(-2 * time.Hour).Unix()
+	oldUnpinned := newDefaultMessage("mytopic", "not pinned")
+	oldUnpinned.Time = time.Now().Add(-2 * time.Hour).Unix()
+	require.Nil(t, c.AddMessage(oldPinned))
+	require.Nil(t, c.AddMessage(oldUnpinned))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "recent")))
+	require.Nil(t, c.PinMessage(oldPinned.ID))
+	require.Equal(t, errNoRows, c.PinMessage("doesnotexist"))
+
+	_, err := c.Prune(time.Now().Add(-time.Hour), time.Now().Add(-time.Hour), nil, nil, nil)
+	require.Nil(t, err)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "pinned, survives pruning", messages[0].Message)
+	require.True(t, messages[0].Pinned)
+	require.Equal(t, "recent", messages[1].Message)
+	require.False(t, messages[1].Pinned)
+
+	require.Nil(t, c.UnpinMessage(oldPinned.ID))
+	_, err = c.Prune(time.Now().Add(-time.Hour), time.Now().Add(-time.Hour), nil, nil, nil)
+	require.Nil(t, err)
+	messages, err = c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "recent", messages[0].Message)
+}
+
+func testCacheDeleteMessages(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "leaked secret")
+	m2 := newDefaultMessage("mytopic", "harmless")
+	m3 := newDefaultMessage("mytopic", "scheduled")
+	m3.Time = time.Now().Add(time.Hour).Unix()
+	m4 := newDefaultMessage("othertopic", "other")
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4}))
+
+	deleted, err := c.DeleteMessage(m1.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, deleted)
+	messages, _ := c.Messages("mytopic", sinceAllMessages, true, 0)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "harmless", messages[0].Message)
+
+	deleted, err = c.DeleteMessage(m3.ID) // Scheduled, not yet published
+	require.Nil(t, err)
+	require.Equal(t, 1, deleted)
+	count, err := c.ScheduledCount()
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+	messages, _ = c.MessagesDue()
+	require.Empty(t, messages)
+
+	deleted, err = c.DeleteMessage("doesnotexist")
+	require.Nil(t, err)
+	require.Equal(t, 0, deleted)
+
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "another one")))
+	deleted, err = c.DeleteMessagesForTopic("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, deleted)
+	count, err = c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+	count, err = c.MessageCount("othertopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+}
+
+func testCacheTopicsFunc(t *testing.T, c cache) {
+	require.Nil(t, c.AddMessage(newDefaultMessage("topic1", "message 1")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("topic2", "message 1")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("topic2", "message 2")))
+	require.Nil(t, c.AddMessage(newDefaultMessage("topic3", "message 1")))
+
+	calls := make(map[string]int)
+	require.Nil(t, c.TopicsFunc(func(topic string) error {
+		calls[topic]++
+		return nil
+	}))
+	require.Equal(t, map[string]int{"topic1": 1, "topic2": 1, "topic3": 1}, calls)
+
+	errStop := errors.New("stop")
+	var count int
+	err := c.TopicsFunc(func(topic string) error {
+		count++
+		return errStop
+	})
+	require.Equal(t, errStop, err)
+	require.Equal(t, 1, count)
+}
+
+func testCachePrioritySource(t *testing.T, c cache) {
+	m := newDefaultMessage("mytopic", "disk is full")
+	m.Priority = 5
+	m.PrioritySource = "rule:disk-full"
 	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "no priority source")))
 
-	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
 	require.Nil(t, err)
 	require.Equal(t, 2, len(messages))
+	require.Equal(t, "rule:disk-full", messages[0].PrioritySource)
+	require.Equal(t, "", messages[1].PrioritySource)
+}
 
-	require.Equal(t, "flower for you", messages[0].Message)
-	require.Equal(t, "flower.jpg", messages[0].Attachment.Name)
-	require.Equal(t, "image/jpeg", messages[0].Attachment.Type)
-	require.Equal(t, int64(5000), messages[0].Attachment.Size)
-	require.Equal(t, expires1, messages[0].Attachment.Expires)
-	require.Equal(t, "https://ntfy.sh/file/AbDeFgJhal.jpg", messages[0].Attachment.URL)
-	require.Equal(t, "1.2.3.4", messages[0].Attachment.Owner)
+func testCacheMetrics(t *testing.T, c cache, metrics *recordingCacheMetrics) {
+	m1 := newDefaultMessage("mytopic", "flower for you")
+	m1.Attachment = &attachment{
+		Name:    "flower.jpg",
+		Type:    "image/jpeg",
+		Size:    5000,
+		Expires: time.Now().Add(time.Hour).Unix(),
+		URL:     "https://ntfy.sh/file/AbDeFgJhal.jpg",
+	}
+	require.Nil(t, c.AddMessage(m1))
 
-	require.Equal(t, "sending you a car", messages[1].Message)
-	require.Equal(t, "car.jpg", messages[1].Attachment.Name)
-	require.Equal(t, "image/jpeg", messages[1].Attachment.Type)
-	require.Equal(t, int64(10000), messages[1].Attachment.Size)
-	require.Equal(t, expires2, messages[1].Attachment.Expires)
-	require.Equal(t, "https://ntfy.sh/file/aCaRURL.jpg", messages[1].Attachment.URL)
-	require.Equal(t, "1.2.3.4", messages[1].Attachment.Owner)
+	// Replayed idempotency keys are not counted
+	m2 := newDefaultMessage("mytopic", "order shipped")
+	m2.IdempotencyKey = "order-1234"
+	require.Nil(t, c.AddMessage(m2))
+	m3 := newDefaultMessage("mytopic", "order shipped")
+	m3.IdempotencyKey = "order-1234"
+	require.Equal(t, errDuplicateMessage, c.AddMessage(m3))
 
-	size, err := c.AttachmentsSize("1.2.3.4")
+	require.Nil(t, c.AddMessages([]*message{
+		newDefaultMessage("example", "a"),
+		newDefaultMessage("example", "bb"),
+	}))
+
+	require.Equal(t, []recordedCacheMetric{
+		{"mytopic", 14, true},
+		{"mytopic", 13, false},
+		{"example", 1, false},
+		{"example", 2, false},
+	}, metrics.recorded())
+}
+
+type recordedCacheMetric struct {
+	topic      string
+	size       int
+	attachment bool
+}
+
+// recordingCacheMetrics is a CacheMetrics that records all calls, see testCacheMetrics
+type recordingCacheMetrics struct {
+	calls []recordedCacheMetric
+	mu    sync.Mutex
+}
+
+func (r *recordingCacheMetrics) MessageAdded(topic string, size int, attachment bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, recordedCacheMetric{topic, size, attachment})
+}
+
+func (r *recordingCacheMetrics) recorded() []recordedCacheMetric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls
+}
+
+func testCacheDeleteScheduled(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "remind me")
+	m1.Time = time.Now().Add(time.Hour).Unix()
+	m2 := newDefaultMessage("mytopic", "already sent")
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	require.Nil(t, c.DeleteScheduled(m1.ID))
+	require.Equal(t, errNoRows, c.DeleteScheduled(m1.ID))
+	require.Equal(t, errMessagePublished, c.DeleteScheduled(m2.ID))
+	require.Equal(t, errNoRows, c.DeleteScheduled("doesnotexist"))
+
+	count, err := c.ScheduledCount()
 	require.Nil(t, err)
-	require.Equal(t, int64(30000), size)
+	require.Equal(t, 0, count)
+	count, err = c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+	messages, _ := c.Messages("mytopic", sinceAllMessages, true, 0)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "already sent", messages[0].Message)
+}
 
-	size, err = c.AttachmentsSize("5.6.7.8")
+func testCacheTakeMessagesDue(t *testing.T, c cache) {
+	m1 := newDefaultMessage("mytopic", "due soon")
+	m1.Time = time.Now().Add(time.Second).Unix()
+	m2 := newDefaultMessage("mytopic", "due later")
+	m2.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessages([]*message{m1, m2}))
+
+	messages, err := c.TakeMessagesDue()
 	require.Nil(t, err)
-	require.Equal(t, int64(0), size)
+	require.Empty(t, messages)
 
-	ids, err := c.AttachmentsExpired()
+	time.Sleep(1100 * time.Millisecond)
+	messages, err = c.TakeMessagesDue()
 	require.Nil(t, err)
-	require.Equal(t, []string{"m1"}, ids)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m1.ID, messages[0].ID)
+
+	// Taken messages are published, so they are not returned again, and can no longer be cancelled
+	messages, err = c.TakeMessagesDue()
+	require.Nil(t, err)
+	require.Empty(t, messages)
+	require.Equal(t, errMessagePublished, c.DeleteScheduled(m1.ID))
+	messages, _ = c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "due soon", messages[0].Message)
+}
+
+func testCacheMaxMessagesPerTopic(t *testing.T, c cache) {
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "message 1")))
+	scheduled := newDefaultMessage("mytopic", "message 2")
+	scheduled.Time = time.Now().Add(time.Hour).Unix()
+	require.Nil(t, c.AddMessage(scheduled)) // Scheduled messages are counted as well
+	require.True(t, errors.Is(c.AddMessage(newDefaultMessage("mytopic", "message 3")), errTopicFull))
+	require.True(t, errors.Is(c.AddMessages([]*message{
+		newDefaultMessage("othertopic", "message 1"),
+		newDefaultMessage("othertopic", "message 2"),
+		newDefaultMessage("othertopic", "message 3"),
+	}), errTopicFull))
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "message 1"))) // Batch was rejected entirely
+
+	count, err := c.MessageCount("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+	count, err = c.MessageCount("othertopic")
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+
+	// Deleting messages makes room again
+	_, err = c.DeleteMessage(scheduled.ID)
+	require.Nil(t, err)
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "message 3")))
+}
+
+func testCacheMaxAttachmentExpiry(t *testing.T, c cache, maxExpiry time.Duration) {
+	newAttachmentMessage := func(expires time.Duration) *message {
+		m := newDefaultMessage("mytopic", "flower for you")
+		m.Attachment = &attachment{
+			Name:    "flower.jpg",
+			URL:     "https://ntfy.sh/file/AbDeFgJhal.jpg",
+			Expires: time.Now().Add(expires).Unix(),
+		}
+		return m
+	}
+	short := newAttachmentMessage(time.Minute)
+	long := newAttachmentMessage(365 * 24 * time.Hour)
+	external := newDefaultMessage("mytopic", "no expiry")
+	external.Attachment = &attachment{Name: "flower.jpg", URL: "https://example.com/flower.jpg"}
+	requested := long.Attachment.Expires
+	require.Nil(t, c.AddMessages([]*message{short, long, external}))
+
+	expected := requested
+	if maxExpiry > 0 {
+		expected = time.Now().Add(maxExpiry).Unix()
+	}
+	require.InDelta(t, expected, long.Attachment.Expires, 1) // Changed in place, so publishers see the actual expiry
+
+	messages, err := c.MessagesByIDs([]string{short.ID, long.ID, external.ID})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	expires := make(map[string]int64)
+	for _, m := range messages {
+		expires[m.ID] = m.Attachment.Expires
+	}
+	require.Equal(t, short.Attachment.Expires, expires[short.ID])
+	require.Equal(t, long.Attachment.Expires, expires[long.ID])
+	require.Equal(t, int64(0), expires[external.ID]) // Attachments without expiry are left alone
+}
+
+func testCacheMessagesBySender(t *testing.T, c cache) {
+	spammer, other := SenderHash("1.2.3.4"), SenderHash("5.6.7.8")
+	m1 := newDefaultMessage("mytopic", "spam 1")
+	m1.Sender = spammer
+	m2 := newDefaultMessage("othertopic", "spam 2")
+	m2.Sender = spammer
+	m2.Time = time.Now().Add(time.Hour).Unix() // Scheduled messages are included
+	m3 := newDefaultMessage("mytopic", "legit")
+	m3.Sender = other
+	m4 := newDefaultMessage("mytopic", "no sender")
+	require.Nil(t, c.AddMessages([]*message{m1, m2, m3, m4}))
+
+	messages, err := c.MessagesBySender(spammer)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "spam 1", messages[0].Message)
+	require.Equal(t, "spam 2", messages[1].Message)
+	require.Equal(t, spammer, messages[0].Sender)
+
+	messages, err = c.MessagesBySender("")
+	require.Nil(t, err)
+	require.Empty(t, messages)
 }
@@ -0,0 +1,438 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cachingCache is a write-through cache in front of another cache, typically a sqliteCache. It keeps the most
+// recent published messages of a fixed set of hot topics in memory (see Config.CacheWarmTopics), and serves
+// queries for these topics from memory if the requested messages are all held in memory, e.g. when a
+// subscriber reconnects with a recent since=... parameter. All other queries fall through to the underlying cache.
+//
+// Messages added through the cachingCache are written to the underlying cache first, and then added to memory.
+// All other operations that may change the messages of a topic invalidate the affected topics, which are then
+// reloaded from the underlying cache on the next query. The write and the invalidation happen while holding
+// c.mu, so that no query can serve or reload a warm topic in between and keep the state from before the write.
+// All methods that write to the underlying cache are implemented explicitly below, even if they do not affect
+// the messages in memory, so that none of them is passed through to the underlying cache without being considered.
+type cachingCache struct {
+	cache
+	capacity int                   // Max number of messages held in memory per topic
+	topics   map[string]*warmTopic // Topic -> messages held in memory; the map is never modified after newCachingCache
+	mu       sync.Mutex            // Held while reading or writing warm topics, including the underlying cache
+}
+
+var _ cache = (*cachingCache)(nil)
+
+// warmTopic holds the most recent published messages of a topic, ordered by time
+type warmTopic struct {
+	messages  []*message
+	complete  bool // True if messages contains all published messages of the topic
+	valid     bool // False if messages must be reloaded from the underlying cache, see invalidate
+	reordered bool // True once a message older than the newest one was added, see add and messages
+}
+
+// newCachingCache wraps the given cache, and preloads the given topics into memory
+func newCachingCache(c cache, topics []string, capacity int) (*cachingCache, error) {
+	cc := &cachingCache{
+		cache:    c,
+		capacity: capacity,
+		topics:   make(map[string]*warmTopic),
+	}
+	for _, topic := range topics {
+		cc.topics[topic] = &warmTopic{}
+		if err := cc.load(topic); err != nil {
+			return nil, err
+		}
+	}
+	return cc, nil
+}
+
+func (c *cachingCache) AddMessage(m *message) error {
+	if !c.warm(m.Topic) {
+		return c.cache.AddMessage(m)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.cache.AddMessage(m); err != nil {
+		return err
+	}
+	c.add(m)
+	return nil
+}
+
+func (c *cachingCache) AddMessagePublished(m *message) (published bool, err error) {
+	if !c.warm(m.Topic) {
+		return c.cache.AddMessagePublished(m)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	published, err = c.cache.AddMessagePublished(m)
+	if err != nil {
+		return false, err
+	}
+	c.add(m)
+	return published, nil
+}
+
+func (c *cachingCache) AddMessages(ms []*message) error {
+	warm := false
+	for _, m := range ms {
+		warm = warm || c.warm(m.Topic)
+	}
+	if !warm {
+		return c.cache.AddMessages(ms)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.cache.AddMessages(ms); err != nil {
+		for _, t := range c.topics {
+			t.valid = false // Some messages may have been added anyway
+		}
+		return err
+	}
+	for _, m := range ms {
+		c.add(m)
+	}
+	return nil
+}
+
+func (c *cachingCache) Messages(topic string, since sinceMarker, scheduled bool, limit int) ([]*message, error) {
+	return c.MessagesContext(context.Background(), topic, since, scheduled, limit, nil)
+}
+
+func (c *cachingCache) MessagesContext(ctx context.Context, topic string, since sinceMarker, scheduled bool, limit int, filter *messageFilter) ([]*message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	} else if messages, ok, err := c.messages(topic, since, scheduled, limit, filter); err != nil {
+		return nil, err
+	} else if ok {
+		return messages, nil
+	}
+	return c.cache.MessagesContext(ctx, topic, since, scheduled, limit, filter)
+}
+
+func (c *cachingCache) MessagesFunc(topic string, since sinceMarker, scheduled bool, fn func(m *message) error) error {
+	return c.MessagesFuncContext(context.Background(), topic, since, scheduled, nil, fn)
+}
+
+func (c *cachingCache) MessagesFuncContext(ctx context.Context, topic string, since sinceMarker, scheduled bool, filter *messageFilter, fn func(m *message) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	messages, ok, err := c.messages(topic, since, scheduled, 0, filter)
+	if err != nil {
+		return err
+	} else if !ok {
+		return c.cache.MessagesFuncContext(ctx, topic, since, scheduled, filter, fn)
+	}
+	for _, m := range messages {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cachingCache) ImportTopic(topic string, r io.Reader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidateReordered(topic) // Imported messages are usually older than the newest message
+	return c.cache.ImportTopic(topic, r)
+}
+
+func (c *cachingCache) Prune(olderThan, inactiveOlderThan time.Time, activeTopics []string, perTopic map[string]time.Time, perPriority map[int]time.Time) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidateAll()
+	return c.cache.Prune(olderThan, inactiveOlderThan, activeTopics, perTopic, perPriority)
+}
+
+func (c *cachingCache) PruneToCount(maxPerTopic int) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidateAll()
+	return c.cache.PruneToCount(maxPerTopic)
+}
+
+func (c *cachingCache) MarkPublished(m *message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidate(m.Topic)
+	return c.cache.MarkPublished(m)
+}
+
+func (c *cachingCache) MarkPublishedBatch(ids []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidateAll()
+	return c.cache.MarkPublishedBatch(ids)
+}
+
+func (c *cachingCache) RecomputePublished(grace time.Duration) (changed int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidateAll()
+	return c.cache.RecomputePublished(grace)
+}
+
+func (c *cachingCache) TakeMessagesDue() ([]*message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	messages, err := c.cache.TakeMessagesDue()
+	for _, m := range messages {
+		c.invalidate(m.Topic) // Published messages are added on the next load
+	}
+	return messages, err
+}
+
+func (c *cachingCache) PinMessage(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidateMessage(id)
+	return c.cache.PinMessage(id)
+}
+
+func (c *cachingCache) UnpinMessage(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidateMessage(id)
+	return c.cache.UnpinMessage(id)
+}
+
+func (c *cachingCache) UpdateMessage(id string, m *message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidateMessage(id)
+	return c.cache.UpdateMessage(id, m)
+}
+
+func (c *cachingCache) DeleteMessage(id string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidateMessage(id)
+	return c.cache.DeleteMessage(id)
+}
+
+func (c *cachingCache) DeleteScheduled(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidateMessage(id) // Scheduled messages are not held in memory, so this is only a safeguard
+	return c.cache.DeleteScheduled(id)
+}
+
+func (c *cachingCache) DeleteMessagesForTopic(topic string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidate(topic)
+	return c.cache.DeleteMessagesForTopic(topic)
+}
+
+func (c *cachingCache) IncrementDownloads(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidateMessage(id)
+	return c.cache.IncrementDownloads(id)
+}
+
+func (c *cachingCache) ReassignAttachments(oldOwner, newOwner string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidateAll()
+	return c.cache.ReassignAttachments(oldOwner, newOwner)
+}
+
+func (c *cachingCache) ClearAttachmentOwner(owner string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidateAll()
+	return c.cache.ClearAttachmentOwner(owner)
+}
+
+func (c *cachingCache) ClearAttachment(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidateMessage(id)
+	return c.cache.ClearAttachment(id)
+}
+
+func (c *cachingCache) RewriteAttachmentURLs(oldBase, newBase string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.invalidateAll()
+	return c.cache.RewriteAttachmentURLs(oldBase, newBase)
+}
+
+// MarkRead does not invalidate anything, since queries for unread messages are never served from memory
+func (c *cachingCache) MarkRead(id, user string) error {
+	return c.cache.MarkRead(id, user)
+}
+
+// Compact does not invalidate anything, since it does not change any messages
+func (c *cachingCache) Compact() error {
+	return c.cache.Compact()
+}
+
+// SetTopicSecret does not invalidate anything, since topic secrets are not held in memory
+func (c *cachingCache) SetTopicSecret(topic, secret string) error {
+	return c.cache.SetTopicSecret(topic, secret)
+}
+
+// SetTopicDisplayName does not invalidate anything, since topic metadata is not held in memory
+func (c *cachingCache) SetTopicDisplayName(topic, name string) error {
+	return c.cache.SetTopicDisplayName(topic, name)
+}
+
+// AddDelivery does not invalidate anything, since deliveries are not held in memory
+func (c *cachingCache) AddDelivery(topic string, failed bool) error {
+	return c.cache.AddDelivery(topic, failed)
+}
+
+// messages returns the messages of a warm topic from memory, see cache.MessagesContext. If the messages
+// cannot be served from memory, ok is false, and the caller must query the underlying cache instead.
+func (c *cachingCache) messages(topic string, since sinceMarker, scheduled bool, limit int, filter *messageFilter) (messages []*message, ok bool, err error) {
+	if !c.warm(topic) || scheduled || since.IsNone() || (filter != nil && (len(filter.Events) > 0 || filter.UnreadBy != "")) {
+		return nil, false, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.topics[topic]
+	if !t.valid {
+		if err := c.load(topic); err != nil {
+			return nil, false, err
+		}
+	}
+	candidates := t.messages
+	if since.IsID() && t.reordered {
+		return nil, false, nil // The underlying cache returns messages added after the given one, which may be older
+	} else if since.IsID() {
+		found := false
+		for i, m := range candidates {
+			if m.ID == since.ID() {
+				candidates, found = candidates[i+1:], true
+				break
+			}
+		}
+		if !found {
+			return nil, false, nil // Message is not in memory, so it may be older than all messages in memory
+		}
+	} else if !since.IsAll() {
+		// Messages of the same second as the oldest message in memory may have been evicted already
+		if !t.complete && (len(candidates) == 0 || since.Time().Unix() <= candidates[0].Time) {
+			return nil, false, nil
+		}
+	}
+	messages = make([]*message, 0)
+	for _, m := range candidates {
+		if m.Time >= since.Time().Unix() && filter.matches(m) {
+			messages = append(messages, m)
+		}
+	}
+	if since.IsAll() && !t.complete && (limit <= 0 || len(messages) < limit) {
+		return nil, false, nil // Older messages may be needed
+	}
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	if filter.descending() {
+		return reverseMessages(copyMessages(messages)), true, nil
+	}
+	return copyMessages(messages), true, nil
+}
+
+// load (re-)reads the most recent messages of the warm topic from the underlying cache.
+// The caller must hold c.mu, unless the topic is not yet in use (see newCachingCache).
+func (c *cachingCache) load(topic string) error {
+	messages, err := c.cache.Messages(topic, sinceAllMessages, false, c.capacity)
+	if err != nil {
+		return err
+	}
+	t := c.topics[topic] // Updated in place, since the map itself is read without holding c.mu, see warm
+	t.messages, t.complete, t.valid = messages, len(messages) < c.capacity, true
+	return nil
+}
+
+// add adds the message to memory after it was written to the underlying cache, if it belongs to a warm
+// topic. Messages that are not published yet are skipped; they are added when they are published, since
+// that invalidates the topic. The caller must hold c.mu.
+//
+// A message that is older than the newest message in memory invalidates the topic: for since=<id>, the
+// underlying cache returns all messages added after the given one, including older ones, whereas messages
+// in memory are ordered by time, so since=<id> queries are no longer served from memory, see messages.
+func (c *cachingCache) add(m *message) {
+	t, ok := c.topics[m.Topic]
+	if !ok || !t.valid || m.Event != messageEvent || m.Time > time.Now().Unix() {
+		return
+	} else if m.Dedup || m.IdempotencyKey != "" {
+		t.valid = false // May have been a duplicate of a message that is already in memory
+		return
+	} else if len(t.messages) > 0 && m.Time < t.messages[len(t.messages)-1].Time {
+		t.valid, t.reordered = false, true
+		return
+	}
+	stored := *m
+	stored.Published = true // Like the underlying cache, which marks messages that are not scheduled as published
+	i := sort.Search(len(t.messages), func(i int) bool { return t.messages[i].Time > m.Time })
+	t.messages = append(t.messages, nil)
+	copy(t.messages[i+1:], t.messages[i:])
+	t.messages[i] = &stored
+	if len(t.messages) > c.capacity {
+		t.messages = t.messages[len(t.messages)-c.capacity:]
+		t.complete = false
+	}
+}
+
+func (c *cachingCache) warm(topic string) bool {
+	_, ok := c.topics[topic]
+	return ok
+}
+
+// invalidate marks the topic to be reloaded from the underlying cache on the next query. The caller must hold c.mu.
+func (c *cachingCache) invalidate(topic string) {
+	if t, ok := c.topics[topic]; ok {
+		t.valid = false
+	}
+}
+
+// invalidateReordered invalidates the topic, and stops serving since=<id> queries for it from memory, see add.
+// The caller must hold c.mu.
+func (c *cachingCache) invalidateReordered(topic string) {
+	if t, ok := c.topics[topic]; ok {
+		t.valid, t.reordered = false, true
+	}
+}
+
+// invalidateMessage invalidates the warm topic that holds the message with the given ID in memory, if any.
+// Messages that are not in memory do not need to be invalidated, since they are outside the window of
+// messages that is served from memory. The caller must hold c.mu.
+func (c *cachingCache) invalidateMessage(id string) {
+	for _, t := range c.topics {
+		for _, m := range t.messages {
+			if m.ID == id {
+				t.valid = false
+				break
+			}
+		}
+	}
+}
+
+// invalidateAll invalidates all warm topics. The caller must hold c.mu.
+func (c *cachingCache) invalidateAll() {
+	for _, t := range c.topics {
+		t.valid = false
+	}
+}
+
+// copyMessages returns shallow copies of the messages, so that callers cannot modify the messages in memory
+func copyMessages(messages []*message) []*message {
+	copies := make([]*message, len(messages))
+	for i, m := range messages {
+		copied := *m
+		copies[i] = &copied
+	}
+	return copies
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCachingCache_Messages(t *testing.T) {
+	testCacheMessages(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MessagesLimit(t *testing.T) {
+	testCacheMessagesLimit(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MessagesContextCanceled(t *testing.T) {
+	testCacheMessagesContextCanceled(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MessagesFunc(t *testing.T) {
+	testCacheMessagesFunc(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MessagesFilter(t *testing.T) {
+	testCacheMessagesFilter(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MessagesFilterTagsExact(t *testing.T) {
+	testCacheMessagesFilterTagsExact(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MessagesMulti(t *testing.T) {
+	testCacheMessagesMulti(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MessagesSinceID(t *testing.T) {
+	testCacheMessagesSinceID(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MessagesSinceIDScheduled(t *testing.T) {
+	testCacheMessagesSinceIDScheduled(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_AddMessages(t *testing.T) {
+	testCacheAddMessages(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_Dedup(t *testing.T) {
+	testCacheDedup(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_IdempotencyKey(t *testing.T) {
+	testCacheIdempotencyKey(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MessageExists(t *testing.T) {
+	testCacheMessageExists(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_UpdateMessage(t *testing.T) {
+	testCacheUpdateMessage(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_Events(t *testing.T) {
+	testCacheEvents(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MessagesBetween(t *testing.T) {
+	testCacheMessagesBetween(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MarkRead(t *testing.T) {
+	testCacheMarkRead(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MarkPublishedBatch(t *testing.T) {
+	testCacheMarkPublishedBatch(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_AddMessagePublished(t *testing.T) {
+	testCacheAddMessagePublished(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_ReadPublished(t *testing.T) {
+	testCacheReadPublished(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_Prune(t *testing.T) {
+	testCachePrune(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_PruneDryRun(t *testing.T) {
+	testCachePruneDryRun(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_PruneToCount(t *testing.T) {
+	testCachePruneToCount(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MessagesTagsPrioAndTitle(t *testing.T) {
+	testCacheMessagesTagsPrioAndTitle(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MessagesScheduled(t *testing.T) {
+	testCacheMessagesScheduled(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MessagesSameSecondOrder(t *testing.T) {
+	testCacheMessagesSameSecondOrder(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_MessagesOrder(t *testing.T) {
+	testCacheMessagesOrder(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_RecomputePublished(t *testing.T) {
+	testCacheRecomputePublished(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_Attachments(t *testing.T) {
+	testCacheAttachments(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_AttachmentDownloads(t *testing.T) {
+	testCacheAttachmentDownloads(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_RewriteAttachmentURLs(t *testing.T) {
+	testCacheRewriteAttachmentURLs(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_ClearAttachment(t *testing.T) {
+	testCacheClearAttachment(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_PinnedMessages(t *testing.T) {
+	testCachePinnedMessages(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_DeleteMessages(t *testing.T) {
+	testCacheDeleteMessages(t, newCachingTestCache(t))
+}
+
+func TestCachingCache_ServedFromMemory(t *testing.T) {
+	c := newCachingTestCache(t)
+	now := time.Now().Unix()
+	ms := make([]*message, 0)
+	for i := 0; i < 5; i++ {
+		m := newDefaultMessage("mytopic", "message")
+		m.Time = now - int64(4-i) // now-4, now-3, ..., now
+		ms = append(ms, m)
+		require.Nil(t, c.AddMessage(m))
+	}
+
+	// Remove all messages from the underlying cache behind the caching cache's back, so that
+	// only queries that are served from memory still return messages
+	_, err := c.cache.(*sqliteCache).db.Exec(`DELETE FROM messages`)
+	require.Nil(t, err)
+
+	messages, err := c.Messages("mytopic", newSinceID(ms[2].ID), false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, ms[3].ID, messages[0].ID)
+	require.Equal(t, ms[4].ID, messages[1].ID)
+
+	messages, err = c.Messages("mytopic", newSinceTime(now-1), false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+
+	messages, err = c.Messages("mytopic", sinceAllMessages, false, 2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, ms[4].ID, messages[1].ID)
+
+	// Not (entirely) in memory: capacity is 3, so the first two messages were evicted
+	messages, err = c.Messages("mytopic", newSinceID(ms[0].ID), false, 0)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	messages, err = c.Messages("mytopic", newSinceTime(now-2), false, 0)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	messages, err = c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	// Topics that are not warm are never served from memory
+	require.Nil(t, c.AddMessage(newDefaultMessage("othertopic", "message")))
+	_, err = c.cache.(*sqliteCache).db.Exec(`DELETE FROM messages`)
+	require.Nil(t, err)
+	messages, err = c.Messages("othertopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestCachingCache_Preload(t *testing.T) {
+	underlying := newSqliteTestCache(t)
+	require.Nil(t, underlying.AddMessage(newDefaultMessage("mytopic", "my message")))
+	c, err := newCachingCache(underlying, []string{"mytopic"}, 3)
+	require.Nil(t, err)
+	_, err = underlying.db.Exec(`DELETE FROM messages`)
+	require.Nil(t, err)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "my message", messages[0].Message)
+}
+
+func TestCachingCache_Invalidate(t *testing.T) {
+	c := newCachingTestCache(t)
+	m := newDefaultMessage("mytopic", "my message")
+	require.Nil(t, c.AddMessage(m))
+	_, err := c.cache.(*sqliteCache).db.Exec(`DELETE FROM messages`)
+	require.Nil(t, err)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages)) // Still in memory
+
+	_, err = c.Prune(time.Unix(0, 0), time.Unix(0, 0), nil, nil, nil)
+	require.Nil(t, err)
+	messages, err = c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Empty(t, messages) // Reloaded
+
+	// Changes to messages in memory invalidate the topic
+	m = newDefaultMessage("mytopic", "another message")
+	require.Nil(t, c.AddMessage(m))
+	require.Nil(t, c.PinMessage(m.ID))
+	messages, err = c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.True(t, messages[0].Pinned)
+
+	// Returned messages are copies
+	messages[0].Message = "changed"
+	messages, err = c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, "another message", messages[0].Message)
+}
+
+func TestCachingCache_InvalidateWithWrite(t *testing.T) {
+	underlying := &pinHookCache{sqliteCache: newSqliteTestCache(t)}
+	c, err := newCachingCache(underlying, []string{"mytopic"}, 3)
+	require.Nil(t, err)
+	m := newDefaultMessage("mytopic", "my message")
+	require.Nil(t, c.AddMessage(m))
+
+	// Query the topic after the message was pinned in the underlying cache, but before PinMessage returns;
+	// the query must not be served from the state in memory before the write
+	var wg sync.WaitGroup
+	var messages []*message
+	var queryErr error
+	underlying.afterPin = func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			messages, queryErr = c.Messages("mytopic", sinceAllMessages, false, 0)
+		}()
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.Nil(t, c.PinMessage(m.ID))
+	wg.Wait()
+	require.Nil(t, queryErr)
+	require.Equal(t, 1, len(messages))
+	require.True(t, messages[0].Pinned)
+}
+
+func TestCachingCache_BackdatedMessage(t *testing.T) {
+	c := newCachingTestCache(t)
+	now := time.Now().Unix()
+	m1 := newDefaultMessage("mytopic", "message 1")
+	m1.Time = now - 10
+	m2 := newDefaultMessage("mytopic", "message 2")
+	m2.Time = now - 5
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+
+	// A back-dated message is returned for since=<id> of a message that was added before it
+	m3 := newDefaultMessage("mytopic", "back-dated message")
+	m3.Time = now - 20
+	require.Nil(t, c.AddMessage(m3))
+
+	expected, err := c.cache.Messages("mytopic", newSinceID(m2.ID), false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(expected))
+	require.Equal(t, m3.ID, expected[0].ID)
+
+	messages, err := c.Messages("mytopic", newSinceID(m2.ID), false, 0)
+	require.Nil(t, err)
+	require.Equal(t, expected, messages)
+
+	// Queries by time are still served from memory, ordered by time
+	messages, err = c.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, m3.ID, messages[0].ID)
+	require.Equal(t, m1.ID, messages[1].ID)
+	require.Equal(t, m2.ID, messages[2].ID)
+}
+
+// pinHookCache calls afterPin after a message was pinned in the underlying cache
+type pinHookCache struct {
+	*sqliteCache
+	afterPin func()
+}
+
+func (c *pinHookCache) PinMessage(id string) error {
+	err := c.sqliteCache.PinMessage(id)
+	if c.afterPin != nil {
+		c.afterPin()
+	}
+	return err
+}
+
+func newCachingTestCache(t *testing.T) *cachingCache {
+	c, err := newCachingCache(newSqliteTestCache(t), []string{"mytopic", "example"}, 3)
+	require.Nil(t, err)
+	return c
+}
@@ -8,6 +8,12 @@ import (
 const (
 	DefaultListenHTTP                = ":80"
 	DefaultCacheDuration             = 12 * time.Hour
+	DefaultCacheBodyThreshold        = 1024 // Bytes
+	DefaultCacheBusyTimeout          = 5 * time.Second
+	DefaultCacheMaxOpenConns         = 10 // SQLite only allows one writer at a time anyway, so this mostly bounds concurrent readers
+	DefaultCacheMaxIdleConns         = 10 // Same as max open connections, so that connections are not constantly reopened
+	DefaultCacheDedupWindow          = time.Minute
+	DefaultCacheWarmCapacity         = 100              // Messages per topic
 	DefaultKeepaliveInterval         = 45 * time.Second // Not too frequently to save battery (Android read timeout used to be 77s!)
 	DefaultManagerInterval           = time.Minute
 	DefaultAtSenderInterval          = 10 * time.Second
@@ -16,13 +22,39 @@ const (
 	DefaultFirebaseKeepaliveInterval = 3 * time.Hour // Not too frequently to save battery
 )
 
+// Defines the databases that the message cache can be stored in, see Config.CacheBackend
+const (
+	CacheBackendSQLite   = "sqlite"   // A local SQLite file, see Config.CacheFile
+	CacheBackendPostgres = "postgres" // A PostgreSQL database shared by several ntfy instances, see Config.CacheDSN
+)
+
+// Defines the synchronous modes of the cache file, see https://www.sqlite.org/pragma.html#pragma_synchronous
+const (
+	CacheSyncModeOff    = "off"    // Fastest, but a power loss or OS crash may lose or corrupt recent writes
+	CacheSyncModeNormal = "normal" // In WAL mode, a power loss or OS crash may lose the most recent writes
+	CacheSyncModeFull   = "full"   // Every commit is synced to disk, slowest
+)
+
+// Defines the tag validation modes, i.e. what to do if a published tag is not a known emoji shortcode
+const (
+	TagValidationOff    = "off"
+	TagValidationWarn   = "warn"
+	TagValidationStrict = "strict"
+)
+
 // Defines all global and per-visitor limits
 // - message size limit: the max number of bytes for a message
+// - message tag limits: the max number of tags per message, and the max number of bytes per tag
 // - total topic limit: max number of topics overall
+// - scheduled message limits: max number of not-yet-published messages overall and per topic (0 means no limit)
 // - various attachment limits
 const (
 	DefaultMessageLengthLimit       = 4096 // Bytes
+	DefaultMessageTagsLimit         = 50
+	DefaultMessageTagLengthLimit    = 100 // Bytes
 	DefaultTotalTopicLimit          = 15000
+	DefaultTotalScheduledLimit      = 0
+	DefaultTopicScheduledLimit      = 0
 	DefaultAttachmentTotalSizeLimit = int64(5 * 1024 * 1024 * 1024) // 5 GB
 	DefaultAttachmentFileSizeLimit  = int64(15 * 1024 * 1024)       // 15 MB
 	DefaultAttachmentExpiryDuration = 3 * time.Hour
@@ -53,8 +85,34 @@ type Config struct {
 	KeyFile                              string
 	CertFile                             string
 	FirebaseKeyFile                      string
+	CacheBackend                         string // CacheBackendSQLite (also if empty) or CacheBackendPostgres
 	CacheFile                            string
+	CacheDSN                             string // Connection string of the PostgreSQL database, see CacheBackendPostgres
+	CacheMigrationBackup                 bool
+	CacheTopicFilterSize                 int
+	CacheBodyDir                         string
+	CacheBodyThreshold                   int
+	CacheBusyTimeout                     time.Duration
+	CacheMaxOpenConns                    int           // Max number of open connections to the cache file, 0 means no limit
+	CacheMaxIdleConns                    int           // Max number of idle connections kept open, 0 means none
+	CacheConnMaxLifetime                 time.Duration // Connections are closed after this long, 0 means never
+	CacheKey                             string        // Encryption key of the cache file, requires SQLCipher
+	CacheSyncMode                        string        // Synchronous mode of the cache file, see CacheSyncModeNormal
+	CacheTablePrefix                     string        // Prefix of all table names, allows several caches to share one cache file
+	CacheCompressionThreshold            int
+	CacheDedupWindow                     time.Duration
 	CacheDuration                        time.Duration
+	InactiveCacheDuration                time.Duration
+	TopicCacheDurations                  map[string]time.Duration // Topic -> cache duration, overrides CacheDuration
+	PriorityCacheDurations               map[int]time.Duration    // Priority (1-5) -> cache duration, overrides CacheDuration
+	CacheTopicMessageLimit               int                      // Max number of messages kept per topic, 0 means no limit
+	CacheMaxMessagesPerTopic             int                      // Publishing fails once a topic has this many messages, 0 means no limit
+	CacheMaxAttachmentExpiry             time.Duration            // Attachment expiries are limited to this long from now, 0 means no limit
+	CacheCompactThreshold                int                      // Compact the cache after this many messages were pruned, 0 means never
+	CacheWarmTopics                      []string                 // Topics whose most recent messages are kept in memory, see cachingCache
+	CacheWarmCapacity                    int                      // Max number of messages per topic kept in memory, see CacheWarmTopics
+	CacheMetrics                         CacheMetrics             // Notified about every stored message, nil means none
+	ReplayWindowGuard                    bool
 	AttachmentCacheDir                   string
 	AttachmentTotalSizeLimit             int64
 	AttachmentFileSizeLimit              int64
@@ -71,9 +129,14 @@ type Config struct {
 	SMTPServerDomain                     string
 	SMTPServerAddrPrefix                 string
 	MessageLimit                         int
+	MessageTagsLimit                     int
+	MessageTagLengthLimit                int
+	TagValidation                        string
 	MinDelay                             time.Duration
 	MaxDelay                             time.Duration
 	TotalTopicLimit                      int
+	TotalScheduledLimit                  int
+	TopicScheduledLimit                  int
 	TotalAttachmentSizeLimit             int64
 	VisitorSubscriptionLimit             int
 	VisitorAttachmentTotalSizeLimit      int64
@@ -95,8 +158,34 @@ func NewConfig() *Config {
 		KeyFile:                              "",
 		CertFile:                             "",
 		FirebaseKeyFile:                      "",
+		CacheBackend:                         CacheBackendSQLite,
 		CacheFile:                            "",
+		CacheDSN:                             "",
+		CacheMigrationBackup:                 false,
+		CacheTopicFilterSize:                 0,
+		CacheBodyDir:                         "",
+		CacheBodyThreshold:                   DefaultCacheBodyThreshold,
+		CacheBusyTimeout:                     DefaultCacheBusyTimeout,
+		CacheMaxOpenConns:                    DefaultCacheMaxOpenConns,
+		CacheMaxIdleConns:                    DefaultCacheMaxIdleConns,
+		CacheConnMaxLifetime:                 0,
+		CacheKey:                             "",
+		CacheSyncMode:                        CacheSyncModeNormal,
+		CacheTablePrefix:                     "",
+		CacheCompressionThreshold:            0,
+		CacheDedupWindow:                     DefaultCacheDedupWindow,
 		CacheDuration:                        DefaultCacheDuration,
+		InactiveCacheDuration:                0,
+		TopicCacheDurations:                  make(map[string]time.Duration),
+		PriorityCacheDurations:               make(map[int]time.Duration),
+		CacheTopicMessageLimit:               0,
+		CacheMaxMessagesPerTopic:             0,
+		CacheMaxAttachmentExpiry:             0,
+		CacheCompactThreshold:                0,
+		CacheWarmTopics:                      make([]string, 0),
+		CacheWarmCapacity:                    DefaultCacheWarmCapacity,
+		CacheMetrics:                         nil,
+		ReplayWindowGuard:                    false,
 		AttachmentCacheDir:                   "",
 		AttachmentTotalSizeLimit:             DefaultAttachmentTotalSizeLimit,
 		AttachmentFileSizeLimit:              DefaultAttachmentFileSizeLimit,
@@ -104,11 +193,16 @@ func NewConfig() *Config {
 		KeepaliveInterval:                    DefaultKeepaliveInterval,
 		ManagerInterval:                      DefaultManagerInterval,
 		MessageLimit:                         DefaultMessageLengthLimit,
+		MessageTagsLimit:                     DefaultMessageTagsLimit,
+		MessageTagLengthLimit:                DefaultMessageTagLengthLimit,
+		TagValidation:                        TagValidationOff,
 		MinDelay:                             DefaultMinDelay,
 		MaxDelay:                             DefaultMaxDelay,
 		AtSenderInterval:                     DefaultAtSenderInterval,
 		FirebaseKeepaliveInterval:            DefaultFirebaseKeepaliveInterval,
 		TotalTopicLimit:                      DefaultTotalTopicLimit,
+		TotalScheduledLimit:                  DefaultTotalScheduledLimit,
+		TopicScheduledLimit:                  DefaultTopicScheduledLimit,
 		VisitorSubscriptionLimit:             DefaultVisitorSubscriptionLimit,
 		VisitorAttachmentTotalSizeLimit:      DefaultVisitorAttachmentTotalSizeLimit,
 		VisitorAttachmentDailyBandwidthLimit: DefaultVisitorAttachmentDailyBandwidthLimit,
@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 )
 
@@ -17,6 +18,12 @@ func (e errHTTP) Error() string {
 	return e.Message
 }
 
+// Wrap returns a copy of the error with the given details appended to its message
+func (e errHTTP) Wrap(details string) *errHTTP {
+	e.Message = fmt.Sprintf("%s: %s", e.Message, details)
+	return &e
+}
+
 func (e errHTTP) JSON() string {
 	b, _ := json.Marshal(&e)
 	return string(b)
@@ -39,12 +46,33 @@ var (
 	errHTTPBadRequestAttachmentsDisallowed           = &errHTTP{40014, http.StatusBadRequest, "invalid request: attachments not allowed", ""}
 	errHTTPBadRequestAttachmentsExpiryBeforeDelivery = &errHTTP{40015, http.StatusBadRequest, "invalid request: attachment expiry before delayed delivery date", ""}
 	errHTTPBadRequestWebSocketsUpgradeHeaderMissing  = &errHTTP{40016, http.StatusBadRequest, "invalid request: client not using the websocket protocol", ""}
+	errHTTPBadRequestEncodedPayloadTooLarge          = &errHTTP{40017, http.StatusBadRequest, "invalid message: decoded message payload too large", ""}
+	errHTTPBadRequestTagUnknown                      = &errHTTP{40018, http.StatusBadRequest, "invalid tags: tag is not a known emoji shortcode", "https://ntfy.sh/docs/publish/#tags-emojis"}
+	errHTTPBadRequestDurableNoCache                  = &errHTTP{40019, http.StatusBadRequest, "cannot disable cache for durable message", ""}
+	errHTTPBadRequestLocationInvalid                 = &errHTTP{40020, http.StatusBadRequest, "invalid location: lat and lon must both be set to valid coordinates", ""}
+	errHTTPBadRequestTooManyTags                     = &errHTTP{40021, http.StatusBadRequest, "invalid tags: too many tags", "https://ntfy.sh/docs/publish/#tags-emojis"}
+	errHTTPBadRequestTagTooLong                      = &errHTTP{40022, http.StatusBadRequest, "invalid tags: tag too long", "https://ntfy.sh/docs/publish/#tags-emojis"}
+	errHTTPBadRequestDedupNoCache                    = &errHTTP{40023, http.StatusBadRequest, "cannot disable cache for deduplicated message", ""}
+	errHTTPBadRequestIdempotencyKeyNoCache           = &errHTTP{40024, http.StatusBadRequest, "cannot disable cache for message with idempotency key", ""}
+	errHTTPBadRequestIdempotencyKeyInvalid           = &errHTTP{40025, http.StatusBadRequest, "invalid idempotency key: must be 1-255 printable ASCII characters", ""}
+	errHTTPBadRequestActionsInvalid                  = &errHTTP{40026, http.StatusBadRequest, "invalid actions: must be a JSON array of up to 3 actions of type view, http or broadcast", "https://ntfy.sh/docs/publish/#action-buttons"}
+	errHTTPBadRequestUntilInvalid                    = &errHTTP{40027, http.StatusBadRequest, "invalid until parameter", "https://ntfy.sh/docs/subscribe/api/#fetch-cached-messages"}
+	errHTTPBadRequestMessageTooLarge                 = &errHTTP{40028, http.StatusBadRequest, "invalid message", "https://ntfy.sh/docs/publish/#limitations"}
+	errHTTPBadRequestUserInvalid                     = &errHTTP{40029, http.StatusBadRequest, "invalid user: must be 1-255 printable ASCII characters", "https://ntfy.sh/docs/subscribe/api/#read-receipts"}
+	errHTTPBadRequestOrderInvalid                    = &errHTTP{40030, http.StatusBadRequest, "invalid order parameter: must be asc or desc, and desc requires poll=1", "https://ntfy.sh/docs/subscribe/api/#fetch-cached-messages"}
+	errHTTPBadRequestMessageIDNoCache                = &errHTTP{40031, http.StatusBadRequest, "cannot disable cache for message with custom message ID", "https://ntfy.sh/docs/publish/#custom-message-ids"}
+	errHTTPBadRequestMessageIDInvalid                = &errHTTP{40032, http.StatusBadRequest, "invalid message ID: must be 10 alphanumeric characters, and not only digits", "https://ntfy.sh/docs/publish/#custom-message-ids"}
+	errHTTPForbiddenNotOwner                         = &errHTTP{40301, http.StatusForbidden, "forbidden: only the publisher of a message can update or delete it", "https://ntfy.sh/docs/publish/#updating-messages"}
 	errHTTPNotFound                                  = &errHTTP{40401, http.StatusNotFound, "page not found", ""}
+	errHTTPConflictMessagePublished                  = &errHTTP{40901, http.StatusConflict, "conflict: message was already delivered, only scheduled messages can be deleted", "https://ntfy.sh/docs/publish/#scheduled-delivery"}
+	errHTTPConflictMessageExists                     = &errHTTP{40902, http.StatusConflict, "conflict: a message with this ID already exists", "https://ntfy.sh/docs/publish/#custom-message-ids"}
 	errHTTPTooManyRequestsLimitRequests              = &errHTTP{42901, http.StatusTooManyRequests, "limit reached: too many requests, please be nice", "https://ntfy.sh/docs/publish/#limitations"}
 	errHTTPTooManyRequestsLimitEmails                = &errHTTP{42902, http.StatusTooManyRequests, "limit reached: too many emails, please be nice", "https://ntfy.sh/docs/publish/#limitations"}
 	errHTTPTooManyRequestsLimitSubscriptions         = &errHTTP{42903, http.StatusTooManyRequests, "limit reached: too many active subscriptions, please be nice", "https://ntfy.sh/docs/publish/#limitations"}
 	errHTTPTooManyRequestsLimitTotalTopics           = &errHTTP{42904, http.StatusTooManyRequests, "limit reached: the total number of topics on the server has been reached, please contact the admin", "https://ntfy.sh/docs/publish/#limitations"}
 	errHTTPTooManyRequestsAttachmentBandwidthLimit   = &errHTTP{42905, http.StatusTooManyRequests, "too many requests: daily bandwidth limit reached", "https://ntfy.sh/docs/publish/#limitations"}
+	errHTTPTooManyRequestsLimitScheduled             = &errHTTP{42906, http.StatusTooManyRequests, "limit reached: too many scheduled messages, please be nice", "https://ntfy.sh/docs/publish/#limitations"}
+	errHTTPTooManyRequestsLimitTopicMessages         = &errHTTP{42907, http.StatusTooManyRequests, "limit reached: too many messages in this topic, please be nice", "https://ntfy.sh/docs/publish/#limitations"}
 	errHTTPInternalError                             = &errHTTP{50001, http.StatusInternalServerError, "internal server error", ""}
 	errHTTPInternalErrorInvalidFilePath              = &errHTTP{50002, http.StatusInternalServerError, "internal server error: invalid file path", ""}
 )
@@ -45,11 +45,10 @@ func (c *fileCache) Write(id string, in io.Reader, limiters ...util.Limiter) (in
 		return 0, errInvalidFileID
 	}
 	file := filepath.Join(c.dir, id)
-	if _, err := os.Stat(file); err == nil {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600) // Fails if the file exists, even if created concurrently
+	if os.IsExist(err) {
 		return 0, errFileExists
-	}
-	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
-	if err != nil {
+	} else if err != nil {
 		return 0, err
 	}
 	defer f.Close()
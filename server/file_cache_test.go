@@ -24,6 +24,16 @@ func TestFileCache_Write_Success(t *testing.T) {
 	require.Equal(t, int64(10229), c.Remaining())
 }
 
+func TestFileCache_Write_Exists(t *testing.T) {
+	dir, c := newTestFileCache(t)
+	_, err := c.Write("abc", strings.NewReader("normal file"))
+	require.Nil(t, err)
+	_, err = c.Write("abc", strings.NewReader("other file"))
+	require.Equal(t, errFileExists, err)
+	require.Equal(t, "normal file", readFile(t, dir+"/abc"))
+	require.Equal(t, int64(11), c.Size())
+}
+
 func TestFileCache_Write_Remove_Success(t *testing.T) {
 	dir, c := newTestFileCache(t) // max = 10k (10240), each = 1k (1024)
 	for i := 0; i < 10; i++ {     // 10x999 = 9990
@@ -18,6 +18,7 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -47,7 +48,10 @@ type Server struct {
 	mailer       mailer
 	messages     int64
 	cache        cache
+	pruned       int   // Messages pruned since the cache was last compacted, see compactCacheIfIdle
+	lastMessages int64 // Value of messages at the last manager run, to detect whether the server is idle
 	fileCache    *fileCache
+	emojis       map[string]string // Emoji shortcode -> emoji, only set if tag validation is enabled
 	closeChan    chan bool
 	mu           sync.Mutex
 }
@@ -66,11 +70,17 @@ var (
 	wsPathRegex      = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/ws$`)
 	publishPathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/(publish|send|trigger)$`)
 
-	staticRegex      = regexp.MustCompile(`^/static/.+`)
-	docsRegex        = regexp.MustCompile(`^/docs(|/.*)$`)
-	fileRegex        = regexp.MustCompile(`^/file/([-_A-Za-z0-9]{1,64})(?:\.[A-Za-z0-9]{1,16})?$`)
-	disallowedTopics = []string{"docs", "static", "file"}
-	attachURLRegex   = regexp.MustCompile(`^https?://`)
+	staticRegex          = regexp.MustCompile(`^/static/.+`)
+	docsRegex            = regexp.MustCompile(`^/docs(|/.*)$`)
+	fileRegex            = regexp.MustCompile(`^/file/([-_A-Za-z0-9]{1,64})(?:\.[A-Za-z0-9]{1,16})?$`)
+	messagePathRegex     = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/[A-Za-z0-9]{10}$`)
+	messageReadPathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/[A-Za-z0-9]{10}/read$`)
+	messageIDRegex       = regexp.MustCompile(`^[A-Za-z0-9]{10}$`)
+	timestampRegex       = regexp.MustCompile(`^[0-9]+$`)             // since=<digits> is a Unix timestamp, see parseSince
+	idempotencyKeyRegex  = regexp.MustCompile(`^[\x21-\x7e]{1,255}$`) // Printable ASCII, no spaces
+	userRegex            = regexp.MustCompile(`^[\x21-\x7e]{1,255}$`) // Same as idempotency keys, see handleMarkRead
+	disallowedTopics     = []string{"docs", "static", "file"}
+	attachURLRegex       = regexp.MustCompile(`^https?://`)
 
 	templateFnMap = template.FuncMap{
 		"durationToHuman": util.DurationToHuman,
@@ -137,10 +147,18 @@ func New(conf *Config) (*Server, error) {
 			return nil, err
 		}
 	}
+	var emojis map[string]string
+	if conf.TagValidation == TagValidationWarn || conf.TagValidation == TagValidationStrict {
+		emojis, err = loadEmojiMap()
+		if err != nil {
+			return nil, err
+		}
+	}
 	return &Server{
 		config:    conf,
 		cache:     cache,
 		fileCache: fileCache,
+		emojis:    emojis,
 		firebase:  firebaseSubscriber,
 		mailer:    mailer,
 		topics:    topics,
@@ -151,10 +169,22 @@ func New(conf *Config) (*Server, error) {
 func createCache(conf *Config) (cache, error) {
 	if conf.CacheDuration == 0 {
 		return newNopCache(), nil
-	} else if conf.CacheFile != "" {
-		return newSqliteCache(conf.CacheFile)
+	} else if conf.CacheBackend == CacheBackendPostgres {
+		c, err := newPostgresCache(conf)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	} else if conf.CacheFile == "" {
+		return newMemCache(conf), nil
 	}
-	return newMemCache(), nil
+	c, err := newSqliteCache(conf)
+	if err != nil {
+		return nil, err
+	} else if len(conf.CacheWarmTopics) == 0 {
+		return c, nil
+	}
+	return newCachingCache(c, conf.CacheWarmTopics, conf.CacheWarmCapacity)
 }
 
 func createFirebaseSubscriber(conf *Config) (subscriber, error) {
@@ -274,7 +304,7 @@ func (s *Server) Run() error {
 	return <-errChan
 }
 
-// Stop stops HTTP (+HTTPS) server and all managers
+// Stop stops HTTP (+HTTPS) server and all managers, and closes the cache
 func (s *Server) Stop() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -291,6 +321,9 @@ func (s *Server) Stop() {
 		s.smtpServer.Close()
 	}
 	close(s.closeChan)
+	if err := s.cache.Close(); err != nil {
+		log.Printf("Closing cache failed: %s", err.Error())
+	}
 }
 
 func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
@@ -318,6 +351,8 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request) error {
 		return s.handleExample(w, r)
 	} else if r.Method == http.MethodHead && r.URL.Path == "/" {
 		return s.handleEmpty(w, r)
+	} else if r.Method == http.MethodGet && r.URL.Path == "/v1/health" {
+		return s.handleHealth(w, r)
 	} else if r.Method == http.MethodGet && staticRegex.MatchString(r.URL.Path) {
 		return s.handleStatic(w, r)
 	} else if r.Method == http.MethodGet && docsRegex.MatchString(r.URL.Path) {
@@ -330,6 +365,12 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request) error {
 		return s.handleTopic(w, r)
 	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && topicPathRegex.MatchString(r.URL.Path) {
 		return s.withRateLimit(w, r, s.handlePublish)
+	} else if r.Method == http.MethodPut && messagePathRegex.MatchString(r.URL.Path) {
+		return s.withRateLimit(w, r, s.handleUpdate)
+	} else if r.Method == http.MethodDelete && messagePathRegex.MatchString(r.URL.Path) {
+		return s.withRateLimit(w, r, s.handleDeleteScheduled)
+	} else if r.Method == http.MethodPut && messageReadPathRegex.MatchString(r.URL.Path) {
+		return s.withRateLimit(w, r, s.handleMarkRead)
 	} else if r.Method == http.MethodGet && publishPathRegex.MatchString(r.URL.Path) {
 		return s.withRateLimit(w, r, s.handlePublish)
 	} else if r.Method == http.MethodGet && jsonPathRegex.MatchString(r.URL.Path) {
@@ -362,6 +403,22 @@ func (s *Server) handleTopic(w http.ResponseWriter, r *http.Request) error {
 	return s.handleHome(w, r)
 }
 
+func (s *Server) handleHealth(w http.ResponseWriter, _ *http.Request) error {
+	response := &healthResponse{Healthy: true}
+	if err := s.cache.Ping(); err != nil {
+		log.Printf("Health check failed: cache is unhealthy: %s", err.Error())
+		response.Healthy = false
+	} else if response.SchemaVersion, err = s.cache.SchemaVersion(); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+	if !response.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(response)
+}
+
 func (s *Server) handleEmpty(_ http.ResponseWriter, _ *http.Request) error {
 	return nil
 }
@@ -404,8 +461,13 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 		return err
 	}
 	defer f.Close()
-	_, err = io.Copy(util.NewContentTypeWriter(w, r.URL.Path), f)
-	return err
+	if _, err := io.Copy(util.NewContentTypeWriter(w, r.URL.Path), f); err != nil {
+		return err
+	}
+	if err := s.cache.IncrementDownloads(messageID); err != nil && err != errNoRows {
+		log.Printf("Unable to count attachment download: %v", err.Error())
+	}
+	return nil
 }
 
 func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -418,6 +480,8 @@ func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visito
 		return err
 	}
 	m := newDefaultMessage(t.ID, "")
+	m.Owner = v.ip // Important for per-owner usage accounting
+	m.Sender = SenderHash(v.ip)
 	cache, firebase, email, unifiedpush, err := s.parsePublishParams(r, v, m)
 	if err != nil {
 		return err
@@ -428,34 +492,49 @@ func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visito
 	if m.Message == "" {
 		m.Message = emptyMessageBody
 	}
-	delayed := m.Time > time.Now().Unix()
-	if !delayed {
+	// Delayed messages are left to the scheduler; they cannot be published without the cache
+	published := m.Time <= time.Now().Unix()
+	cacheFirst := cache && (m.Dedup || m.IdempotencyKey != "" || readParam(r, "x-message-id", "message-id") != "")
+	if cacheFirst {
+		// Deduplicated messages and messages with a custom ID are cached before they are published, so that
+		// duplicates are not forwarded to subscribers at all. The response then contains the original message,
+		// see cache.AddMessagePublished, which also reports whether the message was stored as scheduled.
+		published, err = s.cacheMessage(m)
+		if errors.Is(err, errDuplicateMessage) {
+			return writePublishResponse(w, m)
+		} else if err != nil {
+			return err
+		}
+	}
+	if published {
 		if err := t.Publish(m); err != nil {
 			return err
 		}
 	}
-	if s.firebase != nil && firebase && !delayed {
+	if s.firebase != nil && firebase && published {
 		go func() {
-			if err := s.firebase(m); err != nil {
+			err := s.firebase(m)
+			if err != nil {
 				log.Printf("Unable to publish to Firebase: %v", err.Error())
 			}
+			if err := s.cache.AddDelivery(m.Topic, err != nil); err != nil {
+				log.Printf("Unable to record Firebase delivery: %v", err.Error())
+			}
 		}()
 	}
-	if s.mailer != nil && email != "" && !delayed {
+	if s.mailer != nil && email != "" && published {
 		go func() {
 			if err := s.mailer.Send(v.ip, email, m); err != nil {
 				log.Printf("Unable to send email: %v", err.Error())
 			}
 		}()
 	}
-	if cache {
-		if err := s.cache.AddMessage(m); err != nil {
+	if cache && !cacheFirst {
+		if _, err := s.cacheMessage(m); err != nil {
 			return err
 		}
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
-	if err := json.NewEncoder(w).Encode(m); err != nil {
+	if err := writePublishResponse(w, m); err != nil {
 		return err
 	}
 	s.mu.Lock()
@@ -464,11 +543,198 @@ func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request, v *visito
 	return nil
 }
 
+// cacheMessage adds the message to the cache and translates validation errors into HTTP errors. It returns
+// whether the message was stored as published, or as scheduled, see cache.AddMessagePublished.
+func (s *Server) cacheMessage(m *message) (published bool, err error) {
+	id, local := m.ID, hasLocalAttachment(m)
+	published, err = s.cache.AddMessagePublished(m)
+	if err != nil && local {
+		s.fileCache.Remove(id) // The uploaded file is not referenced by any message
+	}
+	return published, toHTTPCacheError(err)
+}
+
+func toHTTPCacheError(err error) error {
+	if errors.Is(err, errEncodedPayloadTooLarge) {
+		return errHTTPBadRequestEncodedPayloadTooLarge
+	} else if errors.Is(err, errMessageTooLarge) {
+		return errHTTPBadRequestMessageTooLarge.Wrap(err.Error()) // Includes the size and limit
+	} else if errors.Is(err, errTooManyTags) {
+		return errHTTPBadRequestTooManyTags
+	} else if errors.Is(err, errTagTooLong) {
+		return errHTTPBadRequestTagTooLong
+	} else if errors.Is(err, errTooManyActions) || errors.Is(err, errInvalidActionType) {
+		return errHTTPBadRequestActionsInvalid
+	} else if errors.Is(err, errTopicFull) {
+		return errHTTPTooManyRequestsLimitTopicMessages
+	} else if errors.Is(err, errMessageExists) {
+		return errHTTPConflictMessageExists
+	}
+	return err
+}
+
+// handleUpdate replaces the content of a message, see parseContentParams. Only the visitor that published
+// the message may update it, since the topic name alone is not a secret to all subscribers.
+func (s *Server) handleUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	messageID := strings.Split(r.URL.Path, "/")[2]
+	messages, err := s.cache.MessagesByIDs([]string{messageID})
+	if err != nil {
+		return err
+	} else if len(messages) == 0 || messages[0].Topic != t.ID {
+		return errHTTPNotFound
+	} else if messages[0].Owner != v.ip {
+		return errHTTPForbiddenNotOwner
+	}
+	body, err := util.Peak(r.Body, s.config.MessageLimit)
+	if err != nil {
+		return err
+	}
+	m := newDefaultMessage(t.ID, "")
+	if err := s.parseContentParams(r, m); err != nil {
+		return err
+	}
+	if err := s.handleBodyAsTextMessage(m, body); err != nil {
+		return err
+	}
+	if m.Message == "" {
+		m.Message = emptyMessageBody
+	}
+	m.Edited = time.Now().Unix()
+	if err := s.cache.UpdateMessage(messageID, m); errors.Is(err, errNoRows) {
+		return errHTTPNotFound
+	} else if err != nil {
+		return toHTTPCacheError(err)
+	}
+	messages, err = s.cache.MessagesByIDs([]string{messageID})
+	if err != nil {
+		return err
+	} else if len(messages) == 0 {
+		return errHTTPNotFound // Pruned in the meantime
+	}
+	updated := messages[0]
+	if updated.Time <= time.Now().Unix() { // Scheduled messages are delivered with their latest content anyway
+		if err := t.Publish(updated); err != nil {
+			return err
+		}
+	}
+	return writePublishResponse(w, updated)
+}
+
+// handleDeleteScheduled cancels a scheduled message that was not delivered yet. Messages that were
+// already delivered cannot be deleted this way. Like handleUpdate, only the publisher may cancel a message.
+func (s *Server) handleDeleteScheduled(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	messageID := strings.Split(r.URL.Path, "/")[2]
+	messages, err := s.cache.MessagesByIDs([]string{messageID})
+	if err != nil {
+		return err
+	} else if len(messages) == 0 || messages[0].Topic != t.ID {
+		return errHTTPNotFound
+	} else if messages[0].Owner != v.ip {
+		return errHTTPForbiddenNotOwner
+	}
+	if err := s.cache.DeleteScheduled(messageID); errors.Is(err, errNoRows) {
+		return errHTTPNotFound // Pruned in the meantime
+	} else if errors.Is(err, errMessagePublished) {
+		return errHTTPConflictMessagePublished
+	} else if err != nil {
+		return err
+	}
+	if s.fileCache != nil && hasLocalAttachment(messages[0]) {
+		if err := s.fileCache.Remove(messageID); err != nil {
+			log.Printf("error while deleting attachment of message %s: %s", messageID, err.Error())
+		}
+	}
+	return writePublishResponse(w, messages[0])
+}
+
+// handleMarkRead marks a message as read by the user passed in the X-User header (or "user" parameter), so that
+// it is excluded when this user subscribes with "unread-by=...", e.g. on another device. Users are not
+// authenticated; they are opaque identifiers chosen by the clients.
+func (s *Server) handleMarkRead(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	t, err := s.topicFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	messageID := strings.Split(r.URL.Path, "/")[2]
+	user := readParam(r, "x-user", "user")
+	if !userRegex.MatchString(user) {
+		return errHTTPBadRequestUserInvalid
+	}
+	messages, err := s.cache.MessagesByIDs([]string{messageID})
+	if err != nil {
+		return err
+	} else if len(messages) == 0 || messages[0].Topic != t.ID {
+		return errHTTPNotFound
+	}
+	if err := s.cache.MarkRead(messageID, user); errors.Is(err, errNoRows) {
+		return errHTTPNotFound // Pruned in the meantime
+	} else if err != nil {
+		return err
+	}
+	return writePublishResponse(w, messages[0])
+}
+
+func writePublishResponse(w http.ResponseWriter, m *message) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
+	return json.NewEncoder(w).Encode(m)
+}
+
 func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (cache bool, firebase bool, email string, unifiedpush bool, err error) {
 	cache = readBoolParam(r, true, "x-cache", "cache")
 	firebase = readBoolParam(r, true, "x-firebase", "firebase")
-	m.Title = readParam(r, "x-title", "title", "t")
+	m.Durable = readBoolParam(r, false, "x-durable", "durable")
+	if m.Durable && !cache {
+		return false, false, "", false, errHTTPBadRequestDurableNoCache
+	}
+	m.Dedup = readBoolParam(r, false, "x-dedup", "dedup")
+	if m.Dedup && !cache {
+		return false, false, "", false, errHTTPBadRequestDedupNoCache
+	}
+	m.IdempotencyKey = readParam(r, "x-idempotency-key", "idempotency-key")
+	if m.IdempotencyKey != "" {
+		if !cache {
+			return false, false, "", false, errHTTPBadRequestIdempotencyKeyNoCache
+		} else if !idempotencyKeyRegex.MatchString(m.IdempotencyKey) {
+			return false, false, "", false, errHTTPBadRequestIdempotencyKeyInvalid
+		}
+	}
+	if id := readParam(r, "x-message-id", "message-id"); id != "" {
+		if !cache {
+			return false, false, "", false, errHTTPBadRequestMessageIDNoCache
+		} else if !messageIDRegex.MatchString(id) || timestampRegex.MatchString(id) {
+			return false, false, "", false, errHTTPBadRequestMessageIDInvalid
+		}
+		m.ID = id
+	}
 	m.Click = readParam(r, "x-click", "click")
+	m.Icon = readParam(r, "x-icon", "icon")
+	m.ContentType = contentTypePlain
+	if readBoolParam(r, false, "x-markdown", "markdown", "md") || isMarkdownContentType(r.Header.Get("Content-Type")) {
+		m.ContentType = contentTypeMarkdown
+	}
+	actions := readParam(r, "x-actions", "actions")
+	if actions != "" {
+		m.Actions, err = parseActions(actions)
+		if err != nil {
+			return false, false, "", false, errHTTPBadRequestActionsInvalid
+		}
+	}
+	lat, lon := readParam(r, "x-lat", "lat"), readParam(r, "x-lon", "lon")
+	if lat != "" || lon != "" {
+		m.Lat, m.Lon, err = parseLocation(lat, lon)
+		if err != nil {
+			return false, false, "", false, errHTTPBadRequestLocationInvalid
+		}
+	}
 	filename := readParam(r, "x-filename", "filename", "file", "f")
 	attach := readParam(r, "x-attach", "attach", "a")
 	if attach != "" || filename != "" {
@@ -504,21 +770,11 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 	if s.mailer == nil && email != "" {
 		return false, false, "", false, errHTTPBadRequestEmailDisabled
 	}
-	messageStr := readParam(r, "x-message", "message", "m")
-	if messageStr != "" {
-		m.Message = messageStr
-	}
-	m.Priority, err = util.ParsePriority(readParam(r, "x-priority", "priority", "prio", "p"))
-	if err != nil {
-		return false, false, "", false, errHTTPBadRequestPriorityInvalid
-	}
-	tagsStr := readParam(r, "x-tags", "tags", "tag", "ta")
-	if tagsStr != "" {
-		m.Tags = make([]string, 0)
-		for _, s := range util.SplitNoEmpty(tagsStr, ",") {
-			m.Tags = append(m.Tags, strings.TrimSpace(s))
-		}
+	m.Email = email
+	if err := s.parseContentParams(r, m); err != nil {
+		return false, false, "", false, err
 	}
+	m.PrioritySource = readParam(r, "x-priority-source", "priority-source")
 	delayStr := readParam(r, "x-delay", "delay", "x-at", "at", "x-in", "in")
 	if delayStr != "" {
 		if !cache {
@@ -535,6 +791,9 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 		} else if delay.Unix() > time.Now().Add(s.config.MaxDelay).Unix() {
 			return false, false, "", false, errHTTPBadRequestDelayTooLarge
 		}
+		if err := s.scheduledAllowed(m.Topic); err != nil {
+			return false, false, "", false, err
+		}
 		m.Time = delay.Unix()
 	}
 	unifiedpush = readBoolParam(r, false, "x-unifiedpush", "unifiedpush", "up") // see GET too!
@@ -545,18 +804,118 @@ func (s *Server) parsePublishParams(r *http.Request, v *visitor, m *message) (ca
 	return cache, firebase, email, unifiedpush, nil
 }
 
+// validateTags checks the given tags against the known emoji shortcodes, if tag validation is enabled.
+// Unknown tags are either logged (warn mode), or rejected (strict mode).
+func (s *Server) validateTags(tags []string) error {
+	if s.emojis == nil {
+		return nil
+	}
+	for _, tag := range tags {
+		if _, ok := s.emojis[tag]; ok {
+			continue
+		}
+		if s.config.TagValidation == TagValidationStrict {
+			return errHTTPBadRequestTagUnknown
+		}
+		log.Printf("Tag %s is not a known emoji shortcode", tag)
+	}
+	return nil
+}
+
+// scheduledAllowed checks the global and per-topic limits of not-yet-published (scheduled) messages,
+// so that a single client cannot fill up the cache with messages far in the future. A limit of 0 means no limit.
+func (s *Server) scheduledAllowed(topic string) error {
+	if s.config.TotalScheduledLimit > 0 {
+		total, err := s.cache.ScheduledCount()
+		if err != nil {
+			return err
+		} else if total >= s.config.TotalScheduledLimit {
+			return errHTTPTooManyRequestsLimitScheduled
+		}
+	}
+	if s.config.TopicScheduledLimit > 0 {
+		count, err := s.cache.ScheduledCountForTopic(topic)
+		if err != nil {
+			return err
+		} else if count >= s.config.TopicScheduledLimit {
+			return errHTTPTooManyRequestsLimitScheduled
+		}
+	}
+	return nil
+}
+
+// parseLocation parses and validates a pair of latitude/longitude coordinates
+func parseLocation(lat, lon string) (*float64, *float64, error) {
+	latitude, err := strconv.ParseFloat(lat, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	longitude, err := strconv.ParseFloat(lon, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !(latitude >= -90 && latitude <= 90 && longitude >= -180 && longitude <= 180) { // Also catches NaN
+		return nil, nil, errors.New("coordinates out of range")
+	}
+	return &latitude, &longitude, nil
+}
+
+// isMarkdownContentType returns true if the given Content-Type header value is text/markdown, ignoring parameters
+func isMarkdownContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == contentTypeMarkdown
+}
+
+// parseActions parses and validates a JSON array of actions, see checkActions
+func parseActions(s string) ([]*action, error) {
+	var actions []*action
+	if err := json.Unmarshal([]byte(s), &actions); err != nil {
+		return nil, err
+	}
+	if err := checkActions(&message{Actions: actions}); err != nil {
+		return nil, err
+	}
+	return actions, nil
+}
+
+// parseContentParams parses the parameters that make up the content of a message, i.e. the parameters
+// that can be changed when a message is updated, see handleUpdate
+func (s *Server) parseContentParams(r *http.Request, m *message) error {
+	m.Title = readParam(r, "x-title", "title", "t")
+	messageStr := readParam(r, "x-message", "message", "m")
+	if messageStr != "" {
+		m.Message = messageStr
+	}
+	var err error
+	m.Priority, err = util.ParsePriority(readParam(r, "x-priority", "priority", "prio", "p"))
+	if err != nil {
+		return errHTTPBadRequestPriorityInvalid
+	}
+	tagsStr := readParam(r, "x-tags", "tags", "tag", "ta")
+	if tagsStr != "" {
+		m.Tags = make([]string, 0)
+		for _, s := range util.SplitNoEmpty(tagsStr, ",") {
+			m.Tags = append(m.Tags, strings.TrimSpace(s))
+		}
+		if err := s.validateTags(m.Tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // handlePublishBody consumes the PUT/POST body and decides whether the body is an attachment or the message.
 //
-// 1. curl -T somebinarydata.bin "ntfy.sh/mytopic?up=1"
-//    If body is binary, encode as base64, if not do not encode
-// 2. curl -H "Attach: http://example.com/file.jpg" ntfy.sh/mytopic
-//    Body must be a message, because we attached an external URL
-// 3. curl -T short.txt -H "Filename: short.txt" ntfy.sh/mytopic
-//    Body must be attachment, because we passed a filename
-// 4. curl -T file.txt ntfy.sh/mytopic
-//    If file.txt is <= 4096 (message limit) and valid UTF-8, treat it as a message
-// 5. curl -T file.txt ntfy.sh/mytopic
-//    If file.txt is > message limit, treat it as an attachment
+//  1. curl -T somebinarydata.bin "ntfy.sh/mytopic?up=1"
+//     If body is binary, encode as base64, if not do not encode
+//  2. curl -H "Attach: http://example.com/file.jpg" ntfy.sh/mytopic
+//     Body must be a message, because we attached an external URL
+//  3. curl -T short.txt -H "Filename: short.txt" ntfy.sh/mytopic
+//     Body must be attachment, because we passed a filename
+//  4. curl -T file.txt ntfy.sh/mytopic
+//     If file.txt is <= 4096 (message limit) and valid UTF-8, treat it as a message
+//  5. curl -T file.txt ntfy.sh/mytopic
+//     If file.txt is > message limit, treat it as an attachment
 func (s *Server) handlePublishBody(r *http.Request, v *visitor, m *message, body *util.PeakedReadCloser, unifiedpush bool) error {
 	if unifiedpush {
 		return s.handleBodyAsMessageAutoDetect(m, body) // Case 1
@@ -593,6 +952,12 @@ func (s *Server) handleBodyAsTextMessage(m *message, body *util.PeakedReadCloser
 	return nil
 }
 
+// hasLocalAttachment returns true if the message's attachment was uploaded to this server, i.e. it is stored
+// in the file cache under the message ID, see handleBodyAsAttachment. External attachments have no owner.
+func hasLocalAttachment(m *message) bool {
+	return m.Attachment != nil && m.Attachment.Owner != ""
+}
+
 func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message, body *util.PeakedReadCloser) error {
 	if s.fileCache == nil || s.config.BaseURL == "" || s.config.AttachmentCacheDir == "" {
 		return errHTTPBadRequestAttachmentsDisallowed
@@ -611,6 +976,11 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message,
 			return errHTTPBadRequestAttachmentTooLarge
 		}
 	}
+	if messages, err := s.cache.MessagesByIDs([]string{m.ID}); err != nil {
+		return err
+	} else if len(messages) > 0 {
+		return errHTTPConflictMessageExists // Custom message ID; writing the file would replace the other message's attachment
+	}
 	if m.Attachment == nil {
 		m.Attachment = &attachment{}
 	}
@@ -628,6 +998,8 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message,
 	m.Attachment.Size, err = s.fileCache.Write(m.ID, body, v.BandwidthLimiter(), util.NewFixedLimiter(remainingVisitorAttachmentSize))
 	if err == util.ErrLimitReached {
 		return errHTTPBadRequestAttachmentTooLarge
+	} else if err == errFileExists {
+		return errHTTPConflictMessageExists // Published concurrently with the same custom message ID
 	} else if err != nil {
 		return err
 	}
@@ -682,6 +1054,10 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	if err != nil {
 		return err
 	}
+	since, clamped := s.clampSince(since)
+	if clamped {
+		w.Header().Set("X-Since-Clamped", fmt.Sprintf("%d", since.Time().Unix()))
+	}
 	var wlock sync.Mutex
 	sub := func(msg *message) error {
 		if !filters.Pass(msg) {
@@ -704,7 +1080,7 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	w.Header().Set("Access-Control-Allow-Origin", "*")            // CORS, allow cross-origin requests
 	w.Header().Set("Content-Type", contentType+"; charset=utf-8") // Android/Volley client needs charset!
 	if poll {
-		return s.sendOldMessages(topics, since, scheduled, sub)
+		return s.sendOldMessages(r.Context(), topics, since, scheduled, filters, sub)
 	}
 	subscriberIDs := make([]int, 0)
 	for _, t := range topics {
@@ -718,7 +1094,7 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 	if err := sub(newOpenMessage(topicsStr)); err != nil { // Send out open message
 		return err
 	}
-	if err := s.sendOldMessages(topics, since, scheduled, sub); err != nil {
+	if err := s.sendOldMessages(r.Context(), topics, since, scheduled, filters, sub); err != nil {
 		return err
 	}
 	for {
@@ -750,6 +1126,11 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	if err != nil {
 		return err
 	}
+	responseHeader := http.Header{}
+	since, clamped := s.clampSince(since)
+	if clamped {
+		responseHeader.Set("X-Since-Clamped", fmt.Sprintf("%d", since.Time().Unix()))
+	}
 	upgrader := &websocket.Upgrader{
 		ReadBufferSize:  wsBufferSize,
 		WriteBufferSize: wsBufferSize,
@@ -757,7 +1138,7 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 			return true // We're open for business!
 		},
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		return err
 	}
@@ -814,7 +1195,7 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	}
 	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
 	if poll {
-		return s.sendOldMessages(topics, since, scheduled, sub)
+		return s.sendOldMessages(ctx, topics, since, scheduled, filters, sub)
 	}
 	subscriberIDs := make([]int, 0)
 	for _, t := range topics {
@@ -828,7 +1209,7 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	if err := sub(newOpenMessage(topicsStr)); err != nil { // Send out open message
 		return err
 	}
-	if err := s.sendOldMessages(topics, since, scheduled, sub); err != nil {
+	if err := s.sendOldMessages(ctx, topics, since, scheduled, filters, sub); err != nil {
 		return err
 	}
 	err = g.Wait()
@@ -838,7 +1219,7 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	return err
 }
 
-func parseSubscribeParams(r *http.Request) (poll bool, since sinceTime, scheduled bool, filters *queryFilter, err error) {
+func parseSubscribeParams(r *http.Request) (poll bool, since sinceMarker, scheduled bool, filters *queryFilter, err error) {
 	poll = readBoolParam(r, false, "x-poll", "poll", "po")
 	scheduled = readBoolParam(r, false, "x-scheduled", "scheduled", "sched")
 	since, err = parseSince(r, poll)
@@ -848,21 +1229,67 @@ func parseSubscribeParams(r *http.Request) (poll bool, since sinceTime, schedule
 	filters, err = parseQueryFilters(r)
 	if err != nil {
 		return
+	} else if filters.Order == orderDesc && !poll {
+		err = errHTTPBadRequestOrderInvalid // Live streams are always in ascending order
 	}
 	return
 }
 
-func (s *Server) sendOldMessages(topics []*topic, since sinceTime, scheduled bool, sub subscriber) error {
+// clampSince limits the since bound to the cache duration if the replay window guard is enabled, since
+// older messages have been pruned anyway. It returns true if the bound was clamped.
+func (s *Server) clampSince(since sinceMarker) (sinceMarker, bool) {
+	if !s.config.ReplayWindowGuard || since.IsNone() || since.IsID() {
+		return since, false
+	}
+	boundary := time.Now().Add(-s.config.CacheDuration)
+	if since.Time().Before(boundary) {
+		return newSinceTime(boundary.Unix()), true
+	}
+	return since, false
+}
+
+// sendOldMessages sends cached messages to the subscriber. The filters are applied when querying the cache,
+// so that non-matching messages aren't even read; the subscriber is expected to apply them as well. Without
+// filters, the messages of several topics are read with a single query, see cache.MessagesMulti.
+func (s *Server) sendOldMessages(ctx context.Context, topics []*topic, since sinceMarker, scheduled bool, filters *queryFilter, sub subscriber) error {
 	if since.IsNone() {
 		return nil
 	}
+	filter := filters.cacheFilter()
+	if len(topics) > 1 && filter.empty() {
+		return s.sendOldMessagesMulti(ctx, topics, since, scheduled, sub)
+	}
 	for _, t := range topics {
-		messages, err := s.cache.Messages(t.ID, since, scheduled)
+		err := s.cache.MessagesFuncContext(ctx, t.ID, since, scheduled, filter, sub) // Messages are written as they are read
 		if err != nil {
+			if ctx.Err() != nil {
+				return nil // Client went away, no need to send anything
+			}
 			return err
 		}
-		for _, m := range messages {
+	}
+	return nil
+}
+
+// sendOldMessagesMulti sends the cached messages of all topics to the subscriber, topic by topic
+func (s *Server) sendOldMessagesMulti(ctx context.Context, topics []*topic, since sinceMarker, scheduled bool, sub subscriber) error {
+	topicIDs := make([]string, len(topics))
+	for i, t := range topics {
+		topicIDs[i] = t.ID
+	}
+	messages, err := s.cache.MessagesMulti(topicIDs, since, scheduled)
+	if err != nil {
+		return err
+	}
+	for _, topicID := range topicIDs {
+		for _, m := range messages[topicID] {
+			if ctx.Err() != nil {
+				return nil // Client went away, no need to send anything
+			}
 			if err := sub(m); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
 				return err
 			}
 		}
@@ -872,9 +1299,9 @@ func (s *Server) sendOldMessages(topics []*topic, since sinceTime, scheduled boo
 
 // parseSince returns a timestamp identifying the time span from which cached messages should be received.
 //
-// Values in the "since=..." parameter can be either a unix timestamp or a duration (e.g. 12h), or
-// "all" for all messages.
-func parseSince(r *http.Request, poll bool) (sinceTime, error) {
+// Values in the "since=..." parameter can be either a unix timestamp or a duration (e.g. 12h),
+// "all" for all messages, or the ID of the last message the subscriber has received.
+func parseSince(r *http.Request, poll bool) (sinceMarker, error) {
 	since := readParam(r, "x-since", "since", "si")
 	if since == "" {
 		if poll {
@@ -885,16 +1312,18 @@ func parseSince(r *http.Request, poll bool) (sinceTime, error) {
 	if since == "all" {
 		return sinceAllMessages, nil
 	} else if s, err := strconv.ParseInt(since, 10, 64); err == nil {
-		return sinceTime(time.Unix(s, 0)), nil
+		return newSinceTime(s), nil
 	} else if d, err := time.ParseDuration(since); err == nil {
-		return sinceTime(time.Now().Add(-1 * d)), nil
+		return newSinceTime(time.Now().Add(-1 * d).Unix()), nil
+	} else if messageIDRegex.MatchString(since) {
+		return newSinceID(since), nil
 	}
 	return sinceNoMessages, errHTTPBadRequestSinceInvalid
 }
 
 func (s *Server) handleOptions(w http.ResponseWriter, _ *http.Request) error {
 	w.Header().Set("Access-Control-Allow-Origin", "*") // CORS, allow cross-origin requests
-	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, DELETE")
 	return nil
 }
 
@@ -959,17 +1388,56 @@ func (s *Server) updateStatsAndPrune() {
 		if err == nil {
 			if err := s.fileCache.Remove(ids...); err != nil {
 				log.Printf("error while deleting attachments: %s", err.Error())
+			} else {
+				for _, id := range ids {
+					if err := s.cache.ClearAttachment(id); err != nil && err != errNoRows {
+						log.Printf("error while clearing attachment of message %s: %s", id, err.Error())
+					}
+				}
 			}
 		} else {
 			log.Printf("error retrieving expired attachments: %s", err.Error())
 		}
 	}
 
-	// Prune message cache
+	// Prune message cache, topics without subscribers may be pruned more aggressively
 	olderThan := time.Now().Add(-1 * s.config.CacheDuration)
-	if err := s.cache.Prune(olderThan); err != nil {
+	inactiveOlderThan := olderThan
+	if s.config.InactiveCacheDuration > 0 {
+		inactiveOlderThan = time.Now().Add(-1 * s.config.InactiveCacheDuration)
+	}
+	activeTopics := make([]string, 0)
+	for _, t := range s.topics {
+		if t.Subscribers() > 0 {
+			activeTopics = append(activeTopics, t.ID)
+		}
+	}
+	perTopic := make(map[string]time.Time)
+	for topic, duration := range s.config.TopicCacheDurations {
+		perTopic[topic] = time.Now().Add(-1 * duration)
+	}
+	perPriority := make(map[int]time.Time)
+	for priority, duration := range s.config.PriorityCacheDurations {
+		perPriority[priority] = time.Now().Add(-1 * duration)
+	}
+	var pruned int
+	if n, err := s.cache.Prune(olderThan, inactiveOlderThan, activeTopics, perTopic, perPriority); err != nil {
 		log.Printf("error pruning cache: %s", err.Error())
+	} else {
+		pruned += int(n)
+	}
+	if s.config.CacheTopicMessageLimit > 0 {
+		if n, err := s.cache.PruneToCount(s.config.CacheTopicMessageLimit); err != nil {
+			log.Printf("error pruning cache to message limit: %s", err.Error())
+		} else {
+			pruned += n
+		}
+	}
+	if pruned > 0 {
+		log.Printf("Pruned %d message(s) from cache", pruned)
 	}
+	s.pruned += pruned
+	s.compactCacheIfIdle()
 
 	// Prune old topics, remove subscriptions without subscribers
 	var subscribers, messages int
@@ -997,6 +1465,28 @@ func (s *Server) updateStatsAndPrune() {
 	// Print stats
 	log.Printf("Stats: %d message(s) published, %d in cache, %d successful mails, %d failed, %d topic(s) active, %d subscriber(s), %d visitor(s)",
 		s.messages, messages, mailSuccess, mailFailure, len(s.topics), subscribers, len(s.visitors))
+	s.lastMessages = s.messages
+}
+
+// compactCacheIfIdle compacts the cache once more than the configured number of messages were pruned, but only
+// if the server is idle (no subscribers, and nothing published since the last manager run), since compacting
+// locks the cache. Must be called with s.mu held.
+func (s *Server) compactCacheIfIdle() {
+	if s.config.CacheCompactThreshold <= 0 || s.pruned < s.config.CacheCompactThreshold {
+		return
+	} else if s.messages != s.lastMessages {
+		return // Messages were published since the last run
+	}
+	for _, t := range s.topics {
+		if t.Subscribers() > 0 {
+			return
+		}
+	}
+	if err := s.cache.Compact(); err != nil {
+		log.Printf("error compacting cache: %s", err.Error())
+		return
+	}
+	s.pruned = 0
 }
 
 func (s *Server) runSMTPServer() error {
@@ -1071,7 +1561,7 @@ func (s *Server) runFirebaseKeepaliver() {
 func (s *Server) sendDelayedMessages() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	messages, err := s.cache.MessagesDue()
+	messages, err := s.cache.TakeMessagesDue() // Marks them published, so they can no longer be cancelled
 	if err != nil {
 		return err
 	}
@@ -1083,12 +1573,13 @@ func (s *Server) sendDelayedMessages() error {
 			}
 		}
 		if s.firebase != nil { // Firebase subscribers may not show up in topics map
-			if err := s.firebase(m); err != nil {
+			err := s.firebase(m)
+			if err != nil {
 				log.Printf("unable to publish to Firebase: %v", err.Error())
 			}
-		}
-		if err := s.cache.MarkPublished(m); err != nil {
-			return err
+			if err := s.cache.AddDelivery(m.Topic, err != nil); err != nil {
+				log.Printf("unable to record Firebase delivery: %v", err.Error())
+			}
 		}
 	}
 	return nil
@@ -13,6 +13,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -127,6 +128,77 @@ func TestServer_PublishAndSubscribe(t *testing.T) {
 	require.Equal(t, []string{"tag1", "tag 2", "tag3"}, messages[2].Tags)
 }
 
+func TestServer_UpdateMessage(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	subscribeRR := httptest.NewRecorder()
+	subscribeCancel := subscribe(t, s, "/mytopic/json", subscribeRR)
+
+	response := request(t, s, "PUT", "/mytopic", "backup running", map[string]string{
+		"Title": "Backup",
+	})
+	original := toMessage(t, response.Body.String())
+
+	response = request(t, s, "PUT", "/mytopic/"+original.ID, "backup done", map[string]string{
+		"Title": "Backup",
+		"Tags":  "white_check_mark",
+	})
+	require.Equal(t, 200, response.Code)
+	updated := toMessage(t, response.Body.String())
+	require.Equal(t, original.ID, updated.ID)
+	require.Equal(t, original.Time, updated.Time)
+	require.NotZero(t, updated.Edited)
+	require.Equal(t, "backup done", updated.Message)
+
+	// Live subscribers receive the update as another message event
+	subscribeCancel()
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 3, len(messages))
+	var edit *message
+	for _, m := range messages[1:] { // Publishing is asynchronous, so the order is not guaranteed
+		if m.Edited != 0 {
+			edit = m
+		}
+	}
+	require.NotNil(t, edit)
+	require.Equal(t, messageEvent, edit.Event)
+	require.Equal(t, original.ID, edit.ID)
+	require.Equal(t, "backup done", edit.Message)
+	require.Equal(t, []string{"white_check_mark"}, edit.Tags)
+
+	// Reconnecting subscribers get the latest content
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "backup done", messages[0].Message)
+	require.Equal(t, updated.Edited, messages[0].Edited)
+
+	// Unknown message, or message of another topic
+	response = request(t, s, "PUT", "/mytopic/abcdefghij", "nope", nil)
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "PUT", "/othertopic/"+original.ID, "nope", nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestServer_UpdateMessageForeignVisitor(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	original := toMessage(t, request(t, s, "PUT", "/mytopic", "backup running", nil).Body.String())
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/mytopic/"+original.ID, strings.NewReader("hijacked"))
+	require.Nil(t, err)
+	req.RemoteAddr = "1.2.3.4"
+	s.handle(rr, req)
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40301, toHTTPError(t, rr.Body.String()).Code)
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "backup running", messages[0].Message)
+	require.Zero(t, messages[0].Edited)
+}
+
 func TestServer_StaticSites(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -205,6 +277,24 @@ func TestServer_PublishPriority(t *testing.T) {
 	require.Equal(t, 40007, toHTTPError(t, response.Body.String()).Code)
 }
 
+func TestServer_PublishTagValidation(t *testing.T) {
+	c := newTestConfig(t)
+	c.TagValidation = TagValidationStrict
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "known tags", map[string]string{"Tags": "warning,+1"})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, []string{"warning", "+1"}, toMessage(t, response.Body.String()).Tags)
+
+	response = request(t, s, "PUT", "/mytopic", "unknown tag", map[string]string{"Tags": "warning,not-an-emoji"})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40018, toHTTPError(t, response.Body.String()).Code)
+
+	c.TagValidation = TagValidationWarn
+	response = request(t, s, "PUT", "/mytopic", "unknown tag", map[string]string{"Tags": "not-an-emoji"})
+	require.Equal(t, 200, response.Code)
+}
+
 func TestServer_PublishNoCache(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -220,6 +310,350 @@ func TestServer_PublishNoCache(t *testing.T) {
 	require.Empty(t, messages)
 }
 
+func TestServer_PublishDurable(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "a durable message", map[string]string{
+		"Durable": "yes",
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "a durable message", messages[0].Message)
+
+	response = request(t, s, "PUT", "/mytopic", "a durable message", map[string]string{
+		"Durable": "yes",
+		"Cache":   "no",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40019, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishDedup(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "backup failed", map[string]string{
+		"X-Dedup": "yes",
+	})
+	require.Equal(t, 200, response.Code)
+	first := toMessage(t, response.Body.String())
+
+	response = request(t, s, "PUT", "/mytopic?dedup=1", "backup failed", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, first.ID, toMessage(t, response.Body.String()).ID)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, first.ID, messages[0].ID)
+
+	response = request(t, s, "PUT", "/mytopic", "backup failed", map[string]string{
+		"Dedup": "yes",
+		"Cache": "no",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40023, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishIdempotencyKey(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "order shipped", map[string]string{
+		"Idempotency-Key": "order-1234",
+		"Title":           "Shop",
+	})
+	require.Equal(t, 200, response.Code)
+	first := toMessage(t, response.Body.String())
+
+	response = request(t, s, "PUT", "/mytopic", "order shipped", map[string]string{
+		"Idempotency-Key": "order-1234",
+	})
+	require.Equal(t, 200, response.Code)
+	replayed := toMessage(t, response.Body.String())
+	require.Equal(t, first.ID, replayed.ID)
+	require.Equal(t, "Shop", replayed.Title)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 1, len(toMessages(t, response.Body.String())))
+
+	response = request(t, s, "PUT", "/mytopic", "order shipped", map[string]string{
+		"Idempotency-Key": "order-1234",
+		"Cache":           "no",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40024, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic", "order shipped", map[string]string{
+		"Idempotency-Key": "order 1234",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40025, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishCustomMessageID(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "order shipped", map[string]string{
+		"Message-ID": "order12345",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "order12345", toMessage(t, response.Body.String()).ID)
+
+	response = request(t, s, "PUT", "/othertopic", "order shipped again", map[string]string{
+		"X-Message-ID": "order12345",
+	})
+	require.Equal(t, 409, response.Code)
+	require.Equal(t, 40902, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic", util.RandomString(5000), map[string]string{
+		"Message-ID": "order12345",
+	})
+	require.Equal(t, 409, response.Code) // Attachment is not written
+	require.NoFileExists(t, filepath.Join(s.config.AttachmentCacheDir, "order12345"))
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "order shipped", messages[0].Message)
+
+	response = request(t, s, "PUT", "/mytopic", "order shipped", map[string]string{
+		"Message-ID": "order-12345",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40032, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic", "order shipped", map[string]string{
+		"Message-ID": "1234567890", // Would be read as a Unix timestamp in since=1234567890
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40032, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic", "order shipped", map[string]string{
+		"Message-ID": "order67890",
+		"Cache":      "no",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40031, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishCustomMessageIDAttachmentExists(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	// Another publish with the same ID is still uploading its attachment
+	require.Nil(t, os.WriteFile(filepath.Join(s.config.AttachmentCacheDir, "order12345"), []byte("first upload"), 0600))
+	response := request(t, s, "PUT", "/mytopic", util.RandomString(5000), map[string]string{
+		"Message-ID": "order12345",
+	})
+	require.Equal(t, 409, response.Code)
+	require.Equal(t, 40902, toHTTPError(t, response.Body.String()).Code)
+	require.Equal(t, "first upload", readFile(t, filepath.Join(s.config.AttachmentCacheDir, "order12345")))
+}
+
+func TestServer_PublishAttachmentRemovedIfNotCached(t *testing.T) {
+	c := newTestConfig(t)
+	c.CacheMaxMessagesPerTopic = 1
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "first message", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", util.RandomString(5000), map[string]string{
+		"Message-ID": "order12345",
+	})
+	require.Equal(t, 429, response.Code)
+	require.NoFileExists(t, filepath.Join(s.config.AttachmentCacheDir, "order12345"))
+}
+
+func TestServer_PublishActions(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "door opened", map[string]string{
+		"Actions": `[{"type":"view","label":"Open camera","url":"https://home.example.com/camera"},{"type":"http","label":"Lock door","url":"https://home.example.com/door","clear":true}]`,
+	})
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, 2, len(msg.Actions))
+	require.Equal(t, "view", msg.Actions[0].Type)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, msg.Actions, messages[0].Actions)
+	require.Equal(t, "https://home.example.com/door", messages[0].Actions[1].URL)
+	require.True(t, messages[0].Actions[1].Clear)
+
+	response = request(t, s, "PUT", "/mytopic", "invalid", map[string]string{
+		"X-Actions": `[{"type":"download","label":"Download"}]`,
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40026, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic", "invalid", map[string]string{
+		"Actions": "not json",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40026, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishIcon(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "with icon", map[string]string{
+		"X-Icon": "https://example.com/icon.png",
+	})
+	require.Equal(t, "https://example.com/icon.png", toMessage(t, response.Body.String()).Icon)
+
+	response = request(t, s, "PUT", "/mytopic?icon=https://example.com/other.png", "query param", nil)
+	require.Equal(t, "https://example.com/other.png", toMessage(t, response.Body.String()).Icon)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "https://example.com/icon.png", messages[0].Icon)
+	require.Equal(t, "https://example.com/other.png", messages[1].Icon)
+}
+
+func TestServer_PublishMarkdown(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "**plain**", nil)
+	require.Equal(t, "text/plain", toMessage(t, response.Body.String()).ContentType)
+
+	response = request(t, s, "PUT", "/mytopic", "**header**", map[string]string{
+		"X-Markdown": "true",
+	})
+	require.Equal(t, "text/markdown", toMessage(t, response.Body.String()).ContentType)
+
+	response = request(t, s, "PUT", "/mytopic", "**content type**", map[string]string{
+		"Content-Type": "text/markdown; charset=utf-8",
+	})
+	require.Equal(t, "text/markdown", toMessage(t, response.Body.String()).ContentType)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "text/plain", messages[0].ContentType)
+	require.Equal(t, "text/markdown", messages[1].ContentType)
+	require.Equal(t, "text/markdown", messages[2].ContentType)
+}
+
+func TestServer_PublishPrioritySource(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "disk is full", map[string]string{
+		"Priority":        "5",
+		"Priority-Source": "rule:disk-full",
+	})
+	require.Equal(t, "rule:disk-full", toMessage(t, response.Body.String()).PrioritySource)
+
+	response = request(t, s, "PUT", "/mytopic", "no source", nil)
+	require.NotContains(t, response.Body.String(), "priority_source")
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "rule:disk-full", messages[0].PrioritySource)
+	require.Equal(t, "", messages[1].PrioritySource)
+}
+
+func TestServer_PublishTagLimits(t *testing.T) {
+	c := newTestConfig(t)
+	c.MessageTagsLimit = 2
+	c.MessageTagLengthLimit = 10
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "at the limits", map[string]string{
+		"Tags": "warning, skull",
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/mytopic", "too many tags", map[string]string{
+		"Tags": "warning,skull,tada",
+	})
+	require.Equal(t, 40021, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic", "tag too long", map[string]string{
+		"Tags": "warning,a-very-long-tag",
+	})
+	require.Equal(t, 40022, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishMessageTooLarge(t *testing.T) {
+	c := newTestConfig(t)
+	c.MessageLimit = 10
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic?message=0123456789", "", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/mytopic", "", map[string]string{
+		"X-Message": "this message is too long",
+	})
+	require.Equal(t, 400, response.Code)
+	err := toHTTPError(t, response.Body.String())
+	require.Equal(t, 40028, err.Code)
+	require.Equal(t, "invalid message: message too large: message is 24 bytes, limit is 10 bytes", err.Message)
+}
+
+func TestServer_PublishLocation(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic?lat=52.52&lon=13.405", "fire alarm", nil)
+	require.Equal(t, 200, response.Code)
+	require.Contains(t, response.Body.String(), `"lat":52.52,"lon":13.405`)
+
+	response = request(t, s, "PUT", "/mytopic", "no location", nil)
+	require.Equal(t, 200, response.Code)
+	require.NotContains(t, response.Body.String(), `"lat"`)
+	require.NotContains(t, response.Body.String(), `"lon"`)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, 52.52, *messages[0].Lat)
+	require.Equal(t, 13.405, *messages[0].Lon)
+	require.Nil(t, messages[1].Lat)
+	require.Nil(t, messages[1].Lon)
+
+	response = request(t, s, "PUT", "/mytopic", "only lat", map[string]string{
+		"Lat": "52.52",
+	})
+	require.Equal(t, 40020, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/mytopic?lat=91&lon=13.405", "out of range", nil)
+	require.Equal(t, 40020, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PollReplayWindowGuard(t *testing.T) {
+	c := newTestConfig(t)
+	c.CacheDuration = 12 * time.Hour
+	c.ReplayWindowGuard = true
+	s := newTestServer(t, c)
+
+	ancient := newDefaultMessage("mytopic", "ancient message, not yet pruned")
+	ancient.Time = time.Now().Add(-48 * time.Hour).Unix()
+	require.Nil(t, s.cache.AddMessage(ancient))
+	require.Nil(t, s.cache.AddMessage(newDefaultMessage("mytopic", "recent message")))
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1&since=all", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "recent message", messages[0].Message)
+	clamped, err := strconv.ParseInt(response.Header().Get("X-Since-Clamped"), 10, 64)
+	require.Nil(t, err)
+	require.InDelta(t, time.Now().Add(-12*time.Hour).Unix(), clamped, 2)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&since=1h", "", nil)
+	require.Equal(t, 1, len(toMessages(t, response.Body.String())))
+	require.Equal(t, "", response.Header().Get("X-Since-Clamped"))
+
+	s.config.ReplayWindowGuard = false
+	response = request(t, s, "GET", "/mytopic/json?poll=1&since=all", "", nil)
+	require.Equal(t, 2, len(toMessages(t, response.Body.String())))
+	require.Equal(t, "", response.Header().Get("X-Since-Clamped"))
+}
+
 func TestServer_PublishAt(t *testing.T) {
 	c := newTestConfig(t)
 	c.MinDelay = time.Second
@@ -244,6 +678,99 @@ func TestServer_PublishAt(t *testing.T) {
 	require.Equal(t, "a message", messages[0].Message)
 }
 
+func TestServer_DeleteScheduled(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	scheduled := toMessage(t, request(t, s, "PUT", "/mytopic", "a reminder", map[string]string{
+		"In": "1h",
+	}).Body.String())
+	sent := toMessage(t, request(t, s, "PUT", "/mytopic", "a message", nil).Body.String())
+
+	response := request(t, s, "DELETE", "/othertopic/"+scheduled.ID, "", nil)
+	require.Equal(t, 404, response.Code)
+
+	response = request(t, s, "DELETE", "/mytopic/"+scheduled.ID, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, scheduled.ID, toMessage(t, response.Body.String()).ID)
+
+	response = request(t, s, "DELETE", "/mytopic/"+scheduled.ID, "", nil)
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "DELETE", "/mytopic/"+sent.ID, "", nil)
+	require.Equal(t, 409, response.Code)
+	require.Equal(t, 40901, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&scheduled=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "a message", messages[0].Message)
+}
+
+func TestServer_DeleteScheduledWithAttachment(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	scheduled := toMessage(t, request(t, s, "PUT", "/mytopic", util.RandomString(5000), map[string]string{
+		"In": "1h",
+	}).Body.String())
+	require.NotNil(t, scheduled.Attachment)
+	file := filepath.Join(s.config.AttachmentCacheDir, scheduled.ID)
+	require.FileExists(t, file)
+
+	response := request(t, s, "DELETE", "/mytopic/"+scheduled.ID, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.NoFileExists(t, file)
+}
+
+func TestServer_DeleteScheduledForeignVisitor(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	scheduled := toMessage(t, request(t, s, "PUT", "/mytopic", util.RandomString(5000), map[string]string{
+		"In": "1h",
+	}).Body.String())
+	file := filepath.Join(s.config.AttachmentCacheDir, scheduled.ID)
+	require.FileExists(t, file)
+
+	rr := httptest.NewRecorder()
+	req, err := http.NewRequest("DELETE", "/mytopic/"+scheduled.ID, nil)
+	require.Nil(t, err)
+	req.RemoteAddr = "1.2.3.4"
+	s.handle(rr, req)
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40301, toHTTPError(t, rr.Body.String()).Code)
+	require.FileExists(t, file)
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1&scheduled=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, scheduled.ID, messages[0].ID)
+}
+
+func TestServer_PublishTopicFull(t *testing.T) {
+	c := newTestConfig(t)
+	c.CacheMaxMessagesPerTopic = 2
+	s := newTestServer(t, c)
+
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "message 1", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "message 2", nil).Code)
+	response := request(t, s, "PUT", "/mytopic", "message 3", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42907, toHTTPError(t, response.Body.String()).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/othertopic", "message 1", nil).Code)
+}
+
+func TestServer_PublishRecordsSender(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "some spam", nil)
+	require.NotContains(t, response.Body.String(), "sender")
+	msg := toMessage(t, response.Body.String())
+
+	messages, err := s.cache.MessagesBySender(SenderHash("9.9.9.9")) // See request()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, msg.ID, messages[0].ID)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.NotContains(t, response.Body.String(), "sender")
+}
+
 func TestServer_PublishAtWithCacheError(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -303,6 +830,48 @@ func TestServer_PublishAtAndPrune(t *testing.T) {
 	require.Equal(t, "a message", messages[0].Message)
 }
 
+func TestServer_PublishAtTooManyScheduled(t *testing.T) {
+	c := newTestConfig(t)
+	c.TotalScheduledLimit = 3
+	c.TopicScheduledLimit = 2
+	s := newTestServer(t, c)
+
+	for i := 0; i < 2; i++ {
+		response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{"In": "1h"})
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "PUT", "/mytopic", "one too many", map[string]string{"In": "1h"})
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42906, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/othertopic", "a message", map[string]string{"In": "1h"})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/othertopic", "global limit reached", map[string]string{"In": "1h"})
+	require.Equal(t, 429, response.Code)
+
+	response = request(t, s, "PUT", "/mytopic", "immediate message", nil) // Not affected by limit
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "immediate message", messages[0].Message)
+}
+
+func TestServer_PublishAtScheduledLimitDisabled(t *testing.T) {
+	c := newTestConfig(t)
+	c.TotalScheduledLimit = 0
+	c.TopicScheduledLimit = 0
+	s := newTestServer(t, c)
+
+	for i := 0; i < 5; i++ {
+		response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{"In": "1h"})
+		require.Equal(t, 200, response.Code)
+	}
+	count, err := s.cache.ScheduledCount()
+	require.Nil(t, err)
+	require.Equal(t, 5, count)
+}
+
 func TestServer_PublishAndMultiPoll(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -333,6 +902,25 @@ func TestServer_PublishAndMultiPoll(t *testing.T) {
 	require.Equal(t, "message 2", messages[1].Message)
 }
 
+func TestServer_PollMultipleTopicsSinceIDAndFilters(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	first := toMessage(t, request(t, s, "PUT", "/mytopic1", "message 1", nil).Body.String())
+	request(t, s, "PUT", "/mytopic2", "message 2", map[string]string{"Priority": "5"})
+	request(t, s, "PUT", "/mytopic1", "message 3", nil)
+
+	// Without filters, all topics are read at once, see cache.MessagesMulti
+	response := request(t, s, "GET", "/mytopic1,mytopic2/json?poll=1&since="+first.ID, "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "message 3", messages[0].Message)
+	require.Equal(t, "message 2", messages[1].Message)
+
+	response = request(t, s, "GET", "/mytopic1,mytopic2/json?poll=1&priority=5", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "message 2", messages[0].Message)
+}
+
 func TestServer_PublishWithNopCache(t *testing.T) {
 	c := newTestConfig(t)
 	c.CacheDuration = 0
@@ -384,6 +972,31 @@ func TestServer_PublishAndPollSince(t *testing.T) {
 	require.Equal(t, 40008, toHTTPError(t, response.Body.String()).Code)
 }
 
+func TestServer_PublishAndPollSinceID(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	m1 := toMessage(t, request(t, s, "PUT", "/mytopic", "test 1", nil).Body.String())
+	m2 := toMessage(t, request(t, s, "PUT", "/mytopic", "test 2", nil).Body.String()) // Likely the same second
+	request(t, s, "PUT", "/mytopic", "test 3", nil)
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1&since="+m1.ID, "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "test 2", messages[0].Message)
+	require.Equal(t, "test 3", messages[1].Message)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&since="+m2.ID, "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "test 3", messages[0].Message)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&since=0123456789", "", nil) // Parsed as timestamp
+	require.Equal(t, 3, len(toMessages(t, response.Body.String())))
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&since=abcdefghij", "", nil) // Unknown ID, e.g. pruned
+	require.Equal(t, 3, len(toMessages(t, response.Body.String())))
+}
+
 func TestServer_PublishViaGET(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -429,6 +1042,84 @@ func TestServer_PublishInvalidTopic(t *testing.T) {
 	require.Equal(t, 40010, toHTTPError(t, response.Body.String()).Code)
 }
 
+func TestServer_PollUntil(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for _, hour := range []int{12, 14, 15, 16, 17} {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("at %d:00", hour))
+		m.Time = time.Date(2022, 1, 1, hour, 0, 0, 0, time.UTC).Unix()
+		require.Nil(t, s.cache.AddMessage(m))
+	}
+	from := time.Date(2022, 1, 1, 14, 0, 0, 0, time.UTC).Unix()
+	to := time.Date(2022, 1, 1, 16, 0, 0, 0, time.UTC).Unix()
+
+	response := request(t, s, "GET", fmt.Sprintf("/mytopic/json?poll=1&since=%d&until=%d", from, to), "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "at 14:00", messages[0].Message)
+	require.Equal(t, "at 16:00", messages[2].Message)
+
+	response = request(t, s, "GET", fmt.Sprintf("/mytopic/json?poll=1&until=%d", from), "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "at 12:00", messages[0].Message)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&until=yesterday", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40027, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PollOrderDesc(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for i := 1; i <= 3; i++ {
+		m := newDefaultMessage("mytopic", fmt.Sprintf("message %d", i))
+		m.Time = time.Now().Unix() - int64(3-i)
+		require.Nil(t, s.cache.AddMessage(m))
+	}
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1&order=desc", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "message 3", messages[0].Message)
+	require.Equal(t, "message 1", messages[2].Message)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&order=asc", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, "message 1", messages[0].Message)
+
+	response = request(t, s, "GET", "/mytopic/json?order=desc", "", nil) // Not for live streams
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40030, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&order=newest", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40030, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_MarkRead(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	first := toMessage(t, request(t, s, "PUT", "/mytopic", "first message", nil).Body.String())
+	request(t, s, "PUT", "/mytopic", "second message", nil)
+
+	response := request(t, s, "PUT", "/mytopic/"+first.ID+"/read", "", map[string]string{"X-User": "phil"})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, first.ID, toMessage(t, response.Body.String()).ID)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&unread-by=phil", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "second message", messages[0].Message)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&unread-by=lisa", "", nil)
+	require.Equal(t, 2, len(toMessages(t, response.Body.String())))
+
+	response = request(t, s, "PUT", "/mytopic/"+first.ID+"/read", "", nil)
+	require.Equal(t, 40029, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/othertopic/"+first.ID+"/read?user=phil", "", nil)
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "PUT", "/mytopic/abcdefghij/read?user=phil", "", nil)
+	require.Equal(t, 404, response.Code)
+}
+
 func TestServer_PollWithQueryFilters(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -498,6 +1189,18 @@ func TestServer_PollWithQueryFilters(t *testing.T) {
 	}
 }
 
+func TestServer_PollWithTagFilterExact(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	request(t, s, "PUT", "/mytopic", "tagged warning", map[string]string{"Tags": "warning"})
+	request(t, s, "PUT", "/mytopic", "tagged unwarranted", map[string]string{"Tags": "unwarranted"})
+	request(t, s, "PUT", "/mytopic", "tagged warn", map[string]string{"Tags": "disk,warn"})
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1&tags=warn", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "tagged warn", messages[0].Message)
+}
+
 func TestServer_SubscribeWithQueryFilters(t *testing.T) {
 	c := newTestConfig(t)
 	c.KeepaliveInterval = 800 * time.Millisecond
@@ -572,6 +1275,25 @@ func TestServer_PublishTooManyEmails_Defaults(t *testing.T) {
 	require.Equal(t, 429, response.Code)
 }
 
+func TestServer_PublishEmailMasked(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	s.mailer = &testMailer{}
+	response := request(t, s, "PUT", "/mytopic", "also sent via e-mail", map[string]string{
+		"E-Mail": "phil@example.com",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Contains(t, response.Body.String(), `"email":"p***@example.com"`)
+	require.NotContains(t, response.Body.String(), "phil@example.com")
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Contains(t, response.Body.String(), `"email":"p***@example.com"`)
+	require.NotContains(t, response.Body.String(), "phil@example.com")
+
+	messages, err := s.cache.Messages("mytopic", sinceAllMessages, false, 0)
+	require.Nil(t, err)
+	require.Equal(t, "phil@example.com", messages[0].Email)
+}
+
 func TestServer_PublishTooManyEmails_Replenish(t *testing.T) {
 	c := newTestConfig(t)
 	c.VisitorEmailLimitReplenish = 500 * time.Millisecond
@@ -699,6 +1421,45 @@ func TestServer_PublishAttachment(t *testing.T) {
 	size, err := s.cache.AttachmentsSize("9.9.9.9") // See request()
 	require.Nil(t, err)
 	require.Equal(t, int64(5000), size)
+
+	// The download above is counted towards the uploader's download bytes
+	downloaded, err := s.cache.DownloadBytes("9.9.9.9")
+	require.Nil(t, err)
+	require.Equal(t, int64(5000), downloaded)
+}
+
+func TestServer_PublishAttachmentMaxExpiry(t *testing.T) {
+	c := newTestConfig(t)
+	c.CacheMaxAttachmentExpiry = time.Hour // Shorter than the attachment expiry duration of 3h
+	s := newTestServer(t, c)
+	response := request(t, s, "PUT", "/mytopic", util.RandomString(5000), nil)
+	msg := toMessage(t, response.Body.String())
+	require.InDelta(t, time.Now().Add(time.Hour).Unix(), msg.Attachment.Expires, 1)
+}
+
+func TestServer_PublishAttachmentExpiredRetriedAfterRemoveFailed(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentExpiryDuration = time.Second
+	s := newTestServer(t, c)
+	msg := toMessage(t, request(t, s, "PUT", "/mytopic", util.RandomString(5000), nil).Body.String())
+	file := filepath.Join(c.AttachmentCacheDir, msg.ID)
+	require.FileExists(t, file)
+	time.Sleep(2100 * time.Millisecond)
+
+	// Deleting the file fails while the attachment directory is gone
+	movedDir := c.AttachmentCacheDir + ".moved"
+	require.Nil(t, os.Rename(c.AttachmentCacheDir, movedDir))
+	s.updateStatsAndPrune()
+	require.Nil(t, os.Rename(movedDir, c.AttachmentCacheDir))
+	require.FileExists(t, file)
+
+	// Next run tries again
+	s.updateStatsAndPrune()
+	require.NoFileExists(t, file)
+	messages, err := s.cache.MessagesByIDs([]string{msg.ID})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Nil(t, messages[0].Attachment)
 }
 
 func TestServer_PublishAttachmentShortWithFilename(t *testing.T) {
@@ -856,6 +1617,31 @@ func TestServer_PublishAttachmentAndPrune(t *testing.T) {
 	require.NoFileExists(t, file)
 	response = request(t, s, "GET", path, "", nil)
 	require.Equal(t, 404, response.Code)
+
+	// Message is kept, but without the attachment
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, msg.ID, messages[0].ID)
+	require.Nil(t, messages[0].Attachment)
+}
+
+func TestServer_CacheWarmTopics(t *testing.T) {
+	c := newTestConfig(t)
+	c.CacheWarmTopics = []string{"mytopic"}
+	s := newTestServer(t, c)
+	require.IsType(t, &cachingCache{}, s.cache)
+
+	response := request(t, s, "PUT", "/mytopic", "my first message", nil)
+	require.Equal(t, 200, response.Code)
+	first := toMessage(t, response.Body.String())
+	response = request(t, s, "PUT", "/mytopic", "my second message", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&since="+first.ID, "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "my second message", messages[0].Message)
 }
 
 func TestServer_PublishAttachmentBandwidthLimit(t *testing.T) {
@@ -906,6 +1692,28 @@ func TestServer_PublishAttachmentBandwidthLimitUploadOnly(t *testing.T) {
 	require.Equal(t, 40012, err.Code)
 }
 
+func TestServer_Health(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/v1/health", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"healthy":true,"schema_version":`+fmt.Sprintf("%d", currentSchemaVersion)+"}\n", response.Body.String())
+
+	// Cache database no longer reachable
+	require.Nil(t, s.cache.(*sqliteCache).db.Close())
+	response = request(t, s, "GET", "/v1/health", "", nil)
+	require.Equal(t, 503, response.Code)
+	require.Equal(t, `{"healthy":false}`+"\n", response.Body.String())
+}
+
+func TestServer_Health_MemCache(t *testing.T) {
+	c := newTestConfig(t)
+	c.CacheFile = ""
+	s := newTestServer(t, c)
+	response := request(t, s, "GET", "/v1/health", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"healthy":true}`+"\n", response.Body.String())
+}
+
 func newTestConfig(t *testing.T) *Config {
 	conf := NewConfig()
 	conf.BaseURL = "http://127.0.0.1:12345"
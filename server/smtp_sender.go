@@ -98,6 +98,21 @@ type emoji struct {
 	Aliases []string `json:"aliases"`
 }
 
+// loadEmojiMap returns a map of all known emoji shortcodes (aliases) to their emoji
+func loadEmojiMap() (map[string]string, error) {
+	var emojis []emoji
+	if err := json.Unmarshal([]byte(emojisJSON), &emojis); err != nil {
+		return nil, err
+	}
+	emojiMap := make(map[string]string)
+	for _, e := range emojis {
+		for _, alias := range e.Aliases {
+			emojiMap[alias] = e.Emoji
+		}
+	}
+	return emojiMap, nil
+}
+
 func toEmojis(tags []string) (emojisOut []string, tagsOut []string, err error) {
 	var emojis []emoji
 	if err = json.Unmarshal([]byte(emojisJSON), &emojis); err != nil {
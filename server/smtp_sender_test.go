@@ -139,3 +139,12 @@ Priority: max
 This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`
 	require.Equal(t, expected, actual)
 }
+
+func TestLoadEmojiMap(t *testing.T) {
+	emojis, err := loadEmojiMap()
+	require.Nil(t, err)
+	require.Equal(t, "⚠️", emojis["warning"])
+	require.Equal(t, "😆", emojis["satisfied"]) // Second alias
+	_, ok := emojis["not-an-emoji"]
+	require.False(t, ok)
+}
@@ -9,11 +9,19 @@ import (
 // topic represents a channel to which subscribers can subscribe, and publishers
 // can publish a message
 type topic struct {
-	ID          string
+	ID string
+	topicMetadata
 	subscribers map[int]subscriber
 	mu          sync.Mutex
 }
 
+// topicMetadata is persistent information about a topic that is kept by the cache, see cache.Topics
+type topicMetadata struct {
+	LastMessageTime int64  // Unix time of the newest message ever added to the topic
+	MessageCount    int    // Number of messages of the topic, including scheduled ones; like cache.MessageCount
+	DisplayName     string // Optional human-readable name, see cache.SetTopicDisplayName
+}
+
 // subscriber is a function that is called for every new message on a topic
 type subscriber func(msg *message) error
 
@@ -1,44 +1,97 @@
 package server
 
 import (
+	"encoding/json"
 	"heckel.io/ntfy/util"
 	"net/http"
+	"strconv"
 	"time"
 )
 
 // List of possible events
 const (
-	openEvent      = "open"
-	keepaliveEvent = "keepalive"
-	messageEvent   = "message"
+	openEvent        = "open"
+	keepaliveEvent   = "keepalive"
+	messageEvent     = "message"
+	pollRequestEvent = "poll_request"
 )
 
 const (
 	messageIDLength = 10
 )
 
+// List of possible message content types
+const (
+	contentTypePlain    = "text/plain"
+	contentTypeMarkdown = "text/markdown"
+)
+
 // message represents a message published to a topic
 type message struct {
-	ID         string      `json:"id"`    // Random message ID
-	Time       int64       `json:"time"`  // Unix time in seconds
-	Event      string      `json:"event"` // One of the above
-	Topic      string      `json:"topic"`
-	Priority   int         `json:"priority,omitempty"`
-	Tags       []string    `json:"tags,omitempty"`
-	Click      string      `json:"click,omitempty"`
-	Attachment *attachment `json:"attachment,omitempty"`
-	Title      string      `json:"title,omitempty"`
-	Message    string      `json:"message,omitempty"`
-	Encoding   string      `json:"encoding,omitempty"` // empty for raw UTF-8, or "base64" for encoded bytes
+	ID             string      `json:"id"`    // Random message ID
+	Time           int64       `json:"time"`  // Unix time in seconds
+	Event          string      `json:"event"` // One of the above
+	Topic          string      `json:"topic"`
+	Priority       int         `json:"priority,omitempty"`
+	Tags           []string    `json:"tags,omitempty"`
+	Click          string      `json:"click,omitempty"`
+	Actions        []*action   `json:"actions,omitempty"`
+	Icon           string      `json:"icon,omitempty"` // URL of the icon shown with the notification
+	Attachment     *attachment `json:"attachment,omitempty"`
+	Title          string      `json:"title,omitempty"`
+	Message        string      `json:"message,omitempty"`
+	Encoding       string      `json:"encoding,omitempty"`        // empty for raw UTF-8, or "base64" for encoded bytes
+	ContentType    string      `json:"content_type,omitempty"`    // how clients should render the message, one of the above
+	Durable        bool        `json:"-"`                         // if set, the cache must flush the message to disk before returning
+	Dedup          bool        `json:"-"`                         // if set, the cache skips the message if an identical one was stored recently
+	IdempotencyKey string      `json:"-"`                         // if set, the cache skips the message if one with the same key was stored in the topic
+	Email          string      `json:"-"`                         // e-mail address the message was forwarded to, only exposed masked, see MarshalJSON
+	Owner          string      `json:"-"`                         // IP address of publisher, used for rate limiting
+	Lat            *float64    `json:"lat,omitempty"`             // latitude of the location the message refers to, nil if not set
+	Lon            *float64    `json:"lon,omitempty"`             // longitude of the location the message refers to, nil if not set
+	Pinned         bool        `json:"pinned,omitempty"`          // if set, the message is never pruned
+	PrioritySource string      `json:"priority_source,omitempty"` // why the message has its priority, e.g. "rule:disk-full"
+	Edited         int64       `json:"edited,omitempty"`          // Unix time of the last edit, 0 if the message was never edited
+	Published      bool        `json:"-"`                         // if set, the message was delivered (not scheduled); set by all caches, for troubleshooting
+	Sender         string      `json:"-"`                         // hashed IP address of the publisher, for abuse investigation; never sent to subscribers
+	bodyRef        string      // reference to an externally stored message body, see bodyStore
+	sequence       int64       // insertion or publish order, to order messages with the same time and for since=<id>, see sortMessages
+}
+
+// MarshalJSON encodes the message as JSON. The e-mail address the message was forwarded to
+// is only included in masked form, so that subscribers do not learn the full address.
+func (m *message) MarshalJSON() ([]byte, error) {
+	type messageAlias message // Avoid infinite recursion
+	return json.Marshal(&struct {
+		*messageAlias
+		Email string `json:"email,omitempty"`
+	}{
+		messageAlias: (*messageAlias)(m),
+		Email:        maskEmail(m.Email),
+	})
 }
 
 type attachment struct {
-	Name    string `json:"name"`
-	Type    string `json:"type,omitempty"`
-	Size    int64  `json:"size,omitempty"`
-	Expires int64  `json:"expires,omitempty"`
-	URL     string `json:"url"`
-	Owner   string `json:"-"` // IP address of uploader, used for rate limiting
+	Name      string `json:"name"`
+	Type      string `json:"type,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Expires   int64  `json:"expires,omitempty"`
+	URL       string `json:"url"`
+	Owner     string `json:"-"` // IP address of uploader, used for rate limiting
+	Downloads int64  `json:"-"` // Number of times the attachment was downloaded, see IncrementDownloads
+}
+
+// action is a user-defined button that is displayed with the notification, see actionTypes
+type action struct {
+	Type    string            `json:"type"`              // One of actionTypes, e.g. "view"
+	Label   string            `json:"label"`             // Button label
+	URL     string            `json:"url,omitempty"`     // "view" and "http" only
+	Method  string            `json:"method,omitempty"`  // "http" only, defaults to POST
+	Headers map[string]string `json:"headers,omitempty"` // "http" only
+	Body    string            `json:"body,omitempty"`    // "http" only
+	Intent  string            `json:"intent,omitempty"`  // "broadcast" only
+	Extras  map[string]string `json:"extras,omitempty"`  // "broadcast" only
+	Clear   bool              `json:"clear,omitempty"`   // if set, the notification is dismissed when the action is tapped
 }
 
 // messageEncoder is a function that knows how to encode a message
@@ -73,23 +126,44 @@ func newDefaultMessage(topic, msg string) *message {
 	return newMessage(messageEvent, topic, msg)
 }
 
-type sinceTime time.Time
+// sinceMarker marks the position from which cached messages are requested, either a point in time,
+// or the ID of the last message a subscriber has received
+type sinceMarker struct {
+	time time.Time
+	id   string
+}
+
+func newSinceTime(timestamp int64) sinceMarker {
+	return sinceMarker{time.Unix(timestamp, 0), ""}
+}
+
+func newSinceID(id string) sinceMarker {
+	return sinceMarker{time.Unix(0, 0), id}
+}
 
-func (t sinceTime) IsAll() bool {
+func (t sinceMarker) IsAll() bool {
 	return t == sinceAllMessages
 }
 
-func (t sinceTime) IsNone() bool {
+func (t sinceMarker) IsNone() bool {
 	return t == sinceNoMessages
 }
 
-func (t sinceTime) Time() time.Time {
-	return time.Time(t)
+func (t sinceMarker) IsID() bool {
+	return t.id != ""
+}
+
+func (t sinceMarker) Time() time.Time {
+	return t.time
+}
+
+func (t sinceMarker) ID() string {
+	return t.id
 }
 
 var (
-	sinceAllMessages = sinceTime(time.Unix(0, 0))
-	sinceNoMessages  = sinceTime(time.Unix(1, 0))
+	sinceAllMessages = sinceMarker{time.Unix(0, 0), ""}
+	sinceNoMessages  = sinceMarker{time.Unix(1, 0), ""}
 )
 
 type queryFilter struct {
@@ -97,6 +171,9 @@ type queryFilter struct {
 	Title    string
 	Tags     []string
 	Priority []int
+	Until    int64  // Unix time, see messageFilter.Until
+	UnreadBy string // User, see messageFilter.UnreadBy
+	Order    string // See messageFilter.Order
 }
 
 func parseQueryFilters(r *http.Request) (*queryFilter, error) {
@@ -111,14 +188,62 @@ func parseQueryFilters(r *http.Request) (*queryFilter, error) {
 		}
 		priorityFilter = append(priorityFilter, priority)
 	}
+	until, err := parseUntil(r)
+	if err != nil {
+		return nil, err
+	}
+	unreadBy := readParam(r, "x-unread-by", "unread-by")
+	if unreadBy != "" && !userRegex.MatchString(unreadBy) {
+		return nil, errHTTPBadRequestUserInvalid
+	}
+	order := readParam(r, "x-order", "order")
+	if order != "" && order != orderAsc && order != orderDesc {
+		return nil, errHTTPBadRequestOrderInvalid
+	}
 	return &queryFilter{
 		Message:  messageFilter,
 		Title:    titleFilter,
 		Tags:     tagsFilter,
 		Priority: priorityFilter,
+		Until:    until,
+		UnreadBy: unreadBy,
+		Order:    order,
 	}, nil
 }
 
+// parseUntil returns the upper time bound for messages, as Unix time, or 0 if there is none. Like "since=...",
+// values in the "until=..." parameter can be either a Unix timestamp or a duration (e.g. 1h means one hour ago).
+func parseUntil(r *http.Request) (int64, error) {
+	until := readParam(r, "x-until", "until", "un")
+	if until == "" {
+		return 0, nil
+	} else if u, err := strconv.ParseInt(until, 10, 64); err == nil && u > 0 {
+		return u, nil
+	} else if d, err := time.ParseDuration(until); err == nil {
+		return time.Now().Add(-1 * d).Unix(), nil
+	}
+	return 0, errHTTPBadRequestUntilInvalid
+}
+
+// cacheFilter returns a filter to narrow down the messages that are read from the cache. It may be looser
+// than the query filter (e.g. priorities are matched exactly by Pass), so Pass must still be applied.
+func (q *queryFilter) cacheFilter() *messageFilter {
+	minPriority := 0
+	for _, p := range q.Priority {
+		if minPriority == 0 || p < minPriority {
+			minPriority = p
+		}
+	}
+	return &messageFilter{
+		MinPriority:   minPriority,
+		Tags:          q.Tags,
+		TitleContains: q.Title,
+		Until:         q.Until,
+		UnreadBy:      q.UnreadBy,
+		Order:         q.Order,
+	}
+}
+
 func (q *queryFilter) Pass(msg *message) bool {
 	if msg.Event != messageEvent {
 		return true // filters only apply to messages
@@ -129,6 +254,9 @@ func (q *queryFilter) Pass(msg *message) bool {
 	if q.Title != "" && msg.Title != q.Title {
 		return false
 	}
+	if q.Until > 0 && msg.Time > q.Until {
+		return false
+	}
 	messagePriority := msg.Priority
 	if messagePriority == 0 {
 		messagePriority = 3 // For query filters, default priority (3) is the same as "not set" (0)
@@ -141,3 +269,9 @@ func (q *queryFilter) Pass(msg *message) bool {
 	}
 	return true
 }
+
+// healthResponse is the response of the /v1/health endpoint
+type healthResponse struct {
+	Healthy       bool `json:"healthy"`
+	SchemaVersion int  `json:"schema_version,omitempty"` // Cache schema version, 0 for the memory cache
+}
@@ -1,10 +1,13 @@
 package server
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"firebase.google.com/go/messaging"
 	"net/http"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
@@ -53,3 +56,24 @@ func readParam(r *http.Request, names ...string) string {
 	}
 	return ""
 }
+
+// maskEmail masks the local part of an e-mail address, keeping only its first character,
+// e.g. "phil@example.com" becomes "p***@example.com"
+func maskEmail(email string) string {
+	if email == "" {
+		return ""
+	}
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return "***"
+	}
+	_, size := utf8.DecodeRuneInString(email)
+	return email[:size] + "***" + email[at:]
+}
+
+// SenderHash returns the sender that messages published from the given IP address are stored with, see
+// message.Sender. The hash is not salted, so that the messages of an IP address can be looked up later on.
+func SenderHash(ip string) string {
+	h := sha256.Sum256([]byte(ip))
+	return hex.EncodeToString(h[:])
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestMaybeTruncateFCMMessage(t *testing.T) {
@@ -64,3 +65,13 @@ func TestMaybeTruncateFCMMessage_NotTooLong(t *testing.T) {
 	require.Equal(t, len(serializedOrigFCMMessage), len(serializedNotTruncatedFCMMessage))
 	require.Equal(t, "", notTruncatedFCMMessage.Data["truncated"])
 }
+
+func TestMaskEmail(t *testing.T) {
+	require.Equal(t, "", maskEmail(""))
+	require.Equal(t, "***", maskEmail("phil"))
+	require.Equal(t, "***", maskEmail("@example.com"))
+	require.Equal(t, "p***@example.com", maskEmail("phil@example.com"))
+	require.Equal(t, "p***@example.com", maskEmail("p@example.com"))
+	require.Equal(t, "é***@example.com", maskEmail("émile@example.com"))
+	require.True(t, utf8.ValidString(maskEmail("émile@example.com")))
+}
@@ -0,0 +1,72 @@
+package util
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+// BloomFilter is a probabilistic set of strings. If Test returns false, the string was definitely
+// never added; if it returns true, it was probably added. Strings cannot be removed from the filter.
+// BloomFilter may be used by multiple goroutines.
+type BloomFilter struct {
+	bits []uint64
+	m    uint64 // Number of bits
+	k    uint64 // Number of hash functions
+	mu   sync.RWMutex
+}
+
+// NewBloomFilter creates a new BloomFilter sized for the given number of expected items,
+// with a false positive rate of roughly p (e.g. 0.01 for 1%) once that number is reached
+func NewBloomFilter(expected int, p float64) *BloomFilter {
+	if expected < 1 {
+		expected = 1
+	}
+	m := uint64(math.Ceil(-float64(expected) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if m < 64 {
+		m = 64
+	}
+	k := uint64(math.Round(float64(m) / float64(expected) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &BloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+// Add adds s to the filter
+func (f *BloomFilter) Add(s string) {
+	h1, h2 := bloomHashes(s)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Test returns false if s was definitely never added to the filter, and true if it probably was
+func (f *BloomFilter) Test(s string) bool {
+	h1, h2 := bloomHashes(s)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHashes derives two hashes from s, which are combined to simulate k hash functions,
+// see https://www.eecs.harvard.edu/~michaelm/postscripts/rsa2008.pdf
+func bloomHashes(s string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	sum := h.Sum64()
+	return sum & 0xffffffff, (sum >> 32) | 1
+}
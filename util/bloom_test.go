@@ -0,0 +1,31 @@
+package util
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestBloomFilter_AddTest(t *testing.T) {
+	f := NewBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.Add(fmt.Sprintf("topic%d", i))
+	}
+	for i := 0; i < 1000; i++ {
+		require.True(t, f.Test(fmt.Sprintf("topic%d", i)))
+	}
+	var falsePositives int
+	for i := 0; i < 1000; i++ {
+		if f.Test(fmt.Sprintf("other%d", i)) {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, 50)
+}
+
+func TestBloomFilter_Empty(t *testing.T) {
+	f := NewBloomFilter(0, 0.01)
+	require.False(t, f.Test("mytopic"))
+	f.Add("mytopic")
+	require.True(t, f.Test("mytopic"))
+}